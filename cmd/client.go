@@ -5,15 +5,27 @@ import (
 	"github.com/spf13/cobra"
 
 	"ntsc.ac.cn/ta/time-validater/internal/client"
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
 	ccmd "ntsc.ac.cn/tas/tas-commons/pkg/cmd"
 )
 
 var clientEnvs struct {
 	endpoint     string
 	ntpAddr      string
+	ntpNetwork   string
+	ntpKeysFile  string
+	ntpKeyID     uint32
+	ntpNTSKEAddr string
+	ntpKernelTS  bool
+	ntpXleave    bool
 	mt           bool
 	syncFix      int
 	SyncInterval int
+	syncBurst    int
+	ntpScale     string
+	localScale   string
+	cliScale     string
+	scales       [3]timescale.Scale
 }
 var clientCmd = &cobra.Command{
 	Use:    "client",
@@ -29,7 +41,25 @@ func init() {
 		"validate server endpoint")
 	clientCmd.Flags().StringVar(&clientEnvs.ntpAddr,
 		"ntp-addr", "10.25.135.31:12232",
-		"ntp server address")
+		"ntp server addresses, separated by comma")
+	clientCmd.Flags().StringVar(&clientEnvs.ntpNetwork,
+		"ntp-network", "tcp",
+		"ntp server network (tcp, udp, udp4, udp6)")
+	clientCmd.Flags().StringVar(&clientEnvs.ntpKeysFile,
+		"ntp-keys-file", "",
+		"ntp.keys file for symmetric key authentication")
+	clientCmd.Flags().Uint32Var(&clientEnvs.ntpKeyID,
+		"ntp-key-id", 0,
+		"ntp key id, 0 disables authentication")
+	clientCmd.Flags().StringVar(&clientEnvs.ntpNTSKEAddr,
+		"ntp-nts-ke", "",
+		"nts-ke server address, empty disables nts")
+	clientCmd.Flags().BoolVar(&clientEnvs.ntpKernelTS,
+		"ntp-kernel-timestamps", false,
+		"take ntp query timestamps from the kernel (linux only)")
+	clientCmd.Flags().BoolVar(&clientEnvs.ntpXleave,
+		"ntp-interleaved", false,
+		"ask ntp servers for interleaved mode responses")
 	clientCmd.Flags().BoolVar(&clientEnvs.mt,
 		"sync", false,
 		"sync local time")
@@ -39,10 +69,23 @@ func init() {
 	clientCmd.Flags().IntVar(&clientEnvs.SyncInterval,
 		"sync-interval", 30,
 		"sync second")
+	clientCmd.Flags().IntVar(&clientEnvs.syncBurst,
+		"sync-burst", 4,
+		"ntp queries per sync, filtered by lowest delay")
+	clientCmd.Flags().StringVar(&clientEnvs.ntpScale,
+		"ntp-scale", "utc",
+		"time scale of the ntp servers (utc, tai, gps, bds)")
+	clientCmd.Flags().StringVar(&clientEnvs.localScale,
+		"local-scale", "tai",
+		"time scale of the local clock (utc, tai, gps, bds)")
+	clientCmd.Flags().StringVar(&clientEnvs.cliScale,
+		"cli-scale", "utc",
+		"time scale expected by the set time command (utc, tai, gps, bds)")
 }
 
 func _client_prerun(cmd *cobra.Command, args []string) {
 	ccmd.InitGlobalVars()
+	loadLeapFile()
 	var err error
 	if err = ccmd.ValidateStringVar(&clientEnvs.endpoint,
 		"endpooint", true); err != nil {
@@ -54,6 +97,13 @@ func _client_prerun(cmd *cobra.Command, args []string) {
 		logrus.WithField("prefix", "cmd.root").
 			Fatalf("check boot var failed: %s", err.Error())
 	}
+	for i, name := range []string{clientEnvs.ntpScale,
+		clientEnvs.localScale, clientEnvs.cliScale} {
+		if clientEnvs.scales[i], err = timescale.Parse(name); err != nil {
+			logrus.WithField("prefix", "cmd.root").
+				Fatalf("check boot var failed: %v", err)
+		}
+	}
 	go func() {
 		ccmd.RunWithSysSignal(nil)
 	}()
@@ -65,9 +115,19 @@ func _client_run(cmd *cobra.Command, args []string) {
 		CertPath:     envs.certPath,
 		ServerName:   envs.serverName,
 		NTPAddr:      clientEnvs.ntpAddr,
+		NTPNetwork:   clientEnvs.ntpNetwork,
+		NTPKeysFile:  clientEnvs.ntpKeysFile,
+		NTPKeyID:     clientEnvs.ntpKeyID,
+		NTPNTSKEAddr: clientEnvs.ntpNTSKEAddr,
+		NTPKernelTS:  clientEnvs.ntpKernelTS,
+		NTPXleave:    clientEnvs.ntpXleave,
 		Sync:         clientEnvs.mt,
 		SyncFix:      clientEnvs.syncFix,
 		SyncInterval: clientEnvs.SyncInterval,
+		SyncBurst:    clientEnvs.syncBurst,
+		NTPScale:     clientEnvs.scales[0],
+		LocalScale:   clientEnvs.scales[1],
+		CLIScale:     clientEnvs.scales[2],
 	})
 	if err != nil {
 		logrus.WithField("prefix", "cmd.client").
@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+	ccmd "ntsc.ac.cn/tas/tas-commons/pkg/cmd"
+)
+
+var ntpServeEnvs struct {
+	listener       string
+	network        string
+	stratum        int
+	precision      int
+	refID          string
+	rootDelay      time.Duration
+	rootDispersion time.Duration
+	keysFile       string
+	requireAuth    bool
+	ntsKEListener  string
+	ntsCertFile    string
+	ntsKeyFile     string
+	interleaved    bool
+}
+var ntpCmd = &cobra.Command{
+	Use:   "ntp",
+	Short: "TAS tcp ntp tools",
+}
+var ntpServeCmd = &cobra.Command{
+	Use:    "serve",
+	Short:  "TAS tcp ntp server",
+	PreRun: _ntp_serve_prerun,
+	Run:    _ntp_serve_run,
+}
+
+func init() {
+	rootCmd.AddCommand(ntpCmd)
+	ntpCmd.AddCommand(ntpServeCmd)
+	ntpServeCmd.Flags().StringVar(&ntpServeEnvs.listener,
+		"bind-addr", "0.0.0.0:12232",
+		"ntp listener bind address")
+	ntpServeCmd.Flags().StringVar(&ntpServeEnvs.network,
+		"network", "tcp",
+		"ntp listener network (tcp, udp, udp4, udp6)")
+	ntpServeCmd.Flags().IntVar(&ntpServeEnvs.stratum,
+		"stratum", 1,
+		"ntp server stratum")
+	ntpServeCmd.Flags().IntVar(&ntpServeEnvs.precision,
+		"precision", -20,
+		"ntp server clock precision (log2 seconds)")
+	ntpServeCmd.Flags().StringVar(&ntpServeEnvs.refID,
+		"ref-id", "LOCL",
+		"ntp server reference id")
+	ntpServeCmd.Flags().DurationVar(&ntpServeEnvs.rootDelay,
+		"root-delay", 0,
+		"ntp server root delay")
+	ntpServeCmd.Flags().DurationVar(&ntpServeEnvs.rootDispersion,
+		"root-dispersion", 0,
+		"ntp server root dispersion")
+	ntpServeCmd.Flags().StringVar(&ntpServeEnvs.keysFile,
+		"keys-file", "",
+		"ntp.keys file enabling symmetric key authentication")
+	ntpServeCmd.Flags().BoolVar(&ntpServeEnvs.requireAuth,
+		"require-auth", false,
+		"answer only authenticated queries, required on tcp with a keys file")
+	ntpServeCmd.Flags().StringVar(&ntpServeEnvs.ntsKEListener,
+		"nts-ke-bind-addr", "",
+		"nts-ke tls listener bind address, empty disables nts")
+	ntpServeCmd.Flags().StringVar(&ntpServeEnvs.ntsCertFile,
+		"nts-cert-file", "",
+		"nts-ke tls certificate file")
+	ntpServeCmd.Flags().StringVar(&ntpServeEnvs.ntsKeyFile,
+		"nts-key-file", "",
+		"nts-ke tls private key file")
+	ntpServeCmd.Flags().BoolVar(&ntpServeEnvs.interleaved,
+		"interleaved", false,
+		"answer interleaved mode queries")
+}
+
+func _ntp_serve_prerun(cmd *cobra.Command, args []string) {
+	ccmd.InitGlobalVars()
+	loadLeapFile()
+	var err error
+	if err = ccmd.ValidateStringVar(&ntpServeEnvs.listener,
+		"bind_addr", true); err != nil {
+		logrus.WithField("prefix", "cmd.ntp").
+			Fatalf("check boot var failed: %s", err.Error())
+	}
+	go func() {
+		ccmd.RunWithSysSignal(nil)
+	}()
+}
+
+func _ntp_serve_run(cmd *cobra.Command, args []string) {
+	var refID uint32
+	for i := 0; i < 4 && i < len(ntpServeEnvs.refID); i++ {
+		refID |= uint32(ntpServeEnvs.refID[i]) << (24 - 8*i)
+	}
+	var keys *tcpntp.KeyStore
+	if ntpServeEnvs.keysFile != "" {
+		var err error
+		if keys, err = tcpntp.LoadKeys(ntpServeEnvs.keysFile); err != nil {
+			logrus.WithField("prefix", "cmd.ntp").
+				Fatalf("failed to load ntp keys: %v", err)
+		}
+	}
+	var ntsKey *tcpntp.NTSCookieKey
+	var ks *tcpntp.NTSKEServer
+	if ntpServeEnvs.ntsKEListener != "" {
+		cert, err := tls.LoadX509KeyPair(
+			ntpServeEnvs.ntsCertFile, ntpServeEnvs.ntsKeyFile)
+		if err != nil {
+			logrus.WithField("prefix", "cmd.ntp").
+				Fatalf("failed to load nts-ke certificate: %v", err)
+		}
+		if ntsKey, err = tcpntp.GenerateNTSCookieKey(); err != nil {
+			logrus.WithField("prefix", "cmd.ntp").
+				Fatalf("failed to generate nts cookie key: %v", err)
+		}
+		if ks, err = tcpntp.NewNTSKEServer(&tcpntp.NTSKEServerConfig{
+			Address:   ntpServeEnvs.ntsKEListener,
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+			CookieKey: ntsKey,
+		}); err != nil {
+			logrus.WithField("prefix", "cmd.ntp").
+				Fatalf("failed to create nts-ke server: %v", err)
+		}
+		go func() {
+			logrus.WithField("prefix", "cmd.ntp").
+				Fatalf("failed to run nts-ke server: %v", <-ks.Start())
+		}()
+	}
+	s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+		Address:        ntpServeEnvs.listener,
+		Network:        ntpServeEnvs.network,
+		Stratum:        uint8(ntpServeEnvs.stratum),
+		Precision:      int8(ntpServeEnvs.precision),
+		ReferenceID:    refID,
+		RootDelay:      ntpServeEnvs.rootDelay,
+		RootDispersion: ntpServeEnvs.rootDispersion,
+		Keys:           keys,
+		NTSKey:         ntsKey,
+		RequireAuth:    ntpServeEnvs.requireAuth,
+		Interleaved:    ntpServeEnvs.interleaved,
+	})
+	if err != nil {
+		logrus.WithField("prefix", "cmd.ntp").
+			Fatalf("failed to create ntp server: %v", err)
+	}
+	logrus.WithField("prefix", "cmd.ntp").
+		Fatalf("failed to run ntp server: %v", <-s.Start())
+}
@@ -3,15 +3,20 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
 	ccmd "ntsc.ac.cn/tas/tas-commons/pkg/cmd"
 )
 
 var envs struct {
 	certPath   string
 	serverName string
+	leapFile   string
 }
 
 var rootCmd = &cobra.Command{
@@ -29,6 +34,27 @@ func init() {
 		"cert-path", "/etc/ntsc/ta/certs", "TAS certificates root path")
 	rootCmd.PersistentFlags().StringVar(&envs.serverName,
 		"server-name", "ntsc.ac.cn", "TAS certificates server name")
+	rootCmd.PersistentFlags().StringVar(&envs.leapFile,
+		"leap-file", "",
+		"leap-seconds.list file, empty uses the built-in leap second table")
+}
+
+// loadLeapFile replaces the built-in leap second table with the one of
+// the leap seconds file, if set, and warns when the table has expired.
+func loadLeapFile() {
+	if envs.leapFile != "" {
+		t, err := timescale.LoadLeapSecondsList(envs.leapFile)
+		if err != nil {
+			logrus.WithField("prefix", "cmd.root").
+				Fatalf("failed to load leap seconds: %v", err)
+		}
+		timescale.SetDefault(t)
+	}
+	if t := timescale.Default(); t.Expired(time.Now()) {
+		logrus.WithField("prefix", "cmd.root").
+			Warnf("leap second table expired on %s, leap seconds after it "+
+				"are unknown", t.Expires().Format("2006-01-02"))
+	}
 }
 
 func Execute() {
@@ -1,15 +1,28 @@
 package cmd
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"ntsc.ac.cn/ta/time-validater/internal/server"
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
 	ccmd "ntsc.ac.cn/tas/tas-commons/pkg/cmd"
 )
 
 var serverEnvs struct {
-	listener string
+	listener    string
+	serverScale string
+	clientScale string
+	scales      [2]timescale.Scale
+	schedule    string
+	sinks       []string
+	agentx      string
+	alarm       time.Duration
 }
 var serverCmd = &cobra.Command{
 	Use:    "server",
@@ -23,30 +36,117 @@ func init() {
 	serverCmd.Flags().StringVar(&serverEnvs.listener,
 		"bind-addr", "tcp://0.0.0.0:12233",
 		"validate tcp listener bind address")
+	serverCmd.Flags().StringVar(&serverEnvs.serverScale,
+		"server-scale", "utc",
+		"time scale of the server clock (utc, tai, gps, bds)")
+	serverCmd.Flags().StringVar(&serverEnvs.clientScale,
+		"client-scale", "tai",
+		"time scale of the validated clocks (utc, tai, gps, bds)")
+	serverCmd.Flags().StringVar(&serverEnvs.schedule,
+		"probe-schedule", "",
+		"probe schedule file, reloaded on SIGHUP, empty probes every 3s")
+	serverCmd.Flags().StringArrayVar(&serverEnvs.sinks,
+		"sink", []string{server.DefaultTrapURL},
+		"measurement sink, repeatable: an http(s) url of an snmp trap "+
+			"bridge, an snmp:// or snmpv3:// url of an snmp manager, with "+
+			"the v3 passwords in auth-pass-file and priv-pass-file, log, "+
+			"or none")
+	serverCmd.Flags().StringVar(&serverEnvs.agentx,
+		"agentx", "",
+		"agentx master to serve the machine table to: a unix socket path "+
+			"or tcp:host:port, empty disables")
+	serverCmd.Flags().DurationVar(&serverEnvs.alarm,
+		"agentx-alarm-threshold", 100*time.Millisecond,
+		"offset beyond which the machine table reports a major alarm")
 }
 
 func _src_prerun(cmd *cobra.Command, args []string) {
 	ccmd.InitGlobalVars()
+	loadLeapFile()
 	var err error
 	if err = ccmd.ValidateStringVar(&serverEnvs.listener,
 		"bind_addr", true); err != nil {
 		logrus.WithField("prefix", "cmd.root").
 			Fatalf("check boot var failed: %s", err.Error())
 	}
-	go func() {
-		ccmd.RunWithSysSignal(nil)
-	}()
+	for i, name := range []string{serverEnvs.serverScale,
+		serverEnvs.clientScale} {
+		if serverEnvs.scales[i], err = timescale.Parse(name); err != nil {
+			logrus.WithField("prefix", "cmd.root").
+				Fatalf("check boot var failed: %v", err)
+		}
+	}
 }
 
 func _src_run(cmd *cobra.Command, args []string) {
+	var schedule *server.Schedule
+	var err error
+	if serverEnvs.schedule != "" {
+		if schedule, err = server.LoadSchedule(serverEnvs.schedule); err != nil {
+			logrus.WithField("prefix", "cmd.root").
+				Fatalf("failed to load probe schedule: %v", err)
+		}
+	}
+	sinks := make([]server.MeasurementSink, 0, len(serverEnvs.sinks))
+	for _, spec := range serverEnvs.sinks {
+		if spec == "none" {
+			continue
+		}
+		sink, err := server.ParseSink(spec)
+		if err != nil {
+			logrus.WithField("prefix", "cmd.root").
+				Fatalf("failed to create measurement sink: %v", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	var agentx *server.AgentXConfig
+	if serverEnvs.agentx != "" {
+		agentx = &server.AgentXConfig{
+			Address:        serverEnvs.agentx,
+			AlarmThreshold: serverEnvs.alarm,
+		}
+	}
 	s, err := server.NewValidateServer(&server.Config{
-		Listener: serverEnvs.listener,
-		CertPath: envs.certPath,
+		Listener:    serverEnvs.listener,
+		CertPath:    envs.certPath,
+		ServerScale: serverEnvs.scales[0],
+		ClientScale: serverEnvs.scales[1],
+		Schedule:    schedule,
+		Sinks:       sinks,
+		AgentX:      agentx,
 	})
 	if err != nil {
 		logrus.WithField("prefix", "cmd.root").
 			Fatalf("failed to create app: %v", err)
 	}
+	go func() {
+		ccmd.RunWithSysSignal(func() {
+			s.Close()
+		})
+	}()
+	if serverEnvs.schedule != "" {
+		go reloadSchedule(s)
+	}
 	logrus.WithField("prefix", "cmd.root").
 		Fatalf("failed to run app: %v", <-s.Start())
 }
+
+// reloadSchedule applies the probe schedule file to s on every SIGHUP. A
+// file that fails to load leaves the current schedule in place.
+func reloadSchedule(s *server.ValidateServer) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		schedule, err := server.LoadSchedule(serverEnvs.schedule)
+		if err == nil {
+			err = s.SetSchedule(schedule)
+		}
+		if err != nil {
+			logrus.WithField("prefix", "cmd.root").
+				Errorf("failed to reload probe schedule: %v", err)
+			continue
+		}
+		logrus.WithField("prefix", "cmd.root").
+			Infof("probe schedule reloaded from [%s]", serverEnvs.schedule)
+	}
+}
@@ -30,7 +30,7 @@ type ValidateClient struct {
 	conf      *Config
 	machineID string
 	grpcEntry *grpcEntry
-	ntpClient *tcpntp.NTPClient
+	ntpClient *tcpntp.MultiClient
 	crontab   *cron.Cron
 }
 
@@ -49,8 +49,41 @@ func NewValidateClient(conf *Config) (*ValidateClient, error) {
 	if err != nil {
 		return nil, fmt.Errorf("generate tls config failed: %v", err)
 	}
-	nc, err := tcpntp.NewNTPClient(&tcpntp.Config{
-		Address: conf.NTPAddr,
+	var keys *tcpntp.KeyStore
+	if conf.NTPKeysFile != "" {
+		if keys, err = tcpntp.LoadKeys(conf.NTPKeysFile); err != nil {
+			return nil, fmt.Errorf("failed to load ntp keys: %v", err)
+		}
+	}
+	var nts *tcpntp.NTSConfig
+	if conf.NTPNTSKEAddr != "" {
+		// NTS-KE is authenticated with the same PKI as the gRPC side.
+		nts = &tcpntp.NTSConfig{
+			KEAddress: conf.NTPNTSKEAddr,
+			TLSConfig: tlsConf,
+		}
+	}
+	sources := make([]*tcpntp.Config, 0)
+	for _, addr := range strings.Split(conf.NTPAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		sources = append(sources, &tcpntp.Config{
+			Address:          addr,
+			Network:          conf.NTPNetwork,
+			KeyID:            conf.NTPKeyID,
+			Keys:             keys,
+			NTS:              nts,
+			SourceScale:      conf.NTPScale,
+			LocalScale:       conf.LocalScale,
+			KernelTimestamps: conf.NTPKernelTS,
+			Interleaved:      conf.NTPXleave,
+			Clock:            conf.Clock,
+		})
+	}
+	nc, err := tcpntp.NewMultiClient(&tcpntp.MultiConfig{
+		Sources: sources,
+		Burst:   conf.SyncBurst,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create ntp client: %v", err)
@@ -95,7 +128,7 @@ func (vc *ValidateClient) _createRPCClient(errChan chan error) {
 		if vc.grpcEntry.tsvc, err = vc.grpcEntry.tsc.Validate(context.Background()); err != nil {
 			logrus.WithField("prefix", "trap").
 				Errorf("failed to create validate client: %v", err)
-			time.Sleep(time.Second)
+			vc.conf.Clock.Sleep(time.Second)
 			vc._createRPCClient(errChan)
 		}
 	}
@@ -109,7 +142,7 @@ func (vc *ValidateClient) _createRPCClient(errChan chan error) {
 			}); err != nil {
 			logrus.WithField("prefix", "trap").
 				Errorf("failed to create health check client: %v", err)
-			time.Sleep(time.Second)
+			vc.conf.Clock.Sleep(time.Second)
 			vc._createRPCClient(errChan)
 		}
 	}
@@ -124,7 +157,7 @@ func (vc *ValidateClient) _startHealthChekck(errChan chan error) {
 					Errorf("time validate service down: %s", vc.conf.Endpoint)
 				vc.grpcEntry.tsvc = nil
 				vc.grpcEntry.hwc = nil
-				time.Sleep(time.Second)
+				vc.conf.Clock.Sleep(time.Second)
 				vc._createRPCClient(errChan)
 				continue
 			}
@@ -141,18 +174,18 @@ func (vc *ValidateClient) _startHealthChekck(errChan chan error) {
 func (vc *ValidateClient) _startValidate(errChan chan error) {
 	for {
 		resp, err := vc.grpcEntry.tsvc.Recv()
-		t2 := timestamppb.Now()
+		t2 := timestamppb.New(vc.conf.Clock.Now())
 		if err != nil || resp == nil {
 			if strings.Contains(err.Error(), "EOF") {
 				logrus.WithField("prefix", "trap").
 					Errorf("time validate service down: %s", vc.conf.Endpoint)
 				vc.grpcEntry.tsvc = nil
-				time.Sleep(time.Second)
+				vc.conf.Clock.Sleep(time.Second)
 				vc._createRPCClient(errChan)
 				continue
 			}
 		}
-		t3 := timestamppb.Now()
+		t3 := timestamppb.New(vc.conf.Clock.Now())
 		if err := vc.grpcEntry.tsvc.Send(&pb.Response{
 			MachineID: vc.machineID,
 			T2:        t2,
@@ -163,7 +196,7 @@ func (vc *ValidateClient) _startValidate(errChan chan error) {
 					Errorf("time validate service [%s] down: %v",
 						vc.conf.Endpoint, err)
 				vc.grpcEntry.tsvc = nil
-				time.Sleep(time.Second)
+				vc.conf.Clock.Sleep(time.Second)
 				vc._createRPCClient(errChan)
 				continue
 			}
@@ -1,15 +1,48 @@
 package client
 
+import (
+	"fmt"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
+)
+
 type Config struct {
 	Endpoint     string
 	NTPAddr      string
+	NTPNetwork   string
+	NTPKeysFile  string
+	NTPKeyID     uint32
+	NTPNTSKEAddr string
+	NTPKernelTS  bool
+	NTPXleave    bool
 	CertPath     string
 	ServerName   string
 	Sync         bool
 	SyncFix      int
 	SyncInterval int
+	SyncBurst    int
+	// NTPScale is the time scale served by the ntp sources, LocalScale the
+	// one of the local clock and CLIScale the one expected by the set time
+	// command.
+	NTPScale   timescale.Scale
+	LocalScale timescale.Scale
+	CLIScale   timescale.Scale
+	// Clock timestamps the validation requests and the ntp queries. It
+	// defaults to the system clock.
+	Clock clock.Clock
 }
 
 func (conf *Config) Check() error {
+	if conf.NTPKeyID != 0 && conf.NTPKeysFile == "" {
+		return fmt.Errorf("ntp key id set without keys file")
+	}
+	if conf.NTPKeyID != 0 && conf.NTPNTSKEAddr != "" {
+		return fmt.Errorf("ntp key id and nts are exclusive")
+	}
+	if conf.SyncBurst <= 0 {
+		conf.SyncBurst = 1
+	}
+	conf.Clock = clock.Or(conf.Clock)
 	return nil
 }
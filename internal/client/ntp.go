@@ -1,12 +1,16 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
 	"ntsc.ac.cn/tas/tas-commons/pkg/rexec"
 )
 
@@ -15,8 +19,8 @@ func (vc *ValidateClient) _startNTP(errChan chan error) {
 		return
 	}
 	if err := vc.ntpClient.Open(); err != nil {
-		errChan <- fmt.Errorf("failed to open ntp client")
-		return
+		logrus.WithField("prefix", "client.ntp").
+			Warnf("failed to open ntp client, retry on next sync: %v", err)
 	}
 	vc.crontab.Start()
 	interval := fmt.Sprintf("@every %ds", vc.conf.SyncInterval)
@@ -26,21 +30,50 @@ func (vc *ValidateClient) _startNTP(errChan chan error) {
 }
 
 func (vc *ValidateClient) _sync(errChan chan error) {
-	resp, err := vc.ntpClient.Query()
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Second*time.Duration(vc.conf.SyncInterval))
+	defer cancel()
+	result, err := vc.ntpClient.Query(ctx)
+	for _, src := range result.Sources {
+		var ke *tcpntp.KissError
+		if errors.As(src.Err, &ke) && ke.Fatal() {
+			logrus.WithField("prefix", "client.ntp").
+				Warnf("ntp source [%s] refuses service: %v", src.Address, ke)
+		}
+	}
 	if err != nil {
 		logrus.WithField("preifx", "client.ntp").
 			Errorf("failed to query ntp: %v", err)
+		for _, src := range result.Sources {
+			if src.Err != nil {
+				logrus.WithField("prefix", "client.ntp").
+					Debugf("ntp source [%s] failed: %v", src.Address, src.Err)
+			}
+		}
+		return
+	}
+	if ft := result.Falsetickers(); len(ft) > 0 {
+		logrus.WithField("prefix", "client.ntp").
+			Warnf("ntp falsetickers: %s", strings.Join(ft, ","))
 	}
 	logrus.WithField("prefix", "client.ntp").
-		Tracef("offset: %s", resp.ClockOffset)
-	offset_f64 := math.Abs(float64(resp.ClockOffset))
+		Tracef("offset: %s jitter: %s system peer: %s truechimers: %s",
+			result.Offset, result.Jitter, result.SystemPeer,
+			strings.Join(result.Truechimers(), ","))
+	if vc.nearLeap(result.Leap, vc.conf.Clock.Now()) {
+		logrus.WithField("prefix", "client.ntp").
+			Infof("leap second near, defer clock step of %s", result.Offset)
+		return
+	}
+	offset_f64 := math.Abs(float64(result.Offset))
 	conf_f64 := float64(time.Duration(
 		time.Millisecond * time.Duration(vc.conf.SyncFix)))
 	if offset_f64 < conf_f64 {
 		return
 	}
-	local := time.Now().Add(time.Second * -37)
-	fix := local.Add(resp.ClockOffset)
+	local := timescale.Convert(vc.conf.Clock.Now(), vc.conf.LocalScale,
+		vc.conf.CLIScale)
+	fix := local.Add(result.Offset)
 	args := fmt.Sprintf("time_s %04d %02d %02d %02d %02d %02d %d",
 		fix.Year(), fix.Month(), fix.Day(),
 		fix.Hour(), fix.Minute(), fix.Second(), fix.Nanosecond())
@@ -53,10 +86,40 @@ func (vc *ValidateClient) _sync(errChan chan error) {
 			Errorf("failed to create set time execute: %v", err)
 		return
 	}
-	result, err := exec.Run()
+	out, err := exec.Run()
 	if err != nil {
 		logrus.WithField("preifx", "client.ntp").
-			Errorf("failed to create set time execute: %v %s", err, result)
+			Errorf("failed to create set time execute: %v %s", err, out)
 		return
 	}
+	// Samples taken before the step no longer describe the local clock.
+	vc.ntpClient.ResetFilter()
+}
+
+// leapGuard is the time around a leap second in which the local clock is
+// not stepped: sources apply the leap at slightly different instants, so
+// an offset measured then may be off by a second.
+const leapGuard = time.Minute
+
+// nearLeap reports whether local, a reading of the local clock, is within
+// leapGuard of a leap second announced by the sources or by the leap
+// second table.
+func (vc *ValidateClient) nearLeap(li tcpntp.LeapIndicator,
+	local time.Time) bool {
+	leaps := timescale.Default()
+	utc := leaps.Convert(local, vc.conf.LocalScale, timescale.UTC)
+	midnight := utc.Truncate(24 * time.Hour)
+	announced := li == tcpntp.LeapAddSecond || li == tcpntp.LeapDelSecond
+	if announced && leaps.Pending(utc) == 0 {
+		logrus.WithField("prefix", "client.ntp").
+			Warnf("ntp sources announce a leap second missing from the leap " +
+				"second table, update the leap seconds file")
+	}
+	if midnight.Add(24*time.Hour).Sub(utc) <= leapGuard {
+		return announced || leaps.Pending(utc) != 0
+	}
+	if utc.Sub(midnight) < leapGuard {
+		return leaps.Pending(midnight.Add(-time.Second)) != 0
+	}
+	return false
 }
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/agentx"
+	"ntsc.ac.cn/ta/time-validater/pkg/snmp"
+)
+
+// maxMachineIDSize bounds the machine IDs indexing tvMachineTable, so
+// that its OIDs stay within the 128 sub-identifiers of SNMP.
+const maxMachineIDSize = 100
+
+type AgentXConfig struct {
+	// Address is the address of the master agent, as in agentx.Config.
+	Address string
+	// AlarmThreshold is the offset beyond which a machine is in major
+	// alarm, 100 milliseconds by default.
+	AlarmThreshold time.Duration
+}
+
+func (conf *AgentXConfig) alarmThreshold() time.Duration {
+	if conf.AlarmThreshold <= 0 {
+		return defaultAlarmThreshold
+	}
+	return conf.AlarmThreshold
+}
+
+func (s *ValidateServer) newSubAgent() (*agentx.SubAgent, error) {
+	agent, err := agentx.NewSubAgent(&agentx.Config{
+		Address:     s.conf.AgentX.Address,
+		Subtree:     machineTableOID,
+		Description: "time validater machine table",
+		Handler:     s.machineTable,
+		Objects:     machineColumns(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create agentx sub-agent: %v", err)
+	}
+	return agent, nil
+}
+
+// machineTable returns the instances of tvMachineTable, a row per session.
+// The offset and RTT of a machine not measured yet are absent.
+func (s *ValidateServer) machineTable() []snmp.Varbind {
+	now := s.conf.Clock.Now()
+	threshold := s.conf.AgentX.alarmThreshold()
+	var vbs []snmp.Varbind
+	s.sm.each(func(cs *session) bool {
+		info := cs.info(now)
+		if len(info.MachineID) > maxMachineIDSize {
+			return true
+		}
+		index := make(snmp.OID, 0, len(info.MachineID)+1)
+		index = append(index, uint32(len(info.MachineID)))
+		for _, c := range []byte(info.MachineID) {
+			index = append(index, uint32(c))
+		}
+		column := func(c uint32, v interface{}) {
+			vbs = append(vbs, snmp.Varbind{
+				OID:   append(machineEntryOID.Append(c), index...),
+				Value: v,
+			})
+		}
+		lastSeen := info.ConnectedAt
+		if m := info.LastMeasurement; m != nil {
+			column(columnOffset, clampInt32(m.Offset/time.Microsecond))
+			column(columnRTT, snmp.Gauge32(clampUint32(m.Delay/time.Microsecond)))
+			lastSeen = m.Time
+		}
+		column(columnSessionState, int(info.State)+1)
+		column(columnLastSeen, dateAndTime(lastSeen))
+		column(columnAlarmSeverity, severity(&info, threshold))
+		return true
+	})
+	return vbs
+}
+
+// machineColumns returns the accessible columns of tvMachineEntry.
+func machineColumns() []snmp.OID {
+	var columns []snmp.OID
+	for c := uint32(columnOffset); c <= columnAlarmSeverity; c++ {
+		columns = append(columns, machineEntryOID.Append(c))
+	}
+	return columns
+}
+
+// severity rates a session: critical when stale, major when offset beyond
+// threshold, indeterminate until measured and once closed.
+func severity(info *SessionInfo, threshold time.Duration) int {
+	switch {
+	case info.State == SessionStale:
+		return severityCritical
+	case info.LastMeasurement == nil || info.State == SessionClosed:
+		return severityIndeterminate
+	case info.LastMeasurement.Offset > threshold ||
+		info.LastMeasurement.Offset < -threshold:
+		return severityMajor
+	}
+	return severityCleared
+}
+
+// dateAndTime encodes t as a DateAndTime of SNMPv2-TC, in UTC.
+func dateAndTime(t time.Time) []byte {
+	t = t.UTC()
+	return []byte{
+		byte(t.Year() >> 8), byte(t.Year()), byte(t.Month()), byte(t.Day()),
+		byte(t.Hour()), byte(t.Minute()), byte(t.Second()),
+		byte(t.Nanosecond() / int(100*time.Millisecond)),
+		'+', 0, 0,
+	}
+}
+
+func clampInt32(d time.Duration) int {
+	switch {
+	case d > math.MaxInt32:
+		return math.MaxInt32
+	case d < math.MinInt32:
+		return math.MinInt32
+	}
+	return int(d)
+}
+
+func clampUint32(d time.Duration) uint32 {
+	switch {
+	case d > math.MaxUint32:
+		return math.MaxUint32
+	case d < 0:
+		return 0
+	}
+	return uint32(d)
+}
@@ -1,10 +1,49 @@
 package server
 
+import (
+	"fmt"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
+)
+
 type Config struct {
 	Listener string
 	CertPath string
+	// ServerScale is the time scale of the server clock and ClientScale
+	// the one of the validated machine clocks.
+	ServerScale timescale.Scale
+	ClientScale timescale.Scale
+	// Clock timestamps the validation requests and responses and paces
+	// the health checks. It defaults to the system clock.
+	Clock clock.Clock
+	// Schedule sets the probe interval of each machine, every 3 seconds
+	// if nil. ValidateServer.SetSchedule replaces it at run time.
+	Schedule *Schedule
+	// Sinks receive the measurements. The sinks of a nil slice default to
+	// an HTTPSink posting to DefaultTrapURL; an empty one has none.
+	Sinks []MeasurementSink
+	// AgentX, if set, registers the machine table with an AgentX master
+	// agent, for SNMP managers to poll.
+	AgentX *AgentXConfig
 }
 
 func (conf *Config) Check() error {
+	conf.Clock = clock.Or(conf.Clock)
+	if conf.Sinks == nil {
+		sink, err := NewHTTPSink(&HTTPSinkConfig{
+			URL:   DefaultTrapURL,
+			Clock: conf.Clock,
+		})
+		if err != nil {
+			return err
+		}
+		conf.Sinks = []MeasurementSink{sink}
+	}
+	if conf.Schedule != nil {
+		if err := conf.Schedule.Check(); err != nil {
+			return fmt.Errorf("failed to check schedule: %v", err)
+		}
+	}
 	return nil
 }
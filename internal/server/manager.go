@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// staleProbes is the number of probe intervals a session may go without a
+// measurement before it is reported stale, and a closed session stays
+// listed.
+const staleProbes = 3
+
+// SessionState is the lifecycle state of a validation session.
+type SessionState int
+
+const (
+	// SessionConnecting is a session waiting for its first measurement.
+	SessionConnecting SessionState = iota
+	// SessionActive is a session measured within staleProbes intervals.
+	SessionActive
+	// SessionStale is a session whose machine stopped answering, or never
+	// answered since it connected.
+	SessionStale
+	// SessionClosed is a session whose stream ended. It is dropped after
+	// staleProbes intervals, or when its machine connects again.
+	SessionClosed
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case SessionConnecting:
+		return "connecting"
+	case SessionActive:
+		return "active"
+	case SessionStale:
+		return "stale"
+	case SessionClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("SessionState(%d)", int(s))
+}
+
+// Measurement is the result of one validation exchange with a machine.
+type Measurement struct {
+	// Time is when the response was received, on the server clock.
+	Time time.Time
+	// Offset is the offset of the machine clock to the server clock, and
+	// Delay the round trip delay of the exchange.
+	Offset time.Duration
+	Delay  time.Duration
+}
+
+// SessionInfo is a snapshot of a validation session.
+type SessionInfo struct {
+	MachineID   string
+	Peer        string
+	State       SessionState
+	ConnectedAt time.Time
+	// Interval is the probe interval of the session.
+	Interval time.Duration
+	// LastMeasurement is nil until the machine first answers.
+	LastMeasurement *Measurement
+}
+
+// sessionManager is the registry of the sessions, one per machine ID. It
+// is safe for concurrent use.
+type sessionManager struct {
+	mu       sync.RWMutex
+	sessions map[string]*session
+}
+
+func newSessionManager() *sessionManager {
+	return &sessionManager{
+		sessions: make(map[string]*session),
+	}
+}
+
+func (sm *sessionManager) find(machineID string) *session {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	if s := sm.sessions[machineID]; s != nil && !s.expired() {
+		return s
+	}
+	return nil
+}
+
+// add registers s, unless its machine already has a session not closed.
+func (sm *sessionManager) add(s *session) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if prev, ok := sm.sessions[s.machineID]; ok && !prev.closed() {
+		return fmt.Errorf("machine id [%s] existed", s.machineID)
+	}
+	sm.sessions[s.machineID] = s
+	return nil
+}
+
+func (sm *sessionManager) len() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return len(sm.sessions)
+}
+
+// each calls fn on the sessions in machine ID order until it returns
+// false, after dropping the expired ones. The sessions are those registered
+// when each was called; fn may add sessions.
+func (sm *sessionManager) each(fn func(*session) bool) {
+	sm.mu.Lock()
+	ss := make([]*session, 0, len(sm.sessions))
+	for id, s := range sm.sessions {
+		if s.expired() {
+			delete(sm.sessions, id)
+			continue
+		}
+		ss = append(ss, s)
+	}
+	sm.mu.Unlock()
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].machineID < ss[j].machineID
+	})
+	for _, s := range ss {
+		if !fn(s) {
+			return
+		}
+	}
+}
+
+// snapshot returns the state of the sessions at now, in machine ID order.
+func (sm *sessionManager) snapshot(now time.Time) []SessionInfo {
+	infos := make([]SessionInfo, 0, sm.len())
+	sm.each(func(s *session) bool {
+		infos = append(infos, s.info(now))
+		return true
+	})
+	return infos
+}
+
+// Sessions returns a snapshot of the validation sessions, in machine ID
+// order.
+func (s *ValidateServer) Sessions() []SessionInfo {
+	return s.sm.snapshot(s.conf.Clock.Now())
+}
+
+// Session returns a snapshot of the session of machineID, if any.
+func (s *ValidateServer) Session(machineID string) (SessionInfo, bool) {
+	cs := s.sm.find(machineID)
+	if cs == nil {
+		return SessionInfo{}, false
+	}
+	return cs.info(s.conf.Clock.Now()), true
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/snmp"
+)
+
+// The objects of TIME-VALIDATER-MIB, shipped in mibs/.
+
+// defaultAlarmThreshold is the offset beyond which a machine is in alarm.
+const defaultAlarmThreshold = 100 * time.Millisecond
+
+// The values of tvAlarmState.
+const (
+	alarmNormal = 1
+	alarmRaised = 2
+)
+
+// The values of tvMachineAlarmSeverity, those of ItuPerceivedSeverity.
+const (
+	severityCleared       = 1
+	severityIndeterminate = 2
+	severityCritical      = 3
+	severityMajor         = 4
+)
+
+// The columns of tvMachineEntry, indexed by tvMachineIndex.
+const (
+	columnMachineIndex = iota + 1
+	columnOffset
+	columnRTT
+	columnSessionState
+	columnLastSeen
+	columnAlarmSeverity
+)
+
+var (
+	// validaterOID is the subtree of the validater: notifications under
+	// .0, their objects under .1 and the machine table under .2. The
+	// offset keeps the OID the trap bridge reported it under.
+	validaterOID          = snmp.MustParseOID(".1.3.6.1.4.1.326.3.1")
+	offsetNotificationOID = validaterOID.Append(0, 1)
+	offsetVarOID          = validaterOID.Append(1, 1)
+	machineIDVarOID       = validaterOID.Append(1, 2)
+	rttVarOID             = validaterOID.Append(1, 3)
+	alarmStateVarOID      = validaterOID.Append(1, 4)
+	machineTableOID       = validaterOID.Append(2)
+	machineEntryOID       = machineTableOID.Append(1)
+)
@@ -20,26 +20,24 @@ func (s *ValidateServer) Validate(
 		return rpc.GenerateError(codes.PermissionDenied,
 			fmt.Errorf("failed to read machine id: %v", err))
 	}
-	if cs := s.sm.find(machineID); cs != nil {
-		return fmt.Errorf("machine id [%s] existed", machineID)
+	cs := newSession(s.conf, stream, machineID, s.publish)
+	if err = s.sm.add(cs); err != nil {
+		return err
 	}
-
-	cs := newSession(stream, machineID)
-	if cs.cronID, err = s.crontab.AddJob("@every 3s", cs); err != nil {
-		return rpc.GenerateError(codes.Internal, fmt.Errorf(
-			"failed to create crontab job: %v", err))
-	}
-	s.sm.add(cs)
+	s.scheduleProbes(cs)
 	logrus.WithField("prefix", "handler_validate").
 		Debugf("create validate session: %s", machineID)
 	go cs.start()
-	for err := range cs.errChan {
+	select {
+	case err = <-cs.errChan:
+	case <-stream.Context().Done():
+		err = stream.Context().Err()
+	}
+	if err != nil {
 		logrus.WithField("prefix", "handler_validate").
 			Warnf("session failed: %v", err)
-		s.crontab.Remove(cs.cronID)
-		s.sm.remove(cs.machineID)
-		return nil
 	}
+	s.crontab.Remove(cs.close())
 	return nil
 }
 
@@ -52,7 +50,7 @@ func (s *ValidateServer) Watch(req *pb.HealthCheckRequest, stream pb.Health_Watc
 		return rpc.GenerateArgumentRequiredError("service name")
 	}
 	for {
-		time.Sleep(time.Second * 3)
+		s.conf.Clock.Sleep(time.Second * 3)
 		if err := stream.Send(&pb.HealthCheckResponse{
 			Status: pb.HealthCheckResponse_SERVING,
 		}); err != nil {
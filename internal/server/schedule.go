@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultProbeInterval spaces the validation requests of the machines
+	// the schedule does not name.
+	defaultProbeInterval = 3 * time.Second
+	minProbeInterval     = 100 * time.Millisecond
+)
+
+// Schedule sets the interval between the validation requests sent to each
+// machine: the interval of the machine if set, else the one of its group,
+// else Default.
+type Schedule struct {
+	Default time.Duration
+	// Groups maps a group name to its interval, and Members a machine ID
+	// to its group.
+	Groups   map[string]time.Duration
+	Members  map[string]string
+	Machines map[string]time.Duration
+}
+
+func (sc *Schedule) Check() error {
+	if sc.Default != 0 && sc.Default < minProbeInterval {
+		return fmt.Errorf("default probe interval %s below %s",
+			sc.Default, minProbeInterval)
+	}
+	for name, d := range sc.Groups {
+		if d < minProbeInterval {
+			return fmt.Errorf("probe interval %s of group [%s] below %s",
+				d, name, minProbeInterval)
+		}
+	}
+	for id, group := range sc.Members {
+		if _, ok := sc.Groups[group]; !ok {
+			return fmt.Errorf("machine [%s] in unknown group [%s]", id, group)
+		}
+	}
+	for id, d := range sc.Machines {
+		if d < minProbeInterval {
+			return fmt.Errorf("probe interval %s of machine [%s] below %s",
+				d, id, minProbeInterval)
+		}
+	}
+	return nil
+}
+
+// Interval returns the probe interval of machineID. A nil schedule probes
+// every machine at the default interval.
+func (sc *Schedule) Interval(machineID string) time.Duration {
+	if sc == nil {
+		return defaultProbeInterval
+	}
+	if d, ok := sc.Machines[machineID]; ok {
+		return d
+	}
+	if group, ok := sc.Members[machineID]; ok {
+		return sc.Groups[group]
+	}
+	if sc.Default > 0 {
+		return sc.Default
+	}
+	return defaultProbeInterval
+}
+
+// LoadSchedule reads a probe schedule file.
+func LoadSchedule(path string) (*Schedule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open schedule file [%s]: %v", path, err)
+	}
+	defer f.Close()
+	sc, err := ParseSchedule(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schedule file [%s]: %v", path, err)
+	}
+	return sc, nil
+}
+
+// ParseSchedule parses a probe schedule, one directive per line with #
+// comments:
+//
+//	default <interval>
+//	group <name> <interval> <machine-id>...
+//	machine <machine-id> <interval>
+//
+// Intervals are Go durations such as 500ms or 1m. A group may be declared
+// on several lines with the same interval, and a machine belongs to one
+// group at most.
+func ParseSchedule(r io.Reader) (*Schedule, error) {
+	sc := &Schedule{
+		Groups:   make(map[string]time.Duration),
+		Members:  make(map[string]string),
+		Machines: make(map[string]time.Duration),
+	}
+	s := bufio.NewScanner(r)
+	line := 0
+	for s.Scan() {
+		line++
+		text := s.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "default":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: expect \"default interval\"", line)
+			}
+			d, err := time.ParseDuration(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid interval: %v", line, err)
+			}
+			sc.Default = d
+		case "group":
+			if len(fields) < 3 {
+				return nil, fmt.Errorf(
+					"line %d: expect \"group name interval machine-id...\"", line)
+			}
+			d, err := time.ParseDuration(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid interval: %v", line, err)
+			}
+			name := fields[1]
+			if prev, ok := sc.Groups[name]; ok && prev != d {
+				return nil, fmt.Errorf("line %d: group [%s] redeclared with "+
+					"interval %s, was %s", line, name, d, prev)
+			}
+			sc.Groups[name] = d
+			for _, id := range fields[3:] {
+				if group, ok := sc.Members[id]; ok && group != name {
+					return nil, fmt.Errorf("line %d: machine [%s] already in "+
+						"group [%s]", line, id, group)
+				}
+				sc.Members[id] = name
+			}
+		case "machine":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf(
+					"line %d: expect \"machine machine-id interval\"", line)
+			}
+			d, err := time.ParseDuration(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid interval: %v", line, err)
+			}
+			sc.Machines[fields[1]] = d
+		default:
+			return nil, fmt.Errorf("line %d: unknown directive [%s]",
+				line, fields[0])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if err := sc.Check(); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// every is a cron schedule firing at a constant interval. Unlike
+// cron.Every it keeps intervals below a second.
+type every time.Duration
+
+func (d every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(d))
+}
+
+// currentSchedule returns the schedule in effect.
+func (s *ValidateServer) currentSchedule() *Schedule {
+	s.scheduleMu.RLock()
+	defer s.scheduleMu.RUnlock()
+	return s.schedule
+}
+
+// SetSchedule replaces the probe schedule. Live sessions whose interval
+// changes are rescheduled at once, without reconnecting.
+func (s *ValidateServer) SetSchedule(sc *Schedule) error {
+	if sc != nil {
+		if err := sc.Check(); err != nil {
+			return fmt.Errorf("failed to check schedule: %v", err)
+		}
+	}
+	s.scheduleMu.Lock()
+	s.schedule = sc
+	s.scheduleMu.Unlock()
+	s.sm.each(func(cs *session) bool {
+		s.scheduleProbes(cs)
+		return true
+	})
+	return nil
+}
+
+// scheduleProbes schedules the probes of cs at the interval of its machine
+// in the current schedule, replacing its cron entry if the interval
+// changed. The schedule is read under cs.mu, so that of a concurrent
+// SetSchedule and Validate the last to lock applies the latest schedule.
+func (s *ValidateServer) scheduleProbes(cs *session) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.state == SessionClosed {
+		return
+	}
+	interval := s.currentSchedule().Interval(cs.machineID)
+	if cs.cronID != 0 && interval == cs.interval {
+		return
+	}
+	prev := cs.cronID
+	cs.interval = interval
+	cs.cronID = s.crontab.Schedule(every(interval), cs)
+	if prev != 0 {
+		s.crontab.Remove(prev)
+		logrus.WithField("prefix", "server.schedule").
+			Debugf("probe session [%s] every %s", cs.machineID, interval)
+	}
+}
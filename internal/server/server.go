@@ -2,9 +2,11 @@ package server
 
 import (
 	"fmt"
+	"sync"
 
 	cron "github.com/robfig/cron/v3"
 	"google.golang.org/grpc"
+	"ntsc.ac.cn/ta/time-validater/pkg/agentx"
 	"ntsc.ac.cn/tas/tas-commons/pkg/pb"
 	"ntsc.ac.cn/tas/tas-commons/pkg/rpc"
 )
@@ -15,6 +17,11 @@ type ValidateServer struct {
 	rpcServer *rpc.Server
 	crontab   *cron.Cron
 	sm        *sessionManager
+	sinks     []*sinkQueue
+	agent     *agentx.SubAgent
+
+	scheduleMu sync.RWMutex
+	schedule   *Schedule
 }
 
 func NewValidateServer(conf *Config) (*ValidateServer, error) {
@@ -30,6 +37,15 @@ func NewValidateServer(conf *Config) (*ValidateServer, error) {
 	if err = conf.Check(); err != nil {
 		return nil, fmt.Errorf("failed to check server config: %v", err)
 	}
+	server.schedule = conf.Schedule
+	for _, sink := range conf.Sinks {
+		server.sinks = append(server.sinks, newSinkQueue(sink, conf.Clock))
+	}
+	if conf.AgentX != nil {
+		if server.agent, err = server.newSubAgent(); err != nil {
+			return nil, err
+		}
+	}
 	if server.rpcConf, err =
 		rpc.GenServerRPCConfig(conf.CertPath, conf.Listener); err != nil {
 		return nil, fmt.Errorf("failed to generate rpc config: %v", err)
@@ -51,6 +67,12 @@ func NewValidateServer(conf *Config) (*ValidateServer, error) {
 
 func (s *ValidateServer) Start() chan error {
 	errChan := make(chan error, 1)
+	for _, q := range s.sinks {
+		q.start()
+	}
+	if s.agent != nil {
+		s.agent.Start()
+	}
 	s.crontab.Start()
 	go func() {
 		err := <-s.rpcServer.Start()
@@ -58,3 +80,15 @@ func (s *ValidateServer) Start() chan error {
 	}()
 	return errChan
 }
+
+// Close stops probing the sessions and the AgentX sub-agent, then flushes
+// the sinks, waiting sinkDrainTimeout at most.
+func (s *ValidateServer) Close() error {
+	<-s.crontab.Stop().Done()
+	var err error
+	if s.agent != nil {
+		err = s.agent.Close()
+	}
+	s.closeSinks()
+	return err
+}
@@ -1,44 +1,39 @@
 package server
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
+	"sync"
 	"time"
 
 	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
 	"ntsc.ac.cn/tas/tas-commons/pkg/pb"
 )
 
-const (
-	TRAP_URL = "http://127.0.0.1:8787/pushMonitorState"
-)
-
-type snmpLog struct {
-	ID   string      `json:"id"`
-	Data []*snmpData `json:"data"`
-}
-
-type snmpData struct {
-	OID   string `json:"oid"`
-	State int    `json:"state"`
-	Type  string `json:"type"`
-}
-
-type resultLog struct {
-	Result string `json:"result"`
-}
-
 type session struct {
+	conf      *Config
 	machineID string
+	peer      string
 	stream    pb.TimeValidateService_ValidateServer
 	errChan   chan error
-	lastData  *timeData
-	cronID    cron.EntryID
+	// report hands the measurements to the sinks.
+	report func(machineID string, m Measurement)
+
+	mu          sync.Mutex
+	cronID      cron.EntryID
+	interval    time.Duration
+	state       SessionState
+	connectedAt time.Time
+	closedAt    time.Time
+	// probing is set while a probe awaits its response. The responses do
+	// not echo T1, so a single probe may be outstanding.
+	probing  bool
+	lastData *timeData
+	last     *Measurement
 }
 
 type timeData struct {
@@ -48,21 +43,100 @@ type timeData struct {
 	t4 time.Time
 }
 
-func newSession(stream pb.TimeValidateService_ValidateServer,
-	machineID string) *session {
-	return &session{
-		stream:    stream,
-		machineID: machineID,
-		errChan:   make(chan error),
-		lastData:  &timeData{},
+func newSession(conf *Config, stream pb.TimeValidateService_ValidateServer,
+	machineID string, report func(string, Measurement)) *session {
+	s := &session{
+		conf:        conf,
+		stream:      stream,
+		machineID:   machineID,
+		report:      report,
+		errChan:     make(chan error, 1),
+		state:       SessionConnecting,
+		connectedAt: conf.Clock.Now(),
+		lastData:    &timeData{},
+	}
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		s.peer = p.Addr.String()
 	}
+	return s
+}
+
+// end reports the end of the session to Validate: err, or nil when the
+// client closed the stream. Only the first report is kept.
+func (s *session) end(err error) {
+	select {
+	case s.errChan <- err:
+	default:
+	}
+}
+
+// close marks the session closed once its stream ended, and returns the
+// cron entry of its probes.
+func (s *session) close() cron.EntryID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = SessionClosed
+	s.closedAt = s.conf.Clock.Now()
+	return s.cronID
 }
 
+func (s *session) closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == SessionClosed
+}
+
+// expired reports whether the session was closed more than staleProbes
+// probe intervals ago.
+func (s *session) expired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == SessionClosed &&
+		s.conf.Clock.Since(s.closedAt) > staleProbes*s.interval
+}
+
+// info returns the state of the session at now. A session without a
+// measurement for staleProbes probe intervals, or since it connected if it
+// has none, is reported stale.
+func (s *session) info(now time.Time) SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := SessionInfo{
+		MachineID:   s.machineID,
+		Peer:        s.peer,
+		State:       s.state,
+		ConnectedAt: s.connectedAt,
+		Interval:    s.interval,
+	}
+	since := s.connectedAt
+	if s.last != nil {
+		last := *s.last
+		info.LastMeasurement = &last
+		since = last.Time
+	}
+	if (s.state == SessionConnecting || s.state == SessionActive) &&
+		s.interval > 0 && now.Sub(since) > staleProbes*s.interval {
+		info.State = SessionStale
+	}
+	return info
+}
+
+// Run sends a probe, unless the previous one is still unanswered: a machine
+// slower than the probe interval is probed once per response.
 func (s *session) Run() {
-	t1 := timestamppb.Now()
+	t1 := timestamppb.New(s.conf.Clock.Now())
+	s.mu.Lock()
+	if s.probing {
+		s.mu.Unlock()
+		logrus.WithField("prefix", "session").
+			Tracef("session [%s] still probing, skip", s.machineID)
+		return
+	}
+	s.probing = true
 	s.lastData = &timeData{
 		t1: t1.AsTime(),
 	}
+	s.mu.Unlock()
 	logrus.WithField("prefix", "session").
 		Tracef("send session [%s] t1: %s", s.machineID,
 			t1.AsTime().Format(time.RFC3339Nano))
@@ -71,8 +145,8 @@ func (s *session) Run() {
 	}); err != nil {
 		logrus.WithField("prefix", "session").Errorf(
 			"failed to send data to session [%s]: %v", s.machineID, err)
-		s.errChan <- fmt.Errorf(
-			"failed to send data to session [%s]: %v", s.machineID, err)
+		s.end(fmt.Errorf(
+			"failed to send data to session [%s]: %v", s.machineID, err))
 		return
 	}
 }
@@ -80,96 +154,54 @@ func (s *session) Run() {
 func (s *session) start() {
 	for {
 		resp, err := s.stream.Recv()
-		s.lastData.t4 = time.Now()
+		t4 := s.conf.Clock.Now()
 		if err != nil {
 			if err == io.EOF {
 				logrus.WithField("prefix", "sessiobn").
 					Infof("session [%s] closed", s.machineID)
+				s.end(nil)
 				return
 			}
-			s.errChan <- fmt.Errorf(
-				"failed to session [%s] recv: %v", s.machineID, err)
+			s.end(fmt.Errorf(
+				"failed to session [%s] recv: %v", s.machineID, err))
 			return
 		}
+		s.mu.Lock()
+		if !s.probing {
+			s.mu.Unlock()
+			logrus.WithField("prefix", "session").
+				Warnf("session [%s] answered no probe, ignore", s.machineID)
+			continue
+		}
+		s.probing = false
 		s.lastData.t2 = resp.T2.AsTime()
 		s.lastData.t3 = resp.T3.AsTime()
-		_t1 := s.lastData.t1.UnixNano()
-		_t2 := s.lastData.t2.UnixNano()
-		_t3 := s.lastData.t3.UnixNano()
-		_t4 := s.lastData.t4.UnixNano()
+		s.lastData.t4 = t4
+		data := *s.lastData
+		s.mu.Unlock()
+		_t1 := data.t1.UnixNano()
+		_t2 := data.t2.UnixNano()
+		_t3 := data.t3.UnixNano()
+		_t4 := data.t4.UnixNano()
 		offsetValue := ((_t2 - _t1) + (_t3 - _t4)) / 2
-		offset := time.Duration(offsetValue)
-		offset = offset - time.Duration(time.Second*37)
+		// t2 and t3 are read in the client scale, t1 and t4 in the server
+		// scale: remove the difference of the scales themselves.
+		offset := time.Duration(offsetValue) - timescale.Between(
+			data.t1, s.conf.ServerScale, s.conf.ClientScale)
+		m := Measurement{
+			Time:   t4,
+			Offset: offset,
+			Delay:  time.Duration((_t4 - _t1) - (_t3 - _t2)),
+		}
+		s.mu.Lock()
+		s.last = &m
+		if s.state == SessionConnecting {
+			s.state = SessionActive
+		}
+		s.mu.Unlock()
 
 		logrus.WithField("prefix", "session").
 			Tracef("session [%s] offset[%s]", s.machineID, offset)
-		go func() {
-			log := snmpLog{
-				ID: s.machineID,
-				Data: []*snmpData{
-					{
-						OID:   ".1.3.6.1.4.1.326.3.1.1.1",
-						Type:  "Counter64",
-						State: int(offset),
-					},
-				},
-			}
-			logData, err := json.Marshal(&log)
-			if err != nil {
-				logrus.WithField("prefix", "session").
-					Warnf("failed to marshal trap machine [%s] offset[%s]: %v",
-						s.machineID, offset, err)
-				return
-			}
-			resp, err := http.Post(TRAP_URL, "application/json", bytes.NewBuffer(logData))
-			if err != nil {
-				logrus.WithField("prefix", "session").
-					Warnf("failed to send trap machine [%s] offset[%s]: %v",
-						s.machineID, offset, err)
-				return
-			}
-			var r resultLog
-			if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-				logrus.WithField("prefix", "session").
-					Warnf("failed to decoder trap response: %v", err)
-				return
-			}
-			logrus.WithField("prefix", "session").
-				Tracef("send trap machine [%s] offset[%s] success : %v",
-					s.machineID, offset, r.Result)
-		}()
-	}
-}
-
-type sessionManager struct {
-	sessions []*session
-}
-
-func newSessionManager() *sessionManager {
-	return &sessionManager{
-		sessions: make([]*session, 0),
-	}
-}
-
-func (sm *sessionManager) find(machineID string) *session {
-	for _, v := range sm.sessions {
-		if v.machineID == machineID {
-			return v
-		}
-	}
-	return nil
-}
-
-func (sm *sessionManager) add(s *session) {
-	sm.sessions = append(sm.sessions, s)
-}
-
-func (sm *sessionManager) remove(machineID string) {
-	ss := make([]*session, 0)
-	for _, v := range sm.sessions {
-		if v.machineID != machineID {
-			ss = append(ss, v)
-		}
+		s.report(s.machineID, m)
 	}
-	sm.sessions = ss
 }
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+)
+
+const (
+	// sinkQueueSize is the number of measurements a sink may lag behind
+	// before new ones are dropped.
+	sinkQueueSize = 1024
+	// sinkDrainTimeout bounds the time Close waits for the sinks to send
+	// their queued measurements.
+	sinkDrainTimeout = 5 * time.Second
+)
+
+// MeasurementSink receives the measurements of the sessions. Each sink is
+// fed by its own goroutine, in order, so a slow sink delays neither the
+// sessions nor the other sinks. Send returns once ctx is done: Close
+// cancels it for a sink that fails to drain in time.
+type MeasurementSink interface {
+	Send(ctx context.Context, machineID string, m Measurement) error
+}
+
+// ParseSink returns the sink described by spec: an http or https URL for
+// an HTTPSink with default settings, an snmp or snmpv3 URL for an
+// SNMPSink (see parseSNMPSink), or "log" for a LogSink.
+func ParseSink(spec string) (MeasurementSink, error) {
+	switch {
+	case spec == "log":
+		return LogSink{}, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return NewHTTPSink(&HTTPSinkConfig{URL: spec})
+	case strings.HasPrefix(spec, "snmp://"), strings.HasPrefix(spec, "snmpv3://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sink [%s]: %v", spec, err)
+		}
+		return parseSNMPSink(u)
+	}
+	return nil, fmt.Errorf("unsupported sink [%s]", spec)
+}
+
+// LogSink logs the measurements.
+type LogSink struct{}
+
+func (LogSink) Send(ctx context.Context, machineID string, m Measurement) error {
+	logrus.WithField("prefix", "sink.log").
+		Infof("machine [%s] offset [%s] delay [%s]", machineID, m.Offset, m.Delay)
+	return nil
+}
+
+func (LogSink) String() string {
+	return "log"
+}
+
+type sinkRecord struct {
+	machineID string
+	m         Measurement
+}
+
+// sinkQueue feeds a sink from a bounded queue.
+type sinkQueue struct {
+	sink    MeasurementSink
+	clock   clock.Clock
+	records chan sinkRecord
+	// ctx is cancelled when the queue fails to drain in time.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.RWMutex
+	started bool
+	closed  bool
+}
+
+func newSinkQueue(sink MeasurementSink, c clock.Clock) *sinkQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &sinkQueue{
+		sink:    sink,
+		clock:   c,
+		records: make(chan sinkRecord, sinkQueueSize),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+}
+
+func (q *sinkQueue) start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.started || q.closed {
+		return
+	}
+	q.started = true
+	go q.run()
+}
+
+func (q *sinkQueue) run() {
+	defer close(q.done)
+	dropped := 0
+	for r := range q.records {
+		if q.ctx.Err() != nil {
+			dropped++
+			continue
+		}
+		if err := q.sink.Send(q.ctx, r.machineID, r.m); err != nil {
+			logrus.WithField("prefix", "server.sink").
+				Warnf("failed to send machine [%s] offset [%s] to sink [%v]: %v",
+					r.machineID, r.m.Offset, q.sink, err)
+		}
+	}
+	if dropped > 0 {
+		logrus.WithField("prefix", "server.sink").
+			Warnf("sink [%v] closed, drop %d measurements", q.sink, dropped)
+	}
+}
+
+// push queues r, unless the queue is full or closed.
+func (q *sinkQueue) push(r sinkRecord) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return fmt.Errorf("sink closed")
+	}
+	select {
+	case q.records <- r:
+		return nil
+	default:
+		return fmt.Errorf("sink queue full")
+	}
+}
+
+// close stops the queue once the sink has sent the queued measurements. At
+// timeout the send in progress is cancelled and the rest dropped.
+func (q *sinkQueue) close(timeout time.Duration) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.records)
+	started := q.started
+	q.mu.Unlock()
+	if !started {
+		q.cancel()
+		return
+	}
+	timer := q.clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-q.done:
+	case <-timer.C():
+		logrus.WithField("prefix", "server.sink").
+			Warnf("sink [%v] not drained in %s", q.sink, timeout)
+		q.cancel()
+		<-q.done
+	}
+	q.cancel()
+}
+
+// publish queues the measurement m of machineID for every sink.
+func (s *ValidateServer) publish(machineID string, m Measurement) {
+	for _, q := range s.sinks {
+		if err := q.push(sinkRecord{machineID: machineID, m: m}); err != nil {
+			logrus.WithField("prefix", "server.sink").
+				Warnf("drop machine [%s] offset [%s] for sink [%v]: %v",
+					machineID, m.Offset, q.sink, err)
+		}
+	}
+}
+
+// closeSinks closes the sink queues, waiting sinkDrainTimeout at most for
+// them to drain.
+func (s *ValidateServer) closeSinks() {
+	var wg sync.WaitGroup
+	for _, q := range s.sinks {
+		wg.Add(1)
+		go func(q *sinkQueue) {
+			defer wg.Done()
+			q.close(sinkDrainTimeout)
+		}(q)
+	}
+	wg.Wait()
+}
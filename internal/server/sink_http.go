@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+)
+
+const (
+	// DefaultTrapURL is the endpoint of the local SNMP trap bridge.
+	DefaultTrapURL = "http://127.0.0.1:8787/pushMonitorState"
+
+	// offsetOID is the OID the SNMP bridge reports the offset under.
+	offsetOID = ".1.3.6.1.4.1.326.3.1.1.1"
+
+	defaultSinkTimeout    = 5 * time.Second
+	defaultSinkRetries    = 2
+	defaultSinkRetryDelay = time.Second
+)
+
+type snmpLog struct {
+	ID   string      `json:"id"`
+	Data []*snmpData `json:"data"`
+}
+
+type snmpData struct {
+	OID   string `json:"oid"`
+	State int    `json:"state"`
+	Type  string `json:"type"`
+}
+
+type resultLog struct {
+	Result string `json:"result"`
+}
+
+type HTTPSinkConfig struct {
+	URL string
+	// Timeout bounds each POST, 5 seconds by default.
+	Timeout time.Duration
+	// Retries is the number of times a failed POST is retried, 2 by
+	// default and none if negative, RetryDelay apart, 1 second by default.
+	Retries    int
+	RetryDelay time.Duration
+	// Clock paces the retries. It defaults to the system clock.
+	Clock clock.Clock
+}
+
+func (conf *HTTPSinkConfig) Check() error {
+	if conf.URL == "" {
+		return fmt.Errorf("sink url not set")
+	}
+	conf.Clock = clock.Or(conf.Clock)
+	return nil
+}
+
+func (conf *HTTPSinkConfig) timeout() time.Duration {
+	if conf.Timeout <= 0 {
+		return defaultSinkTimeout
+	}
+	return conf.Timeout
+}
+
+func (conf *HTTPSinkConfig) retries() int {
+	switch {
+	case conf.Retries < 0:
+		return 0
+	case conf.Retries == 0:
+		return defaultSinkRetries
+	}
+	return conf.Retries
+}
+
+func (conf *HTTPSinkConfig) retryDelay() time.Duration {
+	if conf.RetryDelay <= 0 {
+		return defaultSinkRetryDelay
+	}
+	return conf.RetryDelay
+}
+
+// HTTPSink POSTs each offset as JSON to the SNMP trap bridge, which turns
+// it into a trap.
+type HTTPSink struct {
+	conf   *HTTPSinkConfig
+	client *http.Client
+}
+
+func NewHTTPSink(conf *HTTPSinkConfig) (*HTTPSink, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("failed to check http sink config: %v", err)
+	}
+	return &HTTPSink{
+		conf:   conf,
+		client: &http.Client{Timeout: conf.timeout()},
+	}, nil
+}
+
+func (hs *HTTPSink) String() string {
+	return hs.conf.URL
+}
+
+func (hs *HTTPSink) Send(ctx context.Context, machineID string,
+	m Measurement) error {
+	body, err := json.Marshal(&snmpLog{
+		ID: machineID,
+		Data: []*snmpData{
+			{
+				OID:   offsetOID,
+				Type:  "Counter64",
+				State: int(m.Offset),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal trap: %v", err)
+	}
+	for i := 0; ; i++ {
+		if err = hs.post(ctx, body); err == nil {
+			logrus.WithField("prefix", "sink.http").
+				Tracef("send trap machine [%s] offset[%s] success",
+					machineID, m.Offset)
+			return nil
+		}
+		if i == hs.conf.retries() {
+			return err
+		}
+		if err = hs.wait(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// wait waits for the retry delay, or until ctx is done.
+func (hs *HTTPSink) wait(ctx context.Context) error {
+	timer := hs.conf.Clock.NewTimer(hs.conf.retryDelay())
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
+
+func (hs *HTTPSink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hs.conf.URL,
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("trap bridge answered %s", resp.Status)
+	}
+	var r resultLog
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("failed to decode trap response: %v", err)
+	}
+	return nil
+}
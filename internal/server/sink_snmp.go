@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/snmp"
+)
+
+type SNMPSinkConfig struct {
+	// Manager is the manager the notifications are sent to, and how.
+	Manager *snmp.Config
+	// AlarmThreshold is the offset beyond which a machine is notified in
+	// alarm, 100 milliseconds by default.
+	AlarmThreshold time.Duration
+}
+
+func (conf *SNMPSinkConfig) Check() error {
+	if conf.Manager == nil {
+		return fmt.Errorf("snmp manager not set")
+	}
+	return nil
+}
+
+func (conf *SNMPSinkConfig) alarmThreshold() time.Duration {
+	if conf.AlarmThreshold <= 0 {
+		return defaultAlarmThreshold
+	}
+	return conf.AlarmThreshold
+}
+
+// SNMPSink sends each measurement to an SNMP manager as a notification,
+// a trap or an inform, with the varbinds:
+//
+//	tvOffset     Counter64, the offset in nanoseconds, two's complement
+//	tvMachineID  OCTET STRING
+//	tvRTT        Gauge32, the round trip delay in microseconds
+//	tvAlarmState INTEGER, normal(1) or alarm(2)
+//
+// tvOffset is the value the trap bridge reported.
+type SNMPSink struct {
+	conf   *SNMPSinkConfig
+	sender *snmp.Sender
+}
+
+func NewSNMPSink(conf *SNMPSinkConfig) (*SNMPSink, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("failed to check snmp sink config: %v", err)
+	}
+	sender, err := snmp.NewSender(conf.Manager)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Manager.Version == snmp.V3 && !conf.Manager.Inform {
+		logrus.WithField("prefix", "sink.snmp").
+			Infof("send v3 traps to [%s] from engine id [%x]",
+				conf.Manager.Address, sender.EngineID())
+	}
+	return &SNMPSink{conf: conf, sender: sender}, nil
+}
+
+func (ss *SNMPSink) String() string {
+	kind := "trap"
+	if ss.conf.Manager.Inform {
+		kind = "inform"
+	}
+	version := ss.conf.Manager.Version
+	if version == 0 {
+		version = snmp.V2c
+	}
+	return fmt.Sprintf("snmp %s %s %s", version, kind, ss.conf.Manager.Address)
+}
+
+func (ss *SNMPSink) Send(ctx context.Context, machineID string,
+	m Measurement) error {
+	offset := m.Offset
+	if offset < 0 {
+		offset = -offset
+	}
+	state := alarmNormal
+	if offset > ss.conf.alarmThreshold() {
+		state = alarmRaised
+	}
+	if err := ss.sender.Notify(ctx, offsetNotificationOID,
+		snmp.Varbind{OID: offsetVarOID, Value: snmp.Counter64(m.Offset)},
+		snmp.Varbind{OID: machineIDVarOID, Value: machineID},
+		snmp.Varbind{OID: rttVarOID,
+			Value: snmp.Gauge32(clampUint32(m.Delay / time.Microsecond))},
+		snmp.Varbind{OID: alarmStateVarOID, Value: state},
+	); err != nil {
+		return err
+	}
+	logrus.WithField("prefix", "sink.snmp").
+		Tracef("notify machine [%s] offset [%s] success", machineID, m.Offset)
+	return nil
+}
+
+// parseSNMPSink returns the SNMPSink of an snmp or snmpv3 URL:
+//
+//	snmp://[community@]host[:port][?option=value&...]
+//	snmpv3://user@host[:port]?auth-pass-file=...&priv-pass-file=...[&option=value...]
+//
+// with the options inform (true or false), timeout, retries and alarm
+// (the alarm threshold), and in v3 auth (md5, sha or sha256, sha if a
+// password is set), auth-pass-file, priv (des or aes, aes if a password is
+// set), priv-pass-file, engine-id (hex), engine-boots, engine-boots-file
+// and context.
+//
+// The passwords are read from the files named by auth-pass-file and
+// priv-pass-file, less a final newline, so that they show in neither the
+// process list nor the shell history.
+//
+// The engine ID defaults to one derived from the host name, the same
+// across restarts, so authenticated v3 traps need engine-boots-file, a
+// file whose count is incremented on every start, or an engine-boots
+// raised by hand on every restart: managers drop the traps of an engine
+// whose boots and time went back. Informs use the engine of the manager
+// and need neither.
+func parseSNMPSink(u *url.URL) (*SNMPSink, error) {
+	manager := &snmp.Config{Address: u.Host, Version: snmp.V2c}
+	conf := &SNMPSinkConfig{Manager: manager}
+	var user *snmp.User
+	if u.Scheme == "snmpv3" {
+		manager.Version = snmp.V3
+		user = &snmp.User{Name: u.User.Username()}
+		manager.User = user
+	} else if u.User != nil {
+		manager.Community = u.User.Username()
+	}
+	var err error
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "inform":
+			manager.Inform, err = strconv.ParseBool(value)
+		case "timeout":
+			manager.Timeout, err = time.ParseDuration(value)
+		case "retries":
+			manager.Retries, err = strconv.Atoi(value)
+		case "alarm":
+			conf.AlarmThreshold, err = time.ParseDuration(value)
+		default:
+			if user == nil {
+				err = fmt.Errorf("unknown option")
+				break
+			}
+			err = parseSNMPv3Option(manager, key, value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid snmp sink option [%s]: %v", key, err)
+		}
+	}
+	if user != nil {
+		if user.Auth == snmp.NoAuth && user.AuthPassword != "" {
+			user.Auth = snmp.SHA
+		}
+		if user.Priv == snmp.NoPriv && user.PrivPassword != "" {
+			user.Priv = snmp.AES
+		}
+	}
+	return NewSNMPSink(conf)
+}
+
+func parseSNMPv3Option(manager *snmp.Config, key, value string) error {
+	user := manager.User
+	var err error
+	switch key {
+	case "auth":
+		user.Auth, err = snmp.ParseAuthProtocol(value)
+	case "auth-pass", "priv-pass":
+		return fmt.Errorf("password not accepted in the url, use %s-file", key)
+	case "auth-pass-file":
+		user.AuthPassword, err = readPassword(value)
+	case "priv":
+		user.Priv, err = snmp.ParsePrivProtocol(value)
+	case "priv-pass-file":
+		user.PrivPassword, err = readPassword(value)
+	case "engine-id":
+		manager.EngineID, err = hex.DecodeString(value)
+	case "engine-boots":
+		var boots int64
+		boots, err = strconv.ParseInt(value, 10, 32)
+		manager.EngineBoots = int32(boots)
+	case "engine-boots-file":
+		manager.EngineBootsFile = value
+	case "context":
+		manager.ContextName = value
+	default:
+		return fmt.Errorf("unknown option")
+	}
+	return err
+}
+
+// readPassword returns the password held in the file path.
+func readPassword(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %v", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,115 @@
+package agentx
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/snmp"
+)
+
+const (
+	defaultAddress       = "/var/agentx/master"
+	defaultTimeout       = 5 * time.Second
+	defaultPriority      = 127
+	defaultRetryInterval = 10 * time.Second
+)
+
+type Config struct {
+	// Address is the address of the master agent, written as the
+	// agentXSocket of snmpd: a unix socket path, optionally prefixed with
+	// "unix:", or "tcp:host:port". It defaults to /var/agentx/master.
+	Address string
+	// Subtree is the OID registered with the master, and Description
+	// describes the sub-agent to it.
+	Subtree     snmp.OID
+	Description string
+	// Timeout is how long the master waits for an answer of the
+	// sub-agent, and the sub-agent for one of the master, 5 seconds by
+	// default.
+	Timeout time.Duration
+	// Priority is the priority of the registration, 127 by default;
+	// lower values take precedence over the registrations of other
+	// sub-agents.
+	Priority uint8
+	// RetryInterval spaces the attempts to reach the master, 10 seconds
+	// by default.
+	RetryInterval time.Duration
+	// Handler returns the instances of Subtree, in any order. It is called
+	// once per request, so that a request sees a consistent view.
+	Handler func() []snmp.Varbind
+	// Objects are the object types of Subtree, such as the columns of a
+	// table. A Get of a missing instance of one of them is answered
+	// noSuchInstance, and of any other OID noSuchObject.
+	Objects []snmp.OID
+}
+
+func (conf *Config) Check() error {
+	if len(conf.Subtree) < 2 {
+		return fmt.Errorf("agentx subtree not set")
+	}
+	if conf.Handler == nil {
+		return fmt.Errorf("agentx handler not set")
+	}
+	if conf.Timeout > 255*time.Second {
+		return fmt.Errorf("agentx timeout %s above 255s", conf.Timeout)
+	}
+	return nil
+}
+
+func (conf *Config) address() (network, address string) {
+	return parseAddress(conf.Address)
+}
+
+func (conf *Config) timeout() time.Duration {
+	if conf.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return conf.Timeout
+}
+
+func (conf *Config) priority() uint8 {
+	if conf.Priority == 0 {
+		return defaultPriority
+	}
+	return conf.Priority
+}
+
+func (conf *Config) retryInterval() time.Duration {
+	if conf.RetryInterval <= 0 {
+		return defaultRetryInterval
+	}
+	return conf.RetryInterval
+}
+
+type MasterConfig struct {
+	// Address is the address listened on, written as Config.Address.
+	Address string
+	// Timeout bounds the requests to the sub-agent, 5 seconds by default.
+	Timeout time.Duration
+}
+
+func (conf *MasterConfig) Check() error {
+	return nil
+}
+
+func (conf *MasterConfig) address() (network, address string) {
+	return parseAddress(conf.Address)
+}
+
+func (conf *MasterConfig) timeout() time.Duration {
+	if conf.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return conf.Timeout
+}
+
+func parseAddress(addr string) (network, address string) {
+	switch {
+	case addr == "":
+		return "unix", defaultAddress
+	case strings.HasPrefix(addr, "tcp:"):
+		return "tcp", strings.TrimPrefix(addr, "tcp:")
+	}
+	return "unix", strings.TrimPrefix(addr, "unix:")
+}
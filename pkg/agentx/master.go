@@ -0,0 +1,308 @@
+package agentx
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/snmp"
+)
+
+// Master is a minimal master agent: it accepts the sessions and
+// registrations of sub-agents, and queries the last sub-agent opened
+// directly rather than on behalf of SNMP managers. It stands in for snmpd
+// in tests.
+type Master struct {
+	conf   *MasterConfig
+	start  time.Time
+	ln     net.Listener
+	closed chan struct{}
+
+	mu         sync.Mutex
+	conn       net.Conn
+	sessionID  uint32
+	packetID   uint32
+	pending    map[uint32]chan *pdu
+	subtrees   []snmp.OID
+	registered chan struct{}
+}
+
+func NewMaster(conf *MasterConfig) (*Master, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("failed to check agentx master config: %v", err)
+	}
+	return &Master{
+		conf:       conf,
+		start:      time.Now(),
+		closed:     make(chan struct{}),
+		pending:    make(map[uint32]chan *pdu),
+		registered: make(chan struct{}),
+	}, nil
+}
+
+func (m *Master) Listen() error {
+	network, address := m.conf.address()
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("failed to listen %s addr [%s]: %v", network,
+			address, err)
+	}
+	m.ln = ln
+	return nil
+}
+
+// Addr returns the address of the master, or nil if not listening.
+func (m *Master) Addr() net.Addr {
+	if m.ln == nil {
+		return nil
+	}
+	return m.ln.Addr()
+}
+
+func (m *Master) Start() chan error {
+	errChan := make(chan error, 1)
+	if m.ln == nil {
+		if err := m.Listen(); err != nil {
+			errChan <- err
+			return errChan
+		}
+	}
+	go func() {
+		for {
+			conn, err := m.ln.Accept()
+			if err != nil {
+				select {
+				case <-m.closed:
+					errChan <- nil
+				default:
+					errChan <- fmt.Errorf("failed to accept: %v", err)
+				}
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return errChan
+}
+
+func (m *Master) Close() error {
+	select {
+	case <-m.closed:
+		return nil
+	default:
+	}
+	close(m.closed)
+	m.mu.Lock()
+	if m.conn != nil {
+		m.conn.Close()
+	}
+	m.mu.Unlock()
+	if m.ln == nil {
+		return nil
+	}
+	return m.ln.Close()
+}
+
+// Registered is closed once a sub-agent registered a subtree.
+func (m *Master) Registered() <-chan struct{} {
+	return m.registered
+}
+
+// Subtrees returns the subtrees registered by the sub-agent.
+func (m *Master) Subtrees() []snmp.OID {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]snmp.OID(nil), m.subtrees...)
+}
+
+func (m *Master) serve(conn net.Conn) {
+	defer func() {
+		m.mu.Lock()
+		if m.conn == conn {
+			m.conn, m.subtrees = nil, nil
+			for id, c := range m.pending {
+				close(c)
+				delete(m.pending, id)
+			}
+		}
+		m.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		p, err := readPDU(conn)
+		if err != nil {
+			return
+		}
+		d := p.decoder()
+		r := &response{sysUpTime: m.uptime()}
+		m.mu.Lock()
+		switch p.typ {
+		case pduResponse:
+			if c, ok := m.pending[p.packetID]; ok {
+				c <- p
+				delete(m.pending, p.packetID)
+			}
+			m.mu.Unlock()
+			continue
+		case pduOpen:
+			m.sessionID++
+			m.conn, m.subtrees = conn, nil
+			p.sessionID = m.sessionID
+		case pduRegister:
+			d.context(p)
+			d.next(4)
+			subtree, _ := d.oid()
+			if d.err != nil {
+				r.err = errParse
+				break
+			}
+			m.subtrees = append(m.subtrees, subtree)
+			select {
+			case <-m.registered:
+			default:
+				close(m.registered)
+			}
+		case pduClose:
+			m.mu.Unlock()
+			return
+		case pduUnregister, pduPing, pduNotify:
+		default:
+			r.err = errProcessing
+		}
+		m.mu.Unlock()
+		b, err := encodeResponse(&p.header, r)
+		if err != nil {
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(m.conf.timeout()))
+		if _, err = conn.Write(b); err != nil {
+			return
+		}
+	}
+}
+
+// Get asks the sub-agent for the instances oids.
+func (m *Master) Get(ctx context.Context, oids ...snmp.OID) ([]snmp.Varbind,
+	error) {
+	return m.request(ctx, pduGet, func(e *encoder) {
+		for _, oid := range oids {
+			e.searchRange(&searchRange{start: oid})
+		}
+	})
+}
+
+// GetNext asks the sub-agent for the instances following oids.
+func (m *Master) GetNext(ctx context.Context,
+	oids ...snmp.OID) ([]snmp.Varbind, error) {
+	return m.request(ctx, pduGetNext, func(e *encoder) {
+		for _, oid := range oids {
+			e.searchRange(&searchRange{start: oid})
+		}
+	})
+}
+
+// GetBulk asks the sub-agent for the instance following each of the
+// nonRepeaters first oids, then for maxRepetitions instances following
+// each of the others.
+func (m *Master) GetBulk(ctx context.Context, nonRepeaters,
+	maxRepetitions uint16, oids ...snmp.OID) ([]snmp.Varbind, error) {
+	return m.request(ctx, pduGetBulk, func(e *encoder) {
+		e.u16(nonRepeaters)
+		e.u16(maxRepetitions)
+		for _, oid := range oids {
+			e.searchRange(&searchRange{start: oid})
+		}
+	})
+}
+
+// Walk returns the instances of the subtree root, in OID order.
+func (m *Master) Walk(ctx context.Context, root snmp.OID) ([]snmp.Varbind,
+	error) {
+	var vbs []snmp.Varbind
+	oid := root
+	for {
+		next, err := m.GetNext(ctx, oid)
+		if err != nil {
+			return nil, err
+		}
+		if len(next) != 1 || next[0].Value == snmp.EndOfMibView ||
+			!next[0].OID.HasPrefix(root) {
+			return vbs, nil
+		}
+		vbs = append(vbs, next[0])
+		oid = next[0].OID
+	}
+}
+
+// Set asks the sub-agent to set the varbinds vbs, the first phase of a set
+// only.
+func (m *Master) Set(ctx context.Context, vbs ...snmp.Varbind) error {
+	_, err := m.request(ctx, pduTestSet, func(e *encoder) {
+		for i := range vbs {
+			e.varbind(&vbs[i])
+		}
+	})
+	return err
+}
+
+func (m *Master) request(ctx context.Context, typ pduType,
+	payload func(e *encoder)) ([]snmp.Varbind, error) {
+	m.mu.Lock()
+	conn := m.conn
+	if conn == nil {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("no agentx session")
+	}
+	m.packetID++
+	e := newEncoder(&header{
+		typ:       typ,
+		sessionID: m.sessionID,
+		packetID:  m.packetID,
+	})
+	payload(e)
+	c := make(chan *pdu, 1)
+	m.pending[m.packetID] = c
+	id := m.packetID
+	conn.SetWriteDeadline(time.Now().Add(m.conf.timeout()))
+	_, err := conn.Write(e.bytes())
+	m.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write pdu: %v", err)
+	}
+	defer func() {
+		m.mu.Lock()
+		delete(m.pending, id)
+		m.mu.Unlock()
+	}()
+	timer := time.NewTimer(m.conf.timeout())
+	defer timer.Stop()
+	select {
+	case p, ok := <-c:
+		if !ok {
+			return nil, fmt.Errorf("agentx session closed")
+		}
+		r, err := p.response()
+		if err != nil {
+			return nil, err
+		}
+		if r.err != errNone {
+			return nil, fmt.Errorf("sub-agent answered error %d at %d",
+				r.err, r.index)
+		}
+		return r.varbinds, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("sub-agent timeout")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// uptime is the sysUpTime of the master, in hundredths of a second.
+func (m *Master) uptime() uint32 {
+	return uint32(time.Since(m.start) / (10 * time.Millisecond))
+}
@@ -0,0 +1,416 @@
+package agentx
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/snmp"
+)
+
+// The PDUs of the AgentX protocol (RFC 2741) a sub-agent and a minimal
+// master need. They are sent in network byte order, and read in the byte
+// order their header sets.
+
+type pduType byte
+
+const (
+	pduOpen       pduType = 1
+	pduClose      pduType = 2
+	pduRegister   pduType = 3
+	pduUnregister pduType = 4
+	pduGet        pduType = 5
+	pduGetNext    pduType = 6
+	pduGetBulk    pduType = 7
+	pduTestSet    pduType = 8
+	pduCommitSet  pduType = 9
+	pduUndoSet    pduType = 10
+	pduCleanupSet pduType = 11
+	pduNotify     pduType = 12
+	pduPing       pduType = 13
+	pduResponse   pduType = 18
+)
+
+const (
+	headerSize = 20
+	version    = 1
+
+	flagNonDefaultContext = 0x08
+	flagNetworkByteOrder  = 0x10
+
+	// maxPayloadSize bounds the PDUs read, far above what the sub-agent
+	// and the master exchange.
+	maxPayloadSize = 1 << 20
+)
+
+// The errors of a Response-PDU.
+const (
+	errNone        = 0
+	errGen         = 5
+	errNotWritable = 17
+	errParse       = 266
+	errProcessing  = 268
+)
+
+// reasonShutdown is the reason of the Close-PDU of a sub-agent closed.
+const reasonShutdown = 5
+
+// The value types of a varbind.
+const (
+	typeInteger        = 2
+	typeOctetString    = 4
+	typeNull           = 5
+	typeOID            = 6
+	typeIPAddress      = 64
+	typeCounter32      = 65
+	typeGauge32        = 66
+	typeTimeTicks      = 67
+	typeOpaque         = 68
+	typeCounter64      = 70
+	typeNoSuchObject   = 128
+	typeNoSuchInstance = 129
+	typeEndOfMibView   = 130
+)
+
+// internetOID prefixes the OIDs compressed in a prefix byte.
+var internetOID = snmp.OID{1, 3, 6, 1}
+
+type header struct {
+	typ           pduType
+	flags         byte
+	sessionID     uint32
+	transactionID uint32
+	packetID      uint32
+}
+
+// pdu is a PDU read, its payload decoded in its byte order.
+type pdu struct {
+	header
+	payload []byte
+}
+
+func (p *pdu) order() binary.ByteOrder {
+	if p.flags&flagNetworkByteOrder != 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func readPDU(r io.Reader) (*pdu, error) {
+	var h [headerSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	if h[0] != version {
+		return nil, fmt.Errorf("unsupported agentx version %d", h[0])
+	}
+	p := &pdu{header: header{typ: pduType(h[1]), flags: h[2]}}
+	order := p.order()
+	p.sessionID = order.Uint32(h[4:])
+	p.transactionID = order.Uint32(h[8:])
+	p.packetID = order.Uint32(h[12:])
+	n := order.Uint32(h[16:])
+	if n > maxPayloadSize || n%4 != 0 {
+		return nil, fmt.Errorf("invalid agentx payload length %d", n)
+	}
+	p.payload = make([]byte, n)
+	if _, err := io.ReadFull(r, p.payload); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// encoder builds a PDU in network byte order.
+type encoder struct {
+	b []byte
+}
+
+func newEncoder(h *header) *encoder {
+	e := &encoder{b: make([]byte, headerSize, 256)}
+	e.b[0], e.b[1], e.b[2] = version, byte(h.typ), h.flags|flagNetworkByteOrder
+	binary.BigEndian.PutUint32(e.b[4:], h.sessionID)
+	binary.BigEndian.PutUint32(e.b[8:], h.transactionID)
+	binary.BigEndian.PutUint32(e.b[12:], h.packetID)
+	return e
+}
+
+// bytes returns the PDU with its payload length set.
+func (e *encoder) bytes() []byte {
+	binary.BigEndian.PutUint32(e.b[16:], uint32(len(e.b)-headerSize))
+	return e.b
+}
+
+func (e *encoder) u8(v ...byte) {
+	e.b = append(e.b, v...)
+}
+
+func (e *encoder) u16(v uint16) {
+	e.b = append(e.b, byte(v>>8), byte(v))
+}
+
+func (e *encoder) u32(v uint32) {
+	e.b = append(e.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) u64(v uint64) {
+	e.u32(uint32(v >> 32))
+	e.u32(uint32(v))
+}
+
+func (e *encoder) oid(o snmp.OID, include bool) {
+	var prefix byte
+	if len(o) > 4 && o[:4].Equal(internetOID) && o[4] > 0 && o[4] < 256 {
+		prefix, o = byte(o[4]), o[5:]
+	}
+	var inc byte
+	if include {
+		inc = 1
+	}
+	e.u8(byte(len(o)), prefix, inc, 0)
+	for _, n := range o {
+		e.u32(n)
+	}
+}
+
+func (e *encoder) octets(v []byte) {
+	e.u32(uint32(len(v)))
+	e.b = append(e.b, v...)
+	for len(e.b)%4 != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *encoder) varbind(vb *snmp.Varbind) error {
+	start := len(e.b)
+	e.u32(0)
+	e.oid(vb.OID, false)
+	var typ uint16
+	switch x := vb.Value.(type) {
+	case nil:
+		typ = typeNull
+	case int:
+		if int64(x) != int64(int32(x)) {
+			return fmt.Errorf("integer %d of [%s] overflows 32 bits", x, vb.OID)
+		}
+		typ = typeInteger
+		e.u32(uint32(int32(x)))
+	case []byte:
+		typ = typeOctetString
+		e.octets(x)
+	case string:
+		typ = typeOctetString
+		e.octets([]byte(x))
+	case snmp.OID:
+		typ = typeOID
+		e.oid(x, false)
+	case net.IP:
+		ip := x.To4()
+		if ip == nil {
+			return fmt.Errorf("ip address [%s] not ipv4", x)
+		}
+		typ = typeIPAddress
+		e.octets(ip)
+	case snmp.Counter32:
+		typ = typeCounter32
+		e.u32(uint32(x))
+	case snmp.Gauge32:
+		typ = typeGauge32
+		e.u32(uint32(x))
+	case snmp.TimeTicks:
+		typ = typeTimeTicks
+		e.u32(uint32(x))
+	case snmp.Counter64:
+		typ = typeCounter64
+		e.u64(uint64(x))
+	case snmp.Exception:
+		typ = uint16(x)
+	default:
+		return fmt.Errorf("unsupported value type %T of [%s]", x, vb.OID)
+	}
+	binary.BigEndian.PutUint16(e.b[start:], typ)
+	return nil
+}
+
+// decoder reads a payload, its first error sticking.
+type decoder struct {
+	b     []byte
+	order binary.ByteOrder
+	err   error
+}
+
+func (p *pdu) decoder() *decoder {
+	return &decoder{b: p.payload, order: p.order()}
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.err = fmt.Errorf("truncated agentx payload")
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) u8() byte {
+	if v := d.next(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (d *decoder) u16() uint16 {
+	if v := d.next(2); v != nil {
+		return d.order.Uint16(v)
+	}
+	return 0
+}
+
+func (d *decoder) u32() uint32 {
+	if v := d.next(4); v != nil {
+		return d.order.Uint32(v)
+	}
+	return 0
+}
+
+func (d *decoder) u64() uint64 {
+	if v := d.next(8); v != nil {
+		return d.order.Uint64(v)
+	}
+	return 0
+}
+
+func (d *decoder) oid() (o snmp.OID, include bool) {
+	h := d.next(4)
+	if h == nil {
+		return nil, false
+	}
+	n, prefix := int(h[0]), h[1]
+	if prefix != 0 {
+		o = append(append(o, internetOID...), uint32(prefix))
+	}
+	for i := 0; i < n && d.err == nil; i++ {
+		o = append(o, d.u32())
+	}
+	return o, h[2] != 0
+}
+
+func (d *decoder) octets() []byte {
+	n := d.u32()
+	if n > uint32(len(d.b)) {
+		d.err = fmt.Errorf("truncated agentx octet string")
+		return nil
+	}
+	v := append([]byte(nil), d.next(int(n))...)
+	d.next((4 - int(n)%4) % 4)
+	return v
+}
+
+// context skips the context of a PDU that has one; the sub-agent serves
+// the default context only.
+func (d *decoder) context(p *pdu) {
+	if p.flags&flagNonDefaultContext != 0 {
+		d.octets()
+	}
+}
+
+func (d *decoder) varbind() snmp.Varbind {
+	typ := d.u16()
+	d.u16()
+	var vb snmp.Varbind
+	vb.OID, _ = d.oid()
+	switch typ {
+	case typeNull:
+	case typeInteger:
+		vb.Value = int(int32(d.u32()))
+	case typeOctetString, typeOpaque:
+		vb.Value = d.octets()
+	case typeOID:
+		vb.Value, _ = d.oid()
+	case typeIPAddress:
+		vb.Value = net.IP(d.octets())
+	case typeCounter32:
+		vb.Value = snmp.Counter32(d.u32())
+	case typeGauge32:
+		vb.Value = snmp.Gauge32(d.u32())
+	case typeTimeTicks:
+		vb.Value = snmp.TimeTicks(d.u32())
+	case typeCounter64:
+		vb.Value = snmp.Counter64(d.u64())
+	case typeNoSuchObject, typeNoSuchInstance, typeEndOfMibView:
+		vb.Value = snmp.Exception(typ)
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("unsupported varbind type %d", typ)
+		}
+	}
+	return vb
+}
+
+func (d *decoder) varbinds() []snmp.Varbind {
+	var vbs []snmp.Varbind
+	for len(d.b) > 0 && d.err == nil {
+		vbs = append(vbs, d.varbind())
+	}
+	return vbs
+}
+
+// searchRange is the range of OIDs a Get, GetNext or GetBulk asks for.
+type searchRange struct {
+	start   snmp.OID
+	include bool
+	end     snmp.OID
+}
+
+func (d *decoder) searchRanges() []searchRange {
+	var srs []searchRange
+	for len(d.b) > 0 && d.err == nil {
+		var sr searchRange
+		sr.start, sr.include = d.oid()
+		sr.end, _ = d.oid()
+		srs = append(srs, sr)
+	}
+	return srs
+}
+
+func (e *encoder) searchRange(sr *searchRange) {
+	e.oid(sr.start, sr.include)
+	e.oid(sr.end, false)
+}
+
+// response is the payload of a Response-PDU.
+type response struct {
+	sysUpTime uint32
+	err       uint16
+	index     uint16
+	varbinds  []snmp.Varbind
+}
+
+func (p *pdu) response() (*response, error) {
+	d := p.decoder()
+	r := &response{sysUpTime: d.u32(), err: d.u16(), index: d.u16()}
+	r.varbinds = d.varbinds()
+	return r, d.err
+}
+
+func encodeResponse(h *header, r *response) ([]byte, error) {
+	e := newEncoder(&header{
+		typ:           pduResponse,
+		sessionID:     h.sessionID,
+		transactionID: h.transactionID,
+		packetID:      h.packetID,
+	})
+	e.u32(r.sysUpTime)
+	e.u16(r.err)
+	e.u16(r.index)
+	for i := range r.varbinds {
+		if err := e.varbind(&r.varbinds[i]); err != nil {
+			return nil, err
+		}
+	}
+	return e.bytes(), nil
+}
@@ -0,0 +1,314 @@
+package agentx
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/snmp"
+)
+
+// SubAgent serves a subtree of OIDs to an AgentX master agent, such as
+// snmpd with "master agentx", which answers the SNMP requests on it. The
+// subtree is read-only.
+type SubAgent struct {
+	conf *Config
+
+	// mu guards the connection and serializes the writes on it.
+	mu        sync.Mutex
+	conn      net.Conn
+	sessionID uint32
+	packetID  uint32
+	closed    chan struct{}
+}
+
+func NewSubAgent(conf *Config) (*SubAgent, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("failed to check agentx config: %v", err)
+	}
+	return &SubAgent{
+		conf:   conf,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// Start connects to the master and serves it until Close, reconnecting
+// every RetryInterval while the master is away. The channel returned
+// yields nil once closed.
+func (a *SubAgent) Start() chan error {
+	errChan := make(chan error, 1)
+	go func() {
+		for {
+			err := a.session()
+			select {
+			case <-a.closed:
+				errChan <- nil
+				return
+			default:
+			}
+			logrus.WithField("prefix", "agentx.subagent").
+				Warnf("agentx session ended: %v, retry in %s", err,
+					a.conf.retryInterval())
+			select {
+			case <-a.closed:
+				errChan <- nil
+				return
+			case <-time.After(a.conf.retryInterval()):
+			}
+		}
+	}()
+	return errChan
+}
+
+func (a *SubAgent) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	select {
+	case <-a.closed:
+		return nil
+	default:
+	}
+	close(a.closed)
+	if a.conn == nil {
+		return nil
+	}
+	a.packetID++
+	e := newEncoder(&header{
+		typ:       pduClose,
+		sessionID: a.sessionID,
+		packetID:  a.packetID,
+	})
+	e.u8(reasonShutdown, 0, 0, 0)
+	a.conn.SetWriteDeadline(time.Now().Add(a.conf.timeout()))
+	a.conn.Write(e.bytes())
+	return a.conn.Close()
+}
+
+// session opens a session with the master, registers the subtree, then
+// serves the master until the connection ends.
+func (a *SubAgent) session() error {
+	network, address := a.conf.address()
+	conn, err := net.DialTimeout(network, address, a.conf.timeout())
+	if err != nil {
+		return fmt.Errorf("failed to dial agentx master [%s]: %v", address, err)
+	}
+	a.mu.Lock()
+	select {
+	case <-a.closed:
+		a.mu.Unlock()
+		return conn.Close()
+	default:
+	}
+	a.conn = conn
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		a.conn = nil
+		a.mu.Unlock()
+		conn.Close()
+	}()
+
+	resp, err := a.request(conn, pduOpen, func(e *encoder) {
+		e.u8(byte(a.conf.timeout()/time.Second), 0, 0, 0)
+		e.oid(a.conf.Subtree, false)
+		e.octets([]byte(a.conf.Description))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open agentx session: %v", err)
+	}
+	a.mu.Lock()
+	a.sessionID = resp.sessionID
+	a.mu.Unlock()
+	if _, err = a.request(conn, pduRegister, func(e *encoder) {
+		e.u8(0, a.conf.priority(), 0, 0)
+		e.oid(a.conf.Subtree, false)
+	}); err != nil {
+		return fmt.Errorf("failed to register [%s]: %v", a.conf.Subtree, err)
+	}
+	logrus.WithField("prefix", "agentx.subagent").
+		Infof("registered [%s] with agentx master [%s]", a.conf.Subtree,
+			address)
+	return a.serve(conn)
+}
+
+// request sends a request of the session, then reads its response. The
+// master sends nothing else until the session is open and registered.
+func (a *SubAgent) request(conn net.Conn, typ pduType,
+	payload func(e *encoder)) (*pdu, error) {
+	a.mu.Lock()
+	a.packetID++
+	h := header{typ: typ, sessionID: a.sessionID, packetID: a.packetID}
+	a.mu.Unlock()
+	e := newEncoder(&h)
+	payload(e)
+	if err := a.write(conn, e.bytes()); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(a.conf.timeout()))
+	defer conn.SetReadDeadline(time.Time{})
+	p, err := readPDU(conn)
+	if err != nil {
+		return nil, err
+	}
+	if p.typ != pduResponse || p.packetID != h.packetID {
+		return nil, fmt.Errorf("unexpected pdu %d", p.typ)
+	}
+	r, err := p.response()
+	if err != nil {
+		return nil, err
+	}
+	if r.err != errNone {
+		return nil, fmt.Errorf("master answered error %d", r.err)
+	}
+	return p, nil
+}
+
+func (a *SubAgent) write(conn net.Conn, b []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(a.conf.timeout()))
+	if _, err := conn.Write(b); err != nil {
+		return fmt.Errorf("failed to write pdu: %v", err)
+	}
+	return nil
+}
+
+func (a *SubAgent) serve(conn net.Conn) error {
+	for {
+		p, err := readPDU(conn)
+		if err != nil {
+			return fmt.Errorf("failed to read pdu: %v", err)
+		}
+		switch p.typ {
+		case pduClose:
+			return fmt.Errorf("session closed by master")
+		case pduResponse, pduCleanupSet:
+			continue
+		}
+		b, err := encodeResponse(&p.header, a.handle(p))
+		if err != nil {
+			// a value of the handler the protocol cannot carry
+			logrus.WithField("prefix", "agentx.subagent").
+				Warnf("failed to encode response: %v", err)
+			if b, err = encodeResponse(&p.header,
+				&response{err: errGen}); err != nil {
+				return err
+			}
+		}
+		if err = a.write(conn, b); err != nil {
+			return err
+		}
+	}
+}
+
+// handle answers a request of the master.
+func (a *SubAgent) handle(p *pdu) *response {
+	d := p.decoder()
+	d.context(p)
+	r := &response{}
+	switch p.typ {
+	case pduGet:
+		vbs := a.instances()
+		for _, sr := range d.searchRanges() {
+			r.varbinds = append(r.varbinds, get(vbs, a.conf.Objects, sr.start))
+		}
+	case pduGetNext:
+		vbs := a.instances()
+		for _, sr := range d.searchRanges() {
+			r.varbinds = append(r.varbinds, next(vbs, &sr))
+		}
+	case pduGetBulk:
+		nonRepeaters, maxRepetitions := int(d.u16()), int(d.u16())
+		r.varbinds = bulk(a.instances(), d.searchRanges(), nonRepeaters,
+			maxRepetitions)
+	case pduTestSet:
+		r.err, r.index = errNotWritable, 1
+	case pduCommitSet, pduUndoSet, pduPing:
+	default:
+		r.err = errProcessing
+	}
+	if d.err != nil {
+		return &response{err: errParse}
+	}
+	return r
+}
+
+// instances returns the instances of the handler in OID order.
+func (a *SubAgent) instances() []snmp.Varbind {
+	vbs := a.conf.Handler()
+	sort.Slice(vbs, func(i, j int) bool {
+		return vbs[i].OID.Compare(vbs[j].OID) < 0
+	})
+	return vbs
+}
+
+// search returns the index of the first of the sorted instances vbs not
+// before oid.
+func search(vbs []snmp.Varbind, oid snmp.OID) int {
+	return sort.Search(len(vbs), func(i int) bool {
+		return vbs[i].OID.Compare(oid) >= 0
+	})
+}
+
+// get returns the instance oid, or noSuchInstance if it is under one of
+// objects, else noSuchObject.
+func get(vbs []snmp.Varbind, objects []snmp.OID, oid snmp.OID) snmp.Varbind {
+	if i := search(vbs, oid); i < len(vbs) && vbs[i].OID.Equal(oid) {
+		return vbs[i]
+	}
+	for _, object := range objects {
+		if oid.HasPrefix(object) {
+			return snmp.Varbind{OID: oid, Value: snmp.NoSuchInstance}
+		}
+	}
+	return snmp.Varbind{OID: oid, Value: snmp.NoSuchObject}
+}
+
+// next returns the first instance in sr, or endOfMibView.
+func next(vbs []snmp.Varbind, sr *searchRange) snmp.Varbind {
+	i := search(vbs, sr.start)
+	if i < len(vbs) && !sr.include && vbs[i].OID.Equal(sr.start) {
+		i++
+	}
+	if i < len(vbs) && (len(sr.end) == 0 || vbs[i].OID.Compare(sr.end) < 0) {
+		return vbs[i]
+	}
+	return snmp.Varbind{OID: sr.start, Value: snmp.EndOfMibView}
+}
+
+// bulk answers a GetBulk: one instance after each of the nonRepeaters
+// first ranges, then up to maxRepetitions rows of instances after each of
+// the others.
+func bulk(vbs []snmp.Varbind, srs []searchRange, nonRepeaters,
+	maxRepetitions int) []snmp.Varbind {
+	if nonRepeaters > len(srs) {
+		nonRepeaters = len(srs)
+	}
+	var out []snmp.Varbind
+	for i := range srs[:nonRepeaters] {
+		out = append(out, next(vbs, &srs[i]))
+	}
+	repeaters := srs[nonRepeaters:]
+	for row := 0; row < maxRepetitions && len(repeaters) > 0; row++ {
+		done := true
+		for i := range repeaters {
+			vb := next(vbs, &repeaters[i])
+			out = append(out, vb)
+			if vb.Value != snmp.EndOfMibView {
+				repeaters[i].start, repeaters[i].include = vb.OID, false
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+	}
+	return out
+}
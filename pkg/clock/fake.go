@@ -0,0 +1,167 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock that only moves when told to, so that tests of offset,
+// delay and scheduling logic are reproducible. True time passes with
+// Advance; the reading of the clock follows it at the rate set by
+// SetDrift, and jumps with Step. Timers and sleeps run on true time, like
+// the monotonic clock of the system, and are not affected by steps.
+//
+// Since is computed from readings, so unlike time.Since it sees steps:
+// a backward step makes it negative.
+type Fake struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	now     time.Time
+	elapsed time.Duration
+	drift   float64
+	timers  []*fakeTimer
+}
+
+func NewFake(start time.Time) *Fake {
+	f := &Fake{now: start}
+	f.changed = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.NewTimer(d).C()
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{f: f, c: make(chan time.Time, 1)}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.schedule(t, d)
+	return t
+}
+
+// SetDrift sets the rate error of the clock in parts per million: a
+// positive drift makes the clock gain ppm microseconds per second of true
+// time.
+func (f *Fake) SetDrift(ppm float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.drift = ppm / 1e6
+}
+
+// Step jumps the reading of the clock by d, as setting the clock does.
+func (f *Fake) Step(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// Advance lets d of true time pass, firing the timers that expire in that
+// time in order.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := f.elapsed + d
+	for len(f.timers) > 0 && f.timers[0].deadline <= end {
+		t := f.timers[0]
+		f.timers = f.timers[1:]
+		f.pass(t.deadline - f.elapsed)
+		t.fire(f.now)
+	}
+	f.pass(end - f.elapsed)
+}
+
+// BlockUntil waits until n timers or sleeps are pending, to advance the
+// clock only once the goroutines under test wait on it.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.timers) < n {
+		f.changed.Wait()
+	}
+}
+
+// pass advances true time by d and the reading accordingly.
+func (f *Fake) pass(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	f.elapsed += d
+	f.now = f.now.Add(d + time.Duration(float64(d)*f.drift))
+}
+
+// schedule arms t to fire after d, or at once if d is not positive.
+func (f *Fake) schedule(t *fakeTimer, d time.Duration) {
+	if d <= 0 {
+		t.fire(f.now)
+		return
+	}
+	t.deadline = f.elapsed + d
+	i := sort.Search(len(f.timers), func(i int) bool {
+		return f.timers[i].deadline > t.deadline
+	})
+	f.timers = append(f.timers, nil)
+	copy(f.timers[i+1:], f.timers[i:])
+	f.timers[i] = t
+	f.changed.Broadcast()
+}
+
+// unschedule removes t from the pending timers and reports whether it was
+// there.
+func (f *Fake) unschedule(t *fakeTimer) bool {
+	for i, v := range f.timers {
+		if v == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	f        *Fake
+	c        chan time.Time
+	deadline time.Duration
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	return t.f.unschedule(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	active := t.f.unschedule(t)
+	t.f.schedule(t, d)
+	return active
+}
+
+// fire delivers now unless the previous expiry was not received, as
+// time.Timer does.
+func (t *fakeTimer) fire(now time.Time) {
+	select {
+	case t.c <- now:
+	default:
+	}
+}
@@ -0,0 +1,401 @@
+package ptp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
+)
+
+// A PTPv2 slave in unicast mode, timestamping in software: it asks the
+// master for a unicast grant of Sync and Delay_Resp messages, then for each
+// query times one Sync (t1, t2) and one Delay_Req (t3, t4):
+//
+//	offset = ((t2 - t1) - (t4 - t3)) / 2
+//	delay  = ((t2 - t1) + (t4 - t3)) / 2
+
+// Response is the measurement of one query. ClockOffset has the sign of
+// tcpntp: add it to the local clock to get the time of the master.
+type Response struct {
+	tcpntp.Response
+
+	// MeanPathDelay is the one way delay between master and slave,
+	// half of RTT.
+	MeanPathDelay time.Duration
+
+	// Master is the port identity of the master and Domain its domain.
+	Master PortIdentity
+	Domain uint8
+}
+
+// Client queries one PTP master. It is safe for concurrent use, queries
+// being serialized.
+type Client struct {
+	conf     *Config
+	identity PortIdentity
+
+	mu           sync.Mutex
+	event        *net.UDPConn
+	general      *net.UDPConn
+	eventRaddr   *net.UDPAddr
+	generalRaddr *net.UDPAddr
+	sequence     uint16
+	grantUntil   time.Time
+}
+
+func NewClient(conf *Config) (*Client, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("failed to check ptp config: %v", err)
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate clock identity: %v", err)
+	}
+	return &Client{
+		conf: conf,
+		identity: PortIdentity{
+			ClockIdentity: binary.BigEndian.Uint64(id[:]),
+			PortNumber:    1,
+		},
+	}, nil
+}
+
+// Open binds the event and general sockets. It is called by Query when the
+// client is not yet open, and may be called beforehand to learn the bound
+// addresses through LocalAddr. The master is resolved by the first query.
+func (c *Client) Open() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.open()
+}
+
+func (c *Client) open() error {
+	if c.event != nil {
+		return nil
+	}
+	event, err := listenUDP(c.conf.localEventAddr())
+	if err != nil {
+		return err
+	}
+	general, err := listenUDP(c.conf.localGeneralAddr())
+	if err != nil {
+		event.Close()
+		return err
+	}
+	c.event, c.general = event, general
+	c.grantUntil = time.Time{}
+	return nil
+}
+
+// resolve resolves the addresses of the master on the first query.
+func (c *Client) resolve() error {
+	if c.eventRaddr != nil {
+		return nil
+	}
+	eventRaddr, err := net.ResolveUDPAddr("udp", c.conf.eventAddr())
+	if err != nil {
+		return fmt.Errorf("failed to resolve udp addr [%s]: %v",
+			c.conf.eventAddr(), err)
+	}
+	if c.generalRaddr, err = net.ResolveUDPAddr("udp", c.conf.generalAddr()); err != nil {
+		return fmt.Errorf("failed to resolve udp addr [%s]: %v",
+			c.conf.generalAddr(), err)
+	}
+	c.eventRaddr = eventRaddr
+	return nil
+}
+
+func listenUDP(addr string) (*net.UDPConn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve udp addr [%s]: %v", addr, err)
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen udp addr [%s]: %v", addr, err)
+	}
+	return conn, nil
+}
+
+// LocalAddr returns the addresses of the event and general sockets, or nil
+// if the client is not open.
+func (c *Client) LocalAddr() (event, general net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.event == nil {
+		return nil, nil
+	}
+	return c.event.LocalAddr(), c.general.LocalAddr()
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.event == nil {
+		return nil
+	}
+	err := c.event.Close()
+	if gerr := c.general.Close(); err == nil {
+		err = gerr
+	}
+	c.event, c.general = nil, nil
+	return err
+}
+
+func (c *Client) header(typ MessageType, control uint8) *header {
+	c.sequence++
+	return &header{
+		Type:        typ,
+		Domain:      c.conf.Domain,
+		Flags:       flagUnicast,
+		Source:      c.identity,
+		Sequence:    c.sequence,
+		Control:     control,
+		LogInterval: 0x7f,
+	}
+}
+
+// Query measures the offset of the local clock to the master.
+func (c *Client) Query(ctx context.Context) (*Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	if err := c.resolve(); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(c.conf.timeout())
+	ctxDeadline := false
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline, ctxDeadline = d, true
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			c.event.SetDeadline(time.Unix(1, 0))
+			c.general.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	resp, err := c.query(ctx, deadline)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		// The read may time out just before ctx is done.
+		if ctxDeadline && !time.Now().Before(deadline) {
+			return nil, context.DeadlineExceeded
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) query(ctx context.Context, deadline time.Time) (*Response, error) {
+	if time.Until(c.grantUntil) < c.conf.grantDuration()/4 {
+		if err := c.negotiate(ctx, deadline); err != nil {
+			return nil, err
+		}
+	}
+	if err := drain(ctx, c.event); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxMessageSize)
+	syncMsg, b, err := c.read(ctx, c.event, deadline, buf, func(h *header) bool {
+		return h.Type == MessageSync
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sync: %v", err)
+	}
+	t2 := time.Now()
+	if len(b) < syncSize {
+		return nil, fmt.Errorf("sync message too short [%d]", len(b))
+	}
+	t1 := parseTimestamp(b[headerSize:]).Add(syncMsg.correction())
+	if syncMsg.Flags&flagTwoStep != 0 {
+		followUp, b, err := c.read(ctx, c.general, deadline, buf, func(h *header) bool {
+			return h.Type == MessageFollowUp && h.Sequence == syncMsg.Sequence &&
+				h.Source == syncMsg.Source
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read follow up: %v", err)
+		}
+		if len(b) < syncSize {
+			return nil, fmt.Errorf("follow up message too short [%d]", len(b))
+		}
+		t1 = parseTimestamp(b[headerSize:]).Add(syncMsg.correction() +
+			followUp.correction())
+	}
+
+	req := c.header(MessageDelayReq, controlDelayReq)
+	if err = c.event.SetWriteDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("failed to set deadline: %v", err)
+	}
+	t3 := time.Now()
+	if _, err = c.event.WriteToUDP(newMessage(req, syncSize), c.eventRaddr); err != nil {
+		return nil, fmt.Errorf("failed to send delay request: %v", err)
+	}
+	delayResp, b, err := c.read(ctx, c.general, deadline, buf, func(h *header) bool {
+		return h.Type == MessageDelayResp && h.Sequence == req.Sequence &&
+			h.Source == syncMsg.Source
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delay response: %v", err)
+	}
+	if len(b) < delayRespSize {
+		return nil, fmt.Errorf("delay response message too short [%d]", len(b))
+	}
+	if parsePortIdentity(b[syncSize:]) != c.identity {
+		return nil, fmt.Errorf("delay response to another port [%s]",
+			parsePortIdentity(b[syncSize:]))
+	}
+	t4 := parseTimestamp(b[headerSize:]).Add(-delayResp.correction())
+
+	// Timestamps of the master are TAI, or arbitrary when it does not use
+	// the PTP timescale.
+	if syncMsg.Flags&flagPTPTimescale != 0 {
+		t1 = timescale.Convert(t1, timescale.TAI, c.conf.LocalScale)
+		t4 = timescale.Convert(t4, timescale.TAI, c.conf.LocalScale)
+	}
+	ms, sm := t2.Sub(t1), t4.Sub(t3)
+	delay := (ms + sm) / 2
+	resp := &Response{
+		Response: tcpntp.Response{
+			Time:         t1,
+			ClockOffset:  -(ms - sm) / 2,
+			RTT:          2 * delay,
+			Leap:         tcpntp.LeapNoWarning,
+			Timestamping: tcpntp.TimestampUser,
+		},
+		MeanPathDelay: delay,
+		Master:        syncMsg.Source,
+		Domain:        syncMsg.Domain,
+	}
+	switch {
+	case syncMsg.Flags&flagLeap61 != 0:
+		resp.Leap = tcpntp.LeapAddSecond
+	case syncMsg.Flags&flagLeap59 != 0:
+		resp.Leap = tcpntp.LeapDelSecond
+	}
+	return resp, nil
+}
+
+// negotiate requests unicast Sync and Delay_Resp messages from the master
+// for Config.GrantDuration.
+func (c *Client) negotiate(ctx context.Context, deadline time.Time) error {
+	duration := uint32(c.conf.grantDuration() / time.Second)
+	req := signaling(c.header(MessageSignaling, controlOther),
+		PortIdentity{ClockIdentity: ^uint64(0), PortNumber: 0xffff},
+		tlvRequestUnicast, []unicastTLV{
+			{Type: MessageSync, LogCycle: c.conf.LogSyncInterval, Duration: duration},
+			{Type: MessageDelayResp, LogCycle: c.conf.LogSyncInterval, Duration: duration},
+		})
+	if err := c.general.SetWriteDeadline(deadline); err != nil {
+		return fmt.Errorf("failed to set deadline: %v", err)
+	}
+	if _, err := c.general.WriteToUDP(req, c.generalRaddr); err != nil {
+		return fmt.Errorf("failed to send unicast request: %v", err)
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		_, b, err := c.read(ctx, c.general, deadline, buf, func(h *header) bool {
+			return h.Type == MessageSignaling
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read unicast grant: %v", err)
+		}
+		if len(b) < signalingSize || parsePortIdentity(b[headerSize:]) != c.identity {
+			continue
+		}
+		grants, err := parseSignaling(b, tlvGrantUnicast)
+		if err != nil {
+			return err
+		}
+		if len(grants) == 0 {
+			continue
+		}
+		until := time.Now().Add(c.conf.grantDuration())
+		for _, g := range grants {
+			if g.Duration == 0 {
+				return fmt.Errorf("ptp master [%s] denied unicast %s",
+					c.conf.Address, g.Type)
+			}
+			if t := time.Now().Add(time.Duration(g.Duration) * time.Second); t.Before(until) {
+				until = t
+			}
+		}
+		c.grantUntil = until
+		return nil
+	}
+}
+
+// read returns the next message of the domain on conn accepted by match.
+func (c *Client) read(ctx context.Context, conn *net.UDPConn,
+	deadline time.Time, buf []byte, match func(*header) bool) (*header, []byte, error) {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, nil, fmt.Errorf("failed to set deadline: %v", err)
+	}
+	// The deadline set when ctx is done must not be overridden.
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && ctx.Err() == nil {
+				return nil, nil, fmt.Errorf("ptp query [%s] timeout after %s",
+					c.conf.Address, c.conf.timeout())
+			}
+			return nil, nil, err
+		}
+		h, err := parseHeader(buf[:n])
+		if err != nil || h.Domain != c.conf.Domain || !match(h) {
+			continue
+		}
+		return h, buf[:h.Length], nil
+	}
+}
+
+// drain discards the messages queued on conn, so that the Sync timed by a
+// query is received after it starts.
+func drain(ctx context.Context, conn *net.UDPConn) error {
+	buf := make([]byte, maxMessageSize)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+			return fmt.Errorf("failed to set deadline: %v", err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, _, err := conn.ReadFromUDP(buf); err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return nil
+			}
+			return err
+		}
+	}
+}
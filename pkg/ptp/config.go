@@ -0,0 +1,140 @@
+package ptp
+
+import (
+	"fmt"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
+)
+
+const (
+	defaultEventPort     = 319
+	defaultGeneralPort   = 320
+	defaultTimeout       = 5 * time.Second
+	defaultGrantDuration = 60 * time.Second
+)
+
+type Config struct {
+	// Address is the host of the master. EventPort and GeneralPort default
+	// to 319 and 320.
+	Address     string
+	EventPort   int
+	GeneralPort int
+	// LocalEventAddr and LocalGeneralAddr are bound to receive the unicast
+	// messages of the master. They default to ":319" and ":320", the
+	// ports a master such as ptp4l sends to.
+	LocalEventAddr   string
+	LocalGeneralAddr string
+	Domain           uint8
+	// Timeout bounds a single query, including the wait for a Sync. It
+	// defaults to 5 seconds.
+	Timeout time.Duration
+	// LogSyncInterval is the log2 of the Sync interval requested from the
+	// master, and GrantDuration how long it is requested for, 60 seconds
+	// by default.
+	LogSyncInterval int8
+	GrantDuration   time.Duration
+	// LocalScale is the time scale of the local clock, UTC by default. PTP
+	// timestamps are TAI.
+	LocalScale timescale.Scale
+}
+
+func (conf *Config) Check() error {
+	if conf.Address == "" {
+		return fmt.Errorf("ptp master address not set")
+	}
+	return nil
+}
+
+func (conf *Config) eventAddr() string {
+	return portAddr(conf.Address, conf.EventPort, defaultEventPort)
+}
+
+func (conf *Config) generalAddr() string {
+	return portAddr(conf.Address, conf.GeneralPort, defaultGeneralPort)
+}
+
+func (conf *Config) localEventAddr() string {
+	if conf.LocalEventAddr == "" {
+		return fmt.Sprintf(":%d", defaultEventPort)
+	}
+	return conf.LocalEventAddr
+}
+
+func (conf *Config) localGeneralAddr() string {
+	if conf.LocalGeneralAddr == "" {
+		return fmt.Sprintf(":%d", defaultGeneralPort)
+	}
+	return conf.LocalGeneralAddr
+}
+
+func (conf *Config) timeout() time.Duration {
+	if conf.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return conf.Timeout
+}
+
+func (conf *Config) grantDuration() time.Duration {
+	if conf.GrantDuration <= 0 {
+		return defaultGrantDuration
+	}
+	return conf.GrantDuration
+}
+
+type MasterConfig struct {
+	// EventAddr and GeneralAddr default to ":319" and ":320".
+	EventAddr   string
+	GeneralAddr string
+	Domain      uint8
+	// PeerEventPort and PeerGeneralPort are the ports unicast messages are
+	// sent to on a slave, 319 and 320 by default.
+	PeerEventPort   int
+	PeerGeneralPort int
+	// TwoStep sends the precise origin timestamp of a Sync in a Follow_Up.
+	TwoStep bool
+	// Offset is added to the local clock, to run a skewed master in tests.
+	Offset time.Duration
+}
+
+func (conf *MasterConfig) Check() error {
+	if conf.PeerEventPort > 65535 || conf.PeerGeneralPort > 65535 {
+		return fmt.Errorf("invalid peer port")
+	}
+	return nil
+}
+
+func (conf *MasterConfig) eventAddr() string {
+	if conf.EventAddr == "" {
+		return fmt.Sprintf(":%d", defaultEventPort)
+	}
+	return conf.EventAddr
+}
+
+func (conf *MasterConfig) generalAddr() string {
+	if conf.GeneralAddr == "" {
+		return fmt.Sprintf(":%d", defaultGeneralPort)
+	}
+	return conf.GeneralAddr
+}
+
+func (conf *MasterConfig) peerEventPort() int {
+	if conf.PeerEventPort <= 0 {
+		return defaultEventPort
+	}
+	return conf.PeerEventPort
+}
+
+func (conf *MasterConfig) peerGeneralPort() int {
+	if conf.PeerGeneralPort <= 0 {
+		return defaultGeneralPort
+	}
+	return conf.PeerGeneralPort
+}
+
+func portAddr(host string, port, def int) string {
+	if port <= 0 {
+		port = def
+	}
+	return fmt.Sprintf("%s:%d", host, port)
+}
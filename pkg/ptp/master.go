@@ -0,0 +1,295 @@
+package ptp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
+)
+
+// Limits of the Sync interval granted to a slave, as log2 seconds.
+const (
+	minLogSyncInterval = -7
+	maxLogSyncInterval = 4
+)
+
+// Master is a minimal unicast PTP master timestamping in software, to test
+// clients against. It grants every unicast Sync and Delay_Resp request and
+// answers Delay_Req from any slave; it sends no Announce.
+type Master struct {
+	conf     *MasterConfig
+	identity PortIdentity
+	event    *net.UDPConn
+	general  *net.UDPConn
+	closed   chan struct{}
+
+	mu     sync.Mutex
+	grants map[string]chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewMaster(conf *MasterConfig) (*Master, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("failed to check ptp master config: %v", err)
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate clock identity: %v", err)
+	}
+	return &Master{
+		conf: conf,
+		identity: PortIdentity{
+			ClockIdentity: binary.BigEndian.Uint64(id[:]),
+			PortNumber:    1,
+		},
+		closed: make(chan struct{}),
+		grants: make(map[string]chan struct{}),
+	}, nil
+}
+
+// Listen binds the event and general sockets. It is called by Start when
+// the master is not yet listening, and may be called beforehand to learn
+// the bound addresses through Addr.
+func (m *Master) Listen() error {
+	event, err := listenUDP(m.conf.eventAddr())
+	if err != nil {
+		return err
+	}
+	general, err := listenUDP(m.conf.generalAddr())
+	if err != nil {
+		event.Close()
+		return err
+	}
+	m.event, m.general = event, general
+	return nil
+}
+
+// Addr returns the addresses of the event and general sockets, or nil if
+// the master is not listening.
+func (m *Master) Addr() (event, general net.Addr) {
+	if m.event == nil {
+		return nil, nil
+	}
+	return m.event.LocalAddr(), m.general.LocalAddr()
+}
+
+func (m *Master) Start() chan error {
+	errChan := make(chan error, 1)
+	if m.event == nil {
+		if err := m.Listen(); err != nil {
+			errChan <- err
+			return errChan
+		}
+	}
+	go func() {
+		errs := make(chan error, 2)
+		go func() { errs <- m.serveEvent() }()
+		go func() { errs <- m.serveGeneral() }()
+		err := <-errs
+		if err == nil {
+			err = <-errs
+		}
+		errChan <- err
+	}()
+	return errChan
+}
+
+func (m *Master) Close() error {
+	select {
+	case <-m.closed:
+		return nil
+	default:
+	}
+	// Under mu, so that no grant starts after the wait below.
+	m.mu.Lock()
+	close(m.closed)
+	m.mu.Unlock()
+	if m.event == nil {
+		return nil
+	}
+	err := m.event.Close()
+	if gerr := m.general.Close(); err == nil {
+		err = gerr
+	}
+	m.wg.Wait()
+	return err
+}
+
+// now returns the time of the master in the PTP timescale.
+func (m *Master) now() time.Time {
+	return timescale.Convert(time.Now().Add(m.conf.Offset), timescale.UTC,
+		timescale.TAI)
+}
+
+func (m *Master) header(typ MessageType, control uint8, sequence uint16,
+	logInterval int8) *header {
+	flags := flagUnicast | flagPTPTimescale
+	if m.conf.TwoStep && typ == MessageSync {
+		flags |= flagTwoStep
+	}
+	return &header{
+		Type:        typ,
+		Domain:      m.conf.Domain,
+		Flags:       flags,
+		Source:      m.identity,
+		Sequence:    sequence,
+		Control:     control,
+		LogInterval: logInterval,
+	}
+}
+
+func (m *Master) serveEvent() error {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, raddr, err := m.event.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-m.closed:
+				return nil
+			default:
+				return fmt.Errorf("failed to read udp packet: %v", err)
+			}
+		}
+		t4 := m.now()
+		h, err := parseHeader(buf[:n])
+		if err != nil || h.Type != MessageDelayReq || h.Domain != m.conf.Domain {
+			continue
+		}
+		resp := newMessage(m.header(MessageDelayResp, controlDelayResp,
+			h.Sequence, 0x7f), delayRespSize)
+		putTimestamp(resp[headerSize:], t4)
+		h.Source.put(resp[syncSize:])
+		m.send(m.general, resp, raddr.IP, m.conf.peerGeneralPort())
+	}
+}
+
+func (m *Master) serveGeneral() error {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, raddr, err := m.general.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-m.closed:
+				return nil
+			default:
+				return fmt.Errorf("failed to read udp packet: %v", err)
+			}
+		}
+		h, err := parseHeader(buf[:n])
+		if err != nil || h.Type != MessageSignaling || h.Domain != m.conf.Domain {
+			continue
+		}
+		reqs, err := parseSignaling(buf[:h.Length], tlvRequestUnicast)
+		if err != nil {
+			logrus.WithField("prefix", "ptp.master").
+				Debugf("drop signaling from [%s]: %v", raddr, err)
+			continue
+		}
+		if len(reqs) == 0 {
+			continue
+		}
+		grants := make([]unicastTLV, len(reqs))
+		for i, req := range reqs {
+			grants[i] = req
+			switch req.Type {
+			case MessageSync:
+				if req.LogCycle < minLogSyncInterval || req.LogCycle > maxLogSyncInterval {
+					grants[i].Duration = 0
+					continue
+				}
+				m.grant(raddr.IP, req)
+			case MessageDelayResp:
+			default:
+				grants[i].Duration = 0
+			}
+		}
+		resp := signaling(m.header(MessageSignaling, controlOther, h.Sequence, 0x7f),
+			h.Source, tlvGrantUnicast, grants)
+		m.send(m.general, resp, raddr.IP, m.conf.peerGeneralPort())
+	}
+}
+
+// grant starts sending Sync messages to ip as requested, replacing a
+// previous grant.
+func (m *Master) grant(ip net.IP, req unicastTLV) {
+	stop := make(chan struct{})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-m.closed:
+		return
+	default:
+	}
+	if prev, ok := m.grants[ip.String()]; ok {
+		close(prev)
+	}
+	m.grants[ip.String()] = stop
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.sendSyncs(ip, req, stop)
+	}()
+}
+
+func (m *Master) sendSyncs(ip net.IP, req unicastTLV, stop chan struct{}) {
+	interval := time.Duration(float64(time.Second) * pow2(req.LogCycle))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	expire := time.NewTimer(time.Duration(req.Duration) * time.Second)
+	defer expire.Stop()
+	var sequence uint16
+	for {
+		select {
+		case <-ticker.C:
+		case <-expire.C:
+			m.mu.Lock()
+			if m.grants[ip.String()] == stop {
+				delete(m.grants, ip.String())
+			}
+			m.mu.Unlock()
+			return
+		case <-stop:
+			return
+		case <-m.closed:
+			return
+		}
+		msg := newMessage(m.header(MessageSync, controlSync, sequence,
+			req.LogCycle), syncSize)
+		t1 := m.now()
+		if !m.conf.TwoStep {
+			putTimestamp(msg[headerSize:], t1)
+		}
+		m.send(m.event, msg, ip, m.conf.peerEventPort())
+		if m.conf.TwoStep {
+			followUp := newMessage(m.header(MessageFollowUp, controlFollowUp,
+				sequence, req.LogCycle), syncSize)
+			putTimestamp(followUp[headerSize:], t1)
+			m.send(m.general, followUp, ip, m.conf.peerGeneralPort())
+		}
+		sequence++
+	}
+}
+
+func (m *Master) send(conn *net.UDPConn, b []byte, ip net.IP, port int) {
+	raddr := &net.UDPAddr{IP: ip, Port: port}
+	if _, err := conn.WriteToUDP(b, raddr); err != nil {
+		logrus.WithField("prefix", "ptp.master").
+			Warnf("failed to write to [%s]: %v", raddr, err)
+	}
+}
+
+func pow2(exp int8) float64 {
+	if exp >= 0 {
+		return float64(uint64(1) << uint(exp))
+	}
+	return 1 / float64(uint64(1)<<uint(-exp))
+}
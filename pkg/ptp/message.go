@@ -0,0 +1,229 @@
+package ptp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// MessageType is the PTP message type of the common header.
+type MessageType uint8
+
+const (
+	MessageSync      MessageType = 0x0
+	MessageDelayReq  MessageType = 0x1
+	MessageFollowUp  MessageType = 0x8
+	MessageDelayResp MessageType = 0x9
+	MessageAnnounce  MessageType = 0xb
+	MessageSignaling MessageType = 0xc
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MessageSync:
+		return "Sync"
+	case MessageDelayReq:
+		return "Delay_Req"
+	case MessageFollowUp:
+		return "Follow_Up"
+	case MessageDelayResp:
+		return "Delay_Resp"
+	case MessageAnnounce:
+		return "Announce"
+	case MessageSignaling:
+		return "Signaling"
+	}
+	return fmt.Sprintf("MessageType(%d)", uint8(t))
+}
+
+// Flags of the common header, IEEE 1588-2008 table 20.
+const (
+	flagLeap61       uint16 = 1 << 0
+	flagLeap59       uint16 = 1 << 1
+	flagPTPTimescale uint16 = 1 << 3
+	flagTwoStep      uint16 = 1 << 9
+	flagUnicast      uint16 = 1 << 10
+)
+
+// controlField values of the common header, kept for PTPv1 hardware.
+const (
+	controlSync      = 0
+	controlDelayReq  = 1
+	controlFollowUp  = 2
+	controlDelayResp = 3
+	controlOther     = 5
+)
+
+// TLV types of signaling messages.
+const (
+	tlvRequestUnicast = 0x0004
+	tlvGrantUnicast   = 0x0005
+)
+
+const (
+	ptpVersion     = 2
+	headerSize     = 34
+	timestampSize  = 10
+	portIDSize     = 10
+	syncSize       = headerSize + timestampSize
+	delayRespSize  = headerSize + timestampSize + portIDSize
+	signalingSize  = headerSize + portIDSize
+	maxMessageSize = 1500
+)
+
+// PortIdentity identifies a PTP port: the clock identity, usually an
+// EUI-64, and the port number.
+type PortIdentity struct {
+	ClockIdentity uint64
+	PortNumber    uint16
+}
+
+func (p PortIdentity) String() string {
+	return fmt.Sprintf("%016x-%d", p.ClockIdentity, p.PortNumber)
+}
+
+func (p PortIdentity) put(b []byte) {
+	binary.BigEndian.PutUint64(b, p.ClockIdentity)
+	binary.BigEndian.PutUint16(b[8:], p.PortNumber)
+}
+
+func parsePortIdentity(b []byte) PortIdentity {
+	return PortIdentity{
+		ClockIdentity: binary.BigEndian.Uint64(b),
+		PortNumber:    binary.BigEndian.Uint16(b[8:]),
+	}
+}
+
+// putTimestamp writes t as 48 bits of seconds and 32 bits of nanoseconds
+// since the PTP epoch, 1970-01-01 TAI. t is already in the TAI scale.
+func putTimestamp(b []byte, t time.Time) {
+	sec := uint64(t.Unix())
+	binary.BigEndian.PutUint16(b, uint16(sec>>32))
+	binary.BigEndian.PutUint32(b[2:], uint32(sec))
+	binary.BigEndian.PutUint32(b[6:], uint32(t.Nanosecond()))
+}
+
+func parseTimestamp(b []byte) time.Time {
+	sec := uint64(binary.BigEndian.Uint16(b))<<32 | uint64(binary.BigEndian.Uint32(b[2:]))
+	return time.Unix(int64(sec), int64(binary.BigEndian.Uint32(b[6:])))
+}
+
+// header is the common header of all PTP messages.
+type header struct {
+	Type   MessageType
+	Length uint16
+	Domain uint8
+	Flags  uint16
+	// Correction is in nanoseconds scaled by 2^16.
+	Correction  int64
+	Source      PortIdentity
+	Sequence    uint16
+	Control     uint8
+	LogInterval int8
+}
+
+// correction returns the correction field as a duration.
+func (h *header) correction() time.Duration {
+	return time.Duration(h.Correction >> 16)
+}
+
+func (h *header) marshal(b []byte) {
+	b[0] = uint8(h.Type) & 0x0f
+	b[1] = ptpVersion
+	binary.BigEndian.PutUint16(b[2:], h.Length)
+	b[4] = h.Domain
+	binary.BigEndian.PutUint16(b[6:], h.Flags)
+	binary.BigEndian.PutUint64(b[8:], uint64(h.Correction))
+	h.Source.put(b[20:])
+	binary.BigEndian.PutUint16(b[30:], h.Sequence)
+	b[32] = h.Control
+	b[33] = uint8(h.LogInterval)
+}
+
+func parseHeader(b []byte) (*header, error) {
+	if len(b) < headerSize {
+		return nil, fmt.Errorf("ptp message too short [%d]", len(b))
+	}
+	if v := b[1] & 0x0f; v != ptpVersion {
+		return nil, fmt.Errorf("unsupported ptp version [%d]", v)
+	}
+	h := &header{
+		Type:        MessageType(b[0] & 0x0f),
+		Length:      binary.BigEndian.Uint16(b[2:]),
+		Domain:      b[4],
+		Flags:       binary.BigEndian.Uint16(b[6:]),
+		Correction:  int64(binary.BigEndian.Uint64(b[8:])),
+		Source:      parsePortIdentity(b[20:]),
+		Sequence:    binary.BigEndian.Uint16(b[30:]),
+		Control:     b[32],
+		LogInterval: int8(b[33]),
+	}
+	if int(h.Length) < headerSize || int(h.Length) > len(b) {
+		return nil, fmt.Errorf("invalid ptp message length [%d]", h.Length)
+	}
+	return h, nil
+}
+
+// newMessage returns a message of size bytes starting with h.
+func newMessage(h *header, size int) []byte {
+	b := make([]byte, size)
+	h.Length = uint16(size)
+	h.marshal(b)
+	return b
+}
+
+// unicastTLV is a REQUEST or GRANT_UNICAST_TRANSMISSION TLV for one
+// message type.
+type unicastTLV struct {
+	Type     MessageType
+	LogCycle int8
+	Duration uint32
+}
+
+// signaling returns a signaling message carrying the unicast TLVs of type
+// tlvType to target.
+func signaling(h *header, target PortIdentity, tlvType uint16,
+	tlvs []unicastTLV) []byte {
+	h.Type, h.Control = MessageSignaling, controlOther
+	valueSize := 6
+	if tlvType == tlvGrantUnicast {
+		valueSize = 8
+	}
+	b := newMessage(h, signalingSize+len(tlvs)*(4+valueSize))
+	target.put(b[headerSize:])
+	off := signalingSize
+	for _, t := range tlvs {
+		binary.BigEndian.PutUint16(b[off:], tlvType)
+		binary.BigEndian.PutUint16(b[off+2:], uint16(valueSize))
+		b[off+4] = uint8(t.Type) << 4
+		b[off+5] = uint8(t.LogCycle)
+		binary.BigEndian.PutUint32(b[off+6:], t.Duration)
+		off += 4 + valueSize
+	}
+	return b
+}
+
+// parseSignaling returns the unicast TLVs of type tlvType of a signaling
+// message, skipping other TLVs.
+func parseSignaling(b []byte, tlvType uint16) ([]unicastTLV, error) {
+	if len(b) < signalingSize {
+		return nil, fmt.Errorf("signaling message too short [%d]", len(b))
+	}
+	var tlvs []unicastTLV
+	for off := signalingSize; off+4 <= len(b); {
+		typ := binary.BigEndian.Uint16(b[off:])
+		n := int(binary.BigEndian.Uint16(b[off+2:]))
+		if off+4+n > len(b) {
+			return nil, fmt.Errorf("truncated tlv [%#04x]", typ)
+		}
+		if typ == tlvType && n >= 6 {
+			tlvs = append(tlvs, unicastTLV{
+				Type:     MessageType(b[off+4] >> 4),
+				LogCycle: int8(b[off+5]),
+				Duration: binary.BigEndian.Uint32(b[off+6:]),
+			})
+		}
+		off += 4 + n
+	}
+	return tlvs, nil
+}
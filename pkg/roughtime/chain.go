@@ -0,0 +1,123 @@
+package roughtime
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"fmt"
+)
+
+// Link is the answer of one server of a chain.
+type Link struct {
+	Client   *Client
+	Response *Response
+	// Err is set when the server did not answer; the chain then goes on
+	// from the previous reply.
+	Err error
+}
+
+// Chain is a sequence of replies from several servers. The nonce of each
+// request is derived from the previous reply, so the replies prove that
+// the servers answered in that order: a server whose time is earlier than
+// that of a server queried before it, beyond their radii, is lying, or
+// the other one is.
+type Chain struct {
+	Links []*Link
+}
+
+// ConsistencyError reports two servers of a chain whose times contradict
+// the order in which they answered.
+type ConsistencyError struct {
+	Earlier *Response
+	Later   *Response
+}
+
+func (e *ConsistencyError) Error() string {
+	return fmt.Sprintf("roughtime server [%s] answered %s ± %s after [%s] answered %s ± %s",
+		e.Later.Address, e.Later.Midpoint.Format("2006-01-02T15:04:05.000000Z07:00"),
+		e.Later.Radius, e.Earlier.Address,
+		e.Earlier.Midpoint.Format("2006-01-02T15:04:05.000000Z07:00"), e.Earlier.Radius)
+}
+
+// QueryChain queries the servers one after the other, chaining the nonces.
+// It fails only when no server answered; the caller checks the replies
+// with Verify or Inconsistencies.
+func QueryChain(ctx context.Context, clients []*Client) (*Chain, error) {
+	ch := &Chain{Links: make([]*Link, 0, len(clients))}
+	var prev []byte
+	answered := 0
+	for _, c := range clients {
+		resp, err := c.query(ctx, prev)
+		ch.Links = append(ch.Links, &Link{Client: c, Response: resp, Err: err})
+		if err != nil {
+			continue
+		}
+		prev = resp.Reply
+		answered++
+	}
+	if answered == 0 && len(clients) > 0 {
+		return ch, fmt.Errorf("no roughtime server answered: %v",
+			ch.Links[len(ch.Links)-1].Err)
+	}
+	return ch, nil
+}
+
+// Responses returns the replies of the servers that answered, in order.
+func (ch *Chain) Responses() []*Response {
+	var resps []*Response
+	for _, l := range ch.Links {
+		if l.Err == nil && l.Response != nil {
+			resps = append(resps, l.Response)
+		}
+	}
+	return resps
+}
+
+// Verify checks the signatures of the replies, that each nonce follows
+// from the previous reply, and that the times are consistent with the
+// order of the replies. A third party holding the chain and the public
+// keys can check it the same way.
+func (ch *Chain) Verify() error {
+	var prev []byte
+	for _, l := range ch.Links {
+		if l.Err != nil || l.Response == nil {
+			continue
+		}
+		resp := l.Response
+		h := sha512.New()
+		h.Write(prev)
+		h.Write(resp.Blind)
+		if !bytes.Equal(h.Sum(nil), resp.Nonce) {
+			return fmt.Errorf("roughtime reply of [%s] not chained to the previous one",
+				resp.Address)
+		}
+		if _, _, err := VerifyReply(l.Client.conf.PublicKey, resp.Nonce,
+			resp.Reply); err != nil {
+			return fmt.Errorf("roughtime reply of [%s]: %v", resp.Address, err)
+		}
+		prev = resp.Reply
+	}
+	if errs := ch.Inconsistencies(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// Inconsistencies returns every pair of replies whose times contradict
+// their order. A server involved in most of them is the likely culprit.
+func (ch *Chain) Inconsistencies() []*ConsistencyError {
+	resps := ch.Responses()
+	var errs []*ConsistencyError
+	for i, earlier := range resps {
+		for _, later := range resps[i+1:] {
+			if earlier.Midpoint.Add(-earlier.Radius).After(
+				later.Midpoint.Add(later.Radius)) {
+				errs = append(errs, &ConsistencyError{
+					Earlier: earlier,
+					Later:   later,
+				})
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,263 @@
+package roughtime
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Roughtime, as deployed by Google: a client sends a nonce, the server
+// answers with its time and an uncertainty radius, signed together with
+// the nonce. Since the nonce of a request may be derived from the reply
+// to the previous one, a chain of replies from several servers proves the
+// order in which they answered, see Chain.
+
+// Response is a verified Roughtime reply.
+type Response struct {
+	Address string
+	// Midpoint is the server time and Radius its uncertainty.
+	Midpoint time.Time
+	Radius   time.Duration
+	// RTT is the round trip time of the query.
+	RTT time.Duration
+	// Nonce is SHA-512 of the previous reply in a chain and Blind.
+	Nonce []byte
+	Blind []byte
+	// Reply is the signed reply as received.
+	Reply []byte
+}
+
+// Client queries one Roughtime server. It is safe for concurrent use.
+type Client struct {
+	conf *Config
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func NewClient(conf *Config) (*Client, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("failed to check roughtime config: %v", err)
+	}
+	return &Client{conf: conf}, nil
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// Query sends a request with a random nonce and returns the verified
+// reply.
+func (c *Client) Query(ctx context.Context) (*Response, error) {
+	return c.query(ctx, nil)
+}
+
+// chainNonce derives the nonce following the reply prev from a random
+// blind, so that it proves the request was sent after prev was received.
+func chainNonce(prev []byte) (nonce, blind []byte, err error) {
+	blind = make([]byte, nonceSize)
+	if _, err = rand.Read(blind); err != nil {
+		return nil, nil, err
+	}
+	h := sha512.New()
+	h.Write(prev)
+	h.Write(blind)
+	return h.Sum(nil), blind, nil
+}
+
+func (c *Client) query(ctx context.Context, prev []byte) (*Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	nonce, blind, err := chainNonce(prev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	req, err := newRequest(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if c.conn, err = net.Dial("udp", c.conf.Address); err != nil {
+			c.conn = nil
+			return nil, fmt.Errorf("failed to dial udp addr [%s]: %v",
+				c.conf.Address, err)
+		}
+	}
+	deadline := time.Now().Add(c.conf.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err = c.conn.SetDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("failed to set deadline: %v", err)
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	start := time.Now()
+	if _, err = c.conn.Write(req); err != nil {
+		return nil, fmt.Errorf("failed to send roughtime request: %v", err)
+	}
+	// Stray or forged datagrams fail verification and are skipped.
+	buf := make([]byte, maxResponseSize)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return nil, fmt.Errorf("roughtime query [%s] timeout after %s",
+					c.conf.Address, c.conf.timeout())
+			}
+			return nil, fmt.Errorf("failed to read roughtime reply: %v", err)
+		}
+		rtt := time.Since(start)
+		reply := append([]byte(nil), buf[:n]...)
+		midpoint, radius, err := VerifyReply(c.conf.PublicKey, nonce, reply)
+		if err != nil {
+			continue
+		}
+		return &Response{
+			Address:  c.conf.Address,
+			Midpoint: midpoint,
+			Radius:   radius,
+			RTT:      rtt,
+			Nonce:    nonce,
+			Blind:    blind,
+			Reply:    reply,
+		}, nil
+	}
+}
+
+// newRequest returns a request for nonce, padded to the minimum size that
+// keeps the server from amplifying traffic.
+func newRequest(nonce []byte) ([]byte, error) {
+	m := message{tagNONC: nonce, tagPAD: nil}
+	b, err := m.encode()
+	if err != nil {
+		return nil, err
+	}
+	m[tagPAD] = make([]byte, minRequestSize-len(b))
+	return m.encode()
+}
+
+// VerifyReply checks the reply of the server with the long-term key pub
+// to a request with nonce: the delegation of the online key, the signature
+// of the signed response, the Merkle path of the nonce and the validity of
+// the delegation at the returned time.
+func VerifyReply(pub ed25519.PublicKey, nonce, reply []byte) (time.Time,
+	time.Duration, error) {
+	m, err := decodeMessage(reply)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid reply: %v", err)
+	}
+	cert, _, err := m.message(tagCERT)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	dele, deleRaw, err := cert.message(tagDELE)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	certSig, err := cert.get(tagSIG, ed25519.SignatureSize)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if !ed25519.Verify(pub, append([]byte(delegationContext), deleRaw...),
+		certSig) {
+		return time.Time{}, 0, fmt.Errorf("invalid delegation signature")
+	}
+	onlineKey, err := dele.get(tagPUBK, ed25519.PublicKeySize)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	mint, err := dele.uint64(tagMINT)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	maxt, err := dele.uint64(tagMAXT)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	srep, srepRaw, err := m.message(tagSREP)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	sig, err := m.get(tagSIG, ed25519.SignatureSize)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if !ed25519.Verify(onlineKey, append([]byte(responseSigContext),
+		srepRaw...), sig) {
+		return time.Time{}, 0, fmt.Errorf("invalid response signature")
+	}
+	root, err := srep.get(tagROOT, hashSize)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	path, err := m.get(tagPATH, 0)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	index, err := m.uint32(tagINDX)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if !verifyPath(root, nonce, path, index) {
+		return time.Time{}, 0, fmt.Errorf("nonce not in signed merkle tree")
+	}
+	midp, err := srep.uint64(tagMIDP)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	radi, err := srep.uint32(tagRADI)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if midp < mint || midp > maxt {
+		return time.Time{}, 0, fmt.Errorf("time outside of delegation validity")
+	}
+	return fromMicros(midp), time.Duration(radi) * time.Microsecond, nil
+}
+
+// Times are microseconds since the Unix epoch.
+func fromMicros(us uint64) time.Time {
+	return time.Unix(int64(us/1e6), int64(us%1e6)*1e3)
+}
+
+func toMicros(t time.Time) uint64 {
+	return uint64(t.UnixNano() / 1e3)
+}
@@ -0,0 +1,96 @@
+package roughtime
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultTimeout     = 5 * time.Second
+	defaultRadius      = time.Second
+	defaultValidity    = 24 * time.Hour
+	defaultMaxBatch    = 64
+	minRequestSize     = 1024
+	maxResponseSize    = 4096
+	nonceSize          = 64
+	delegationContext  = "RoughTime v1 delegation signature--\x00"
+	responseSigContext = "RoughTime v1 response signature\x00"
+)
+
+type Config struct {
+	// Address is the udp address of the server.
+	Address string
+	// PublicKey is the long-term Ed25519 key of the server.
+	PublicKey ed25519.PublicKey
+	// Timeout bounds a single query. It defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+func (conf *Config) Check() error {
+	if conf.Address == "" {
+		return fmt.Errorf("roughtime server address not set")
+	}
+	if len(conf.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid roughtime public key length [%d]",
+			len(conf.PublicKey))
+	}
+	return nil
+}
+
+func (conf *Config) timeout() time.Duration {
+	if conf.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return conf.Timeout
+}
+
+type ServerConfig struct {
+	Address string
+	// RootKey is the long-term key, which only signs the delegation of an
+	// online key renewed every Validity, 24 hours by default.
+	RootKey  ed25519.PrivateKey
+	Validity time.Duration
+	// Radius is the uncertainty announced with the time. It defaults to
+	// 1 second.
+	Radius time.Duration
+	// BatchWindow is how long requests are gathered after a first one to
+	// be signed together, up to MaxBatch (64 by default). Zero answers
+	// every request on its own.
+	BatchWindow time.Duration
+	MaxBatch    int
+	// Offset is added to the local clock, to run a skewed server in tests.
+	Offset time.Duration
+}
+
+func (conf *ServerConfig) Check() error {
+	if conf.Address == "" {
+		return fmt.Errorf("server address not set")
+	}
+	if len(conf.RootKey) != ed25519.PrivateKeySize {
+		return fmt.Errorf("invalid roughtime root key length [%d]",
+			len(conf.RootKey))
+	}
+	return nil
+}
+
+func (conf *ServerConfig) validity() time.Duration {
+	if conf.Validity <= 0 {
+		return defaultValidity
+	}
+	return conf.Validity
+}
+
+func (conf *ServerConfig) radius() time.Duration {
+	if conf.Radius <= 0 {
+		return defaultRadius
+	}
+	return conf.Radius
+}
+
+func (conf *ServerConfig) maxBatch() int {
+	if conf.MaxBatch <= 0 {
+		return defaultMaxBatch
+	}
+	return conf.MaxBatch
+}
@@ -0,0 +1,95 @@
+package roughtime
+
+import (
+	"bytes"
+	"crypto/sha512"
+)
+
+// A server signs one SREP for a batch of requests: its ROOT is the root of
+// a Merkle tree over their nonces, and each response carries the path from
+// its nonce up to the root. Leaves are SHA-512(0x00 || nonce), nodes
+// SHA-512(0x01 || left || right).
+
+const (
+	hashSize = sha512.Size
+	// maxPathNodes bounds the path, and so a batch to 2^32 requests.
+	maxPathNodes = 32
+)
+
+func leafHash(nonce []byte) []byte {
+	h := sha512.New()
+	h.Write([]byte{0})
+	h.Write(nonce)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha512.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleTree holds the levels of the tree, from the leaves to the root.
+// The leaves are padded to a power of two with the hash of an empty nonce.
+type merkleTree struct {
+	levels [][][]byte
+}
+
+func newMerkleTree(nonces [][]byte) *merkleTree {
+	size := 1
+	for size < len(nonces) {
+		size *= 2
+	}
+	leaves := make([][]byte, size)
+	for i := range leaves {
+		if i < len(nonces) {
+			leaves[i] = leafHash(nonces[i])
+		} else {
+			leaves[i] = leafHash(nil)
+		}
+	}
+	t := &merkleTree{levels: [][][]byte{leaves}}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			next[i] = nodeHash(level[2*i], level[2*i+1])
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+	return t
+}
+
+func (t *merkleTree) root() []byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// path returns the siblings from leaf i up to the root.
+func (t *merkleTree) path(i int) []byte {
+	path := make([]byte, 0, hashSize*(len(t.levels)-1))
+	for _, level := range t.levels[:len(t.levels)-1] {
+		path = append(path, level[i^1]...)
+		i /= 2
+	}
+	return path
+}
+
+// verifyPath reports whether path leads from nonce at index to root. A
+// bit of index set means the node is the right child at that level.
+func verifyPath(root, nonce, path []byte, index uint32) bool {
+	if len(path)%hashSize != 0 || len(path)/hashSize > maxPathNodes {
+		return false
+	}
+	h := leafHash(nonce)
+	for ; len(path) > 0; path = path[hashSize:] {
+		if index&1 == 0 {
+			h = nodeHash(h, path[:hashSize])
+		} else {
+			h = nodeHash(path[:hashSize], h)
+		}
+		index >>= 1
+	}
+	return index == 0 && bytes.Equal(h, root)
+}
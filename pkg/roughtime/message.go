@@ -0,0 +1,168 @@
+package roughtime
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// tag is a message tag: four ASCII bytes read as a little-endian uint32.
+// A message lists its tags in ascending order of that value.
+type tag uint32
+
+func makeTag(s string) tag {
+	return tag(binary.LittleEndian.Uint32([]byte(s)))
+}
+
+func (t tag) String() string {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(t))
+	return fmt.Sprintf("%q", b)
+}
+
+var (
+	tagCERT = makeTag("CERT")
+	tagDELE = makeTag("DELE")
+	tagINDX = makeTag("INDX")
+	tagMAXT = makeTag("MAXT")
+	tagMIDP = makeTag("MIDP")
+	tagMINT = makeTag("MINT")
+	tagNONC = makeTag("NONC")
+	tagPAD  = makeTag("PAD\xff")
+	tagPATH = makeTag("PATH")
+	tagPUBK = makeTag("PUBK")
+	tagRADI = makeTag("RADI")
+	tagROOT = makeTag("ROOT")
+	tagSIG  = makeTag("SIG\x00")
+	tagSREP = makeTag("SREP")
+)
+
+// maxTags bounds the tags of a decoded message.
+const maxTags = 64
+
+// message maps tags to values, whose lengths are multiples of 4 bytes.
+//
+// The encoding is the number of tags N, N-1 offsets of the values but the
+// first, relative to the end of the header, the N tags and the values, all
+// integers being little-endian uint32.
+type message map[tag][]byte
+
+func (m message) encode() ([]byte, error) {
+	tags := make([]tag, 0, len(m))
+	for t, v := range m {
+		if len(v)%4 != 0 {
+			return nil, fmt.Errorf("value of tag %s not a multiple of 4 bytes", t)
+		}
+		tags = append(tags, t)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	n := len(tags)
+	hdr := 4
+	if n > 0 {
+		hdr = 8 * n
+	}
+	size := hdr
+	for _, t := range tags {
+		size += len(m[t])
+	}
+	b := make([]byte, hdr, size)
+	binary.LittleEndian.PutUint32(b, uint32(n))
+	off := 0
+	for i, t := range tags {
+		if i > 0 {
+			binary.LittleEndian.PutUint32(b[4*i:], uint32(off))
+		}
+		binary.LittleEndian.PutUint32(b[4*n+4*i:], uint32(t))
+		off += len(m[t])
+	}
+	for _, t := range tags {
+		b = append(b, m[t]...)
+	}
+	return b, nil
+}
+
+func decodeMessage(b []byte) (message, error) {
+	if len(b) < 4 || len(b)%4 != 0 {
+		return nil, fmt.Errorf("invalid message length [%d]", len(b))
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	if n == 0 {
+		return message{}, nil
+	}
+	if n > maxTags || 8*n > len(b) {
+		return nil, fmt.Errorf("invalid number of tags [%d]", n)
+	}
+	values := b[8*n:]
+	m := make(message, n)
+	var prev tag
+	start := 0
+	for i := 0; i < n; i++ {
+		t := tag(binary.LittleEndian.Uint32(b[4*n+4*i:]))
+		if i > 0 && t <= prev {
+			return nil, fmt.Errorf("tags not in ascending order")
+		}
+		end := len(values)
+		if i < n-1 {
+			end = int(binary.LittleEndian.Uint32(b[4+4*i:]))
+		}
+		if end%4 != 0 || end < start || end > len(values) {
+			return nil, fmt.Errorf("invalid offset of tag %s", t)
+		}
+		m[t] = values[start:end]
+		prev, start = t, end
+	}
+	return m, nil
+}
+
+// get returns the value of t, checking its length if size is not 0.
+func (m message) get(t tag, size int) ([]byte, error) {
+	v, ok := m[t]
+	if !ok {
+		return nil, fmt.Errorf("missing tag %s", t)
+	}
+	if size != 0 && len(v) != size {
+		return nil, fmt.Errorf("invalid length [%d] of tag %s", len(v), t)
+	}
+	return v, nil
+}
+
+// message returns the value of t decoded as a nested message.
+func (m message) message(t tag) (message, []byte, error) {
+	v, err := m.get(t, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	nested, err := decodeMessage(v)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid %s: %v", t, err)
+	}
+	return nested, v, nil
+}
+
+func (m message) uint32(t tag) (uint32, error) {
+	v, err := m.get(t, 4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(v), nil
+}
+
+func (m message) uint64(t tag) (uint64, error) {
+	v, err := m.get(t, 8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(v), nil
+}
+
+func uint32Value(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func uint64Value(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,234 @@
+package roughtime
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Server answers Roughtime requests over udp, signing them with an online
+// key delegated by the root key.
+type Server struct {
+	conf       *ServerConfig
+	packetConn *net.UDPConn
+	closed     chan struct{}
+
+	// Online key and its delegation, renewed halfway through its validity.
+	onlineKey ed25519.PrivateKey
+	cert      []byte
+	renewAt   time.Time
+}
+
+func NewServer(conf *ServerConfig) (*Server, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("failed to check roughtime server config: %v", err)
+	}
+	s := &Server{
+		conf:   conf,
+		closed: make(chan struct{}),
+	}
+	if err := s.delegate(s.now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Listen binds the server to the configured address. It is called by Start
+// when the server is not yet listening, and may be called beforehand to
+// learn the bound address through Addr.
+func (s *Server) Listen() error {
+	laddr, err := net.ResolveUDPAddr("udp", s.conf.Address)
+	if err != nil {
+		return fmt.Errorf("failed to resolve udp addr [%s]: %v",
+			s.conf.Address, err)
+	}
+	if s.packetConn, err = net.ListenUDP("udp", laddr); err != nil {
+		return fmt.Errorf("failed to listen udp addr [%s]: %v",
+			s.conf.Address, err)
+	}
+	return nil
+}
+
+// Addr returns the listener address, or nil if the server is not listening.
+func (s *Server) Addr() net.Addr {
+	if s.packetConn == nil {
+		return nil
+	}
+	return s.packetConn.LocalAddr()
+}
+
+func (s *Server) Start() chan error {
+	errChan := make(chan error, 1)
+	if s.packetConn == nil {
+		if err := s.Listen(); err != nil {
+			errChan <- err
+			return errChan
+		}
+	}
+	go func() {
+		errChan <- s.serve()
+	}()
+	return errChan
+}
+
+func (s *Server) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	close(s.closed)
+	if s.packetConn == nil {
+		return nil
+	}
+	return s.packetConn.Close()
+}
+
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.conf.Offset)
+}
+
+// delegate generates a new online key and its certificate, valid from now
+// for ServerConfig.Validity.
+func (s *Server) delegate(now time.Time) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate online key: %v", err)
+	}
+	validity := s.conf.validity()
+	dele, err := message{
+		tagPUBK: pub,
+		tagMINT: uint64Value(toMicros(now.Add(-time.Minute))),
+		tagMAXT: uint64Value(toMicros(now.Add(validity))),
+	}.encode()
+	if err != nil {
+		return err
+	}
+	sig := ed25519.Sign(s.conf.RootKey, append([]byte(delegationContext), dele...))
+	if s.cert, err = (message{tagDELE: dele, tagSIG: sig}).encode(); err != nil {
+		return err
+	}
+	s.onlineKey = priv
+	s.renewAt = now.Add(validity / 2)
+	return nil
+}
+
+type request struct {
+	addr  *net.UDPAddr
+	nonce []byte
+}
+
+func (s *Server) serve() error {
+	buf := make([]byte, maxResponseSize)
+	for {
+		batch, err := s.readBatch(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return nil
+			default:
+				return fmt.Errorf("failed to read udp packet: %v", err)
+			}
+		}
+		if err = s.answer(batch); err != nil {
+			logrus.WithField("prefix", "roughtime.server").
+				Warnf("failed to answer batch: %v", err)
+		}
+	}
+}
+
+// readBatch waits for a valid request, then gathers those arriving within
+// ServerConfig.BatchWindow.
+func (s *Server) readBatch(buf []byte) ([]*request, error) {
+	var batch []*request
+	for len(batch) < s.conf.maxBatch() {
+		n, raddr, err := s.packetConn.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if len(batch) > 0 && errors.As(err, &ne) && ne.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		nonce, err := parseRequest(buf[:n])
+		if err != nil {
+			logrus.WithField("prefix", "roughtime.server").
+				Debugf("drop request from [%s]: %v", raddr, err)
+			continue
+		}
+		batch = append(batch, &request{addr: raddr, nonce: nonce})
+		if s.conf.BatchWindow <= 0 {
+			break
+		}
+		if len(batch) == 1 {
+			s.packetConn.SetReadDeadline(time.Now().Add(s.conf.BatchWindow))
+		}
+	}
+	s.packetConn.SetReadDeadline(time.Time{})
+	return batch, nil
+}
+
+func parseRequest(b []byte) ([]byte, error) {
+	if len(b) < minRequestSize {
+		return nil, fmt.Errorf("request too short [%d]", len(b))
+	}
+	m, err := decodeMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := m.get(tagNONC, nonceSize)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), nonce...), nil
+}
+
+// answer signs the batch with a single signed response over the Merkle
+// tree of its nonces.
+func (s *Server) answer(batch []*request) error {
+	now := s.now()
+	if now.After(s.renewAt) {
+		if err := s.delegate(now); err != nil {
+			return err
+		}
+	}
+	nonces := make([][]byte, len(batch))
+	for i, req := range batch {
+		nonces[i] = req.nonce
+	}
+	tree := newMerkleTree(nonces)
+	srep, err := message{
+		tagRADI: uint32Value(uint32(s.conf.radius() / time.Microsecond)),
+		tagMIDP: uint64Value(toMicros(now)),
+		tagROOT: tree.root(),
+	}.encode()
+	if err != nil {
+		return err
+	}
+	sig := ed25519.Sign(s.onlineKey, append([]byte(responseSigContext), srep...))
+	for i, req := range batch {
+		reply, err := message{
+			tagSIG:  sig,
+			tagPATH: tree.path(i),
+			tagSREP: srep,
+			tagCERT: s.cert,
+			tagINDX: uint32Value(uint32(i)),
+		}.encode()
+		if err != nil {
+			return err
+		}
+		if _, err = s.packetConn.WriteToUDP(reply, req.addr); err != nil {
+			logrus.WithField("prefix", "roughtime.server").
+				Warnf("failed to write to [%s]: %v", req.addr, err)
+		}
+	}
+	return nil
+}
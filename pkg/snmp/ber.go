@@ -0,0 +1,287 @@
+package snmp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The subset of BER (X.690) SNMP messages use: definite lengths and
+// single-octet tags.
+
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagNull        = 0x05
+	tagOID         = 0x06
+	tagSequence    = 0x30
+	tagIPAddress   = 0x40
+	tagCounter32   = 0x41
+	tagGauge32     = 0x42
+	tagTimeTicks   = 0x43
+	tagOpaque      = 0x44
+	tagCounter64   = 0x46
+
+	tagNoSuchObject   = 0x80
+	tagNoSuchInstance = 0x81
+	tagEndOfMibView   = 0x82
+)
+
+// OID is an object identifier.
+type OID []uint32
+
+// ParseOID parses a dotted OID such as 1.3.6.1 or .1.3.6.1.
+func ParseOID(s string) (OID, error) {
+	s = strings.TrimPrefix(s, ".")
+	if s == "" {
+		return nil, fmt.Errorf("empty oid")
+	}
+	parts := strings.Split(s, ".")
+	o := make(OID, len(parts))
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid oid [%s]: %v", s, err)
+		}
+		o[i] = uint32(n)
+	}
+	if len(o) < 2 || o[0] > 2 || (o[0] < 2 && o[1] >= 40) {
+		return nil, fmt.Errorf("invalid oid [%s]", s)
+	}
+	return o, nil
+}
+
+// MustParseOID is ParseOID for constant OIDs, panicking on error.
+func MustParseOID(s string) OID {
+	o, err := ParseOID(s)
+	if err != nil {
+		panic(err)
+	}
+	return o
+}
+
+func (o OID) String() string {
+	var b strings.Builder
+	for _, n := range o {
+		b.WriteByte('.')
+		b.WriteString(strconv.FormatUint(uint64(n), 10))
+	}
+	return b.String()
+}
+
+func (o OID) Equal(other OID) bool {
+	if len(o) != len(other) {
+		return false
+	}
+	for i := range o {
+		if o[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare orders OIDs lexicographically, returning -1, 0 or 1.
+func (o OID) Compare(other OID) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		switch {
+		case o[i] < other[i]:
+			return -1
+		case o[i] > other[i]:
+			return 1
+		}
+	}
+	switch {
+	case len(o) < len(other):
+		return -1
+	case len(o) > len(other):
+		return 1
+	}
+	return 0
+}
+
+// HasPrefix tells whether o is prefix or in its subtree.
+func (o OID) HasPrefix(prefix OID) bool {
+	return len(o) >= len(prefix) && o[:len(prefix)].Equal(prefix)
+}
+
+// Append returns the OID o followed by the sub-identifiers ids.
+func (o OID) Append(ids ...uint32) OID {
+	return append(append(make(OID, 0, len(o)+len(ids)), o...), ids...)
+}
+
+func appendLength(b []byte, n int) []byte {
+	switch {
+	case n < 0x80:
+		return append(b, byte(n))
+	case n <= 0xff:
+		return append(b, 0x81, byte(n))
+	case n <= 0xffff:
+		return append(b, 0x82, byte(n>>8), byte(n))
+	}
+	return append(b, 0x83, byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendTLV(b []byte, tag byte, v []byte) []byte {
+	b = appendLength(append(b, tag), len(v))
+	return append(b, v...)
+}
+
+func appendInt(b []byte, tag byte, v int64) []byte {
+	n := 1
+	for n < 8 && (v>>(8*n-1) != 0 && v>>(8*n-1) != -1) {
+		n++
+	}
+	b = append(b, tag, byte(n))
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*i)))
+	}
+	return b
+}
+
+func appendUint(b []byte, tag byte, v uint64) []byte {
+	n := 1
+	for n < 9 && v>>(8*n-1) != 0 {
+		n++
+	}
+	b = append(b, tag, byte(n))
+	for i := n - 1; i >= 0; i-- {
+		if i < 8 {
+			b = append(b, byte(v>>(8*i)))
+		} else {
+			b = append(b, 0)
+		}
+	}
+	return b
+}
+
+func appendOID(b []byte, o OID) ([]byte, error) {
+	if len(o) < 2 || o[0] > 2 || (o[0] < 2 && o[1] >= 40) {
+		return nil, fmt.Errorf("invalid oid [%s]", o)
+	}
+	v := appendSubID(nil, o[0]*40+o[1])
+	for _, n := range o[2:] {
+		v = appendSubID(v, n)
+	}
+	return appendTLV(b, tagOID, v), nil
+}
+
+func appendSubID(b []byte, n uint32) []byte {
+	var tmp [5]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(n & 0x7f)
+	for n >>= 7; n > 0; n >>= 7 {
+		i--
+		tmp[i] = byte(n&0x7f) | 0x80
+	}
+	return append(b, tmp[i:]...)
+}
+
+// readTLV splits the first TLV off b. v and rest are subslices of b, so
+// the offset of v in a message is cap(message) - cap(v).
+func readTLV(b []byte) (tag byte, v, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, fmt.Errorf("truncated ber element")
+	}
+	tag, n := b[0], int(b[1])
+	b = b[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 3 || len(b) < size {
+			return 0, nil, nil, fmt.Errorf("invalid ber length")
+		}
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+		b = b[size:]
+	}
+	if len(b) < n {
+		return 0, nil, nil, fmt.Errorf("truncated ber element")
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+// expectTLV splits the first TLV off b, checking its tag.
+func expectTLV(b []byte, tag byte) (v, rest []byte, err error) {
+	t, v, rest, err := readTLV(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t != tag {
+		return nil, nil, fmt.Errorf("unexpected ber tag 0x%02x, expect 0x%02x",
+			t, tag)
+	}
+	return v, rest, nil
+}
+
+// expectLastTLV is expectTLV for the last element of b.
+func expectLastTLV(b []byte, tag byte) ([]byte, error) {
+	v, _, err := expectTLV(b, tag)
+	return v, err
+}
+
+func parseInt(v []byte) (int64, error) {
+	if len(v) == 0 || len(v) > 8 {
+		return 0, fmt.Errorf("invalid ber integer size %d", len(v))
+	}
+	n := int64(int8(v[0]))
+	for _, c := range v[1:] {
+		n = n<<8 | int64(c)
+	}
+	return n, nil
+}
+
+func parseUint(v []byte) (uint64, error) {
+	if len(v) == 0 || len(v) > 9 || (len(v) == 9 && v[0] != 0) {
+		return 0, fmt.Errorf("invalid ber unsigned size %d", len(v))
+	}
+	var n uint64
+	for _, c := range v {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+func expectInt(b []byte) (int64, []byte, error) {
+	v, rest, err := expectTLV(b, tagInteger)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := parseInt(v)
+	return n, rest, err
+}
+
+func parseOID(v []byte) (OID, error) {
+	if len(v) == 0 {
+		return nil, fmt.Errorf("empty oid")
+	}
+	var o OID
+	var n uint32
+	for i, c := range v {
+		if n > 0x1ffffff {
+			return nil, fmt.Errorf("oid sub-identifier overflow")
+		}
+		n = n<<7 | uint32(c&0x7f)
+		if c&0x80 != 0 {
+			if i == len(v)-1 {
+				return nil, fmt.Errorf("truncated oid")
+			}
+			continue
+		}
+		if o == nil {
+			switch {
+			case n < 40:
+				o = OID{0, n}
+			case n < 80:
+				o = OID{1, n - 40}
+			default:
+				o = OID{2, n - 80}
+			}
+		} else {
+			o = append(o, n)
+		}
+		n = 0
+	}
+	return o, nil
+}
@@ -0,0 +1,234 @@
+package snmp
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+)
+
+const (
+	defaultPort        = 162
+	defaultCommunity   = "public"
+	defaultTimeout     = 2 * time.Second
+	defaultRetries     = 3
+	defaultEngineBoots = 1
+
+	// enterpriseNumber is the IANA number the default engine IDs are
+	// derived under, that of the OIDs of the validater.
+	enterpriseNumber = 326
+)
+
+type Config struct {
+	// Address is the host of the manager, with port 162 by default.
+	Address string
+	// Version is V2c, the default, or V3.
+	Version Version
+	// Community is the v2c community, "public" by default.
+	Community string
+	// User is the v3 user the notifications are sent as.
+	User *User
+	// EngineID is the engine ID of the sender, authoritative for its v3
+	// traps: managers receiving them localize the keys of User to it. It
+	// defaults to one derived from the host name.
+	EngineID []byte
+	// EngineBoots counts the restarts of the sender engine, 1 by default.
+	// A sender restarted with the same EngineID must increase it, or the
+	// managers drop its authenticated traps as outside of the time window
+	// until its engine time catches up with the one they cached.
+	EngineBoots int32
+	// EngineBootsFile keeps the engine boots across restarts in place of
+	// EngineBoots: NewSender increments the count it holds, none if the
+	// file is missing. Authenticated v3 traps require one of the two.
+	EngineBootsFile string
+	ContextName     string
+	// Inform sends InformRequests, which the manager acknowledges, rather
+	// than traps. An unacknowledged inform is retransmitted Retries times,
+	// 3 by default and none if negative, Timeout apart, 2 seconds by
+	// default.
+	Inform  bool
+	Timeout time.Duration
+	Retries int
+	// Clock times sysUpTime and the engine times. It defaults to the
+	// system clock. The Timeout of informs runs on the system clock
+	// regardless.
+	Clock clock.Clock
+}
+
+func (conf *Config) Check() error {
+	if conf.Address == "" {
+		return fmt.Errorf("snmp manager address not set")
+	}
+	switch conf.version() {
+	case V2c:
+	case V3:
+		if conf.User == nil {
+			return fmt.Errorf("snmp v3 user not set")
+		}
+		if err := conf.User.Check(); err != nil {
+			return err
+		}
+		if conf.User.Auth != NoAuth && !conf.Inform &&
+			conf.EngineBoots <= 0 && conf.EngineBootsFile == "" {
+			return fmt.Errorf("engine boots of authenticated traps not set")
+		}
+	default:
+		return fmt.Errorf("unsupported snmp version %d", conf.Version)
+	}
+	return checkEngineID(conf.EngineID)
+}
+
+func (conf *Config) version() Version {
+	if conf.Version == 0 {
+		return V2c
+	}
+	return conf.Version
+}
+
+func (conf *Config) address() string {
+	if _, _, err := net.SplitHostPort(conf.Address); err != nil {
+		return net.JoinHostPort(conf.Address, fmt.Sprint(defaultPort))
+	}
+	return conf.Address
+}
+
+func (conf *Config) community() string {
+	if conf.Community == "" {
+		return defaultCommunity
+	}
+	return conf.Community
+}
+
+// engineBoots returns the engine boots of a new sender, incremented in
+// EngineBootsFile if set.
+func (conf *Config) engineBoots() (int32, error) {
+	if conf.EngineBootsFile != "" {
+		return nextEngineBoots(conf.EngineBootsFile)
+	}
+	if conf.EngineBoots <= 0 {
+		return defaultEngineBoots, nil
+	}
+	return conf.EngineBoots, nil
+}
+
+func (conf *Config) timeout() time.Duration {
+	if conf.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return conf.Timeout
+}
+
+func (conf *Config) retries() int {
+	switch {
+	case conf.Retries < 0:
+		return 0
+	case conf.Retries == 0:
+		return defaultRetries
+	}
+	return conf.Retries
+}
+
+type ReceiverConfig struct {
+	// Addr defaults to ":162".
+	Addr string
+	// Community is the v2c community accepted, "public" by default.
+	Community string
+	// Users are the v3 users accepted, each at its own security level.
+	Users []*User
+	// EngineID is the engine ID of the receiver, authoritative for the v3
+	// informs it receives. It defaults to one derived from the host name.
+	EngineID []byte
+	// Handler is called with each notification received, in turn.
+	Handler func(*Notification)
+	// Clock times the engine time. It defaults to the system clock.
+	Clock clock.Clock
+}
+
+func (conf *ReceiverConfig) Check() error {
+	if conf.Handler == nil {
+		return fmt.Errorf("notification handler not set")
+	}
+	names := make(map[string]bool)
+	for _, u := range conf.Users {
+		if err := u.Check(); err != nil {
+			return err
+		}
+		if names[u.Name] {
+			return fmt.Errorf("user [%s] duplicated", u.Name)
+		}
+		names[u.Name] = true
+	}
+	return checkEngineID(conf.EngineID)
+}
+
+func (conf *ReceiverConfig) addr() string {
+	if conf.Addr == "" {
+		return fmt.Sprintf(":%d", defaultPort)
+	}
+	return conf.Addr
+}
+
+func (conf *ReceiverConfig) community() string {
+	if conf.Community == "" {
+		return defaultCommunity
+	}
+	return conf.Community
+}
+
+func checkEngineID(id []byte) error {
+	if id != nil && (len(id) < 5 || len(id) > 32) {
+		return fmt.Errorf("engine id size %d not in [5, 32]", len(id))
+	}
+	return nil
+}
+
+// defaultEngineID returns the engine ID of the host in the text format of
+// RFC 3411, or id if set.
+func defaultEngineID(id []byte) []byte {
+	if id != nil {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	if len(host) > 27 {
+		host = host[:27]
+	}
+	return append([]byte{0x80, 0, enterpriseNumber >> 8, enterpriseNumber & 0xff,
+		4}, host...)
+}
+
+// nextEngineBoots increments the engine boots held in path and returns
+// them. The count latches at 2147483647, as in RFC 3414.
+func nextEngineBoots(path string) (int32, error) {
+	var boots int64
+	b, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return 0, fmt.Errorf("failed to read engine boots file [%s]: %v", path, err)
+	default:
+		boots, err = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 32)
+		if err != nil || boots < 0 {
+			return 0, fmt.Errorf("invalid engine boots file [%s]", path)
+		}
+	}
+	if boots < math.MaxInt32 {
+		boots++
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, []byte(strconv.FormatInt(boots, 10)+"\n"),
+		0644); err != nil {
+		return 0, fmt.Errorf("failed to write engine boots file [%s]: %v", path, err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return 0, fmt.Errorf("failed to write engine boots file [%s]: %v", path, err)
+	}
+	return int32(boots), nil
+}
@@ -0,0 +1,426 @@
+package snmp
+
+import (
+	"fmt"
+	"net"
+)
+
+// Version is the SNMP message version.
+type Version int
+
+const (
+	V2c Version = 1
+	V3  Version = 3
+)
+
+func (v Version) String() string {
+	switch v {
+	case V2c:
+		return "v2c"
+	case V3:
+		return "v3"
+	}
+	return fmt.Sprintf("Version(%d)", int(v))
+}
+
+// PDUType is the tag of a PDU.
+type PDUType byte
+
+const (
+	GetRequest     PDUType = 0xa0
+	GetNextRequest PDUType = 0xa1
+	Response       PDUType = 0xa2
+	SetRequest     PDUType = 0xa3
+	GetBulkRequest PDUType = 0xa5
+	InformRequest  PDUType = 0xa6
+	SNMPv2Trap     PDUType = 0xa7
+	Report         PDUType = 0xa8
+)
+
+// The application types of varbind values. Integer values are int, OCTET
+// STRING []byte or string, OBJECT IDENTIFIER OID, IpAddress net.IP and
+// NULL nil.
+type (
+	Counter32 uint32
+	Gauge32   uint32
+	TimeTicks uint32
+	Counter64 uint64
+)
+
+// Exception is the value of a varbind an agent has no value for.
+type Exception byte
+
+const (
+	NoSuchObject   Exception = tagNoSuchObject
+	NoSuchInstance Exception = tagNoSuchInstance
+	EndOfMibView   Exception = tagEndOfMibView
+)
+
+func (e Exception) String() string {
+	switch e {
+	case NoSuchObject:
+		return "noSuchObject"
+	case NoSuchInstance:
+		return "noSuchInstance"
+	case EndOfMibView:
+		return "endOfMibView"
+	}
+	return fmt.Sprintf("Exception(0x%02x)", byte(e))
+}
+
+var (
+	// sysUpTime.0 and snmpTrapOID.0 lead the varbinds of a notification.
+	sysUpTimeOID   = MustParseOID(".1.3.6.1.2.1.1.3.0")
+	snmpTrapOIDOID = MustParseOID(".1.3.6.1.6.3.1.1.4.1.0")
+)
+
+// Varbind binds a value to an OID.
+type Varbind struct {
+	OID   OID
+	Value interface{}
+}
+
+func appendVarbind(b []byte, vb *Varbind) ([]byte, error) {
+	v, err := appendOID(nil, vb.OID)
+	if err != nil {
+		return nil, err
+	}
+	switch x := vb.Value.(type) {
+	case nil:
+		v = append(v, tagNull, 0)
+	case int:
+		v = appendInt(v, tagInteger, int64(x))
+	case []byte:
+		v = appendTLV(v, tagOctetString, x)
+	case string:
+		v = appendTLV(v, tagOctetString, []byte(x))
+	case OID:
+		if v, err = appendOID(v, x); err != nil {
+			return nil, err
+		}
+	case net.IP:
+		ip := x.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("ip address [%s] not ipv4", x)
+		}
+		v = appendTLV(v, tagIPAddress, ip)
+	case Counter32:
+		v = appendUint(v, tagCounter32, uint64(x))
+	case Gauge32:
+		v = appendUint(v, tagGauge32, uint64(x))
+	case TimeTicks:
+		v = appendUint(v, tagTimeTicks, uint64(x))
+	case Counter64:
+		v = appendUint(v, tagCounter64, uint64(x))
+	case Exception:
+		v = append(v, byte(x), 0)
+	default:
+		return nil, fmt.Errorf("unsupported value type %T of [%s]", x, vb.OID)
+	}
+	return appendTLV(b, tagSequence, v), nil
+}
+
+// parseVarbind parses the content of a varbind sequence.
+func parseVarbind(v []byte) (Varbind, error) {
+	var vb Varbind
+	o, v, err := expectTLV(v, tagOID)
+	if err != nil {
+		return vb, err
+	}
+	if vb.OID, err = parseOID(o); err != nil {
+		return vb, err
+	}
+	tag, x, _, err := readTLV(v)
+	if err != nil {
+		return vb, err
+	}
+	switch tag {
+	case tagNull:
+	case tagNoSuchObject, tagNoSuchInstance, tagEndOfMibView:
+		vb.Value = Exception(tag)
+	case tagInteger:
+		var n int64
+		n, err = parseInt(x)
+		vb.Value = int(n)
+	case tagOctetString, tagOpaque:
+		vb.Value = append([]byte(nil), x...)
+	case tagOID:
+		vb.Value, err = parseOID(x)
+	case tagIPAddress:
+		if len(x) != net.IPv4len {
+			return vb, fmt.Errorf("invalid ip address size %d", len(x))
+		}
+		vb.Value = net.IP(append([]byte(nil), x...))
+	case tagCounter32, tagGauge32, tagTimeTicks, tagCounter64:
+		var n uint64
+		if n, err = parseUint(x); err != nil {
+			break
+		}
+		if tag != tagCounter64 && n > 0xffffffff {
+			return vb, fmt.Errorf("32 bits value overflow of [%s]", vb.OID)
+		}
+		switch tag {
+		case tagCounter32:
+			vb.Value = Counter32(n)
+		case tagGauge32:
+			vb.Value = Gauge32(n)
+		case tagTimeTicks:
+			vb.Value = TimeTicks(n)
+		default:
+			vb.Value = Counter64(n)
+		}
+	default:
+		return vb, fmt.Errorf("unsupported value tag 0x%02x of [%s]", tag, vb.OID)
+	}
+	return vb, err
+}
+
+// PDU is a protocol data unit of SNMPv2.
+type PDU struct {
+	Type        PDUType
+	RequestID   int32
+	ErrorStatus int
+	ErrorIndex  int
+	Varbinds    []Varbind
+}
+
+func (p *PDU) append(b []byte) ([]byte, error) {
+	v := appendInt(nil, tagInteger, int64(p.RequestID))
+	v = appendInt(v, tagInteger, int64(p.ErrorStatus))
+	v = appendInt(v, tagInteger, int64(p.ErrorIndex))
+	var vbs []byte
+	for i := range p.Varbinds {
+		var err error
+		if vbs, err = appendVarbind(vbs, &p.Varbinds[i]); err != nil {
+			return nil, err
+		}
+	}
+	v = appendTLV(v, tagSequence, vbs)
+	return appendTLV(b, byte(p.Type), v), nil
+}
+
+// response returns the Response acknowledging p.
+func (p *PDU) response() *PDU {
+	return &PDU{Type: Response, RequestID: p.RequestID, Varbinds: p.Varbinds}
+}
+
+func parsePDU(b []byte) (*PDU, error) {
+	tag, v, _, err := readTLV(b)
+	if err != nil {
+		return nil, err
+	}
+	p := &PDU{Type: PDUType(tag)}
+	if tag&0xe0 != 0xa0 {
+		return nil, fmt.Errorf("unexpected pdu tag 0x%02x", tag)
+	}
+	var n int64
+	if n, v, err = expectInt(v); err != nil {
+		return nil, err
+	}
+	p.RequestID = int32(n)
+	if n, v, err = expectInt(v); err != nil {
+		return nil, err
+	}
+	p.ErrorStatus = int(n)
+	if n, v, err = expectInt(v); err != nil {
+		return nil, err
+	}
+	p.ErrorIndex = int(n)
+	if v, err = expectLastTLV(v, tagSequence); err != nil {
+		return nil, err
+	}
+	for len(v) > 0 {
+		var x []byte
+		if x, v, err = expectTLV(v, tagSequence); err != nil {
+			return nil, err
+		}
+		vb, err := parseVarbind(x)
+		if err != nil {
+			return nil, err
+		}
+		p.Varbinds = append(p.Varbinds, vb)
+	}
+	return p, nil
+}
+
+// Message flags and security model of SNMPv3.
+const (
+	flagAuth       = 0x01
+	flagPriv       = 0x02
+	flagReportable = 0x04
+
+	securityModelUSM = 3
+
+	maxMessageSize = 65507
+)
+
+// message is an SNMP message. The v2c community or the v3 header is set
+// depending on version; data is the PDU in v2c, the scoped PDU or its
+// ciphertext in v3.
+type message struct {
+	version   Version
+	community string
+
+	msgID    int32
+	maxSize  int
+	flags    byte
+	security usmParams
+	data     []byte
+}
+
+// usmParams are the security parameters of the user-based security model.
+type usmParams struct {
+	engineID    []byte
+	engineBoots int32
+	engineTime  int32
+	userName    string
+	authParams  []byte
+	privParams  []byte
+}
+
+func (m *message) encode() []byte {
+	v := appendInt(nil, tagInteger, int64(m.version))
+	if m.version != V3 {
+		v = appendTLV(v, tagOctetString, []byte(m.community))
+		return appendTLV(nil, tagSequence, append(v, m.data...))
+	}
+	h := appendInt(nil, tagInteger, int64(m.msgID))
+	h = appendInt(h, tagInteger, int64(m.maxSize))
+	h = appendTLV(h, tagOctetString, []byte{m.flags})
+	h = appendInt(h, tagInteger, securityModelUSM)
+	v = appendTLV(v, tagSequence, h)
+
+	s := appendTLV(nil, tagOctetString, m.security.engineID)
+	s = appendInt(s, tagInteger, int64(m.security.engineBoots))
+	s = appendInt(s, tagInteger, int64(m.security.engineTime))
+	s = appendTLV(s, tagOctetString, []byte(m.security.userName))
+	s = appendTLV(s, tagOctetString, m.security.authParams)
+	s = appendTLV(s, tagOctetString, m.security.privParams)
+	v = appendTLV(v, tagOctetString, appendTLV(nil, tagSequence, s))
+	return appendTLV(nil, tagSequence, append(v, m.data...))
+}
+
+// decodeMessage decodes b, whose slices the fields of the message share.
+func decodeMessage(b []byte) (*message, error) {
+	v, err := expectLastTLV(b, tagSequence)
+	if err != nil {
+		return nil, err
+	}
+	m := &message{}
+	var n int64
+	if n, v, err = expectInt(v); err != nil {
+		return nil, err
+	}
+	m.version = Version(n)
+	switch m.version {
+	case V2c:
+		var c []byte
+		if c, v, err = expectTLV(v, tagOctetString); err != nil {
+			return nil, err
+		}
+		m.community, m.data = string(c), v
+		return m, nil
+	case V3:
+	default:
+		return nil, fmt.Errorf("unsupported snmp version %d", n)
+	}
+
+	h, v, err := expectTLV(v, tagSequence)
+	if err != nil {
+		return nil, err
+	}
+	if n, h, err = expectInt(h); err != nil {
+		return nil, err
+	}
+	m.msgID = int32(n)
+	if n, h, err = expectInt(h); err != nil {
+		return nil, err
+	}
+	m.maxSize = int(n)
+	flags, h, err := expectTLV(h, tagOctetString)
+	if err != nil {
+		return nil, err
+	}
+	if len(flags) != 1 {
+		return nil, fmt.Errorf("invalid message flags size %d", len(flags))
+	}
+	m.flags = flags[0]
+	if n, _, err = expectInt(h); err != nil {
+		return nil, err
+	}
+	if n != securityModelUSM {
+		return nil, fmt.Errorf("unsupported security model %d", n)
+	}
+
+	s, v, err := expectTLV(v, tagOctetString)
+	if err != nil {
+		return nil, err
+	}
+	if s, err = expectLastTLV(s, tagSequence); err != nil {
+		return nil, err
+	}
+	sec := &m.security
+	if sec.engineID, s, err = expectTLV(s, tagOctetString); err != nil {
+		return nil, err
+	}
+	if n, s, err = expectInt(s); err != nil {
+		return nil, err
+	}
+	sec.engineBoots = int32(n)
+	if n, s, err = expectInt(s); err != nil {
+		return nil, err
+	}
+	sec.engineTime = int32(n)
+	var user []byte
+	if user, s, err = expectTLV(s, tagOctetString); err != nil {
+		return nil, err
+	}
+	sec.userName = string(user)
+	if sec.authParams, s, err = expectTLV(s, tagOctetString); err != nil {
+		return nil, err
+	}
+	if sec.privParams, err = expectLastTLV(s, tagOctetString); err != nil {
+		return nil, err
+	}
+	m.data = v
+	return m, nil
+}
+
+// scopedPDU is the PDU of an SNMPv3 message with its context.
+type scopedPDU struct {
+	contextEngineID []byte
+	contextName     string
+	pdu             *PDU
+}
+
+func (sp *scopedPDU) encode() ([]byte, error) {
+	v := appendTLV(nil, tagOctetString, sp.contextEngineID)
+	v = appendTLV(v, tagOctetString, []byte(sp.contextName))
+	v, err := sp.pdu.append(v)
+	if err != nil {
+		return nil, err
+	}
+	return appendTLV(nil, tagSequence, v), nil
+}
+
+// parseScopedPDU parses the scoped PDU leading b, ignoring the padding a
+// block cipher may leave after it.
+func parseScopedPDU(b []byte) (*scopedPDU, error) {
+	v, _, err := expectTLV(b, tagSequence)
+	if err != nil {
+		return nil, err
+	}
+	sp := &scopedPDU{}
+	if sp.contextEngineID, v, err = expectTLV(v, tagOctetString); err != nil {
+		return nil, err
+	}
+	name, v, err := expectTLV(v, tagOctetString)
+	if err != nil {
+		return nil, err
+	}
+	sp.contextName = string(name)
+	if sp.pdu, err = parsePDU(v); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
@@ -0,0 +1,310 @@
+package snmp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+)
+
+// Notification is a trap or an inform received.
+type Notification struct {
+	Addr    net.Addr
+	Version Version
+	// Community is the v2c community and User the v3 user name.
+	Community string
+	User      string
+	// Inform is set for an InformRequest, which the receiver acknowledged.
+	Inform  bool
+	Uptime  TimeTicks
+	TrapOID OID
+	// Varbinds are those following sysUpTime.0 and snmpTrapOID.0.
+	Varbinds []Varbind
+}
+
+// Receiver is a notification receiver, a minimal manager accepting the
+// notifications of a Sender. It is the authoritative engine of the v3
+// informs it acknowledges.
+type Receiver struct {
+	conf     *ReceiverConfig
+	engineID []byte
+	clock    clock.Clock
+	start    time.Time
+	users    map[string]*usmUser
+	salt     uint64
+
+	conn   *net.UDPConn
+	closed chan struct{}
+}
+
+func NewReceiver(conf *ReceiverConfig) (*Receiver, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("failed to check snmp receiver config: %v", err)
+	}
+	c := clock.Or(conf.Clock)
+	r := &Receiver{
+		conf:     conf,
+		engineID: defaultEngineID(conf.EngineID),
+		clock:    c,
+		start:    c.Now(),
+		users:    make(map[string]*usmUser),
+		closed:   make(chan struct{}),
+	}
+	for _, u := range conf.Users {
+		r.users[u.Name] = newUSMUser(u)
+	}
+	return r, nil
+}
+
+// EngineID returns the engine ID of the receiver.
+func (r *Receiver) EngineID() []byte {
+	return r.engineID
+}
+
+func (r *Receiver) Listen() error {
+	laddr, err := net.ResolveUDPAddr("udp", r.conf.addr())
+	if err != nil {
+		return fmt.Errorf("failed to resolve udp addr [%s]: %v",
+			r.conf.addr(), err)
+	}
+	if r.conn, err = net.ListenUDP("udp", laddr); err != nil {
+		return fmt.Errorf("failed to listen udp addr [%s]: %v", laddr, err)
+	}
+	return nil
+}
+
+// Addr returns the address of the receiver, or nil if not listening.
+func (r *Receiver) Addr() net.Addr {
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.LocalAddr()
+}
+
+func (r *Receiver) Start() chan error {
+	errChan := make(chan error, 1)
+	if r.conn == nil {
+		if err := r.Listen(); err != nil {
+			errChan <- err
+			return errChan
+		}
+	}
+	go func() {
+		errChan <- r.serve()
+	}()
+	return errChan
+}
+
+func (r *Receiver) Close() error {
+	select {
+	case <-r.closed:
+		return nil
+	default:
+	}
+	close(r.closed)
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.Close()
+}
+
+func (r *Receiver) serve() error {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, raddr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-r.closed:
+				return nil
+			default:
+				return fmt.Errorf("failed to read udp packet: %v", err)
+			}
+		}
+		if err = r.handle(buf[:n:n], raddr); err != nil {
+			logrus.WithField("prefix", "snmp.receiver").
+				Debugf("drop message from [%s]: %v", raddr, err)
+		}
+	}
+}
+
+func (r *Receiver) handle(b []byte, raddr *net.UDPAddr) error {
+	m, err := decodeMessage(b)
+	if err != nil {
+		return err
+	}
+	if m.version == V3 {
+		return r.handleV3(b, m, raddr)
+	}
+	if m.community != r.conf.community() {
+		return fmt.Errorf("unknown community")
+	}
+	pdu, err := parsePDU(m.data)
+	if err != nil {
+		return err
+	}
+	if err = r.notify(raddr, m, "", pdu); err != nil {
+		return err
+	}
+	if pdu.Type != InformRequest {
+		return nil
+	}
+	if m.data, err = pdu.response().append(nil); err != nil {
+		return err
+	}
+	return r.send(m.encode(), raddr)
+}
+
+func (r *Receiver) handleV3(b []byte, m *message, raddr *net.UDPAddr) error {
+	sec := &m.security
+	if len(sec.engineID) == 0 {
+		// discovery, reported in clear
+		if m.flags&(flagAuth|flagPriv) != 0 || m.flags&flagReportable == 0 {
+			return fmt.Errorf("invalid discovery flags 0x%02x", m.flags)
+		}
+		sp, err := parseScopedPDU(m.data)
+		if err != nil {
+			return err
+		}
+		return r.report(m, sp.pdu.RequestID, usmStatsUnknownEngineIDs, nil,
+			raddr)
+	}
+	u, ok := r.users[sec.userName]
+	if !ok {
+		return fmt.Errorf("unknown user [%s]", sec.userName)
+	}
+	if m.flags&(flagAuth|flagPriv) != u.flags() {
+		return fmt.Errorf("security level 0x%02x unsupported by user [%s]",
+			m.flags, u.Name)
+	}
+	sp, err := unseal(b, m, u, u.keys(sec.engineID))
+	if err != nil {
+		return err
+	}
+	pdu := sp.pdu
+	if pdu.Type == InformRequest {
+		// the receiver is authoritative for informs (RFC 3414 3.2.7)
+		if !bytes.Equal(sec.engineID, r.engineID) {
+			return r.report(m, pdu.RequestID, usmStatsUnknownEngineIDs, nil,
+				raddr)
+		}
+		if d := sec.engineTime - r.engineTime(); sec.engineBoots != r.engineBoots() ||
+			d > timeWindow || d < -timeWindow {
+			return r.report(m, pdu.RequestID, usmStatsNotInTimeWindows, u,
+				raddr)
+		}
+	}
+	if err = r.notify(raddr, m, u.Name, pdu); err != nil {
+		return err
+	}
+	if pdu.Type != InformRequest {
+		return nil
+	}
+	resp := r.reply(m, u.flags())
+	b, err = seal(resp, &scopedPDU{
+		contextEngineID: sp.contextEngineID,
+		contextName:     sp.contextName,
+		pdu:             pdu.response(),
+	}, u, u.keys(r.engineID), r.nextSalt())
+	if err != nil {
+		return err
+	}
+	return r.send(b, raddr)
+}
+
+// report answers the request of m with a report of oid, authenticated
+// with u if not nil.
+func (r *Receiver) report(m *message, requestID int32, oid OID, u *usmUser,
+	raddr *net.UDPAddr) error {
+	var flags byte
+	var k *usmKeys
+	if u != nil {
+		flags, k = flagAuth, u.keys(r.engineID)
+	}
+	resp := r.reply(m, flags)
+	b, err := seal(resp, &scopedPDU{
+		contextEngineID: r.engineID,
+		pdu: &PDU{
+			Type:      Report,
+			RequestID: requestID,
+			Varbinds:  []Varbind{{OID: oid, Value: Counter32(1)}},
+		},
+	}, u, k, r.nextSalt())
+	if err != nil {
+		return err
+	}
+	return r.send(b, raddr)
+}
+
+// reply returns the header of a reply to m, with the security parameters
+// of the receiver engine.
+func (r *Receiver) reply(m *message, flags byte) *message {
+	return &message{
+		version: V3,
+		msgID:   m.msgID,
+		maxSize: maxMessageSize,
+		flags:   flags,
+		security: usmParams{
+			engineID:    r.engineID,
+			engineBoots: r.engineBoots(),
+			engineTime:  r.engineTime(),
+			userName:    m.security.userName,
+		},
+	}
+}
+
+func (r *Receiver) notify(raddr *net.UDPAddr, m *message, user string,
+	pdu *PDU) error {
+	if pdu.Type != SNMPv2Trap && pdu.Type != InformRequest {
+		return fmt.Errorf("unexpected pdu 0x%02x", byte(pdu.Type))
+	}
+	vbs := pdu.Varbinds
+	if len(vbs) < 2 || !vbs[0].OID.Equal(sysUpTimeOID) ||
+		!vbs[1].OID.Equal(snmpTrapOIDOID) {
+		return fmt.Errorf("notification without sysUpTime.0 and snmpTrapOID.0")
+	}
+	uptime, _ := vbs[0].Value.(TimeTicks)
+	trapOID, ok := vbs[1].Value.(OID)
+	if !ok {
+		return fmt.Errorf("snmpTrapOID.0 not an oid")
+	}
+	n := &Notification{
+		Addr:     raddr,
+		Version:  m.version,
+		User:     user,
+		Inform:   pdu.Type == InformRequest,
+		Uptime:   uptime,
+		TrapOID:  trapOID,
+		Varbinds: vbs[2:],
+	}
+	if m.version == V2c {
+		n.Community = m.community
+	}
+	r.conf.Handler(n)
+	return nil
+}
+
+func (r *Receiver) send(b []byte, raddr *net.UDPAddr) error {
+	if _, err := r.conn.WriteToUDP(b, raddr); err != nil {
+		return fmt.Errorf("failed to write reply: %v", err)
+	}
+	return nil
+}
+
+func (r *Receiver) engineBoots() int32 {
+	return defaultEngineBoots
+}
+
+func (r *Receiver) engineTime() int32 {
+	return int32(r.clock.Since(r.start) / time.Second)
+}
+
+func (r *Receiver) nextSalt() uint64 {
+	r.salt++
+	return r.salt
+}
@@ -0,0 +1,374 @@
+package snmp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+)
+
+// errNoReply is the timeout of a single attempt of an exchange.
+var errNoReply = errors.New("no reply")
+
+// Sender sends SNMPv2c or SNMPv3 notifications to one manager. It is safe
+// for concurrent use, notifications being serialized.
+type Sender struct {
+	conf     *Config
+	engineID []byte
+	boots    int32
+	user     *usmUser
+	clock    clock.Clock
+	start    time.Time
+
+	mu        sync.Mutex
+	conn      *net.UDPConn
+	requestID int32
+	msgID     int32
+	salt      uint64
+	// the engine of the manager, authoritative for informs, and when its
+	// time was learnt
+	remoteEngineID []byte
+	remoteBoots    int32
+	remoteTime     int32
+	remoteTimeAt   time.Time
+}
+
+func NewSender(conf *Config) (*Sender, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("failed to check snmp config: %v", err)
+	}
+	var seed [16]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return nil, fmt.Errorf("failed to seed request ids: %v", err)
+	}
+	boots, err := conf.engineBoots()
+	if err != nil {
+		return nil, err
+	}
+	c := clock.Or(conf.Clock)
+	s := &Sender{
+		conf:      conf,
+		engineID:  defaultEngineID(conf.EngineID),
+		boots:     boots,
+		clock:     c,
+		start:     c.Now(),
+		requestID: int32(binary.BigEndian.Uint32(seed[:]) >> 1),
+		msgID:     int32(binary.BigEndian.Uint32(seed[4:]) >> 1),
+		salt:      binary.BigEndian.Uint64(seed[8:]),
+	}
+	if conf.version() == V3 {
+		s.user = newUSMUser(conf.User)
+	}
+	return s, nil
+}
+
+// EngineID returns the engine ID of the sender.
+func (s *Sender) EngineID() []byte {
+	return s.engineID
+}
+
+// EngineBoots returns the engine boots of the sender.
+func (s *Sender) EngineBoots() int32 {
+	return s.boots
+}
+
+// Open resolves the manager and binds the socket. It is called by Notify
+// when the sender is not yet open.
+func (s *Sender) Open() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.open()
+}
+
+func (s *Sender) open() error {
+	if s.conn != nil {
+		return nil
+	}
+	raddr, err := net.ResolveUDPAddr("udp", s.conf.address())
+	if err != nil {
+		return fmt.Errorf("failed to resolve udp addr [%s]: %v",
+			s.conf.address(), err)
+	}
+	if s.conn, err = net.DialUDP("udp", nil, raddr); err != nil {
+		return fmt.Errorf("failed to dial udp addr [%s]: %v", raddr, err)
+	}
+	return nil
+}
+
+func (s *Sender) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// Notify sends the notification trapOID with the varbinds vbs, following
+// sysUpTime.0 and snmpTrapOID.0. An inform returns once acknowledged, or
+// with an error once its retransmissions are exhausted.
+func (s *Sender) Notify(ctx context.Context, trapOID OID,
+	vbs ...Varbind) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.open(); err != nil {
+		return err
+	}
+	s.requestID++
+	pdu := &PDU{
+		Type:      SNMPv2Trap,
+		RequestID: s.requestID,
+		Varbinds: append([]Varbind{
+			{OID: sysUpTimeOID, Value: s.uptime()},
+			{OID: snmpTrapOIDOID, Value: trapOID},
+		}, vbs...),
+	}
+	if s.conf.Inform {
+		pdu.Type = InformRequest
+		return s.inform(ctx, pdu)
+	}
+	var b []byte
+	var err error
+	if s.conf.version() == V3 {
+		b, err = s.sealV3(pdu, s.engineID, s.boots,
+			s.engineTime(), s.user.flags())
+	} else {
+		b, err = s.encodeV2c(pdu)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode trap: %v", err)
+	}
+	if _, err = s.conn.Write(b); err != nil {
+		return fmt.Errorf("failed to send trap: %v", err)
+	}
+	return nil
+}
+
+// inform sends pdu until the manager acknowledges it. The retransmissions
+// keep the request ID, so that the manager may spot duplicates.
+func (s *Sender) inform(ctx context.Context, pdu *PDU) error {
+	var err error
+	for i := 0; i <= s.conf.retries(); i++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if s.conf.version() == V3 && s.remoteEngineID == nil {
+			if err = s.discover(ctx); err != nil {
+				continue
+			}
+		}
+		var b []byte
+		if s.conf.version() == V3 {
+			b, err = s.sealV3(pdu, s.remoteEngineID, s.remoteBoots,
+				s.remoteEngineTime(), s.user.flags()|flagReportable)
+		} else {
+			b, err = s.encodeV2c(pdu)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to encode inform: %v", err)
+		}
+		var reply *PDU
+		var m *message
+		if reply, m, err = s.exchange(ctx, b, pdu.RequestID); err != nil {
+			continue
+		}
+		if reply.Type == Response {
+			if reply.ErrorStatus != 0 {
+				return fmt.Errorf("inform rejected with error status %d",
+					reply.ErrorStatus)
+			}
+			return nil
+		}
+		err = s.handleReport(m, reply)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("inform unacknowledged after %d attempts: %v",
+		s.conf.retries()+1, err)
+}
+
+// handleReport updates the view of the manager engine from a report on
+// an inform, for the next attempt.
+func (s *Sender) handleReport(m *message, report *PDU) error {
+	if report.Type != Report || len(report.Varbinds) == 0 {
+		return fmt.Errorf("unexpected pdu 0x%02x", byte(report.Type))
+	}
+	oid := report.Varbinds[0].OID
+	switch {
+	case oid.Equal(usmStatsUnknownEngineIDs):
+		s.remoteEngineID = nil
+	case oid.Equal(usmStatsNotInTimeWindows) && m.flags&flagAuth != 0:
+		s.learnRemoteTime(m)
+	}
+	return fmt.Errorf("manager reported [%s]", oid)
+}
+
+// discover learns the engine ID, boots and time of the manager, which are
+// reported to an unauthenticated request (RFC 3414 4).
+func (s *Sender) discover(ctx context.Context) error {
+	s.msgID++
+	m := &message{
+		version: V3,
+		msgID:   s.msgID,
+		maxSize: maxMessageSize,
+		flags:   flagReportable,
+	}
+	s.requestID++
+	sp := &scopedPDU{pdu: &PDU{Type: GetRequest, RequestID: s.requestID}}
+	b, err := seal(m, sp, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	_, reply, err := s.exchange(ctx, b, sp.pdu.RequestID)
+	if err != nil {
+		return fmt.Errorf("failed to discover manager engine: %v", err)
+	}
+	if len(reply.security.engineID) == 0 {
+		return fmt.Errorf("manager reported no engine id")
+	}
+	s.remoteEngineID = append([]byte(nil), reply.security.engineID...)
+	s.learnRemoteTime(reply)
+	return nil
+}
+
+func (s *Sender) learnRemoteTime(m *message) {
+	s.remoteBoots = m.security.engineBoots
+	s.remoteTime = m.security.engineTime
+	s.remoteTimeAt = s.clock.Now()
+}
+
+// remoteEngineTime estimates the engine time of the manager.
+func (s *Sender) remoteEngineTime() int32 {
+	return s.remoteTime + int32(s.clock.Since(s.remoteTimeAt)/time.Second)
+}
+
+// exchange sends the request b and waits Timeout for its reply, whose
+// PDU has requestID, returning the PDU and, in v3, its message.
+func (s *Sender) exchange(ctx context.Context, b []byte,
+	requestID int32) (*PDU, *message, error) {
+	if _, err := s.conn.Write(b); err != nil {
+		return nil, nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	// Socket deadlines run on the system clock, whatever s.clock is.
+	deadline := time.Now().Add(s.conf.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := s.conn.SetReadDeadline(deadline); err != nil {
+		return nil, nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return nil, nil, errNoReply
+			}
+			return nil, nil, fmt.Errorf("failed to read reply: %v", err)
+		}
+		pdu, m, err := s.parseReply(buf[:n:n])
+		if err != nil || pdu.RequestID != requestID {
+			continue
+		}
+		return pdu, m, nil
+	}
+}
+
+// parseReply authenticates and parses a reply from the manager.
+func (s *Sender) parseReply(b []byte) (*PDU, *message, error) {
+	m, err := decodeMessage(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.version != s.conf.version() {
+		return nil, nil, fmt.Errorf("unexpected version %s", m.version)
+	}
+	if m.version == V2c {
+		if m.community != s.conf.community() {
+			return nil, nil, fmt.Errorf("unexpected community")
+		}
+		pdu, err := parsePDU(m.data)
+		return pdu, m, err
+	}
+	var u *usmUser
+	var k *usmKeys
+	if m.flags&(flagAuth|flagPriv) != 0 {
+		if m.security.userName != s.user.Name ||
+			m.flags&^flagReportable&^s.user.flags() != 0 {
+			return nil, nil, fmt.Errorf("unexpected user or security level")
+		}
+		if s.remoteEngineID != nil &&
+			!bytes.Equal(m.security.engineID, s.remoteEngineID) {
+			return nil, nil, fmt.Errorf("unexpected engine id")
+		}
+		u, k = s.user, s.user.keys(m.security.engineID)
+	}
+	sp, err := unseal(b, m, u, k)
+	if err != nil {
+		return nil, nil, err
+	}
+	// only reports may come below the security level of the user
+	if sp.pdu.Type != Report &&
+		m.flags&(flagAuth|flagPriv) != s.user.flags() {
+		return nil, nil, fmt.Errorf("reply below the security level")
+	}
+	return sp.pdu, m, nil
+}
+
+func (s *Sender) encodeV2c(pdu *PDU) ([]byte, error) {
+	data, err := pdu.append(nil)
+	if err != nil {
+		return nil, err
+	}
+	m := &message{version: V2c, community: s.conf.community(), data: data}
+	return m.encode(), nil
+}
+
+// sealV3 encodes pdu as a v3 message of the user, with the security
+// parameters of the authoritative engine engineID.
+func (s *Sender) sealV3(pdu *PDU, engineID []byte, boots, engineTime int32,
+	flags byte) ([]byte, error) {
+	s.msgID++
+	s.salt++
+	m := &message{
+		version: V3,
+		msgID:   s.msgID,
+		maxSize: maxMessageSize,
+		flags:   flags,
+		security: usmParams{
+			engineID:    engineID,
+			engineBoots: boots,
+			engineTime:  engineTime,
+			userName:    s.user.Name,
+		},
+	}
+	sp := &scopedPDU{
+		contextEngineID: s.engineID,
+		contextName:     s.conf.ContextName,
+		pdu:             pdu,
+	}
+	return seal(m, sp, s.user, s.user.keys(engineID), s.salt)
+}
+
+// uptime is the sysUpTime of the sender, in hundredths of a second.
+func (s *Sender) uptime() TimeTicks {
+	return TimeTicks(s.clock.Since(s.start) / (10 * time.Millisecond))
+}
+
+func (s *Sender) engineTime() int32 {
+	return int32(s.clock.Since(s.start) / time.Second)
+}
@@ -0,0 +1,379 @@
+package snmp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// The user-based security model of SNMPv3 (RFC 3414), with the AES
+// privacy of RFC 3826 and the SHA-256 authentication of RFC 7860.
+
+// AuthProtocol is the authentication protocol of a user.
+type AuthProtocol int
+
+const (
+	NoAuth AuthProtocol = iota
+	MD5
+	SHA
+	SHA256
+)
+
+func (p AuthProtocol) String() string {
+	switch p {
+	case NoAuth:
+		return "none"
+	case MD5:
+		return "md5"
+	case SHA:
+		return "sha"
+	case SHA256:
+		return "sha256"
+	}
+	return fmt.Sprintf("AuthProtocol(%d)", int(p))
+}
+
+// ParseAuthProtocol parses none, md5, sha or sha256.
+func ParseAuthProtocol(s string) (AuthProtocol, error) {
+	for p := NoAuth; p <= SHA256; p++ {
+		if strings.EqualFold(s, p.String()) {
+			return p, nil
+		}
+	}
+	return NoAuth, fmt.Errorf("unsupported auth protocol [%s]", s)
+}
+
+func (p AuthProtocol) hash() func() hash.Hash {
+	switch p {
+	case MD5:
+		return md5.New
+	case SHA:
+		return sha1.New
+	case SHA256:
+		return sha256.New
+	}
+	return nil
+}
+
+// macSize is the size of the truncated HMAC carried in authParams.
+func (p AuthProtocol) macSize() int {
+	if p == SHA256 {
+		return 24
+	}
+	return 12
+}
+
+// PrivProtocol is the privacy protocol of a user.
+type PrivProtocol int
+
+const (
+	NoPriv PrivProtocol = iota
+	DES
+	AES
+)
+
+func (p PrivProtocol) String() string {
+	switch p {
+	case NoPriv:
+		return "none"
+	case DES:
+		return "des"
+	case AES:
+		return "aes"
+	}
+	return fmt.Sprintf("PrivProtocol(%d)", int(p))
+}
+
+// ParsePrivProtocol parses none, des or aes, AES being AES-128.
+func ParsePrivProtocol(s string) (PrivProtocol, error) {
+	for p := NoPriv; p <= AES; p++ {
+		if strings.EqualFold(s, p.String()) {
+			return p, nil
+		}
+	}
+	return NoPriv, fmt.Errorf("unsupported priv protocol [%s]", s)
+}
+
+// User is an SNMPv3 user. Its security level is noAuthNoPriv, authNoPriv
+// or authPriv depending on the protocols set.
+type User struct {
+	Name         string
+	Auth         AuthProtocol
+	AuthPassword string
+	Priv         PrivProtocol
+	PrivPassword string
+}
+
+func (u *User) Check() error {
+	if u.Name == "" {
+		return fmt.Errorf("user name not set")
+	}
+	if u.Auth.hash() == nil && u.Auth != NoAuth {
+		return fmt.Errorf("invalid auth protocol of user [%s]", u.Name)
+	}
+	if u.Priv > AES || u.Priv < NoPriv {
+		return fmt.Errorf("invalid priv protocol of user [%s]", u.Name)
+	}
+	if u.Priv != NoPriv && u.Auth == NoAuth {
+		return fmt.Errorf("user [%s] has privacy without authentication", u.Name)
+	}
+	// RFC 3414 requires passwords of 8 characters at least
+	if u.Auth != NoAuth && len(u.AuthPassword) < 8 {
+		return fmt.Errorf("auth password of user [%s] shorter than 8", u.Name)
+	}
+	if u.Priv != NoPriv && len(u.PrivPassword) < 8 {
+		return fmt.Errorf("priv password of user [%s] shorter than 8", u.Name)
+	}
+	return nil
+}
+
+func (u *User) flags() byte {
+	var flags byte
+	if u.Auth != NoAuth {
+		flags |= flagAuth
+	}
+	if u.Priv != NoPriv {
+		flags |= flagPriv
+	}
+	return flags
+}
+
+// usmUser is a user with the master keys of its passwords, which are
+// costly to derive, and its keys localized to the engines seen.
+type usmUser struct {
+	*User
+	authKu, privKu []byte
+	localized      map[string]*usmKeys
+}
+
+type usmKeys struct {
+	auth, priv []byte
+}
+
+func newUSMUser(u *User) *usmUser {
+	uu := &usmUser{User: u, localized: make(map[string]*usmKeys)}
+	if h := u.Auth.hash(); h != nil {
+		uu.authKu = passwordToKey(h, u.AuthPassword)
+		if u.Priv != NoPriv {
+			uu.privKu = passwordToKey(h, u.PrivPassword)
+		}
+	}
+	return uu
+}
+
+// keys returns the keys of u localized to engineID.
+func (u *usmUser) keys(engineID []byte) *usmKeys {
+	if k, ok := u.localized[string(engineID)]; ok {
+		return k
+	}
+	k := &usmKeys{}
+	if h := u.Auth.hash(); h != nil {
+		k.auth = localizeKey(h, u.authKu, engineID)
+		if u.privKu != nil {
+			k.priv = localizeKey(h, u.privKu, engineID)
+		}
+	}
+	u.localized[string(engineID)] = k
+	return k
+}
+
+// passwordToKey hashes a megabyte of the repeated password (RFC 3414
+// A.2).
+func passwordToKey(newHash func() hash.Hash, password string) []byte {
+	h := newHash()
+	buf := make([]byte, 64)
+	for i, n := 0, 0; n < 1<<20; n += len(buf) {
+		for j := range buf {
+			buf[j] = password[i%len(password)]
+			i++
+		}
+		h.Write(buf)
+	}
+	return h.Sum(nil)
+}
+
+func localizeKey(newHash func() hash.Hash, ku, engineID []byte) []byte {
+	h := newHash()
+	h.Write(ku)
+	h.Write(engineID)
+	h.Write(ku)
+	return h.Sum(nil)
+}
+
+// authenticate writes into b the HMAC of the message b, whose authParams
+// at offset are zeroed.
+func (u *usmUser) authenticate(b []byte, offset int, k *usmKeys) {
+	mac := hmac.New(u.Auth.hash(), k.auth)
+	mac.Write(b)
+	copy(b[offset:offset+u.Auth.macSize()], mac.Sum(nil))
+}
+
+// verify checks the HMAC of the message b, whose authParams are at
+// offset.
+func (u *usmUser) verify(b []byte, offset int, k *usmKeys) bool {
+	size := u.Auth.macSize()
+	if offset+size > len(b) {
+		return false
+	}
+	got := append([]byte(nil), b[offset:offset+size]...)
+	zeroed := append([]byte(nil), b...)
+	copy(zeroed[offset:offset+size], make([]byte, size))
+	mac := hmac.New(u.Auth.hash(), k.auth)
+	mac.Write(zeroed)
+	return hmac.Equal(got, mac.Sum(nil)[:size])
+}
+
+// encrypt returns the ciphertext of the scoped PDU and its privParams
+// salt. salt is a counter unique to the engine boots.
+func (u *usmUser) encrypt(plain []byte, k *usmKeys, boots, engineTime int32,
+	salt uint64) (cipherText, privParams []byte, err error) {
+	privParams = make([]byte, 8)
+	switch u.Priv {
+	case DES:
+		binary.BigEndian.PutUint32(privParams, uint32(boots))
+		binary.BigEndian.PutUint32(privParams[4:], uint32(salt))
+		block, err := des.NewCipher(k.priv[:8])
+		if err != nil {
+			return nil, nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = k.priv[8+i] ^ privParams[i]
+		}
+		if pad := len(plain) % 8; pad != 0 {
+			plain = append(plain[:len(plain):len(plain)], make([]byte, 8-pad)...)
+		}
+		cipherText = make([]byte, len(plain))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(cipherText, plain)
+	case AES:
+		binary.BigEndian.PutUint64(privParams, salt)
+		block, err := aes.NewCipher(k.priv[:16])
+		if err != nil {
+			return nil, nil, err
+		}
+		cipherText = make([]byte, len(plain))
+		cipher.NewCFBEncrypter(block, aesIV(boots, engineTime, privParams)).
+			XORKeyStream(cipherText, plain)
+	default:
+		return nil, nil, fmt.Errorf("user [%s] has no privacy", u.Name)
+	}
+	return cipherText, privParams, nil
+}
+
+func (u *usmUser) decrypt(cipherText []byte, k *usmKeys, boots,
+	engineTime int32, privParams []byte) ([]byte, error) {
+	if len(privParams) != 8 {
+		return nil, fmt.Errorf("invalid priv params size %d", len(privParams))
+	}
+	plain := make([]byte, len(cipherText))
+	switch u.Priv {
+	case DES:
+		if len(cipherText)%8 != 0 {
+			return nil, fmt.Errorf("des ciphertext not a multiple of 8")
+		}
+		block, err := des.NewCipher(k.priv[:8])
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = k.priv[8+i] ^ privParams[i]
+		}
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, cipherText)
+	case AES:
+		block, err := aes.NewCipher(k.priv[:16])
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCFBDecrypter(block, aesIV(boots, engineTime, privParams)).
+			XORKeyStream(plain, cipherText)
+	default:
+		return nil, fmt.Errorf("user [%s] has no privacy", u.Name)
+	}
+	return plain, nil
+}
+
+func aesIV(boots, engineTime int32, salt []byte) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint32(iv, uint32(boots))
+	binary.BigEndian.PutUint32(iv[4:], uint32(engineTime))
+	copy(iv[8:], salt)
+	return iv
+}
+
+var (
+	// The usmStats counters reported to the peers of an engine.
+	usmStatsNotInTimeWindows = MustParseOID(".1.3.6.1.6.3.15.1.1.2.0")
+	usmStatsUnknownEngineIDs = MustParseOID(".1.3.6.1.6.3.15.1.1.4.0")
+)
+
+// timeWindow is how far, in seconds, the engine time of an authenticated
+// message may be from that of its authoritative engine (RFC 3414 3.2.7).
+const timeWindow = 150
+
+// seal encodes the v3 message m carrying sp, encrypted and authenticated
+// as its flags require with the keys k of u. u may be nil for a message
+// without authentication.
+func seal(m *message, sp *scopedPDU, u *usmUser, k *usmKeys,
+	salt uint64) ([]byte, error) {
+	plain, err := sp.encode()
+	if err != nil {
+		return nil, err
+	}
+	m.data = plain
+	if m.flags&flagPriv != 0 {
+		cipherText, privParams, err := u.encrypt(plain, k,
+			m.security.engineBoots, m.security.engineTime, salt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt scoped pdu: %v", err)
+		}
+		m.data = appendTLV(nil, tagOctetString, cipherText)
+		m.security.privParams = privParams
+	}
+	if m.flags&flagAuth == 0 {
+		return m.encode(), nil
+	}
+	m.security.authParams = make([]byte, u.Auth.macSize())
+	b := m.encode()
+	// decode b again to find where its authParams are
+	sealed, err := decodeMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	u.authenticate(b, cap(b)-cap(sealed.security.authParams), k)
+	return b, nil
+}
+
+// unseal authenticates and decrypts the v3 message m decoded from b as its
+// flags require with the keys k of u, returning its scoped PDU. u may be
+// nil for a message without authentication.
+func unseal(b []byte, m *message, u *usmUser, k *usmKeys) (*scopedPDU, error) {
+	if m.flags&flagAuth != 0 {
+		if len(m.security.authParams) != u.Auth.macSize() ||
+			!u.verify(b, cap(b)-cap(m.security.authParams), k) {
+			return nil, fmt.Errorf("wrong digest from user [%s]",
+				m.security.userName)
+		}
+	}
+	if m.flags&flagPriv == 0 {
+		return parseScopedPDU(m.data)
+	}
+	cipherText, err := expectLastTLV(m.data, tagOctetString)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := u.decrypt(cipherText, k, m.security.engineBoots,
+		m.security.engineTime, m.security.privParams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt scoped pdu: %v", err)
+	}
+	return parseScopedPDU(plain)
+}
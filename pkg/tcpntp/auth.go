@@ -0,0 +1,290 @@
+package tcpntp
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrCryptoNAK is returned when the server answered with a crypto-NAK,
+// meaning it does not know the key ID or failed to verify the MAC.
+var ErrCryptoNAK = errors.New("ntp server sent crypto-NAK")
+
+// KeyType is the digest algorithm of a symmetric key.
+type KeyType string
+
+const (
+	KeyMD5        KeyType = "MD5"
+	KeySHA1       KeyType = "SHA1"
+	KeyAES128CMAC KeyType = "AES128CMAC"
+)
+
+// Key is a symmetric key as found in an ntp.keys file.
+type Key struct {
+	ID     uint32
+	Type   KeyType
+	Secret []byte
+}
+
+// digestSize returns the length of the digest following the key ID in
+// the MAC.
+func (k *Key) digestSize() int {
+	switch k.Type {
+	case KeySHA1:
+		return sha1.Size
+	default:
+		return 16
+	}
+}
+
+// digest computes the digest of data. MD5 and SHA-1 hash the key followed
+// by the packet as in RFC 5905, AES-CMAC is keyed as in RFC 8573.
+func (k *Key) digest(data []byte) []byte {
+	switch k.Type {
+	case KeyMD5:
+		h := md5.New()
+		h.Write(k.Secret)
+		h.Write(data)
+		return h.Sum(nil)
+	case KeySHA1:
+		h := sha1.New()
+		h.Write(k.Secret)
+		h.Write(data)
+		return h.Sum(nil)
+	case KeyAES128CMAC:
+		block, err := aes.NewCipher(k.Secret)
+		if err != nil {
+			// Secret length is checked when the key is loaded.
+			panic(err)
+		}
+		return cmac(block, data)
+	}
+	return nil
+}
+
+func (k *Key) check() error {
+	if k.ID == 0 {
+		return fmt.Errorf("key id 0 is reserved")
+	}
+	switch k.Type {
+	case KeyMD5, KeySHA1:
+		if len(k.Secret) == 0 {
+			return fmt.Errorf("key [%d] secret is empty", k.ID)
+		}
+	case KeyAES128CMAC:
+		if len(k.Secret) != 16 {
+			return fmt.Errorf("key [%d] AES-128 secret must be 16 bytes",
+				k.ID)
+		}
+	default:
+		return fmt.Errorf("key [%d] unsupported type [%s]", k.ID, k.Type)
+	}
+	return nil
+}
+
+// KeyStore holds symmetric keys by key ID.
+type KeyStore struct {
+	keys map[uint32]*Key
+}
+
+func NewKeyStore(keys ...*Key) (*KeyStore, error) {
+	ks := &KeyStore{keys: make(map[uint32]*Key)}
+	for _, k := range keys {
+		if err := ks.Add(k); err != nil {
+			return nil, err
+		}
+	}
+	return ks, nil
+}
+
+func (ks *KeyStore) Add(k *Key) error {
+	if err := k.check(); err != nil {
+		return err
+	}
+	ks.keys[k.ID] = k
+	return nil
+}
+
+// Get returns the key with the given ID, or nil.
+func (ks *KeyStore) Get(id uint32) *Key {
+	if ks == nil {
+		return nil
+	}
+	return ks.keys[id]
+}
+
+// LoadKeys reads an ntp.keys file.
+func LoadKeys(path string) (*KeyStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open keys file [%s]: %v", path, err)
+	}
+	defer f.Close()
+	ks, err := ParseKeys(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse keys file [%s]: %v", path, err)
+	}
+	return ks, nil
+}
+
+// ParseKeys parses keys in the ntp.keys format, one "id type secret" per
+// line with # comments. Type is MD5, SHA1 (or SHA-1) or AES128CMAC (or
+// AES128). A secret with a "HEX:" prefix or longer than 20 characters is
+// hex encoded, otherwise it is taken as ASCII.
+func ParseKeys(r io.Reader) (*KeyStore, error) {
+	ks, _ := NewKeyStore()
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := sc.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expect \"id type secret\"", line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid key id: %v", line, err)
+		}
+		k := &Key{ID: uint32(id)}
+		switch strings.ToUpper(fields[1]) {
+		case "M", "MD5":
+			k.Type = KeyMD5
+		case "SHA1", "SHA-1":
+			k.Type = KeySHA1
+		case "AES128CMAC", "AES128", "AES-128-CMAC":
+			k.Type = KeyAES128CMAC
+		default:
+			return nil, fmt.Errorf("line %d: unsupported key type [%s]",
+				line, fields[1])
+		}
+		secret := fields[2]
+		switch {
+		case strings.HasPrefix(secret, "HEX:"):
+			k.Secret, err = hex.DecodeString(secret[4:])
+		case strings.HasPrefix(secret, "ASCII:"):
+			k.Secret = []byte(secret[6:])
+		case len(secret) > 20:
+			k.Secret, err = hex.DecodeString(secret)
+		default:
+			k.Secret = []byte(secret)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid hex secret: %v", line, err)
+		}
+		if err = ks.Add(k); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// appendMAC appends the key ID and the digest of pkt to pkt.
+func appendMAC(pkt []byte, k *Key) []byte {
+	digest := k.digest(pkt)
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, k.ID)
+	pkt = append(pkt, id...)
+	return append(pkt, digest...)
+}
+
+// appendCryptoNAK appends the 4-byte zero MAC of a crypto-NAK to pkt.
+func appendCryptoNAK(pkt []byte) []byte {
+	return append(pkt, 0, 0, 0, 0)
+}
+
+// verifyMAC checks the MAC trailing the data in pkt against the key store
+// and returns the key used. A crypto-NAK is reported as ErrCryptoNAK.
+func verifyMAC(pkt []byte, dataLen int, ks *KeyStore) (*Key, error) {
+	mac := pkt[dataLen:]
+	if len(mac) == 4 && binary.BigEndian.Uint32(mac) == 0 {
+		return nil, ErrCryptoNAK
+	}
+	if len(mac) < 4 {
+		return nil, fmt.Errorf("packet not authenticated")
+	}
+	id := binary.BigEndian.Uint32(mac)
+	k := ks.Get(id)
+	if k == nil {
+		return nil, fmt.Errorf("unknown key id [%d]", id)
+	}
+	if len(mac)-4 != k.digestSize() {
+		return nil, fmt.Errorf("invalid MAC length [%d] for key [%d]",
+			len(mac), id)
+	}
+	if subtle.ConstantTimeCompare(mac[4:], k.digest(pkt[:dataLen])) != 1 {
+		return nil, fmt.Errorf("MAC verification failed for key [%d]", id)
+	}
+	return k, nil
+}
+
+// cmac computes the AES-CMAC of RFC 4493.
+func cmac(block cipher.Block, data []byte) []byte {
+	const bs = aes.BlockSize
+	k1 := make([]byte, bs)
+	block.Encrypt(k1, k1)
+	cmacShift(k1)
+	k2 := make([]byte, bs)
+	copy(k2, k1)
+	cmacShift(k2)
+
+	n := (len(data) + bs - 1) / bs
+	last := make([]byte, bs)
+	if n == 0 || len(data)%bs != 0 {
+		if n == 0 {
+			n = 1
+		}
+		copy(last, data[(n-1)*bs:])
+		last[len(data)-(n-1)*bs] = 0x80
+		xorBytes(last, last, k2)
+	} else {
+		xorBytes(last, data[(n-1)*bs:], k1)
+	}
+	x := make([]byte, bs)
+	for i := 0; i < n-1; i++ {
+		xorBytes(x, x, data[i*bs:(i+1)*bs])
+		block.Encrypt(x, x)
+	}
+	xorBytes(x, x, last)
+	block.Encrypt(x, x)
+	return x
+}
+
+func xorBytes(dst, a, b []byte) {
+	for i := range dst {
+		dst[i] = a[i] ^ b[i]
+	}
+}
+
+// cmacShift derives a CMAC subkey in place: a left shift by one bit,
+// reduced by the Rb constant when the top bit was set.
+func cmacShift(b []byte) {
+	msb := b[0] >> 7
+	for i := 0; i < len(b)-1; i++ {
+		b[i] = b[i]<<1 | b[i+1]>>7
+	}
+	b[len(b)-1] <<= 1
+	if msb == 1 {
+		b[len(b)-1] ^= 0x87
+	}
+}
@@ -1,53 +1,341 @@
 package tcpntp
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
+
+	"github.com/sirupsen/logrus"
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
 )
 
+// ErrConnBroken is returned by Query while a broken connection waits for
+// the backoff before its redial; LastError returns the failure that broke
+// it. Open redials at once.
+var ErrConnBroken = errors.New("ntp connection broken")
+
+// TimeoutError is returned by Query when the server did not answer before
+// the deadline taken from the context or Config.Timeout.
+type TimeoutError struct {
+	Address string
+	After   time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("ntp query [%s] timeout after %s", e.Address, e.After)
+}
+
+// Timeout reports true, so that TimeoutError satisfies net.Error checks.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary reports true, the query may succeed once the link recovers.
+func (e *TimeoutError) Temporary() bool {
+	return true
+}
+
+// ConnState describes the health of the NTPClient connection.
+type ConnState int
+
+const (
+	// StateIdle means the connection was never opened.
+	StateIdle ConnState = iota
+	// StateConnected means the last dial or query succeeded.
+	StateConnected
+	// StateBroken means the connection failed and will be redialed by the
+	// next query once the backoff has elapsed.
+	StateBroken
+	// StateClosed means Close was called; Open must be called again.
+	StateClosed
+	// StateDenied means the server answered DENY or RSTR; Open must be
+	// called again.
+	StateDenied
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnected:
+		return "connected"
+	case StateBroken:
+		return "broken"
+	case StateClosed:
+		return "closed"
+	case StateDenied:
+		return "denied"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// NTPClient queries one server. It is safe for concurrent use: each query
+// in flight takes a connection from a pool of at most Config.PoolSize,
+// dialed on demand and kept for the following queries.
 type NTPClient struct {
-	conf *Config
-	conn *net.TCPConn
+	conf  *Config
+	clock clock.Clock
+
+	mu       sync.Mutex
+	state    ConnState
+	lastErr  error
+	failures int
+	nextDial time.Time
+
+	// Connection pool, see pool.go.
+	slots chan struct{}
+	idle  []*poolConn
+	busy  map[*poolConn]struct{}
+	gen   int
+	keMu  sync.Mutex
+
+	// Rate control, see kod.go.
+	denied   error
+	lastPoll time.Time
+	minPoll  time.Duration
+	ratePoll time.Duration
+
+	filter clockFilter
+	nts    *ntsSession
 }
 
 func NewNTPClient(conf *Config) (*NTPClient, error) {
+	if conf.NTS != nil && conf.KeyID != 0 {
+		return nil, fmt.Errorf("symmetric key and nts are exclusive")
+	}
 	return &NTPClient{
-		conf: conf,
+		conf:  conf,
+		clock: clock.Or(conf.Clock),
+		slots: make(chan struct{}, conf.poolSize()),
+		busy:  make(map[*poolConn]struct{}),
 	}, nil
 }
 
+// State returns the current connection state.
+func (nc *NTPClient) State() ConnState {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.state
+}
+
+// LastError returns the error of the last failed dial or query, or nil if
+// the last one succeeded.
+func (nc *NTPClient) LastError() error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.lastErr
+}
+
+// Open dials the server, replacing any existing connection. Calling it is
+// optional: Query dials on demand and redials broken connections. It also
+// clears a DENY or RSTR received from the server.
 func (nc *NTPClient) Open() error {
-	var err error
-	raddr, err := net.ResolveTCPAddr("tcp", nc.conf.Address)
+	nc.mu.Lock()
+	nc.denied = nil
+	idle := nc.drop()
+	nc.mu.Unlock()
+	closeConns(idle)
+
+	pc, err := nc.dial()
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
 	if err != nil {
-		return fmt.Errorf("failed to resolve tcp addr [%s]: %v",
-			nc.conf.Address, err)
-	}
-	if nc.conn, err = net.DialTCP("tcp", nil, raddr); err != nil {
-		return fmt.Errorf(
-			"failed to dial tcp addr [%s]: %v", nc.conf.Address, err)
+		nc.failures++
+		nc.nextDial = nc.clock.Now().Add(nc.conf.backoff(nc.failures))
+		nc.state = StateBroken
+		nc.lastErr = err
+		return err
 	}
+	nc.failures = 0
+	nc.state = StateConnected
+	nc.lastErr = nil
+	nc.idle = append(nc.idle, pc)
 	return nil
 }
 
+// dial opens a new connection to the server, after a key exchange if NTS
+// is enabled and the session has run out of cookies.
+func (nc *NTPClient) dial() (*poolConn, error) {
+	if nc.conf.NTS != nil {
+		if err := nc.keyExchange(); err != nil {
+			return nil, err
+		}
+	}
+	nc.mu.Lock()
+	pc := &poolConn{gen: nc.gen, nts: nc.nts}
+	nc.mu.Unlock()
+	address := nc.conf.Address
+	if pc.nts != nil {
+		address = pc.nts.address
+	}
+	network := nc.conf.network()
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		raddr, err := net.ResolveTCPAddr(network, address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s addr [%s]: %v",
+				network, address, err)
+		}
+		if pc.Conn, err = net.DialTCP(network, nil, raddr); err != nil {
+			return nil, fmt.Errorf("failed to dial %s addr [%s]: %v",
+				network, address, err)
+		}
+	case "udp", "udp4", "udp6":
+		raddr, err := net.ResolveUDPAddr(network, address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s addr [%s]: %v",
+				network, address, err)
+		}
+		if pc.Conn, err = net.DialUDP(network, nil, raddr); err != nil {
+			return nil, fmt.Errorf("failed to dial %s addr [%s]: %v",
+				network, address, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported network [%s]", network)
+	}
+	if nc.conf.KernelTimestamps {
+		tc, err := newTimestampConn(pc.Conn, !nc.conf.datagram())
+		if err != nil {
+			logrus.WithField("prefix", "tcpntp.client").
+				Debugf("kernel timestamps unavailable for [%s]: %v",
+					address, err)
+		} else {
+			pc.Conn = tc
+		}
+	}
+	return pc, nil
+}
+
+// Close closes all connections, aborting the queries in flight.
 func (nc *NTPClient) Close() error {
-	return nc.conn.Close()
+	nc.mu.Lock()
+	nc.state = StateClosed
+	conns := nc.drop()
+	for pc := range nc.busy {
+		conns = append(conns, pc)
+	}
+	nc.mu.Unlock()
+	return closeConns(conns)
+}
+
+// markBroken records a failed query and releases its connection. A stream
+// connection that fails mid query is closed, since a late response would
+// otherwise be read as the answer to the next query, and is redialed after
+// the backoff; datagram sockets stay usable.
+func (nc *NTPClient) markBroken(pc *poolConn, err error) {
+	nc.mu.Lock()
+	nc.lastErr = err
+	keep := nc.conf.datagram()
+	if !keep && nc.state != StateClosed {
+		nc.failures++
+		nc.nextDial = nc.clock.Now().Add(nc.conf.backoff(nc.failures))
+		nc.state = StateBroken
+	}
+	nc.mu.Unlock()
+	nc.release(pc, keep)
 }
 
+// Query is QueryContext with a background context, bounded only by
+// Config.Timeout.
 func (nc *NTPClient) Query() (*Response, error) {
+	return nc.QueryContext(context.Background())
+}
+
+// QueryContext sends a single query and waits for the response until the
+// earlier of the context deadline and Config.Timeout. A timeout is reported
+// as *TimeoutError, a cancelled context as the context error and a
+// Kiss-o'-Death as *KissError. The connection is dialed on demand and
+// redialed with backoff after failures. Queries are refused while the poll
+// interval asked for by the server has not elapsed.
+func (nc *NTPClient) QueryContext(ctx context.Context) (*Response, error) {
+	if err := nc.startPoll(); err != nil {
+		return nil, err
+	}
+	return nc.queryContext(ctx)
+}
+
+func (nc *NTPClient) queryContext(ctx context.Context) (*Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pc, err := nc.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Socket deadlines run on the system clock, whatever nc.clock is.
+	timeout := nc.conf.timeout()
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+		timeout = time.Until(d)
+	}
+	if err := pc.SetDeadline(deadline); err != nil {
+		nc.markBroken(pc, err)
+		return nil, fmt.Errorf("failed to set deadline: %v", err)
+	}
+	// The watcher must be gone before the connection is released, or it
+	// could cut short the query of the next user.
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			// Unblock the pending read or write.
+			pc.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	resp, err := nc.query(pc)
+	close(stop)
+	<-done
+
+	if err == nil {
+		pc.SetDeadline(time.Time{})
+		nc.mu.Lock()
+		nc.lastErr = nil
+		nc.mu.Unlock()
+		nc.release(pc, true)
+		nc.polled(resp)
+		return resp, nil
+	}
+	var ke *KissError
+	if errors.As(err, &ke) {
+		pc.SetDeadline(time.Time{})
+		nc.kissed(pc, ke)
+		return nil, err
+	}
+	var ne net.Error
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if ctxErr == context.DeadlineExceeded {
+			err = &TimeoutError{Address: nc.conf.Address, After: timeout}
+		} else {
+			err = ctxErr
+		}
+	} else if errors.As(err, &ne) && ne.Timeout() {
+		err = &TimeoutError{Address: nc.conf.Address, After: timeout}
+	}
+	nc.markBroken(pc, err)
+	return nil, err
+}
+
+func (nc *NTPClient) query(pc *poolConn) (*Response, error) {
 	var err error
-	// Allocate a message to hold the response.
-	recvMsg := new(msg)
+	var recvMsg *msg
 
 	// Allocate a message to hold the query.
 	xmitMsg := new(msg)
-	xmitMsg.setMode(client)
+	xmitMsg.setMode(ModeClient)
 	xmitMsg.setVersion(4)
 	xmitMsg.setLeap(LeapNotInSync)
+	xmitMsg.Poll = queryPoll
+	nc.interleaved(pc, xmitMsg)
 
 	// To ensure privacy and prevent spoofing, try to use a random 64-bit
 	// value for the TransmitTime. If crypto/rand couldn't generate a
@@ -58,52 +346,218 @@ func (nc *NTPClient) Query() (*Response, error) {
 	var xmitTime time.Time
 	if err == nil {
 		xmitMsg.TransmitTime = ntpTime(binary.BigEndian.Uint64(bits))
-		xmitTime = time.Now()
+		xmitTime = nc.clock.Now()
 	} else {
-		xmitTime = time.Now()
+		xmitTime = nc.clock.Now()
 		xmitMsg.TransmitTime = toNtpTime(xmitTime)
 	}
 
 	// Transmit the query.
-	err = binary.Write(nc.conn, binary.BigEndian, xmitMsg)
-	if err != nil {
+	auth := &queryAuth{nts: pc.nts}
+	if nc.conf.KeyID != 0 {
+		if auth.key = nc.conf.Keys.Get(nc.conf.KeyID); auth.key == nil {
+			return nil, fmt.Errorf("key [%d] not found", nc.conf.KeyID)
+		}
+	}
+	pkt := encodeMsg(xmitMsg)
+	switch {
+	case auth.nts != nil:
+		if pkt, auth.uid, err = auth.nts.request(pkt); err != nil {
+			return nil, err
+		}
+	case auth.key != nil:
+		pkt = appendMAC(pkt, auth.key)
+	}
+	if _, err = pc.Write(pkt); err != nil {
 		return nil, err
 	}
 
 	// Receive the response.
-	err = binary.Read(nc.conn, binary.BigEndian, recvMsg)
-	if err != nil {
+	if recvMsg, err = nc.recv(pc, xmitMsg, auth); err != nil {
 		return nil, err
 	}
 
 	// Keep track of the time the response was received.
-	delta := time.Since(xmitTime)
+	delta := nc.clock.Since(xmitTime)
 	if delta < 0 {
 		// The local system may have had its clock adjusted since it
 		// sent the query. In go 1.9 and later, time.Since ensures
 		// that a monotonic clock is used, so delta can never be less
-		// than zero. In versions before 1.9, a monotonic clock is
-		// not used, so we have to check.
+		// than zero. In versions before 1.9, or with a Clock without a
+		// monotonic reading, we have to check.
 		return nil, errors.New("client clock ticked backwards")
 	}
 	recvTime := toNtpTime(xmitTime.Add(delta))
 
+	// Prefer the kernel timestamps, free of scheduling and syscall delays.
+	source := TimestampUser
+	if tc, ok := pc.Conn.(timestampConn); ok {
+		tx, rx := tc.timestamps()
+		if !tx.IsZero() {
+			xmitTime = tx
+			source |= TimestampKernelTx
+		}
+		if !rx.IsZero() {
+			recvTime = toNtpTime(rx)
+			source |= TimestampKernelRx
+		}
+	}
+
 	// Check for invalid fields.
-	if recvMsg.getMode() != server {
+	if recvMsg.getMode() != ModeServer {
 		return nil, errors.New("invalid mode in response")
 	}
+	interleaved := isInterleaved(xmitMsg, recvMsg)
+	if recvMsg.OriginTime != xmitMsg.TransmitTime && !interleaved {
+		return nil, errors.New("server response mismatch")
+	}
+	if recvMsg.Stratum == 0 {
+		return nil, &KissError{
+			Address: nc.conf.Address,
+			Code:    kissCode(recvMsg.ReferenceID),
+			Poll:    toInterval(recvMsg.Poll),
+		}
+	}
 	if recvMsg.TransmitTime == ntpTime(0) {
 		return nil, errors.New("invalid transmit time in response")
 	}
-	if recvMsg.OriginTime != xmitMsg.TransmitTime {
-		return nil, errors.New("server response mismatch")
+	if recvMsg.getLeap() == LeapNotInSync {
+		return nil, errors.New("server clock not synchronized")
+	}
+
+	// Correct the received message's origin time using the actual
+	// transmit time. An interleaved response carries the transmit time of
+	// the previous response, so it times the previous exchange.
+	next := &xleaveExchange{
+		xmit:   xmitTime,
+		recv:   recvMsg.ReceiveTime,
+		dst:    recvTime,
+		source: source,
+	}
+	if interleaved {
+		recvMsg.OriginTime = toNtpTime(pc.prev.xmit)
+		recvMsg.ReceiveTime = pc.prev.recv
+		recvTime, source = pc.prev.dst, pc.prev.source
+	} else {
+		recvMsg.OriginTime = toNtpTime(xmitTime)
 	}
 	if recvMsg.ReceiveTime > recvMsg.TransmitTime {
 		return nil, errors.New("server clock ticked backwards")
 	}
+	pc.prev = next
+	resp := parseTime(recvMsg, recvTime, xmitTime)
+	resp.Timestamping = source
+	resp.Interleaved = interleaved
 
-	// Correct the received message's origin time using the actual
-	// transmit time.
-	recvMsg.OriginTime = toNtpTime(xmitTime)
-	return parseTime(recvMsg, recvTime), nil
+	// Express the server clock in the time scale of the local clock.
+	resp.ClockOffset += timescale.Between(resp.Time,
+		nc.conf.SourceScale, nc.conf.LocalScale)
+	return resp, nil
+}
+
+// queryAuth carries what is needed to authenticate the response to a
+// query: the symmetric key, or the NTS session and the unique identifier.
+type queryAuth struct {
+	key *Key
+	nts *ntsSession
+	uid []byte
+}
+
+// recv reads the response to the query q. A stream connection carries
+// exactly one response per query, so it is returned as is. A datagram
+// socket may deliver stray, late or duplicated packets, so those that are
+// too short, not in server mode, not answering q or failing authentication
+// are dropped until the matching one arrives.
+func (nc *NTPClient) recv(conn net.Conn, q *msg, auth *queryAuth) (*msg, error) {
+	if !nc.conf.datagram() {
+		pkt, err := readStream(conn, auth)
+		if err != nil {
+			return nil, err
+		}
+		if err = nc.verify(pkt, auth); err != nil {
+			return nil, err
+		}
+		return decodeMsg(pkt)
+	}
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		m, err := decodeMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+		if m.getMode() != ModeServer ||
+			(m.OriginTime != q.TransmitTime && !isInterleaved(q, m)) {
+			continue
+		}
+		if err = nc.verify(buf[:n], auth); err == ErrCryptoNAK ||
+			err == ErrNTSNAK {
+			return nil, err
+		} else if err != nil {
+			continue
+		}
+		return m, nil
+	}
+}
+
+// readStream reads one response from a stream connection. Its length
+// depends on the authentication in use.
+func readStream(conn net.Conn, auth *queryAuth) ([]byte, error) {
+	pkt := make([]byte, packetSize)
+	if _, err := io.ReadFull(conn, pkt); err != nil {
+		return nil, err
+	}
+	switch {
+	case auth.nts != nil:
+		// An NTS NAK carries only the unique identifier, a regular
+		// response ends with the authenticator.
+		last := ExtNTSAuthenticator
+		if m, _ := decodeMsg(pkt); m.Stratum == 0 &&
+			m.ReferenceID == ntsNAKCode {
+			last = ExtUniqueIdentifier
+		}
+		ext, err := readExtFields(conn, func(typ uint16) bool {
+			return typ == last
+		})
+		if err != nil {
+			return nil, err
+		}
+		return append(pkt, ext...), nil
+	case auth.key != nil:
+		// A crypto-NAK carries only the zero key ID.
+		mac := make([]byte, 4, 4+auth.key.digestSize())
+		if _, err := io.ReadFull(conn, mac); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint32(mac) != 0 {
+			mac = mac[:cap(mac)]
+			if _, err := io.ReadFull(conn, mac[4:]); err != nil {
+				return nil, err
+			}
+		}
+		return append(pkt, mac...), nil
+	}
+	return pkt, nil
+}
+
+// verify checks that pkt carries a valid MAC made with the query key or
+// valid NTS extension fields for the query.
+func (nc *NTPClient) verify(pkt []byte, auth *queryAuth) error {
+	switch {
+	case auth.nts != nil:
+		return auth.nts.verify(pkt, auth.uid)
+	case auth.key != nil:
+		k, err := verifyMAC(pkt, packetSize, nc.conf.Keys)
+		if err != nil {
+			return err
+		}
+		if k.ID != auth.key.ID {
+			return fmt.Errorf("response signed with key [%d], expect [%d]",
+				k.ID, auth.key.ID)
+		}
+	}
+	return nil
 }
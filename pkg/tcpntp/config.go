@@ -1,5 +1,279 @@
 package tcpntp
 
+import (
+	"fmt"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
+)
+
 type Config struct {
 	Address string
+	// Network is one of "tcp", "tcp4", "tcp6", "udp", "udp4" or "udp6".
+	// It defaults to "tcp".
+	Network string
+	// Timeout bounds a single query. It defaults to 5 seconds.
+	Timeout time.Duration
+	// MinBackoff and MaxBackoff bound the exponential delay between
+	// redials of a broken connection. They default to 1 and 64 seconds.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// BurstInterval spaces the queries of QueryBurst. It defaults to
+	// 200 milliseconds.
+	BurstInterval time.Duration
+	// KeyID selects the symmetric key in Keys used to authenticate
+	// queries and responses. Zero disables authentication.
+	KeyID uint32
+	Keys  *KeyStore
+	// NTS enables Network Time Security. It excludes KeyID.
+	NTS *NTSConfig
+	// SourceScale is the time scale served by the server and LocalScale
+	// the one of the local clock. ClockOffset is corrected by their
+	// difference. Both default to UTC.
+	SourceScale timescale.Scale
+	LocalScale  timescale.Scale
+	// KernelTimestamps takes the origin and destination timestamps from
+	// Linux SO_TIMESTAMPING software timestamps when available, instead of
+	// reading the clock around the socket calls.
+	KernelTimestamps bool
+	// Interleaved asks the server for interleaved responses, carrying the
+	// precise transmit time of its previous response. Servers without
+	// support answer in basic mode.
+	Interleaved bool
+	// PoolSize bounds the connections, and so the queries in flight, of a
+	// client shared by several goroutines. It defaults to 4.
+	PoolSize int
+	// Clock timestamps queries and paces bursts and redials. It defaults
+	// to the system clock. Kernel timestamps are read from the system
+	// clock regardless.
+	Clock clock.Clock
+}
+
+func (conf *Config) burstInterval() time.Duration {
+	if conf.BurstInterval <= 0 {
+		return defaultBurstDelay
+	}
+	return conf.BurstInterval
+}
+
+func (conf *Config) timeout() time.Duration {
+	if conf.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return conf.Timeout
+}
+
+func (conf *Config) poolSize() int {
+	if conf.PoolSize <= 0 {
+		return defaultPoolSize
+	}
+	return conf.PoolSize
+}
+
+func (conf *Config) network() string {
+	if conf.Network == "" {
+		return "tcp"
+	}
+	return conf.Network
+}
+
+// backoff returns the delay before the next dial after failures
+// consecutive failed dials.
+func (conf *Config) backoff(failures int) time.Duration {
+	min, max := conf.MinBackoff, conf.MaxBackoff
+	if min <= 0 {
+		min = defaultMinBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	d := min
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func (conf *Config) datagram() bool {
+	switch conf.network() {
+	case "udp", "udp4", "udp6":
+		return true
+	}
+	return false
+}
+
+type MultiConfig struct {
+	Sources []*Config
+	// Burst is the number of queries sent to each source per poll. It
+	// defaults to 1. The empty stages of a fresh clock filter count as
+	// maxDispersion, so the first polls yield wide correctness intervals
+	// unless the burst fills several stages at once.
+	Burst int
+	// MinSurvivors stops clustering once this many sources are left. It
+	// defaults to 3.
+	MinSurvivors int
+	// MinTruechimers is the number of truechimers required to select a
+	// time. It defaults to 1.
+	MinTruechimers int
+}
+
+func (conf *MultiConfig) Check() error {
+	if len(conf.Sources) == 0 {
+		return fmt.Errorf("no ntp source set")
+	}
+	for _, sc := range conf.Sources {
+		if sc == nil || sc.Address == "" {
+			return fmt.Errorf("ntp source address not set")
+		}
+	}
+	return nil
+}
+
+func (conf *MultiConfig) burst() int {
+	if conf.Burst <= 0 {
+		return 1
+	}
+	return conf.Burst
+}
+
+func (conf *MultiConfig) minSurvivors() int {
+	if conf.MinSurvivors <= 0 {
+		return minSurvivors
+	}
+	return conf.MinSurvivors
+}
+
+func (conf *MultiConfig) minTruechimers() int {
+	if conf.MinTruechimers <= 0 {
+		return 1
+	}
+	return conf.MinTruechimers
+}
+
+// ControlConfig configures a ControlClient.
+type ControlConfig struct {
+	Address string
+	// Network is one of "udp", "udp4", "udp6", "tcp", "tcp4" or "tcp6".
+	// It defaults to "udp", the transport of ntpd.
+	Network string
+	// Timeout bounds a single request. It defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+func (conf *ControlConfig) Check() error {
+	if conf.Address == "" {
+		return fmt.Errorf("control address not set")
+	}
+	switch conf.Network {
+	case "", "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return fmt.Errorf("unsupported network [%s]", conf.Network)
+	}
+	return nil
+}
+
+func (conf *ControlConfig) network() string {
+	if conf.Network == "" {
+		return "udp"
+	}
+	return conf.Network
+}
+
+func (conf *ControlConfig) datagram() bool {
+	switch conf.network() {
+	case "udp", "udp4", "udp6":
+		return true
+	}
+	return false
+}
+
+func (conf *ControlConfig) timeout() time.Duration {
+	if conf.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return conf.Timeout
+}
+
+type ServerConfig struct {
+	Address        string
+	Network        string
+	Stratum        uint8
+	Precision      int8
+	ReferenceID    uint32
+	RootDelay      time.Duration
+	RootDispersion time.Duration
+	// Keys enables symmetric key authentication: authenticated queries
+	// are answered with a MAC, and unauthenticated ones without unless
+	// RequireAuth is set. On tcp the MAC following a packet cannot be told
+	// apart from the next query, so Keys requires RequireAuth there.
+	Keys *KeyStore
+	// NTSKey enables Network Time Security with cookies sealed by the
+	// NTS-KE server sharing this key. A tcp server then requires NTS on
+	// every query. It excludes Keys on tcp.
+	NTSKey *NTSCookieKey
+	// RequireAuth answers unauthenticated queries with a CRYP kiss code
+	// rather than the time. It requires Keys or NTSKey.
+	RequireAuth bool
+	// Scale is the time scale of the server clock, UTC by default. Leaps
+	// is the leap second table announced through the leap indicator,
+	// timescale.Default() if nil.
+	Scale timescale.Scale
+	Leaps *timescale.Table
+	// Interleaved answers interleaved queries with the transmit time of
+	// the previous response, taken by the kernel where SO_TIMESTAMPING is
+	// available, else once the write returned.
+	Interleaved bool
+	// Clock timestamps queries and responses. It defaults to the system
+	// clock.
+	Clock clock.Clock
+}
+
+func (conf *ServerConfig) Check() error {
+	if conf.Address == "" {
+		return fmt.Errorf("server address not set")
+	}
+	switch conf.Network {
+	case "", "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return fmt.Errorf("unsupported network [%s]", conf.Network)
+	}
+	if conf.Keys != nil && conf.NTSKey != nil && !conf.datagram() {
+		return fmt.Errorf("symmetric keys and nts are exclusive on tcp")
+	}
+	if conf.Keys != nil && !conf.RequireAuth && !conf.datagram() {
+		return fmt.Errorf("symmetric keys require authentication on tcp")
+	}
+	if conf.RequireAuth && conf.Keys == nil && conf.NTSKey == nil {
+		return fmt.Errorf("authentication required without keys or nts")
+	}
+	if conf.Stratum == 0 || conf.Stratum >= maxStratum {
+		return fmt.Errorf("invalid stratum [%d]", conf.Stratum)
+	}
+	return nil
+}
+
+func (conf *ServerConfig) leaps() *timescale.Table {
+	if conf.Leaps == nil {
+		return timescale.Default()
+	}
+	return conf.Leaps
+}
+
+func (conf *ServerConfig) datagram() bool {
+	switch conf.network() {
+	case "udp", "udp4", "udp6":
+		return true
+	}
+	return false
+}
+
+func (conf *ServerConfig) network() string {
+	if conf.Network == "" {
+		return "tcp"
+	}
+	return conf.Network
 }
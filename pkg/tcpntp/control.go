@@ -0,0 +1,550 @@
+package tcpntp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NTP control messages, mode 6 of RFC 1305 appendix B and RFC 9327, as
+// used by ntpq. A request carries an opcode, a sequence number and an
+// association ID; the response comes back in fragments of at most
+// maxControlData bytes each, placed by their offset in the whole data.
+
+const (
+	controlHeaderSize = 12
+	maxControlData    = 468
+
+	// Second byte of the header: response, error and more bits, opcode.
+	controlResponseBit = 0x80
+	controlErrorBit    = 0x40
+	controlMoreBit     = 0x20
+	controlOpMask      = 0x1f
+
+	controlOpReadStat uint8 = 1
+	controlOpReadVar  uint8 = 2
+)
+
+// ControlError is returned when the server answered a control request with
+// an error, RFC 9327 section 2.
+type ControlError struct {
+	Address string
+	Code    uint8
+}
+
+func (e *ControlError) Error() string {
+	var reason string
+	switch e.Code {
+	case 1:
+		reason = "authentication failure"
+	case 2:
+		reason = "invalid message length or format"
+	case 3:
+		reason = "invalid opcode"
+	case 4:
+		reason = "unknown association identifier"
+	case 5:
+		reason = "unknown variable name"
+	case 6:
+		reason = "invalid variable value"
+	case 7:
+		reason = "administratively prohibited"
+	default:
+		reason = "unspecified error"
+	}
+	return fmt.Sprintf("ntp control [%s] error [%d]: %s", e.Address, e.Code, reason)
+}
+
+// SystemStatus is the system status word of a control response.
+type SystemStatus struct {
+	Leap LeapIndicator
+	// Source is the clock source code, 6 meaning an NTP server.
+	Source     uint8
+	EventCount uint8
+	EventCode  uint8
+}
+
+// Synchronized reports whether the system clock is synchronized.
+func (s SystemStatus) Synchronized() bool {
+	return s.Leap != LeapNotInSync
+}
+
+func parseSystemStatus(w uint16) SystemStatus {
+	return SystemStatus{
+		Leap:       LeapIndicator(w >> 14),
+		Source:     uint8(w>>8) & 0x3f,
+		EventCount: uint8(w>>4) & 0x0f,
+		EventCode:  uint8(w) & 0x0f,
+	}
+}
+
+// PeerSelection is the outcome of the clock selection for a peer.
+type PeerSelection uint8
+
+const (
+	PeerReject PeerSelection = iota
+	PeerFalseticker
+	PeerExcess
+	PeerOutlier
+	PeerCandidate
+	PeerBackup
+	PeerSystem
+	PeerPPS
+)
+
+func (s PeerSelection) String() string {
+	switch s {
+	case PeerReject:
+		return "reject"
+	case PeerFalseticker:
+		return "falsetick"
+	case PeerExcess:
+		return "excess"
+	case PeerOutlier:
+		return "outlier"
+	case PeerCandidate:
+		return "candidate"
+	case PeerBackup:
+		return "backup"
+	case PeerSystem:
+		return "sys.peer"
+	case PeerPPS:
+		return "pps.peer"
+	}
+	return fmt.Sprintf("PeerSelection(%d)", uint8(s))
+}
+
+// PeerStatus is an association and its peer status word.
+type PeerStatus struct {
+	AssocID     uint16
+	Configured  bool
+	AuthEnabled bool
+	Authentic   bool
+	Reachable   bool
+	Broadcast   bool
+	Selection   PeerSelection
+	EventCount  uint8
+	EventCode   uint8
+}
+
+func parsePeerStatus(assoc, w uint16) PeerStatus {
+	return PeerStatus{
+		AssocID:     assoc,
+		Configured:  w&0x8000 != 0,
+		AuthEnabled: w&0x4000 != 0,
+		Authentic:   w&0x2000 != 0,
+		Reachable:   w&0x1000 != 0,
+		Broadcast:   w&0x0800 != 0,
+		Selection:   PeerSelection(w>>8) & 0x07,
+		EventCount:  uint8(w>>4) & 0x0f,
+		EventCode:   uint8(w) & 0x0f,
+	}
+}
+
+// ControlValue is the value of a control variable, unquoted, with
+// accessors for the types ntpd reports.
+type ControlValue string
+
+func (v ControlValue) String() string {
+	return string(v)
+}
+
+// Int parses a decimal or 0x prefixed hexadecimal integer.
+func (v ControlValue) Int() (int64, error) {
+	return strconv.ParseInt(string(v), 0, 64)
+}
+
+// Float parses a decimal number.
+func (v ControlValue) Float() (float64, error) {
+	return strconv.ParseFloat(string(v), 64)
+}
+
+// Millis parses a decimal number of milliseconds, the unit of offset,
+// delay, dispersion and jitter variables.
+func (v ControlValue) Millis() (time.Duration, error) {
+	f, err := v.Float()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(f * float64(time.Millisecond)), nil
+}
+
+// Time parses an NTP timestamp written as 0xSSSSSSSS.FFFFFFFF, such as
+// reftime or clock, in the era nearest to pivot, such as the time the
+// variables were read.
+func (v ControlValue) Time(pivot time.Time) (time.Time, error) {
+	s := strings.TrimPrefix(string(v), "0x")
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) != 2 || len(parts[0]) != 8 || len(parts[1]) != 8 {
+		return time.Time{}, fmt.Errorf("invalid ntp timestamp [%s]", v)
+	}
+	ts, err := strconv.ParseUint(parts[0]+parts[1], 16, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid ntp timestamp [%s]", v)
+	}
+	if ts == 0 {
+		return time.Time{}, nil
+	}
+	return FromNTPTime(ts, pivot), nil
+}
+
+// ControlVars are the variables returned by READVAR, by name.
+type ControlVars map[string]ControlValue
+
+// Names returns the variable names in lexical order.
+func (vars ControlVars) Names() []string {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseControlVars parses the name=value list of a READVAR response. Values
+// may be quoted, in which case they may hold commas.
+func parseControlVars(data []byte) (ControlVars, error) {
+	vars := make(ControlVars)
+	s := string(data)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t\r\n,")
+		if s == "" {
+			break
+		}
+		end := strings.IndexAny(s, "=,")
+		if end < 0 {
+			end = len(s)
+		}
+		name := strings.TrimSpace(s[:end])
+		s = s[end:]
+		if !strings.HasPrefix(s, "=") {
+			vars[name] = ""
+			continue
+		}
+		s = strings.TrimLeft(s[1:], " \t")
+		if strings.HasPrefix(s, `"`) {
+			end = strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated value of variable [%s]", name)
+			}
+			vars[name] = ControlValue(s[1 : end+1])
+			s = s[end+2:]
+			continue
+		}
+		if end = strings.IndexByte(s, ','); end < 0 {
+			end = len(s)
+		}
+		vars[name] = ControlValue(strings.TrimSpace(s[:end]))
+		s = s[end:]
+	}
+	return vars, nil
+}
+
+// controlFragment is a control message.
+type controlFragment struct {
+	flags  uint8
+	op     uint8
+	seq    uint16
+	status uint16
+	assoc  uint16
+	offset uint16
+	data   []byte
+}
+
+func parseControlFragment(b []byte) (*controlFragment, error) {
+	if len(b) < controlHeaderSize {
+		return nil, fmt.Errorf("control message too short [%d]", len(b))
+	}
+	if Mode(b[0]&0x07) != ModeControl {
+		return nil, fmt.Errorf("invalid mode [%d] in control message", b[0]&0x07)
+	}
+	count := int(binary.BigEndian.Uint16(b[10:]))
+	if controlHeaderSize+count > len(b) || count > maxControlData {
+		return nil, fmt.Errorf("invalid control data count [%d]", count)
+	}
+	return &controlFragment{
+		flags:  b[1] &^ controlOpMask,
+		op:     b[1] & controlOpMask,
+		seq:    binary.BigEndian.Uint16(b[2:]),
+		status: binary.BigEndian.Uint16(b[4:]),
+		assoc:  binary.BigEndian.Uint16(b[6:]),
+		offset: binary.BigEndian.Uint16(b[8:]),
+		data:   b[controlHeaderSize : controlHeaderSize+count],
+	}, nil
+}
+
+// controlReassembly collects the fragments of a response, which may arrive
+// out of order or duplicated over udp.
+type controlReassembly struct {
+	status uint16
+	assoc  uint16
+	frags  map[int][]byte
+	// end is the length of the data once the last fragment arrived.
+	end int
+}
+
+func (r *controlReassembly) add(f *controlFragment) error {
+	off := int(f.offset)
+	if off+len(f.data) > 0xffff {
+		return fmt.Errorf("control fragment beyond data end")
+	}
+	if r.frags == nil {
+		r.frags = make(map[int][]byte)
+		r.end = -1
+	}
+	if f.offset == 0 {
+		r.status, r.assoc = f.status, f.assoc
+	}
+	r.frags[off] = f.data
+	if f.flags&controlMoreBit == 0 {
+		r.end = off + len(f.data)
+	}
+	return nil
+}
+
+// data returns the reassembled data, or false while fragments are missing.
+func (r *controlReassembly) data() ([]byte, bool) {
+	if r.end < 0 {
+		return nil, false
+	}
+	var data []byte
+	for len(data) < r.end {
+		frag, ok := r.frags[len(data)]
+		if !ok || (len(frag) == 0 && len(data) < r.end) {
+			return nil, false
+		}
+		data = append(data, frag...)
+	}
+	return data, len(data) == r.end
+}
+
+// ControlClient reads the system and peer variables of an NTP server with
+// mode 6 control messages. It is safe for concurrent use; requests are
+// sent one at a time.
+type ControlClient struct {
+	conf *ControlConfig
+
+	mu   sync.Mutex
+	conn net.Conn
+	seq  uint16
+}
+
+func NewControlClient(conf *ControlConfig) (*ControlClient, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("failed to check ntp control config: %v", err)
+	}
+	return &ControlClient{conf: conf}, nil
+}
+
+func (cc *ControlClient) Close() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.conn == nil {
+		return nil
+	}
+	err := cc.conn.Close()
+	cc.conn = nil
+	return err
+}
+
+// ReadStatus returns the system status and the status of every peer
+// association.
+func (cc *ControlClient) ReadStatus(ctx context.Context) (SystemStatus,
+	[]PeerStatus, error) {
+	r, err := cc.request(ctx, controlOpReadStat, 0, nil)
+	if err != nil {
+		return SystemStatus{}, nil, err
+	}
+	data, _ := r.data()
+	if len(data)%4 != 0 {
+		return SystemStatus{}, nil, fmt.Errorf("invalid status list length [%d]",
+			len(data))
+	}
+	peers := make([]PeerStatus, 0, len(data)/4)
+	for i := 0; i < len(data); i += 4 {
+		peers = append(peers, parsePeerStatus(
+			binary.BigEndian.Uint16(data[i:]), binary.BigEndian.Uint16(data[i+2:])))
+	}
+	return parseSystemStatus(r.status), peers, nil
+}
+
+// ReadVars returns the variables of the association assoc, or the system
+// variables if assoc is 0. Without names the server returns its default
+// list.
+func (cc *ControlClient) ReadVars(ctx context.Context, assoc uint16,
+	names ...string) (ControlVars, error) {
+	r, err := cc.request(ctx, controlOpReadVar, assoc,
+		[]byte(strings.Join(names, ",")))
+	if err != nil {
+		return nil, err
+	}
+	data, _ := r.data()
+	return parseControlVars(data)
+}
+
+// request sends a control request and reassembles its response until the
+// earlier of the context deadline and ControlConfig.Timeout.
+func (cc *ControlClient) request(ctx context.Context, op uint8, assoc uint16,
+	body []byte) (*controlReassembly, error) {
+	if len(body) > maxControlData {
+		return nil, fmt.Errorf("control request data too long [%d]", len(body))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.conn == nil {
+		if err := cc.dial(); err != nil {
+			return nil, err
+		}
+	}
+	timeout := cc.conf.timeout()
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+		timeout = time.Until(d)
+	}
+	conn := cc.conn
+	if err := conn.SetDeadline(deadline); err != nil {
+		cc.broken()
+		return nil, fmt.Errorf("failed to set deadline: %v", err)
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	r, err := cc.exchange(op, assoc, body)
+	close(stop)
+	<-done
+	if err == nil {
+		conn.SetDeadline(time.Time{})
+		return r, nil
+	}
+	var ce *ControlError
+	if errors.As(err, &ce) {
+		return nil, err
+	}
+	var ne net.Error
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if ctxErr == context.DeadlineExceeded {
+			err = &TimeoutError{Address: cc.conf.Address, After: timeout}
+		} else {
+			err = ctxErr
+		}
+	} else if errors.As(err, &ne) && ne.Timeout() {
+		err = &TimeoutError{Address: cc.conf.Address, After: timeout}
+	}
+	cc.broken()
+	return nil, err
+}
+
+func (cc *ControlClient) exchange(op uint8, assoc uint16,
+	body []byte) (*controlReassembly, error) {
+	cc.seq++
+	seq := cc.seq
+	pkt := make([]byte, controlHeaderSize, controlHeaderSize+len(body)+3)
+	pkt[0] = defaultNtpVersion<<3 | uint8(ModeControl)
+	pkt[1] = op
+	binary.BigEndian.PutUint16(pkt[2:], seq)
+	binary.BigEndian.PutUint16(pkt[6:], assoc)
+	binary.BigEndian.PutUint16(pkt[10:], uint16(len(body)))
+	pkt = append(pkt, body...)
+	// The request is padded to a multiple of 4 bytes.
+	pkt = append(pkt, make([]byte, (4-len(pkt)%4)%4)...)
+	if _, err := cc.conn.Write(pkt); err != nil {
+		return nil, err
+	}
+
+	r := new(controlReassembly)
+	for {
+		f, err := cc.readFragment()
+		if err != nil {
+			return nil, err
+		}
+		// Drop late responses to earlier requests.
+		if f.flags&controlResponseBit == 0 || f.seq != seq || f.op != op {
+			continue
+		}
+		if f.flags&controlErrorBit != 0 {
+			return nil, &ControlError{
+				Address: cc.conf.Address,
+				Code:    uint8(f.status >> 8),
+			}
+		}
+		if err = r.add(f); err != nil {
+			return nil, err
+		}
+		if _, ok := r.data(); ok {
+			return r, nil
+		}
+	}
+}
+
+// readFragment reads a control message: a datagram, or on a stream the
+// header and the data padded to a multiple of 4 bytes.
+func (cc *ControlClient) readFragment() (*controlFragment, error) {
+	if cc.conf.datagram() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, err := cc.conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			if f, err := parseControlFragment(buf[:n]); err == nil {
+				return f, nil
+			}
+		}
+	}
+	hdr := make([]byte, controlHeaderSize)
+	if _, err := io.ReadFull(cc.conn, hdr); err != nil {
+		return nil, err
+	}
+	count := int(binary.BigEndian.Uint16(hdr[10:]))
+	if count > maxControlData {
+		return nil, fmt.Errorf("invalid control data count [%d]", count)
+	}
+	pkt := make([]byte, controlHeaderSize+(count+3)&^3)
+	copy(pkt, hdr)
+	if _, err := io.ReadFull(cc.conn, pkt[controlHeaderSize:]); err != nil {
+		return nil, err
+	}
+	return parseControlFragment(pkt)
+}
+
+func (cc *ControlClient) dial() error {
+	var err error
+	if cc.conn, err = net.DialTimeout(cc.conf.network(), cc.conf.Address,
+		cc.conf.timeout()); err != nil {
+		cc.conn = nil
+		return fmt.Errorf("failed to dial %s addr [%s]: %v",
+			cc.conf.network(), cc.conf.Address, err)
+	}
+	return nil
+}
+
+// broken closes a connection that failed mid request; a stream could
+// otherwise deliver the rest of the response to the next one. The next
+// request dials again.
+func (cc *ControlClient) broken() {
+	if cc.conn != nil {
+		cc.conn.Close()
+		cc.conn = nil
+	}
+}
@@ -0,0 +1,105 @@
+package tcpntp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Extension field types of RFC 8915 section 5.
+const (
+	ExtUniqueIdentifier     uint16 = 0x0104
+	ExtNTSCookie            uint16 = 0x0204
+	ExtNTSCookiePlaceholder uint16 = 0x0304
+	ExtNTSAuthenticator     uint16 = 0x0404
+)
+
+const (
+	extHeaderSize = 4
+	maxExtFields  = 32
+)
+
+// ExtensionField is an RFC 7822 extension field following the 48-byte
+// header. Body excludes the 4-byte field header and includes any padding.
+type ExtensionField struct {
+	Type uint16
+	Body []byte
+}
+
+// appendExtField appends an extension field with the body padded to a
+// multiple of 4 bytes.
+func appendExtField(pkt []byte, typ uint16, body []byte) []byte {
+	padded := (len(body) + 3) &^ 3
+	hdr := make([]byte, extHeaderSize)
+	binary.BigEndian.PutUint16(hdr, typ)
+	binary.BigEndian.PutUint16(hdr[2:], uint16(extHeaderSize+padded))
+	pkt = append(pkt, hdr...)
+	pkt = append(pkt, body...)
+	return append(pkt, make([]byte, padded-len(body))...)
+}
+
+// AppendExtensionField appends the wire encoding of f to pkt, padding the
+// body to a multiple of 4 bytes.
+func AppendExtensionField(pkt []byte, f ExtensionField) ([]byte, error) {
+	if len(f.Body) > 0xffff-extHeaderSize-3 {
+		return nil, fmt.Errorf("extension field body too long [%d]", len(f.Body))
+	}
+	return appendExtField(pkt, f.Type, f.Body), nil
+}
+
+// ParseExtensionFields splits b, the bytes following the 48-byte header
+// and preceding any MAC, into extension fields.
+func ParseExtensionFields(b []byte) ([]ExtensionField, error) {
+	fields, _, err := parseExtFields(b, 0)
+	return fields, err
+}
+
+// parseExtFields splits b, the bytes following the header, into extension
+// fields and the trailing bytes, at most mac of them, left for a MAC.
+func parseExtFields(b []byte, mac int) ([]ExtensionField, []byte, error) {
+	fields := make([]ExtensionField, 0)
+	for len(b) > mac {
+		if len(fields) == maxExtFields {
+			return nil, nil, fmt.Errorf("too many extension fields")
+		}
+		if len(b) < extHeaderSize {
+			return nil, nil, fmt.Errorf("truncated extension field header")
+		}
+		typ := binary.BigEndian.Uint16(b)
+		length := int(binary.BigEndian.Uint16(b[2:]))
+		if length < extHeaderSize || length%4 != 0 || length > len(b) {
+			return nil, nil, fmt.Errorf("invalid extension field length [%d]", length)
+		}
+		fields = append(fields, ExtensionField{Type: typ, Body: b[extHeaderSize:length]})
+		b = b[length:]
+	}
+	return fields, b, nil
+}
+
+// readExtFields reads extension fields from a stream until last returns
+// true for the field just read, and returns their raw bytes. Streams have
+// no datagram boundary, so the caller must know which field ends a packet.
+func readExtFields(r io.Reader, last func(typ uint16) bool) ([]byte, error) {
+	raw := make([]byte, 0, 256)
+	for i := 0; i < maxExtFields; i++ {
+		hdr := make([]byte, extHeaderSize)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return nil, err
+		}
+		typ := binary.BigEndian.Uint16(hdr)
+		length := int(binary.BigEndian.Uint16(hdr[2:]))
+		if length < extHeaderSize || length%4 != 0 {
+			return nil, fmt.Errorf("invalid extension field length [%d]", length)
+		}
+		body := make([]byte, length-extHeaderSize)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		raw = append(raw, hdr...)
+		raw = append(raw, body...)
+		if last(typ) {
+			return raw, nil
+		}
+	}
+	return nil, fmt.Errorf("too many extension fields")
+}
@@ -0,0 +1,167 @@
+package tcpntp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// FilterResult is the output of the clock filter after a burst of queries.
+type FilterResult struct {
+	// Offset and Delay are taken from the register sample with the
+	// lowest round-trip delay.
+	Offset time.Duration
+	Delay  time.Duration
+
+	// Dispersion is the weighted sum of the sample dispersions, the
+	// peer dispersion of RFC 5905 section 10.
+	Dispersion time.Duration
+
+	// Jitter is the RMS of the offset differences between the selected
+	// sample and the other samples in the register.
+	Jitter time.Duration
+
+	// Samples is the number of valid samples in the register.
+	Samples int
+
+	// Response is the server response of the selected sample.
+	Response *Response
+}
+
+type filterSample struct {
+	offset time.Duration
+	delay  time.Duration
+	disp   time.Duration
+	time   time.Time
+	resp   *Response
+}
+
+// clockFilter is the 8-stage shift register of RFC 5905 section 10. New
+// samples replace the oldest one, and the dispersion of every sample grows
+// at phi while it stays in the register.
+type clockFilter struct {
+	samples [filterStages]*filterSample
+	next    int
+}
+
+func (f *clockFilter) add(resp *Response, now time.Time) {
+	f.samples[f.next] = &filterSample{
+		offset: resp.ClockOffset,
+		delay:  resp.RTT,
+		disp: resp.Precision + localPrecision +
+			time.Duration(phi*float64(resp.RTT)),
+		time: now,
+		resp: resp,
+	}
+	f.next = (f.next + 1) % filterStages
+}
+
+func (f *clockFilter) filter(now time.Time) *FilterResult {
+	valid := make([]*filterSample, 0, filterStages)
+	disps := make(map[*filterSample]time.Duration, filterStages)
+	for _, s := range f.samples {
+		if s == nil {
+			continue
+		}
+		disp := s.disp + time.Duration(phi*float64(now.Sub(s.time)))
+		if disp >= maxDispersion {
+			continue
+		}
+		disps[s] = disp
+		valid = append(valid, s)
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+	sort.SliceStable(valid, func(i, j int) bool {
+		if valid[i].delay != valid[j].delay {
+			return valid[i].delay < valid[j].delay
+		}
+		return disps[valid[i]] < disps[valid[j]]
+	})
+
+	best := valid[0]
+	result := &FilterResult{
+		Offset:   best.offset,
+		Delay:    best.delay,
+		Samples:  len(valid),
+		Response: best.resp,
+	}
+	// Invalid stages count as maxDispersion, halving the weight per stage.
+	var disp, jitter float64
+	for i := 0; i < filterStages; i++ {
+		d := float64(maxDispersion)
+		if i < len(valid) {
+			d = float64(disps[valid[i]])
+			diff := float64(valid[i].offset - best.offset)
+			jitter += diff * diff
+		}
+		disp += d / math.Exp2(float64(i+1))
+	}
+	result.Dispersion = time.Duration(disp)
+	if len(valid) > 1 {
+		result.Jitter = time.Duration(math.Sqrt(jitter / float64(len(valid)-1)))
+	}
+	return result
+}
+
+// ResetFilter clears the clock filter register, for example after the
+// local clock was stepped.
+func (nc *NTPClient) ResetFilter() {
+	nc.mu.Lock()
+	nc.filter = clockFilter{}
+	nc.mu.Unlock()
+}
+
+// QueryBurst sends n queries spaced by Config.BurstInterval, feeds each
+// answered one into the client's clock filter register and returns the
+// filtered result. Failed queries are skipped; an error is returned only
+// when none of them was answered. A Kiss-o'-Death ends the burst. The
+// register persists across bursts, so older samples still take part until
+// they are shifted out or their dispersion has aged past maxDispersion.
+func (nc *NTPClient) QueryBurst(ctx context.Context, n int) (*FilterResult, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid burst size [%d]", n)
+	}
+	if err := nc.startPoll(); err != nil {
+		return nil, err
+	}
+	var lastErr error
+	answered := 0
+burst:
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				lastErr = ctx.Err()
+				break burst
+			case <-nc.clock.After(nc.conf.burstInterval()):
+			}
+		}
+		resp, err := nc.queryContext(ctx)
+		if err != nil {
+			lastErr = err
+			var ke *KissError
+			if errors.As(err, &ke) {
+				if answered == 0 {
+					return nil, err
+				}
+				break burst
+			}
+			continue
+		}
+		nc.mu.Lock()
+		nc.filter.add(resp, nc.clock.Now())
+		nc.mu.Unlock()
+		answered++
+	}
+	if answered == 0 {
+		return nil, fmt.Errorf("no answer in burst of %d: %v", n, lastErr)
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.filter.filter(nc.clock.Now()), nil
+}
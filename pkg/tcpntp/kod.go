@@ -0,0 +1,102 @@
+package tcpntp
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// queryPoll is the poll exponent sent in queries. A server asking for
+	// a larger one in its response sets the minimum interval between polls.
+	queryPoll int8 = 0
+	// minRatePoll is the poll interval after a first RATE kiss code.
+	minRatePoll = 16 * time.Second
+)
+
+// KissError is returned by a query answered with a Kiss-o'-Death packet,
+// RFC 5905 section 7.4.
+type KissError struct {
+	Address string
+	Code    string
+	// Poll is the poll interval advertised in the kiss packet.
+	Poll time.Duration
+}
+
+func (e *KissError) Error() string {
+	return fmt.Sprintf("ntp server [%s] sent kiss code [%s]", e.Address, e.Code)
+}
+
+// Fatal reports whether the server refused service with DENY or RSTR. The
+// client then stops querying it until Open is called again.
+func (e *KissError) Fatal() bool {
+	return e.Code == "DENY" || e.Code == "RSTR"
+}
+
+// startPoll starts a poll, a single query or a burst, unless the server
+// denied access or the interval it asked for since the previous poll has
+// not elapsed.
+func (nc *NTPClient) startPoll() error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.denied != nil {
+		return nc.denied
+	}
+	interval := nc.minPoll
+	if nc.ratePoll > interval {
+		interval = nc.ratePoll
+	}
+	now := nc.clock.Now()
+	if next := nc.lastPoll.Add(interval); now.Before(next) {
+		return fmt.Errorf("ntp client [%s] rate limited until %s",
+			nc.conf.Address, next.Format(time.RFC3339))
+	}
+	nc.lastPoll = now
+	return nil
+}
+
+// polled records the poll interval advertised by a server response. The
+// interval raised by RATE kiss codes relaxes by half on each answer.
+func (nc *NTPClient) polled(resp *Response) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.minPoll = 0
+	if resp.Poll > toInterval(queryPoll) {
+		nc.minPoll = resp.Poll
+	}
+	if nc.ratePoll /= 2; nc.ratePoll < minRatePoll {
+		nc.ratePoll = 0
+	}
+}
+
+// kissed acts on a Kiss-o'-Death received on pc: RATE doubles the poll
+// interval, DENY and RSTR stop the client, and any other code drops the
+// connections so that the next query resolves and dials the server again.
+func (nc *NTPClient) kissed(pc *poolConn, ke *KissError) {
+	nc.mu.Lock()
+	nc.lastErr = ke
+	var idle []*poolConn
+	switch {
+	case ke.Code == "RATE":
+		nc.ratePoll *= 2
+		if nc.ratePoll < minRatePoll {
+			nc.ratePoll = minRatePoll
+		}
+		if ke.Poll > nc.ratePoll {
+			nc.ratePoll = ke.Poll
+		}
+		if nc.ratePoll > maxPollInterval {
+			nc.ratePoll = maxPollInterval
+		}
+	case ke.Fatal():
+		nc.denied = ke
+		nc.state = StateDenied
+		idle = nc.drop()
+	default:
+		nc.state = StateBroken
+		nc.nextDial = nc.clock.Now()
+		idle = nc.drop()
+	}
+	nc.mu.Unlock()
+	closeConns(idle)
+	nc.release(pc, true)
+}
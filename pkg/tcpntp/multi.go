@@ -0,0 +1,340 @@
+package tcpntp
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SourceResult is the per server outcome of a MultiClient query.
+type SourceResult struct {
+	Address string
+
+	// Filter is the clock filter output of the source, nil if the source
+	// did not answer.
+	Filter *FilterResult
+	Err    error
+
+	// RootDistance is the synchronization distance used as the half width
+	// of the source's correctness interval.
+	RootDistance time.Duration
+
+	// Truechimer reports whether the correctness interval of the source
+	// overlaps the intersection interval; otherwise it is a falseticker.
+	Truechimer bool
+
+	// Survivor reports whether the source survived clustering and took
+	// part in the combined offset.
+	Survivor bool
+}
+
+// SelectResult is the outcome of the selection, clustering and combining
+// algorithms of RFC 5905 section 11.2.
+type SelectResult struct {
+	// Offset is the combined offset of the survivors, weighted by the
+	// inverse of their root distance.
+	Offset time.Duration
+
+	// Jitter is the selection jitter of the survivors relative to the
+	// system peer.
+	Jitter time.Duration
+
+	// SystemPeer is the address of the survivor with the lowest root
+	// distance.
+	SystemPeer string
+
+	// Leap is the leap indicator announced by a majority of the
+	// survivors, LeapNoWarning otherwise.
+	Leap LeapIndicator
+
+	// Low and High bound the intersection interval.
+	Low  time.Duration
+	High time.Duration
+
+	Sources []*SourceResult
+}
+
+// Truechimers returns the addresses of the sources found to be truechimers.
+func (sr *SelectResult) Truechimers() []string {
+	addrs := make([]string, 0, len(sr.Sources))
+	for _, s := range sr.Sources {
+		if s.Truechimer {
+			addrs = append(addrs, s.Address)
+		}
+	}
+	return addrs
+}
+
+// Falsetickers returns the addresses of the sources that answered but were
+// rejected by the intersection algorithm.
+func (sr *SelectResult) Falsetickers() []string {
+	addrs := make([]string, 0, len(sr.Sources))
+	for _, s := range sr.Sources {
+		if s.Filter != nil && !s.Truechimer {
+			addrs = append(addrs, s.Address)
+		}
+	}
+	return addrs
+}
+
+// MultiClient polls a list of servers and selects the time from the
+// majority of them.
+type MultiClient struct {
+	conf    *MultiConfig
+	clients []*NTPClient
+}
+
+func NewMultiClient(conf *MultiConfig) (*MultiClient, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("failed to check multi client config: %v", err)
+	}
+	mc := &MultiClient{
+		conf:    conf,
+		clients: make([]*NTPClient, 0, len(conf.Sources)),
+	}
+	for _, sc := range conf.Sources {
+		nc, err := NewNTPClient(sc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ntp client [%s]: %v",
+				sc.Address, err)
+		}
+		mc.clients = append(mc.clients, nc)
+	}
+	return mc, nil
+}
+
+// Open dials every source and returns the first error. Sources that fail
+// are redialed by later queries.
+func (mc *MultiClient) Open() error {
+	var first error
+	for _, nc := range mc.clients {
+		if err := nc.Open(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (mc *MultiClient) Close() error {
+	var first error
+	for _, nc := range mc.clients {
+		if err := nc.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ResetFilter clears the clock filter register of every source.
+func (mc *MultiClient) ResetFilter() {
+	for _, nc := range mc.clients {
+		nc.ResetFilter()
+	}
+}
+
+// Query runs a burst against every source in parallel and selects the
+// system offset from the answers.
+func (mc *MultiClient) Query(ctx context.Context) (*SelectResult, error) {
+	sources := make([]*SourceResult, len(mc.clients))
+	var wg sync.WaitGroup
+	for i, nc := range mc.clients {
+		wg.Add(1)
+		go func(i int, nc *NTPClient) {
+			defer wg.Done()
+			src := &SourceResult{Address: nc.conf.Address}
+			src.Filter, src.Err = nc.QueryBurst(ctx, mc.conf.burst())
+			sources[i] = src
+		}(i, nc)
+	}
+	wg.Wait()
+	return selectSources(sources, mc.conf.minSurvivors(), mc.conf.minTruechimers())
+}
+
+// selectSources runs the intersection, clustering and combining algorithms
+// over the answered sources.
+func selectSources(sources []*SourceResult,
+	nmin, cmin int) (*SelectResult, error) {
+	result := &SelectResult{Sources: sources}
+	cands := make([]*SourceResult, 0, len(sources))
+	for _, s := range sources {
+		if s.Filter == nil {
+			continue
+		}
+		s.RootDistance = sourceRootDistance(s.Filter)
+		cands = append(cands, s)
+	}
+	if len(cands) == 0 {
+		return result, fmt.Errorf("no source answered")
+	}
+
+	low, high, ok := intersect(cands)
+	if !ok {
+		return result, fmt.Errorf("no majority agreement among %d sources",
+			len(cands))
+	}
+	result.Low, result.High = low, high
+	survivors := make([]*SourceResult, 0, len(cands))
+	for _, s := range cands {
+		if s.Filter.Offset+s.RootDistance < low ||
+			s.Filter.Offset-s.RootDistance > high {
+			continue
+		}
+		s.Truechimer = true
+		survivors = append(survivors, s)
+	}
+	if len(survivors) < cmin {
+		return result, fmt.Errorf("only %d truechimers, need %d",
+			len(survivors), cmin)
+	}
+
+	survivors = cluster(survivors, nmin)
+	for _, s := range survivors {
+		s.Survivor = true
+	}
+	result.SystemPeer = survivors[0].Address
+	result.Offset, result.Jitter = combine(survivors)
+	result.Leap = voteLeap(survivors)
+	return result, nil
+}
+
+// sourceRootDistance returns lambda of RFC 5905 section 11.2:
+// (delay + rootDelay)/2 + dispersion + rootDispersion + jitter.
+func sourceRootDistance(f *FilterResult) time.Duration {
+	var rootDelay, rootDisp time.Duration
+	if f.Response != nil {
+		rootDelay = f.Response.RootDelay
+		rootDisp = f.Response.RootDispersion
+	}
+	d := (f.Delay+rootDelay)/2 + f.Dispersion + rootDisp + f.Jitter
+	if d < minDispersion {
+		d = minDispersion
+	}
+	return d
+}
+
+type endpoint struct {
+	edge time.Duration
+	// kind is +1 for a lower edge, 0 for a midpoint and -1 for an upper
+	// edge.
+	kind int
+}
+
+// intersect is Marzullo's algorithm as modified by RFC 5905 section
+// 11.2.1. It returns the smallest interval containing points from the
+// largest number of correctness intervals, allowing fewer than half of
+// the sources to be falsetickers.
+func intersect(cands []*SourceResult) (low, high time.Duration, ok bool) {
+	n := len(cands)
+	list := make([]endpoint, 0, 3*n)
+	for _, s := range cands {
+		list = append(list,
+			endpoint{s.Filter.Offset - s.RootDistance, 1},
+			endpoint{s.Filter.Offset, 0},
+			endpoint{s.Filter.Offset + s.RootDistance, -1})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].edge != list[j].edge {
+			return list[i].edge < list[j].edge
+		}
+		return list[i].kind > list[j].kind
+	})
+	for allow := 0; 2*allow < n; allow++ {
+		found, chime := 0, 0
+		low, high = math.MaxInt64, math.MinInt64
+		for _, e := range list {
+			chime += e.kind
+			if chime >= n-allow {
+				low = e.edge
+				break
+			}
+			if e.kind == 0 {
+				found++
+			}
+		}
+		chime = 0
+		for i := len(list) - 1; i >= 0; i-- {
+			chime -= list[i].kind
+			if chime >= n-allow {
+				high = list[i].edge
+				break
+			}
+			if list[i].kind == 0 {
+				found++
+			}
+		}
+		if found > allow {
+			continue
+		}
+		if high >= low {
+			return low, high, true
+		}
+	}
+	return 0, 0, false
+}
+
+// cluster is the clustering algorithm of RFC 5905 section 11.2.2. The
+// survivor with the largest selection jitter is pruned until that jitter
+// is below the smallest peer jitter or only nmin survivors are left. The
+// result is sorted by root distance.
+func cluster(survivors []*SourceResult, nmin int) []*SourceResult {
+	sort.SliceStable(survivors, func(i, j int) bool {
+		return survivors[i].RootDistance < survivors[j].RootDistance
+	})
+	for len(survivors) > nmin {
+		maxSel, maxIdx := -1.0, 0
+		minPeer := math.MaxFloat64
+		for i, s := range survivors {
+			var sum float64
+			for _, o := range survivors {
+				d := float64(s.Filter.Offset - o.Filter.Offset)
+				sum += d * d
+			}
+			sel := math.Sqrt(sum / float64(len(survivors)-1))
+			if sel > maxSel {
+				maxSel, maxIdx = sel, i
+			}
+			if j := float64(s.Filter.Jitter); j < minPeer {
+				minPeer = j
+			}
+		}
+		if maxSel <= minPeer {
+			break
+		}
+		survivors = append(survivors[:maxIdx], survivors[maxIdx+1:]...)
+	}
+	return survivors
+}
+
+// voteLeap returns the leap indicator of more than half of the survivors.
+func voteLeap(survivors []*SourceResult) LeapIndicator {
+	votes := make(map[LeapIndicator]int)
+	for _, s := range survivors {
+		votes[s.Filter.Response.Leap]++
+	}
+	for li, n := range votes {
+		if li != LeapNoWarning && 2*n > len(survivors) {
+			return li
+		}
+	}
+	return LeapNoWarning
+}
+
+// combine is the combining algorithm of RFC 5905 section 11.2.3.
+func combine(survivors []*SourceResult) (offset, jitter time.Duration) {
+	var y, z, w float64
+	peer := float64(survivors[0].Filter.Offset)
+	for _, s := range survivors {
+		x := 1 / float64(s.RootDistance)
+		y += x
+		z += x * float64(s.Filter.Offset)
+		d := float64(s.Filter.Offset) - peer
+		w += x * d * d
+	}
+	return time.Duration(z / y), time.Duration(math.Sqrt(w / y))
+}
@@ -1,6 +1,11 @@
 package tcpntp
 
-import "time"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
 
 // The LeapIndicator is used to warn if a leap second should be inserted
 // or deleted in the last minute of the current month.
@@ -28,6 +33,18 @@ const (
 	defaultTimeout    = 5 * time.Second
 	maxPollInterval   = (1 << 17) * time.Second
 	maxDispersion     = 16 * time.Second
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = 64 * time.Second
+	defaultBurstDelay = 200 * time.Millisecond
+	defaultPoolSize   = 4
+	filterStages      = 8
+	minDispersion     = 10 * time.Millisecond
+	minSurvivors      = 3
+	phi               = 15e-6 // frequency tolerance (s/s)
+	localPrecision    = time.Microsecond
+	packetSize        = 48
+	maxMACSize        = 24
+	maxPacketSize     = 1500
 )
 
 // Internal variables
@@ -35,6 +52,14 @@ var (
 	ntpEpoch = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
 )
 
+// ntpUnixOffset is the number of seconds from the NTP epoch to the Unix
+// epoch, and eraSeconds the length of an NTP era, the range of the 32-bit
+// seconds field. Era 1 starts on 2036-02-07 06:28:16 UTC.
+const (
+	ntpUnixOffset = 2208988800
+	eraSeconds    = 1 << 32
+)
+
 // An ntpTime is a 64-bit fixed-point (Q32.32) representation of the number of
 // seconds elapsed.
 type ntpTime uint64
@@ -51,23 +76,86 @@ func (t ntpTime) Duration() time.Duration {
 	return time.Duration(sec + nsec)
 }
 
-// Time interprets the fixed-point ntpTime as an absolute time and returns
-// the corresponding time.Time value.
-func (t ntpTime) Time() time.Time {
-	return ntpEpoch.Add(t.Duration())
+// Time interprets the fixed-point ntpTime as an absolute time in the NTP
+// era closest to pivot, normally a reading of the local clock. The zero
+// ntpTime, used for unset timestamps, is the NTP epoch.
+func (t ntpTime) Time(pivot time.Time) time.Time {
+	if t == 0 {
+		return ntpEpoch
+	}
+	return t.timeNear(pivot)
+}
+
+// timeNear interprets the fixed-point ntpTime as an absolute time in the
+// NTP era closest to pivot, that is within 68 years of it.
+func (t ntpTime) timeNear(pivot time.Time) time.Time {
+	p := pivot.Unix() + ntpUnixOffset
+	sec := p + int64(int32(uint32(t>>32)-uint32(p)))
+	return time.Unix(sec-ntpUnixOffset, 0).UTC().
+		Add((t & 0xffffffff).Duration())
+}
+
+// sub returns t-u. Like RFC 5905, it takes the difference modulo 2^64 as
+// signed, so it holds across an era boundary for times less than 68 years
+// apart.
+func (t ntpTime) sub(u ntpTime) time.Duration {
+	d := int64(t - u)
+	if d < 0 {
+		return -ntpTime(-d).Duration()
+	}
+	return ntpTime(d).Duration()
 }
 
 // toNtpTime converts the time.Time value t into its 64-bit fixed-point
-// ntpTime representation.
+// ntpTime representation. The era of t is not represented and must be
+// recovered from a pivot, see timeNear.
 func toNtpTime(t time.Time) ntpTime {
-	nsec := uint64(t.Sub(ntpEpoch))
-	sec := nsec / nanoPerSec
-	nsec = uint64(nsec-sec*nanoPerSec) << 32
-	frac := uint64(nsec / nanoPerSec)
+	sec := t.Unix() + ntpUnixOffset
+	nsec := uint64(t.Nanosecond()) << 32
+	frac := nsec / nanoPerSec
 	if nsec%nanoPerSec >= nanoPerSec/2 {
 		frac++
 	}
-	return ntpTime(sec<<32 | frac)
+	if frac == 1<<32 {
+		sec, frac = sec+1, 0
+	}
+	return ntpTime(uint64(uint32(sec))<<32 | frac)
+}
+
+// ntpEra returns the NTP era of t; era 0 starts at the NTP epoch.
+func ntpEra(t time.Time) int {
+	sec := t.Unix() + ntpUnixOffset
+	if sec < 0 {
+		return int((sec+1)/eraSeconds) - 1
+	}
+	return int(sec / eraSeconds)
+}
+
+// ToNTPTime returns the 64-bit NTP timestamp of t, with the era dropped.
+func ToNTPTime(t time.Time) uint64 {
+	return uint64(toNtpTime(t))
+}
+
+// FromNTPTime returns the time of the 64-bit NTP timestamp ts in the era
+// closest to pivot, usually the local clock.
+func FromNTPTime(ts uint64, pivot time.Time) time.Time {
+	return ntpTime(ts).timeNear(pivot)
+}
+
+// NTPEra returns the NTP era of t: 0 from 1900 to February 2036, 1 after.
+func NTPEra(t time.Time) int {
+	return ntpEra(t)
+}
+
+// ToNTPTimeShort returns the 32-bit NTP short format of d, saturated to
+// [0, 65536) seconds.
+func ToNTPTimeShort(d time.Duration) uint32 {
+	return uint32(toNtpTimeShort(d))
+}
+
+// FromNTPTimeShort returns the duration of the 32-bit NTP short format v.
+func FromNTPTimeShort(v uint32) time.Duration {
+	return ntpTimeShort(v).Duration()
 }
 
 // A Response contains time data, some of which is returned by the NTP server
@@ -136,6 +224,16 @@ type Response struct {
 	// Poll is the maximum interval between successive NTP polling messages.
 	// It is not relevant for simple NTP clients like this one.
 	Poll time.Duration
+
+	// Timestamping tells whether the origin and destination timestamps
+	// were taken by the kernel or in user space, see
+	// Config.KernelTimestamps.
+	Timestamping TimestampSource
+
+	// Interleaved is set when the server answered in interleaved mode.
+	// The offset and delay then measure the previous exchange, timed with
+	// the precise transmit time of the server's previous response.
+	Interleaved bool
 }
 
 // An ntpTimeShort is a 32-bit fixed-point (Q16.16) representation of the
@@ -154,18 +252,34 @@ func (t ntpTimeShort) Duration() time.Duration {
 	return time.Duration(sec + nsec)
 }
 
-type mode uint8
+// toNtpTimeShort converts the time.Duration value d into its 32-bit
+// fixed-point ntpTimeShort representation, saturated to its range of
+// [0, 65536) seconds.
+func toNtpTimeShort(d time.Duration) ntpTimeShort {
+	if d < 0 {
+		return 0
+	}
+	if d >= 65536*time.Second {
+		return ntpTimeShort(0xffffffff)
+	}
+	sec := uint64(d) / nanoPerSec
+	frac := ((uint64(d) - sec*nanoPerSec) << 16) / nanoPerSec
+	return ntpTimeShort(sec<<16 | frac)
+}
+
+// Mode is the association mode of an NTP packet.
+type Mode uint8
 
-// NTP modes. This package uses only client mode.
+// NTP modes. This package uses client and server modes.
 const (
-	reserved mode = 0 + iota
-	symmetricActive
-	symmetricPassive
-	client
-	server
-	broadcast
-	controlMessage
-	reservedPrivate
+	ModeReserved Mode = 0 + iota
+	ModeSymmetricActive
+	ModeSymmetricPassive
+	ModeClient
+	ModeServer
+	ModeBroadcast
+	ModeControl
+	ModePrivate
 )
 
 // msg is an internal representation of an NTP packet.
@@ -183,13 +297,33 @@ type msg struct {
 	TransmitTime   ntpTime
 }
 
+// encodeMsg returns the 48-byte wire encoding of m.
+func encodeMsg(m *msg) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, m)
+	return buf.Bytes()
+}
+
+// decodeMsg decodes the 48-byte header at the start of b.
+func decodeMsg(b []byte) (*msg, error) {
+	if len(b) < packetSize {
+		return nil, fmt.Errorf("short ntp packet [%d]", len(b))
+	}
+	m := new(msg)
+	if err := binary.Read(bytes.NewReader(b[:packetSize]),
+		binary.BigEndian, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // setVersion sets the NTP protocol version on the message.
 func (m *msg) setVersion(v int) {
 	m.LiVnMode = (m.LiVnMode & 0xc7) | uint8(v)<<3
 }
 
 // setMode sets the NTP protocol mode on the message.
-func (m *msg) setMode(md mode) {
+func (m *msg) setMode(md Mode) {
 	m.LiVnMode = (m.LiVnMode & 0xf8) | uint8(md)
 }
 
@@ -199,13 +333,13 @@ func (m *msg) setLeap(li LeapIndicator) {
 }
 
 // getVersion returns the version value in the message.
-// func (m *msg) getVersion() int {
-// 	return int((m.LiVnMode >> 3) & 0x07)
-// }
+func (m *msg) getVersion() int {
+	return int((m.LiVnMode >> 3) & 0x07)
+}
 
 // getMode returns the mode value in the message.
-func (m *msg) getMode() mode {
-	return mode(m.LiVnMode & 0x07)
+func (m *msg) getMode() Mode {
+	return Mode(m.LiVnMode & 0x07)
 }
 
 // getLeap returns the leap indicator on the message.
@@ -214,16 +348,17 @@ func (m *msg) getLeap() LeapIndicator {
 }
 
 // parseTime parses the NTP packet along with the packet receive time to
-// generate a Response record.
-func parseTime(m *msg, recvTime ntpTime) *Response {
+// generate a Response record. Its timestamps are read in the era closest
+// to pivot.
+func parseTime(m *msg, recvTime ntpTime, pivot time.Time) *Response {
 	r := &Response{
-		Time:           m.TransmitTime.Time(),
+		Time:           m.TransmitTime.Time(pivot),
 		ClockOffset:    offset(m.OriginTime, m.ReceiveTime, m.TransmitTime, recvTime),
 		RTT:            rtt(m.OriginTime, m.ReceiveTime, m.TransmitTime, recvTime),
 		Precision:      toInterval(m.Precision),
 		Stratum:        m.Stratum,
 		ReferenceID:    m.ReferenceID,
-		ReferenceTime:  m.ReferenceTime.Time(),
+		ReferenceTime:  m.ReferenceTime.Time(pivot),
 		RootDelay:      m.RootDelay.Duration(),
 		RootDispersion: m.RootDispersion.Duration(),
 		Leap:           m.getLeap(),
@@ -248,17 +383,17 @@ func minError(org, rec, xmt, dst ntpTime) time.Duration {
 	// When either pair indicates a "causality violation", we calculate the
 	// error as the difference in time between them. The minimum error is
 	// the greater of the two causality violations.
-	var error0, error1 ntpTime
-	if org >= rec {
-		error0 = org - rec
+	var error0, error1 time.Duration
+	if d := org.sub(rec); d >= 0 {
+		error0 = d
 	}
-	if xmt >= dst {
-		error1 = xmt - dst
+	if d := xmt.sub(dst); d >= 0 {
+		error1 = d
 	}
 	if error0 > error1 {
-		return error0.Duration()
+		return error0
 	}
-	return error1.Duration()
+	return error1
 }
 
 func kissCode(id uint32) string {
@@ -307,11 +442,9 @@ func toInterval(t int8) time.Duration {
 func offset(org, rec, xmt, dst ntpTime) time.Duration {
 	// local clock offset
 	//   offset = ((rec-org) + (xmt-dst)) / 2
-	a := rec.Time().Sub(org.Time())
-	b := xmt.Time().Sub(dst.Time())
-	offset := (a + b) / time.Duration(2)
-	offset = offset - time.Duration(time.Second*-37)
-	return offset
+	a := rec.sub(org)
+	b := xmt.sub(dst)
+	return (a + b) / time.Duration(2)
 }
 
 // The following helper functions calculate additional metadata about the
@@ -325,8 +458,8 @@ func offset(org, rec, xmt, dst ntpTime) time.Duration {
 func rtt(org, rec, xmt, dst ntpTime) time.Duration {
 	// round trip delay time
 	//   rtt = (dst-org) - (xmt-rec)
-	a := dst.Time().Sub(org.Time())
-	b := xmt.Time().Sub(rec.Time())
+	a := dst.sub(org)
+	b := xmt.sub(rec)
 	rtt := a - b
 	if rtt < 0 {
 		rtt = 0
@@ -0,0 +1,661 @@
+package tcpntp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrNTSNAK is returned when the server answered with an NTS NAK, meaning
+// it could not decrypt the cookie. The client runs a new key exchange on
+// the next query.
+var ErrNTSNAK = errors.New("ntp server sent NTS NAK")
+
+const (
+	ntskeALPN            = "ntske/1"
+	ntsExporterLabel     = "EXPORTER-network-time-security"
+	ntsProtocolNTPv4     = 0
+	ntsAEADAESSIVCMAC256 = 15
+	ntsKeySize           = 32
+	ntsCookieCount       = 8
+	ntsUIDSize           = 32
+	ntsNonceSize         = 16
+	ntsNAKCode           = 0x4e54534e // "NTSN"
+	maxKERecords         = 64
+)
+
+// NTS-KE record types of RFC 8915 section 4.
+const (
+	keEndOfMessage  uint16 = 0
+	keNextProtocol  uint16 = 1
+	keError         uint16 = 2
+	keWarning       uint16 = 3
+	keAEADAlgorithm uint16 = 4
+	keNewCookie     uint16 = 5
+	keServer        uint16 = 6
+	kePort          uint16 = 7
+	keCritical      uint16 = 0x8000
+)
+
+// NTSConfig enables Network Time Security on an NTPClient.
+type NTSConfig struct {
+	// KEAddress is the host:port of the NTS-KE server.
+	KEAddress string
+	// TLSConfig is used for the NTS-KE handshake. TLS 1.3 and the
+	// ntske/1 protocol are enforced on a clone of it.
+	TLSConfig *tls.Config
+}
+
+// ntsSession is the outcome of a key exchange: the AEAD keys, the cookies
+// not spent yet and the negotiated NTP server.
+type ntsSession struct {
+	c2s     *aesSIV
+	s2c     *aesSIV
+	address string
+
+	// mu guards cookies, shared by the queries in flight.
+	mu      sync.Mutex
+	cookies [][]byte
+}
+
+func (st *ntsSession) ready() bool {
+	if st == nil {
+		return false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.cookies) > 0
+}
+
+func appendKERecord(b []byte, typ uint16, critical bool, body []byte) []byte {
+	if critical {
+		typ |= keCritical
+	}
+	hdr := make([]byte, 4)
+	binary.BigEndian.PutUint16(hdr, typ)
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(body)))
+	b = append(b, hdr...)
+	return append(b, body...)
+}
+
+func readKERecord(r io.Reader) (typ uint16, critical bool, body []byte, err error) {
+	hdr := make([]byte, 4)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return
+	}
+	typ = binary.BigEndian.Uint16(hdr)
+	critical = typ&keCritical != 0
+	typ &^= keCritical
+	body = make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+func uint16s(vs ...uint16) []byte {
+	b := make([]byte, 2*len(vs))
+	for i, v := range vs {
+		binary.BigEndian.PutUint16(b[2*i:], v)
+	}
+	return b
+}
+
+func containsUint16(b []byte, v uint16) bool {
+	for i := 0; i+1 < len(b); i += 2 {
+		if binary.BigEndian.Uint16(b[i:]) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ntsExportKeys derives the client-to-server and server-to-client keys
+// from the TLS session as in RFC 8915 section 5.1.
+func ntsExportKeys(cs tls.ConnectionState) (c2s, s2c []byte, err error) {
+	ctx := []byte{0, ntsProtocolNTPv4, 0, ntsAEADAESSIVCMAC256, 0}
+	if c2s, err = cs.ExportKeyingMaterial(ntsExporterLabel,
+		ctx, ntsKeySize); err != nil {
+		return
+	}
+	ctx[4] = 1
+	s2c, err = cs.ExportKeyingMaterial(ntsExporterLabel, ctx, ntsKeySize)
+	return
+}
+
+func ntsTLSConfig(conf *tls.Config) *tls.Config {
+	if conf == nil {
+		conf = &tls.Config{}
+	} else {
+		conf = conf.Clone()
+	}
+	conf.MinVersion = tls.VersionTLS13
+	conf.NextProtos = []string{ntskeALPN}
+	return conf
+}
+
+// ntsKeyExchange runs the NTS-KE protocol against conf.KEAddress. The
+// negotiated NTP server replaces the host and port of defaultAddr.
+func ntsKeyExchange(conf *NTSConfig, defaultAddr string,
+	timeout time.Duration) (*ntsSession, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp",
+		conf.KEAddress, ntsTLSConfig(conf.TLSConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial nts-ke [%s]: %v",
+			conf.KEAddress, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	cs := conn.ConnectionState()
+	if cs.NegotiatedProtocol != ntskeALPN {
+		return nil, fmt.Errorf("nts-ke [%s] did not negotiate %s",
+			conf.KEAddress, ntskeALPN)
+	}
+
+	req := appendKERecord(nil, keNextProtocol, true, uint16s(ntsProtocolNTPv4))
+	req = appendKERecord(req, keAEADAlgorithm, false,
+		uint16s(ntsAEADAESSIVCMAC256))
+	req = appendKERecord(req, keEndOfMessage, true, nil)
+	if _, err = conn.Write(req); err != nil {
+		return nil, fmt.Errorf("failed to send nts-ke request: %v", err)
+	}
+
+	st := &ntsSession{cookies: make([][]byte, 0, ntsCookieCount)}
+	host, port, err := net.SplitHostPort(defaultAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ntp address [%s]: %v", defaultAddr, err)
+	}
+	var protocolOK, aeadOK bool
+	for i := 0; ; i++ {
+		if i == maxKERecords {
+			return nil, fmt.Errorf("too many nts-ke records")
+		}
+		typ, critical, body, err := readKERecord(conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read nts-ke response: %v", err)
+		}
+		switch typ {
+		case keEndOfMessage:
+			if !protocolOK || !aeadOK {
+				return nil, fmt.Errorf("nts-ke [%s] rejected NTPv4 with "+
+					"AEAD_AES_SIV_CMAC_256", conf.KEAddress)
+			}
+			if len(st.cookies) == 0 {
+				return nil, fmt.Errorf("nts-ke [%s] sent no cookie",
+					conf.KEAddress)
+			}
+			c2s, s2c, err := ntsExportKeys(cs)
+			if err != nil {
+				return nil, fmt.Errorf("failed to export nts keys: %v", err)
+			}
+			st.c2s, _ = newAESSIV(c2s)
+			st.s2c, _ = newAESSIV(s2c)
+			st.address = net.JoinHostPort(host, port)
+			return st, nil
+		case keNextProtocol:
+			protocolOK = len(body) == 2 && containsUint16(body, ntsProtocolNTPv4)
+		case keAEADAlgorithm:
+			aeadOK = len(body) == 2 &&
+				containsUint16(body, ntsAEADAESSIVCMAC256)
+		case keError:
+			code := -1
+			if len(body) == 2 {
+				code = int(binary.BigEndian.Uint16(body))
+			}
+			return nil, fmt.Errorf("nts-ke [%s] error code [%d]",
+				conf.KEAddress, code)
+		case keWarning:
+			logrus.WithField("prefix", "tcpntp.nts").
+				Warnf("nts-ke [%s] warning: %x", conf.KEAddress, body)
+		case keNewCookie:
+			st.cookies = append(st.cookies, body)
+		case keServer:
+			host = string(body)
+		case kePort:
+			if len(body) == 2 {
+				port = strconv.Itoa(int(binary.BigEndian.Uint16(body)))
+			}
+		default:
+			if critical {
+				return nil, fmt.Errorf("unknown critical nts-ke record [%d]", typ)
+			}
+		}
+	}
+}
+
+// request appends the NTS extension fields to the encoded query header
+// hdr, spending one cookie and asking for enough new ones to refill the
+// pool. It returns the packet and its unique identifier.
+func (st *ntsSession) request(hdr []byte) ([]byte, []byte, error) {
+	uid := make([]byte, ntsUIDSize)
+	nonce := make([]byte, ntsNonceSize)
+	if _, err := rand.Read(uid); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	st.mu.Lock()
+	if len(st.cookies) == 0 {
+		st.mu.Unlock()
+		return nil, nil, fmt.Errorf("no nts cookie left")
+	}
+	cookie := st.cookies[0]
+	st.cookies = st.cookies[1:]
+	left := len(st.cookies)
+	st.mu.Unlock()
+	pkt := appendExtField(hdr, ExtUniqueIdentifier, uid)
+	pkt = appendExtField(pkt, ExtNTSCookie, cookie)
+	for i := left + 1; i < ntsCookieCount; i++ {
+		pkt = appendExtField(pkt, ExtNTSCookiePlaceholder, make([]byte, len(cookie)))
+	}
+	return appendNTSAuth(pkt, st.c2s, nonce, nil), uid, nil
+}
+
+// verify checks the NTS extension fields of the response pkt to the query
+// identified by uid and stores the cookies it carries.
+func (st *ntsSession) verify(pkt []byte, uid []byte) error {
+	fields, _, err := parseExtFields(pkt[packetSize:], 0)
+	if err != nil {
+		return err
+	}
+	uidOK := false
+	for _, f := range fields {
+		if f.Type == ExtUniqueIdentifier && bytes.Equal(f.Body, uid) {
+			uidOK = true
+		}
+	}
+	if !uidOK {
+		return fmt.Errorf("nts unique identifier mismatch")
+	}
+	if m, _ := decodeMsg(pkt); m.Stratum == 0 && m.ReferenceID == ntsNAKCode {
+		st.mu.Lock()
+		st.cookies = nil
+		st.mu.Unlock()
+		return ErrNTSNAK
+	}
+	plaintext, err := openNTSAuth(pkt, fields, st.s2c)
+	if err != nil {
+		return err
+	}
+	inner, _, err := parseExtFields(plaintext, 0)
+	if err != nil {
+		return fmt.Errorf("invalid encrypted extension fields: %v", err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, f := range inner {
+		if f.Type == ExtNTSCookie && len(st.cookies) < ntsCookieCount {
+			st.cookies = append(st.cookies, f.Body)
+		}
+	}
+	return nil
+}
+
+// appendNTSAuth appends the NTS Authenticator and Encrypted Extension
+// Fields field, authenticating everything in pkt so far.
+func appendNTSAuth(pkt []byte, aead *aesSIV, nonce, plaintext []byte) []byte {
+	ct := aead.seal(nonce, plaintext, pkt)
+	body := uint16s(uint16(len(nonce)), uint16(len(ct)))
+	body = append(body, nonce...)
+	body = append(body, make([]byte, (len(nonce)+3)&^3-len(nonce))...)
+	body = append(body, ct...)
+	return appendExtField(pkt, ExtNTSAuthenticator, body)
+}
+
+// openNTSAuth verifies the authenticator among fields of pkt and returns
+// the decrypted extension fields. Fields after the authenticator are not
+// authenticated and are ignored.
+func openNTSAuth(pkt []byte, fields []ExtensionField, aead *aesSIV) ([]byte, error) {
+	off := packetSize
+	for _, f := range fields {
+		if f.Type != ExtNTSAuthenticator {
+			off += extHeaderSize + len(f.Body)
+			continue
+		}
+		if len(f.Body) < 4 {
+			return nil, fmt.Errorf("truncated nts authenticator")
+		}
+		nlen := int(binary.BigEndian.Uint16(f.Body))
+		clen := int(binary.BigEndian.Uint16(f.Body[2:]))
+		npad := (nlen + 3) &^ 3
+		if 4+npad+clen > len(f.Body) {
+			return nil, fmt.Errorf("truncated nts authenticator")
+		}
+		nonce := f.Body[4 : 4+nlen]
+		ct := f.Body[4+npad : 4+npad+clen]
+		plaintext, err := aead.open(nonce, ct, pkt[:off])
+		if err != nil {
+			return nil, fmt.Errorf("nts authenticator: %v", err)
+		}
+		return plaintext, nil
+	}
+	return nil, fmt.Errorf("nts authenticator missing")
+}
+
+// NTSCookieKey seals the cookies handed out by the NTS-KE server. The
+// NTS-KE server and the NTP servers accepting its cookies must share it.
+type NTSCookieKey struct {
+	id   uint32
+	aead *aesSIV
+}
+
+func NewNTSCookieKey(id uint32, secret []byte) (*NTSCookieKey, error) {
+	aead, err := newAESSIV(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nts cookie key: %v", err)
+	}
+	return &NTSCookieKey{id: id, aead: aead}, nil
+}
+
+// GenerateNTSCookieKey returns a cookie key with a random secret.
+func GenerateNTSCookieKey() (*NTSCookieKey, error) {
+	secret := make([]byte, ntsKeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return NewNTSCookieKey(binary.BigEndian.Uint32(id), secret)
+}
+
+// seal returns a cookie made of the key ID, a nonce and the sealed keys.
+func (k *NTSCookieKey) seal(c2s, s2c []byte) ([]byte, error) {
+	cookie := make([]byte, 4+ntsNonceSize)
+	binary.BigEndian.PutUint32(cookie, k.id)
+	if _, err := rand.Read(cookie[4:]); err != nil {
+		return nil, err
+	}
+	plaintext := append(append([]byte{}, c2s...), s2c...)
+	return append(cookie, k.aead.seal(cookie[4:], plaintext, cookie[:4])...), nil
+}
+
+func (k *NTSCookieKey) open(cookie []byte) (c2s, s2c []byte, err error) {
+	if len(cookie) < 4+ntsNonceSize {
+		return nil, nil, fmt.Errorf("nts cookie too short")
+	}
+	if binary.BigEndian.Uint32(cookie) != k.id {
+		return nil, nil, fmt.Errorf("unknown nts cookie key id")
+	}
+	plaintext, err := k.aead.open(cookie[4:4+ntsNonceSize],
+		cookie[4+ntsNonceSize:], cookie[:4])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(plaintext) != 2*ntsKeySize {
+		return nil, nil, fmt.Errorf("invalid nts cookie content")
+	}
+	return plaintext[:ntsKeySize], plaintext[ntsKeySize:], nil
+}
+
+// ntsRequest is an NTS query accepted by the server.
+type ntsRequest struct {
+	uid          []byte
+	s2c          *aesSIV
+	c2sKey       []byte
+	s2cKey       []byte
+	placeholders int
+}
+
+// ntsCheckRequest verifies the NTS extension fields of the query pkt. The
+// unique identifier is returned along with an error when the query can be
+// answered with an NTS NAK.
+func ntsCheckRequest(pkt []byte, k *NTSCookieKey) (*ntsRequest, []byte, error) {
+	fields, _, err := parseExtFields(pkt[packetSize:], 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	req := &ntsRequest{}
+	var cookie []byte
+	for _, f := range fields {
+		switch f.Type {
+		case ExtUniqueIdentifier:
+			req.uid = f.Body
+		case ExtNTSCookie:
+			if cookie != nil {
+				return nil, nil, fmt.Errorf("more than one nts cookie")
+			}
+			cookie = f.Body
+		case ExtNTSCookiePlaceholder:
+			req.placeholders++
+		}
+	}
+	if len(req.uid) < ntsUIDSize || cookie == nil {
+		return nil, nil, fmt.Errorf("not an nts query")
+	}
+	if req.c2sKey, req.s2cKey, err = k.open(cookie); err != nil {
+		return nil, req.uid, fmt.Errorf("failed to open nts cookie: %v", err)
+	}
+	c2s, _ := newAESSIV(req.c2sKey)
+	req.s2c, _ = newAESSIV(req.s2cKey)
+	if _, err = openNTSAuth(pkt, fields, c2s); err != nil {
+		return nil, req.uid, err
+	}
+	if req.placeholders > ntsCookieCount-1 {
+		req.placeholders = ntsCookieCount - 1
+	}
+	return req, nil, nil
+}
+
+// response appends the NTS extension fields to the encoded response header
+// hdr: the unique identifier and, encrypted, one new cookie per cookie and
+// placeholder in the query.
+func (req *ntsRequest) response(hdr []byte, k *NTSCookieKey) ([]byte, error) {
+	var plaintext []byte
+	for i := 0; i <= req.placeholders; i++ {
+		cookie, err := k.seal(req.c2sKey, req.s2cKey)
+		if err != nil {
+			return nil, err
+		}
+		plaintext = appendExtField(plaintext, ExtNTSCookie, cookie)
+	}
+	nonce := make([]byte, ntsNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	pkt := appendExtField(hdr, ExtUniqueIdentifier, req.uid)
+	return appendNTSAuth(pkt, req.s2c, nonce, plaintext), nil
+}
+
+// ntsNAK returns an NTS NAK answering the query with unique identifier
+// uid, built on the response m.
+func ntsNAK(m *msg, uid []byte) []byte {
+	m.Stratum = 0
+	m.ReferenceID = ntsNAKCode
+	return appendExtField(encodeMsg(m), ExtUniqueIdentifier, uid)
+}
+
+type NTSKEServerConfig struct {
+	Address string
+	// TLSConfig must carry the server certificate. TLS 1.3 and the
+	// ntske/1 protocol are enforced on a clone of it.
+	TLSConfig *tls.Config
+	CookieKey *NTSCookieKey
+	// NTPServer and NTPPort are announced to clients when set.
+	NTPServer string
+	NTPPort   uint16
+}
+
+func (conf *NTSKEServerConfig) Check() error {
+	if conf.Address == "" {
+		return fmt.Errorf("nts-ke address not set")
+	}
+	if conf.TLSConfig == nil || (len(conf.TLSConfig.Certificates) == 0 &&
+		conf.TLSConfig.GetCertificate == nil) {
+		return fmt.Errorf("nts-ke tls certificate not set")
+	}
+	if conf.CookieKey == nil {
+		return fmt.Errorf("nts cookie key not set")
+	}
+	return nil
+}
+
+// NTSKEServer hands out NTS cookies and keys over TLS.
+type NTSKEServer struct {
+	conf     *NTSKEServerConfig
+	listener net.Listener
+	wg       sync.WaitGroup
+	closed   chan struct{}
+}
+
+func NewNTSKEServer(conf *NTSKEServerConfig) (*NTSKEServer, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("failed to check nts-ke server config: %v", err)
+	}
+	return &NTSKEServer{
+		conf:   conf,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+func (ks *NTSKEServer) Listen() error {
+	l, err := net.Listen("tcp", ks.conf.Address)
+	if err != nil {
+		return fmt.Errorf("failed to listen nts-ke addr [%s]: %v",
+			ks.conf.Address, err)
+	}
+	ks.listener = tls.NewListener(l, ntsTLSConfig(ks.conf.TLSConfig))
+	return nil
+}
+
+// Addr returns the listener address, or nil if the server is not listening.
+func (ks *NTSKEServer) Addr() net.Addr {
+	if ks.listener == nil {
+		return nil
+	}
+	return ks.listener.Addr()
+}
+
+func (ks *NTSKEServer) Start() chan error {
+	errChan := make(chan error, 1)
+	if ks.listener == nil {
+		if err := ks.Listen(); err != nil {
+			errChan <- err
+			return errChan
+		}
+	}
+	go func() {
+		for {
+			conn, err := ks.listener.Accept()
+			if err != nil {
+				select {
+				case <-ks.closed:
+					errChan <- nil
+				default:
+					errChan <- fmt.Errorf("failed to accept nts-ke conn: %v", err)
+				}
+				return
+			}
+			ks.wg.Add(1)
+			go ks.serve(conn.(*tls.Conn))
+		}
+	}()
+	return errChan
+}
+
+func (ks *NTSKEServer) Close() error {
+	select {
+	case <-ks.closed:
+		return nil
+	default:
+	}
+	close(ks.closed)
+	var err error
+	if ks.listener != nil {
+		err = ks.listener.Close()
+	}
+	ks.wg.Wait()
+	return err
+}
+
+func (ks *NTSKEServer) serve(conn *tls.Conn) {
+	defer ks.wg.Done()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(defaultTimeout))
+	if err := ks.exchange(conn); err != nil {
+		logrus.WithField("prefix", "tcpntp.nts").
+			Warnf("nts-ke with [%s] failed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+func (ks *NTSKEServer) exchange(conn *tls.Conn) error {
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	cs := conn.ConnectionState()
+	if cs.NegotiatedProtocol != ntskeALPN {
+		return fmt.Errorf("client did not negotiate %s", ntskeALPN)
+	}
+	var protocolOK, aeadOK bool
+	for i := 0; ; i++ {
+		if i == maxKERecords {
+			return fmt.Errorf("too many nts-ke records")
+		}
+		typ, critical, body, err := readKERecord(conn)
+		if err != nil {
+			return err
+		}
+		if typ == keEndOfMessage {
+			break
+		}
+		switch typ {
+		case keNextProtocol:
+			protocolOK = containsUint16(body, ntsProtocolNTPv4)
+		case keAEADAlgorithm:
+			aeadOK = containsUint16(body, ntsAEADAESSIVCMAC256)
+		default:
+			if critical {
+				// Unrecognized Critical Record
+				conn.Write(appendKERecord(appendKERecord(nil, keError, true,
+					uint16s(0)), keEndOfMessage, true, nil))
+				return fmt.Errorf("unknown critical nts-ke record [%d]", typ)
+			}
+		}
+	}
+
+	resp := make([]byte, 0, 1024)
+	if protocolOK {
+		resp = appendKERecord(resp, keNextProtocol, true,
+			uint16s(ntsProtocolNTPv4))
+	} else {
+		resp = appendKERecord(resp, keNextProtocol, true, nil)
+	}
+	if protocolOK && aeadOK {
+		resp = appendKERecord(resp, keAEADAlgorithm, false,
+			uint16s(ntsAEADAESSIVCMAC256))
+		if ks.conf.NTPServer != "" {
+			resp = appendKERecord(resp, keServer, true,
+				[]byte(ks.conf.NTPServer))
+		}
+		if ks.conf.NTPPort != 0 {
+			resp = appendKERecord(resp, kePort, true, uint16s(ks.conf.NTPPort))
+		}
+		c2s, s2c, err := ntsExportKeys(cs)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < ntsCookieCount; i++ {
+			cookie, err := ks.conf.CookieKey.seal(c2s, s2c)
+			if err != nil {
+				return err
+			}
+			resp = appendKERecord(resp, keNewCookie, false, cookie)
+		}
+	}
+	resp = appendKERecord(resp, keEndOfMessage, true, nil)
+	_, err := conn.Write(resp)
+	return err
+}
@@ -0,0 +1,127 @@
+package tcpntp
+
+import (
+	"fmt"
+)
+
+// Packet is an NTP packet: the 48-byte header, the RFC 7822 extension
+// fields and an optional MAC. Timestamps keep their wire formats; convert
+// them with FromNTPTime and FromNTPTimeShort.
+type Packet struct {
+	LiVnMode       uint8 // Leap Indicator (2) + Version (3) + Mode (3)
+	Stratum        uint8
+	Poll           int8
+	Precision      int8
+	RootDelay      uint32
+	RootDispersion uint32
+	ReferenceID    uint32
+	ReferenceTime  uint64
+	OriginTime     uint64
+	ReceiveTime    uint64
+	TransmitTime   uint64
+
+	// Extensions are the extension fields following the header.
+	Extensions []ExtensionField
+	// MAC is the key ID and digest ending the packet, or the 4-byte zero
+	// key ID of a crypto-NAK.
+	MAC []byte
+}
+
+// Leap returns the leap indicator of the packet.
+func (p *Packet) Leap() LeapIndicator {
+	return LeapIndicator(p.LiVnMode >> 6)
+}
+
+// SetLeap sets the leap indicator of the packet.
+func (p *Packet) SetLeap(li LeapIndicator) {
+	p.LiVnMode = (p.LiVnMode & 0x3f) | uint8(li&0x03)<<6
+}
+
+// Version returns the protocol version of the packet.
+func (p *Packet) Version() int {
+	return int((p.LiVnMode >> 3) & 0x07)
+}
+
+// SetVersion sets the protocol version of the packet.
+func (p *Packet) SetVersion(v int) {
+	p.LiVnMode = (p.LiVnMode & 0xc7) | uint8(v&0x07)<<3
+}
+
+// Mode returns the association mode of the packet.
+func (p *Packet) Mode() Mode {
+	return Mode(p.LiVnMode & 0x07)
+}
+
+// SetMode sets the association mode of the packet.
+func (p *Packet) SetMode(m Mode) {
+	p.LiVnMode = (p.LiVnMode & 0xf8) | uint8(m&0x07)
+}
+
+// Marshal returns the wire encoding of the packet.
+func (p *Packet) Marshal() ([]byte, error) {
+	pkt := encodeMsg(p.msg())
+	var err error
+	for _, f := range p.Extensions {
+		if pkt, err = AppendExtensionField(pkt, f); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.MAC) > maxMACSize {
+		return nil, fmt.Errorf("mac too long [%d]", len(p.MAC))
+	}
+	return append(pkt, p.MAC...), nil
+}
+
+// Unmarshal decodes the packet b. As in RFC 7822, at most 24 bytes left
+// after the header or an extension field are the MAC, anything longer
+// starts another extension field.
+func (p *Packet) Unmarshal(b []byte) error {
+	m, err := decodeMsg(b)
+	if err != nil {
+		return err
+	}
+	*p = Packet{
+		LiVnMode:       m.LiVnMode,
+		Stratum:        m.Stratum,
+		Poll:           m.Poll,
+		Precision:      m.Precision,
+		RootDelay:      uint32(m.RootDelay),
+		RootDispersion: uint32(m.RootDispersion),
+		ReferenceID:    m.ReferenceID,
+		ReferenceTime:  uint64(m.ReferenceTime),
+		OriginTime:     uint64(m.OriginTime),
+		ReceiveTime:    uint64(m.ReceiveTime),
+		TransmitTime:   uint64(m.TransmitTime),
+	}
+	fields, mac, err := parseExtFields(b[packetSize:], maxMACSize)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		p.Extensions = append(p.Extensions, ExtensionField{
+			Type: f.Type,
+			Body: append([]byte(nil), f.Body...),
+		})
+	}
+	if len(mac) > 0 {
+		p.MAC = append([]byte(nil), mac...)
+	}
+	return nil
+}
+
+// msg returns the header of the packet.
+func (p *Packet) msg() *msg {
+	return &msg{
+		LiVnMode:       p.LiVnMode,
+		Stratum:        p.Stratum,
+		Poll:           p.Poll,
+		Precision:      p.Precision,
+		RootDelay:      ntpTimeShort(p.RootDelay),
+		RootDispersion: ntpTimeShort(p.RootDispersion),
+		ReferenceID:    p.ReferenceID,
+		ReferenceTime:  ntpTime(p.ReferenceTime),
+		OriginTime:     ntpTime(p.OriginTime),
+		ReceiveTime:    ntpTime(p.ReceiveTime),
+		TransmitTime:   ntpTime(p.TransmitTime),
+	}
+}
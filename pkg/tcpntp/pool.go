@@ -0,0 +1,148 @@
+package tcpntp
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// poolConn is a connection of the NTPClient pool. A stream carries one
+// query at a time, and a datagram socket would hand the response of one
+// query to the reader of another, so each query in flight holds its own.
+type poolConn struct {
+	net.Conn
+	// gen is the pool generation the connection was dialed in; it is
+	// closed instead of kept once the generation moved on.
+	gen int
+	// nts is the session the connection was dialed for.
+	nts *ntsSession
+	// prev is the last exchange, timed by an interleaved response to the
+	// next query.
+	prev *xleaveExchange
+}
+
+// acquire waits for a free slot of the pool and returns an idle connection,
+// or dials a new one unless the backoff after the previous failure has not
+// elapsed yet. The connection must be given back with release.
+func (nc *NTPClient) acquire(ctx context.Context) (*poolConn, error) {
+	select {
+	case nc.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	pc, err := nc.take()
+	if err != nil {
+		<-nc.slots
+		return nil, err
+	}
+	return pc, nil
+}
+
+func (nc *NTPClient) take() (*poolConn, error) {
+	nc.mu.Lock()
+	state, lastErr, nextDial := nc.state, nc.lastErr, nc.nextDial
+	switch state {
+	case StateClosed:
+		nc.mu.Unlock()
+		return nil, fmt.Errorf("ntp client [%s] closed", nc.conf.Address)
+	case StateDenied:
+		nc.mu.Unlock()
+		return nil, lastErr
+	}
+	// Once all cookies are spent or were rejected, the next dial runs a
+	// new key exchange.
+	if n := len(nc.idle); n > 0 && (nc.conf.NTS == nil || nc.nts.ready()) {
+		pc := nc.idle[n-1]
+		nc.idle = nc.idle[:n-1]
+		nc.busy[pc] = struct{}{}
+		nc.mu.Unlock()
+		return pc, nil
+	}
+	nc.mu.Unlock()
+
+	if state == StateBroken && nc.clock.Now().Before(nextDial) {
+		return nil, ErrConnBroken
+	}
+	pc, err := nc.dial()
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.state == StateClosed {
+		if pc != nil {
+			pc.Close()
+		}
+		return nil, fmt.Errorf("ntp client [%s] closed", nc.conf.Address)
+	}
+	if err != nil {
+		nc.failures++
+		nc.nextDial = nc.clock.Now().Add(nc.conf.backoff(nc.failures))
+		nc.state = StateBroken
+		nc.lastErr = err
+		return nil, err
+	}
+	nc.failures = 0
+	nc.state = StateConnected
+	nc.lastErr = nil
+	nc.busy[pc] = struct{}{}
+	return pc, nil
+}
+
+// release gives back a connection taken by acquire. It is kept for the
+// next query only if keep is set and the pool was not reset meanwhile.
+func (nc *NTPClient) release(pc *poolConn, keep bool) {
+	nc.mu.Lock()
+	delete(nc.busy, pc)
+	keep = keep && pc.gen == nc.gen && nc.state != StateClosed
+	if keep {
+		nc.idle = append(nc.idle, pc)
+	}
+	nc.mu.Unlock()
+	if !keep {
+		pc.Close()
+	}
+	<-nc.slots
+}
+
+// drop resets the pool: it returns the idle connections for the caller to
+// close, and the busy ones are closed when released. nc.mu must be held.
+func (nc *NTPClient) drop() []*poolConn {
+	nc.gen++
+	idle := nc.idle
+	nc.idle = nil
+	return idle
+}
+
+// keyExchange runs a new NTS key exchange unless the session still holds
+// cookies, for example because a concurrent query just ran one. The
+// connections of the previous session are dropped, since the exchange may
+// have pointed to another server.
+func (nc *NTPClient) keyExchange() error {
+	nc.keMu.Lock()
+	defer nc.keMu.Unlock()
+	nc.mu.Lock()
+	st := nc.nts
+	nc.mu.Unlock()
+	if st.ready() {
+		return nil
+	}
+	st, err := ntsKeyExchange(nc.conf.NTS, nc.conf.Address, nc.conf.timeout())
+	if err != nil {
+		return err
+	}
+	nc.mu.Lock()
+	nc.nts = st
+	idle := nc.drop()
+	nc.mu.Unlock()
+	closeConns(idle)
+	return nil
+}
+
+// closeConns closes conns and returns the first error.
+func closeConns(conns []*poolConn) error {
+	var err error
+	for _, pc := range conns {
+		if cerr := pc.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,438 @@
+package tcpntp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
+)
+
+type NTPServer struct {
+	conf       *ServerConfig
+	clock      clock.Clock
+	listener   *net.TCPListener
+	packetConn *net.UDPConn
+	wg         sync.WaitGroup
+	closed     chan struct{}
+}
+
+func NewNTPServer(conf *ServerConfig) (*NTPServer, error) {
+	if conf == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if err := conf.Check(); err != nil {
+		return nil, fmt.Errorf("failed to check ntp server config: %v", err)
+	}
+	return &NTPServer{
+		conf:   conf,
+		clock:  clock.Or(conf.Clock),
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// Listen binds the server to the configured address. It is called by Start
+// when the server is not yet listening, and may be called beforehand to
+// learn the bound address through Addr.
+func (ns *NTPServer) Listen() error {
+	network := ns.conf.network()
+	switch network {
+	case "udp", "udp4", "udp6":
+		laddr, err := net.ResolveUDPAddr(network, ns.conf.Address)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s addr [%s]: %v",
+				network, ns.conf.Address, err)
+		}
+		if ns.packetConn, err = net.ListenUDP(network, laddr); err != nil {
+			return fmt.Errorf("failed to listen %s addr [%s]: %v",
+				network, ns.conf.Address, err)
+		}
+	default:
+		laddr, err := net.ResolveTCPAddr(network, ns.conf.Address)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s addr [%s]: %v",
+				network, ns.conf.Address, err)
+		}
+		if ns.listener, err = net.ListenTCP(network, laddr); err != nil {
+			return fmt.Errorf("failed to listen %s addr [%s]: %v",
+				network, ns.conf.Address, err)
+		}
+	}
+	return nil
+}
+
+// Addr returns the listener address, or nil if the server is not listening.
+func (ns *NTPServer) Addr() net.Addr {
+	if ns.packetConn != nil {
+		return ns.packetConn.LocalAddr()
+	}
+	if ns.listener != nil {
+		return ns.listener.Addr()
+	}
+	return nil
+}
+
+func (ns *NTPServer) Start() chan error {
+	errChan := make(chan error, 1)
+	if ns.listener == nil && ns.packetConn == nil {
+		if err := ns.Listen(); err != nil {
+			errChan <- err
+			return errChan
+		}
+	}
+	if ns.packetConn != nil {
+		go func() {
+			errChan <- ns.servePacket()
+		}()
+		return errChan
+	}
+	go func() {
+		for {
+			conn, err := ns.listener.AcceptTCP()
+			if err != nil {
+				select {
+				case <-ns.closed:
+					errChan <- nil
+				default:
+					errChan <- fmt.Errorf("failed to accept tcp conn: %v", err)
+				}
+				return
+			}
+			ns.wg.Add(1)
+			go ns.serve(conn)
+		}
+	}()
+	return errChan
+}
+
+func (ns *NTPServer) Close() error {
+	select {
+	case <-ns.closed:
+		return nil
+	default:
+	}
+	close(ns.closed)
+	var err error
+	if ns.listener != nil {
+		err = ns.listener.Close()
+	}
+	if ns.packetConn != nil {
+		err = ns.packetConn.Close()
+	}
+	ns.wg.Wait()
+	return err
+}
+
+func (ns *NTPServer) serve(tcpConn *net.TCPConn) {
+	defer ns.wg.Done()
+	defer tcpConn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ns.closed:
+			tcpConn.Close()
+		case <-done:
+		}
+	}()
+	// In interleaved mode the transmit time of a response is taken by the
+	// kernel when available, else as soon as the write returns.
+	var conn net.Conn = tcpConn
+	if ns.conf.Interleaved {
+		if tc, err := newTimestampConn(tcpConn, true); err != nil {
+			logrus.WithField("prefix", "tcpntp.server").
+				Debugf("kernel timestamps unavailable for [%s]: %v",
+					tcpConn.RemoteAddr(), err)
+		} else {
+			conn = tc
+		}
+	}
+	var xleave xleaveState
+	for {
+		pkt := make([]byte, packetSize)
+		_, err := io.ReadFull(conn, pkt)
+		recvTime := ns.clock.Now()
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				logrus.WithField("prefix", "tcpntp.server").
+					Warnf("failed to read from [%s]: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		var key *Key
+		var nts *ntsRequest
+		switch {
+		case ns.conf.NTSKey != nil:
+			ext, err := readExtFields(conn, func(typ uint16) bool {
+				return typ == ExtNTSAuthenticator
+			})
+			if err != nil {
+				logrus.WithField("prefix", "tcpntp.server").
+					Warnf("invalid nts query from [%s]: %v", conn.RemoteAddr(), err)
+				return
+			}
+			pkt = append(pkt, ext...)
+			var uid []byte
+			if nts, uid, err = ntsCheckRequest(pkt, ns.conf.NTSKey); err != nil {
+				logrus.WithField("prefix", "tcpntp.server").
+					Warnf("drop query from [%s]: %v", conn.RemoteAddr(), err)
+				if uid != nil {
+					ns.writeNTSNAK(conn, pkt, uid, recvTime)
+				}
+				continue
+			}
+		case ns.conf.Keys != nil:
+			// Every query carries a MAC. The digest length depends on the
+			// key, so a query with an unknown key ID cannot be framed:
+			// answer with a crypto-NAK and drop the connection.
+			mac := make([]byte, 4)
+			if _, err = io.ReadFull(conn, mac); err != nil {
+				return
+			}
+			if key = ns.conf.Keys.Get(binary.BigEndian.Uint32(mac)); key == nil {
+				ns.writeCryptoNAK(conn, pkt, recvTime)
+				return
+			}
+			mac = append(mac, make([]byte, key.digestSize())...)
+			if _, err = io.ReadFull(conn, mac[4:]); err != nil {
+				return
+			}
+			if _, err = verifyMAC(append(pkt, mac...), packetSize,
+				ns.conf.Keys); err != nil {
+				logrus.WithField("prefix", "tcpntp.server").
+					Warnf("drop query from [%s]: %v", conn.RemoteAddr(), err)
+				ns.writeCryptoNAK(conn, pkt, recvTime)
+				continue
+			}
+		}
+		recvMsg, _ := decodeMsg(pkt)
+		if recvMsg.getMode() != ModeClient {
+			logrus.WithField("prefix", "tcpntp.server").
+				Debugf("drop mode [%d] packet from [%s]",
+					recvMsg.getMode(), conn.RemoteAddr())
+			continue
+		}
+		xmitMsg := ns.reply(recvMsg, recvTime)
+		if !ns.interleave(xmitMsg, recvMsg, xleave) {
+			xmitMsg.TransmitTime = toNtpTime(ns.clock.Now())
+		}
+		out, err := ns.authenticate(encodeMsg(xmitMsg), key, nts)
+		if err != nil {
+			logrus.WithField("prefix", "tcpntp.server").
+				Warnf("failed to authenticate response: %v", err)
+			return
+		}
+		if _, err = conn.Write(out); err != nil {
+			logrus.WithField("prefix", "tcpntp.server").
+				Warnf("failed to write to [%s]: %v", conn.RemoteAddr(), err)
+			return
+		}
+		xleave = xleaveState{
+			rx: xmitMsg.ReceiveTime,
+			tx: toNtpTime(sentTime(conn, ns.clock)),
+		}
+	}
+}
+
+// authenticate appends the MAC or the NTS extension fields to the encoded
+// response hdr.
+func (ns *NTPServer) authenticate(hdr []byte, key *Key,
+	nts *ntsRequest) ([]byte, error) {
+	switch {
+	case nts != nil:
+		return nts.response(hdr, ns.conf.NTSKey)
+	case key != nil:
+		return appendMAC(hdr, key), nil
+	}
+	return hdr, nil
+}
+
+// writeNTSNAK answers the query in pkt with an NTS NAK.
+func (ns *NTPServer) writeNTSNAK(w io.Writer, pkt, uid []byte,
+	recvTime time.Time) {
+	recvMsg, err := decodeMsg(pkt)
+	if err != nil {
+		return
+	}
+	xmitMsg := ns.reply(recvMsg, recvTime)
+	xmitMsg.TransmitTime = toNtpTime(ns.clock.Now())
+	w.Write(ntsNAK(xmitMsg, uid))
+}
+
+// writeKiss answers the query in pkt with the Kiss-o'-Death code.
+func (ns *NTPServer) writeKiss(w io.Writer, pkt []byte, code string,
+	recvTime time.Time) {
+	recvMsg, err := decodeMsg(pkt)
+	if err != nil {
+		return
+	}
+	xmitMsg := ns.reply(recvMsg, recvTime)
+	xmitMsg.setLeap(LeapNotInSync)
+	xmitMsg.Stratum = 0
+	xmitMsg.ReferenceID = binary.BigEndian.Uint32([]byte(code))
+	xmitMsg.TransmitTime = toNtpTime(ns.clock.Now())
+	w.Write(encodeMsg(xmitMsg))
+}
+
+// writeCryptoNAK answers the query in pkt with a crypto-NAK.
+func (ns *NTPServer) writeCryptoNAK(w io.Writer, pkt []byte,
+	recvTime time.Time) {
+	recvMsg, err := decodeMsg(pkt)
+	if err != nil {
+		return
+	}
+	xmitMsg := ns.reply(recvMsg, recvTime)
+	xmitMsg.TransmitTime = toNtpTime(ns.clock.Now())
+	w.Write(appendCryptoNAK(encodeMsg(xmitMsg)))
+}
+
+// packetWriter is a connection sending to any address, a datagram socket
+// not connected.
+type packetWriter interface {
+	net.Conn
+	WriteTo(b []byte, addr net.Addr) (int, error)
+}
+
+func (ns *NTPServer) servePacket() error {
+	buf := make([]byte, maxPacketSize)
+	xleave := make(map[string]xleaveState)
+	// In interleaved mode the transmit time of a response is taken by the
+	// kernel when available, else as soon as the write returns. All the
+	// writes then go through the timestamping connection, which counts
+	// them to match their timestamps.
+	var conn packetWriter = ns.packetConn
+	if ns.conf.Interleaved {
+		if tc, err := newTimestampConn(ns.packetConn, false); err != nil {
+			logrus.WithField("prefix", "tcpntp.server").
+				Debugf("kernel timestamps unavailable for [%s]: %v",
+					ns.packetConn.LocalAddr(), err)
+		} else if pw, ok := tc.(packetWriter); ok {
+			conn = pw
+		}
+	}
+	writeTo := func(b []byte, raddr *net.UDPAddr) error {
+		_, err := conn.WriteTo(b, raddr)
+		return err
+	}
+	for {
+		n, raddr, err := ns.packetConn.ReadFromUDP(buf)
+		recvTime := ns.clock.Now()
+		if err != nil {
+			select {
+			case <-ns.closed:
+				return nil
+			default:
+				return fmt.Errorf("failed to read udp packet: %v", err)
+			}
+		}
+		recvMsg, err := decodeMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+		if recvMsg.getMode() != ModeClient {
+			logrus.WithField("prefix", "tcpntp.server").
+				Debugf("drop mode [%d] packet from [%s]",
+					recvMsg.getMode(), raddr)
+			continue
+		}
+		var key *Key
+		var nts *ntsRequest
+		switch rest := n - packetSize; {
+		case rest > maxMACSize && ns.conf.NTSKey != nil:
+			var uid []byte
+			if nts, uid, err = ntsCheckRequest(buf[:n],
+				ns.conf.NTSKey); err != nil {
+				logrus.WithField("prefix", "tcpntp.server").
+					Warnf("drop query from [%s]: %v", raddr, err)
+				if uid != nil {
+					var out bytes.Buffer
+					ns.writeNTSNAK(&out, buf[:n], uid, recvTime)
+					writeTo(out.Bytes(), raddr)
+				}
+				continue
+			}
+		case rest > 0:
+			if key, err = verifyMAC(buf[:n], packetSize,
+				ns.conf.Keys); err != nil {
+				logrus.WithField("prefix", "tcpntp.server").
+					Warnf("drop query from [%s]: %v", raddr, err)
+				var out bytes.Buffer
+				ns.writeCryptoNAK(&out, buf[:packetSize], recvTime)
+				writeTo(out.Bytes(), raddr)
+				continue
+			}
+		case ns.conf.RequireAuth:
+			logrus.WithField("prefix", "tcpntp.server").
+				Warnf("drop unauthenticated query from [%s]", raddr)
+			var out bytes.Buffer
+			ns.writeKiss(&out, buf[:packetSize], "CRYP", recvTime)
+			writeTo(out.Bytes(), raddr)
+			continue
+		}
+		xmitMsg := ns.reply(recvMsg, recvTime)
+		if !ns.interleave(xmitMsg, recvMsg, xleave[raddr.String()]) {
+			xmitMsg.TransmitTime = toNtpTime(ns.clock.Now())
+		}
+		out, err := ns.authenticate(encodeMsg(xmitMsg), key, nts)
+		if err != nil {
+			logrus.WithField("prefix", "tcpntp.server").
+				Warnf("failed to authenticate response: %v", err)
+			continue
+		}
+		if err = writeTo(out, raddr); err != nil {
+			logrus.WithField("prefix", "tcpntp.server").
+				Warnf("failed to write to [%s]: %v", raddr, err)
+			continue
+		}
+		if ns.conf.Interleaved {
+			if len(xleave) >= maxXleaveClients {
+				xleave = make(map[string]xleaveState)
+			}
+			xleave[raddr.String()] = xleaveState{
+				rx: xmitMsg.ReceiveTime,
+				tx: toNtpTime(sentTime(conn, ns.clock)),
+			}
+		}
+	}
+}
+
+// leap returns the leap indicator announcing a leap second at the end of
+// the UTC day of now, a reading of the server clock.
+func (ns *NTPServer) leap(now time.Time) LeapIndicator {
+	leaps := ns.conf.leaps()
+	utc := leaps.Convert(now, ns.conf.Scale, timescale.UTC)
+	switch leaps.Pending(utc) {
+	case 1:
+		return LeapAddSecond
+	case -1:
+		return LeapDelSecond
+	}
+	return LeapNoWarning
+}
+
+// reply builds the server mode response for the client query req, received
+// at recvTime. The transmit time is left for the caller to fill in as late
+// as possible.
+func (ns *NTPServer) reply(req *msg, recvTime time.Time) *msg {
+	resp := new(msg)
+	resp.setMode(ModeServer)
+	resp.setVersion(req.getVersion())
+	resp.setLeap(ns.leap(recvTime))
+	resp.Stratum = ns.conf.Stratum
+	resp.Poll = req.Poll
+	resp.Precision = ns.conf.Precision
+	resp.RootDelay = toNtpTimeShort(ns.conf.RootDelay)
+	resp.RootDispersion = toNtpTimeShort(ns.conf.RootDispersion)
+	resp.ReferenceID = ns.conf.ReferenceID
+	resp.ReferenceTime = toNtpTime(recvTime)
+	resp.OriginTime = req.TransmitTime
+	resp.ReceiveTime = toNtpTime(recvTime)
+	return resp
+}
@@ -0,0 +1,92 @@
+package tcpntp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+// aesSIV is the AEAD_AES_SIV_CMAC_256 algorithm of RFC 5297, the AEAD
+// required by NTS. The nonce is passed to S2V as the last associated data
+// component.
+type aesSIV struct {
+	mac cipher.Block
+	ctr cipher.Block
+}
+
+func newAESSIV(key []byte) (*aesSIV, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid AES-SIV key length [%d]", len(key))
+	}
+	mac, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := aes.NewCipher(key[16:])
+	if err != nil {
+		return nil, err
+	}
+	return &aesSIV{mac: mac, ctr: ctr}, nil
+}
+
+// s2v is the S2V construction of RFC 5297 section 2.4.
+func (s *aesSIV) s2v(ad [][]byte, plaintext []byte) []byte {
+	d := cmac(s.mac, make([]byte, aes.BlockSize))
+	for _, a := range ad {
+		cmacShift(d)
+		xorBytes(d, d, cmac(s.mac, a))
+	}
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		t = make([]byte, len(plaintext))
+		copy(t, plaintext)
+		tail := t[len(t)-aes.BlockSize:]
+		xorBytes(tail, tail, d)
+	} else {
+		cmacShift(d)
+		t = make([]byte, aes.BlockSize)
+		copy(t, plaintext)
+		t[len(plaintext)] = 0x80
+		xorBytes(t, t, d)
+	}
+	return cmac(s.mac, t)
+}
+
+func (s *aesSIV) xorStream(v, dst, src []byte) {
+	q := make([]byte, aes.BlockSize)
+	copy(q, v)
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+	cipher.NewCTR(s.ctr, q).XORKeyStream(dst, src)
+}
+
+// seal returns the synthetic IV followed by the ciphertext of plaintext.
+func (s *aesSIV) seal(nonce, plaintext []byte, ad ...[]byte) []byte {
+	if nonce != nil {
+		ad = append(ad[:len(ad):len(ad)], nonce)
+	}
+	v := s.s2v(ad, plaintext)
+	out := make([]byte, len(v)+len(plaintext))
+	copy(out, v)
+	s.xorStream(v, out[len(v):], plaintext)
+	return out
+}
+
+// open authenticates and decrypts the output of seal.
+func (s *aesSIV) open(nonce, ciphertext []byte, ad ...[]byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errors.New("AES-SIV ciphertext too short")
+	}
+	if nonce != nil {
+		ad = append(ad[:len(ad):len(ad)], nonce)
+	}
+	v := ciphertext[:aes.BlockSize]
+	plaintext := make([]byte, len(ciphertext)-aes.BlockSize)
+	s.xorStream(v, plaintext, ciphertext[aes.BlockSize:])
+	if subtle.ConstantTimeCompare(v, s.s2v(ad, plaintext)) != 1 {
+		return nil, errors.New("AES-SIV authentication failed")
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,49 @@
+package tcpntp
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// TimestampSource tells where the origin and destination timestamps of a
+// Response were taken.
+type TimestampSource uint8
+
+const (
+	// TimestampUser means both were read from the system clock in user
+	// space, around the socket calls.
+	TimestampUser TimestampSource = 0
+	// TimestampKernelTx is set when the origin timestamp was taken by the
+	// kernel as the query left the socket.
+	TimestampKernelTx TimestampSource = 1 << 0
+	// TimestampKernelRx is set when the destination timestamp was taken by
+	// the kernel as the response reached the socket.
+	TimestampKernelRx TimestampSource = 1 << 1
+	// TimestampKernel means both were taken by the kernel.
+	TimestampKernel = TimestampKernelTx | TimestampKernelRx
+)
+
+func (s TimestampSource) String() string {
+	if s == TimestampUser {
+		return "user"
+	}
+	parts := make([]string, 0, 2)
+	if s&TimestampKernelTx != 0 {
+		parts = append(parts, "kernel-tx")
+	}
+	if s&TimestampKernelRx != 0 {
+		parts = append(parts, "kernel-rx")
+	}
+	return strings.Join(parts, "+")
+}
+
+// timestampConn is a connection reporting kernel software timestamps, see
+// newTimestampConn.
+type timestampConn interface {
+	net.Conn
+	// timestamps returns the kernel time the last write left the socket
+	// and the time the data of the reads since then reached it. A zero
+	// time means the kernel did not report it.
+	timestamps() (tx, rx time.Time)
+}
@@ -0,0 +1,252 @@
+//go:build linux
+
+package tcpntp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// SO_TIMESTAMPING flags of linux/net_tstamp.h.
+const (
+	sofTimestampingTxSoftware = 1 << 1
+	sofTimestampingRxSoftware = 1 << 3
+	sofTimestampingSoftware   = 1 << 4
+	sofTimestampingOptID      = 1 << 7
+	sofTimestampingOptTSOnly  = 1 << 11
+
+	soEEOriginTimestamping = 4
+)
+
+const (
+	// The transmit timestamp is queued on the error queue once the packet
+	// leaves the driver, usually before the write returns.
+	txTimestampPolls = 20
+	txTimestampWait  = 50 * time.Microsecond
+)
+
+// sockExtendedErr is struct sock_extended_err of linux/errqueue.h.
+type sockExtendedErr struct {
+	Errno  uint32
+	Origin uint8
+	Type   uint8
+	Code   uint8
+	Pad    uint8
+	Info   uint32
+	Data   uint32
+}
+
+// kernelConn reads transmit timestamps from the socket error queue and
+// receive timestamps from the control messages of recvmsg.
+type kernelConn struct {
+	net.Conn
+	raw    syscall.RawConn
+	stream bool
+	// txEnabled is false when only SO_TIMESTAMPNS could be enabled.
+	txEnabled bool
+	// sent is the SOF_TIMESTAMPING_OPT_ID counter: datagrams sent, or
+	// bytes sent on a stream.
+	sent uint32
+	oob  []byte
+	tx   time.Time
+	rx   time.Time
+}
+
+// newTimestampConn enables SO_TIMESTAMPING software timestamps on conn,
+// falling back to SO_TIMESTAMPNS receive timestamps on older kernels.
+func newTimestampConn(conn net.Conn, stream bool) (timestampConn, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("connection has no file descriptor")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	kc := &kernelConn{
+		Conn:   conn,
+		raw:    raw,
+		stream: stream,
+		oob:    make([]byte, 256),
+	}
+	var serr error
+	if err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET,
+			syscall.SO_TIMESTAMPING, sofTimestampingTxSoftware|
+				sofTimestampingRxSoftware|sofTimestampingSoftware|
+				sofTimestampingOptID|sofTimestampingOptTSOnly)
+		if kc.txEnabled = serr == nil; !kc.txEnabled {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET,
+				syscall.SO_TIMESTAMPNS, 1)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, os.NewSyscallError("setsockopt", serr)
+	}
+	return kc, nil
+}
+
+func (kc *kernelConn) timestamps() (tx, rx time.Time) {
+	return kc.tx, kc.rx
+}
+
+func (kc *kernelConn) Write(b []byte) (int, error) {
+	kc.tx, kc.rx = time.Time{}, time.Time{}
+	n, err := kc.Conn.Write(b)
+	kc.written(n, err)
+	return n, err
+}
+
+// WriteTo sends b to addr on a datagram socket not connected, timing it as
+// Write does.
+func (kc *kernelConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pc, ok := kc.Conn.(net.PacketConn)
+	if !ok {
+		return 0, fmt.Errorf("connection not a packet connection")
+	}
+	kc.tx, kc.rx = time.Time{}, time.Time{}
+	n, err := pc.WriteTo(b, addr)
+	kc.written(n, err)
+	return n, err
+}
+
+// written counts a write of n bytes and takes its transmit timestamp.
+func (kc *kernelConn) written(n int, err error) {
+	if !kc.txEnabled || n == 0 {
+		return
+	}
+	var key uint32
+	if kc.stream {
+		kc.sent += uint32(n)
+		key = kc.sent - 1
+	} else {
+		key = kc.sent
+		kc.sent++
+	}
+	if err == nil {
+		kc.tx = kc.txTimestamp(key)
+	}
+}
+
+// txTimestamp drains the error queue and returns the transmit timestamp
+// with the OPT_ID key, or the zero time if it did not arrive in time.
+func (kc *kernelConn) txTimestamp(key uint32) time.Time {
+	buf := make([]byte, 64)
+	for i := 0; i < txTimestampPolls; i++ {
+		var ts time.Time
+		kc.raw.Control(func(fd uintptr) {
+			for {
+				_, oobn, _, _, err := syscall.Recvmsg(int(fd), buf, kc.oob,
+					syscall.MSG_ERRQUEUE|syscall.MSG_DONTWAIT)
+				if err != nil {
+					return
+				}
+				if t, id, ok := parseTxTimestamp(kc.oob[:oobn]); ok && id == key {
+					ts = t
+				}
+			}
+		})
+		if !ts.IsZero() {
+			return ts
+		}
+		time.Sleep(txTimestampWait)
+	}
+	return time.Time{}
+}
+
+func (kc *kernelConn) Read(b []byte) (int, error) {
+	var n, oobn int
+	var rerr error
+	err := kc.raw.Read(func(fd uintptr) bool {
+		n, oobn, _, _, rerr = syscall.Recvmsg(int(fd), b, kc.oob, 0)
+		return rerr != syscall.EAGAIN
+	})
+	if err == nil && rerr != nil {
+		err = os.NewSyscallError("recvmsg", rerr)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 && len(b) > 0 && kc.stream {
+		return 0, io.EOF
+	}
+	// A stream response is timed by its first segment, a datagram one by
+	// the last datagram read, earlier ones being stray.
+	if rx := parseRxTimestamp(kc.oob[:oobn]); !rx.IsZero() &&
+		(!kc.stream || kc.rx.IsZero()) {
+		kc.rx = rx
+	}
+	return n, nil
+}
+
+// parseRxTimestamp returns the software receive timestamp of the control
+// messages.
+func parseRxTimestamp(oob []byte) time.Time {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_SOCKET {
+			continue
+		}
+		switch m.Header.Type {
+		case syscall.SCM_TIMESTAMPING, syscall.SCM_TIMESTAMPNS:
+			if ts := cmsgTimespec(m.Data); !ts.IsZero() {
+				return ts
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// parseTxTimestamp returns the software transmit timestamp and its OPT_ID
+// key from the control messages of an error queue message.
+func parseTxTimestamp(oob []byte) (time.Time, uint32, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	var ts time.Time
+	var id uint32
+	var found bool
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.SOL_SOCKET &&
+			m.Header.Type == syscall.SCM_TIMESTAMPING:
+			ts = cmsgTimespec(m.Data)
+		case (m.Header.Level == syscall.SOL_IP &&
+			m.Header.Type == syscall.IP_RECVERR) ||
+			(m.Header.Level == syscall.SOL_IPV6 &&
+				m.Header.Type == syscall.IPV6_RECVERR):
+			if len(m.Data) < int(unsafe.Sizeof(sockExtendedErr{})) {
+				continue
+			}
+			ee := (*sockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+			if ee.Origin == soEEOriginTimestamping {
+				id, found = ee.Data, true
+			}
+		}
+	}
+	return ts, id, found && !ts.IsZero()
+}
+
+// cmsgTimespec returns the first timespec of a timestamp control message;
+// for SCM_TIMESTAMPING it holds the software timestamp.
+func cmsgTimespec(data []byte) time.Time {
+	if len(data) < int(unsafe.Sizeof(syscall.Timespec{})) {
+		return time.Time{}
+	}
+	ts := (*syscall.Timespec)(unsafe.Pointer(&data[0]))
+	if ts.Sec == 0 && ts.Nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(ts.Unix())
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package tcpntp
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// newTimestampConn is only implemented on Linux.
+func newTimestampConn(conn net.Conn, stream bool) (timestampConn, error) {
+	return nil, fmt.Errorf("kernel timestamps not supported on %s", runtime.GOOS)
+}
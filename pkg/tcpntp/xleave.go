@@ -0,0 +1,76 @@
+package tcpntp
+
+import (
+	"net"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+)
+
+// Interleaved client/server mode, draft-ietf-ntp-interleaved-modes. The
+// transmit time of a response is only known precisely once it has been
+// written, so the server hands it out in its next response to the same
+// client. The client asks for it by setting the origin timestamp of its
+// query to the receive timestamp of the previous response and the receive
+// timestamp to the time that response arrived; the server answers in
+// interleaved mode by echoing the latter as origin timestamp. A server
+// without support echoes the transmit timestamp as usual, in basic mode.
+
+// maxXleaveClients bounds the clients remembered by a datagram server.
+const maxXleaveClients = 4096
+
+// xleaveState is what a server remembers of its last response to a
+// client: the time the query was received and the response transmitted.
+type xleaveState struct {
+	rx ntpTime
+	tx ntpTime
+}
+
+// interleave fills in the response resp to req in interleaved mode if the
+// client asked for it and prev is the response it refers to, and reports
+// whether it did. Otherwise the caller sends a basic response.
+func (ns *NTPServer) interleave(resp, req *msg, prev xleaveState) bool {
+	if !ns.conf.Interleaved || prev.rx == 0 || req.OriginTime != prev.rx ||
+		req.ReceiveTime == 0 {
+		return false
+	}
+	resp.OriginTime = req.ReceiveTime
+	resp.TransmitTime = prev.tx
+	return true
+}
+
+// sentTime returns the time the last write on conn left the socket: the
+// kernel transmit timestamp if there is one, else the current time of c.
+func sentTime(conn net.Conn, c clock.Clock) time.Time {
+	if tc, ok := conn.(timestampConn); ok {
+		if tx, _ := tc.timestamps(); !tx.IsZero() {
+			return tx
+		}
+	}
+	return c.Now()
+}
+
+// xleaveExchange is what a client remembers of the last exchange on a
+// connection: when the query was sent, received by the server, and when
+// the response arrived.
+type xleaveExchange struct {
+	xmit   time.Time
+	recv   ntpTime
+	dst    ntpTime
+	source TimestampSource
+}
+
+// interleaved sets up the query q to ask for an interleaved response
+// about the previous exchange on pc.
+func (nc *NTPClient) interleaved(pc *poolConn, q *msg) {
+	if !nc.conf.Interleaved || pc.prev == nil {
+		return
+	}
+	q.OriginTime = pc.prev.recv
+	q.ReceiveTime = pc.prev.dst
+}
+
+// isInterleaved reports whether m is an interleaved response to q.
+func isInterleaved(q, m *msg) bool {
+	return q.ReceiveTime != 0 && m.OriginTime == q.ReceiveTime
+}
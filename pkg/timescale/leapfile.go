@@ -0,0 +1,133 @@
+package timescale
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ntpEpochOffset is the number of seconds from the NTP epoch, 1900-01-01,
+// to the Unix epoch.
+const ntpEpochOffset = 2208988800
+
+func ntpSeconds(s string) (time.Time, error) {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec-ntpEpochOffset, 0).UTC(), nil
+}
+
+// LoadLeapSecondsList loads a leap-seconds.list file. See
+// ParseLeapSecondsList.
+func LoadLeapSecondsList(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open leap seconds file [%s]: %v",
+			path, err)
+	}
+	defer f.Close()
+	t, err := ParseLeapSecondsList(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse leap seconds file [%s]: %v",
+			path, err)
+	}
+	return t, nil
+}
+
+// ParseLeapSecondsList parses a leap-seconds.list file as published by the
+// IERS and the IETF. Data lines hold an NTP timestamp and the TAI-UTC
+// offset from then on; "#@" gives the expiry time and "#h" the SHA-1 of
+// the digits of the "#$", "#@" and data lines, which must match. The
+// expiry is not checked against the current time, see Table.Expired.
+func ParseLeapSecondsList(r io.Reader) (*Table, error) {
+	h := sha1.New()
+	var expires time.Time
+	var hash []byte
+	leaps := make([]Leap, 0, 32)
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := sc.Text()
+		switch {
+		case strings.HasPrefix(text, "#$"):
+			hashDigits(h, text[2:])
+		case strings.HasPrefix(text, "#@"):
+			hashDigits(h, text[2:])
+			var err error
+			if expires, err = ntpSeconds(strings.TrimSpace(text[2:])); err != nil {
+				return nil, fmt.Errorf("line %d: invalid expiry: %v", line, err)
+			}
+		case strings.HasPrefix(text, "#h"):
+			words := strings.Fields(text[2:])
+			if len(words) != sha1.Size/4 {
+				return nil, fmt.Errorf("line %d: invalid hash", line)
+			}
+			hash = make([]byte, sha1.Size)
+			for i, w := range words {
+				v, err := strconv.ParseUint(w, 16, 32)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid hash: %v", line, err)
+				}
+				binary.BigEndian.PutUint32(hash[i*4:], uint32(v))
+			}
+		case strings.HasPrefix(text, "#"):
+		default:
+			if i := strings.IndexByte(text, '#'); i >= 0 {
+				text = text[:i]
+			}
+			fields := strings.Fields(text)
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %d: expect \"time offset\"", line)
+			}
+			hashDigits(h, text)
+			ts, err := ntpSeconds(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid time: %v", line, err)
+			}
+			offset, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid offset: %v", line, err)
+			}
+			leaps = append(leaps, Leap{
+				Time:      ts,
+				TAIOffset: time.Duration(offset) * time.Second,
+			})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if expires.IsZero() {
+		return nil, fmt.Errorf("missing expiry")
+	}
+	if hash == nil {
+		return nil, fmt.Errorf("missing hash")
+	}
+	if !bytes.Equal(hash, h.Sum(nil)) {
+		return nil, fmt.Errorf("hash mismatch")
+	}
+	return NewTable(leaps, expires)
+}
+
+// hashDigits feeds the digits of s to h, the way the file hash is built.
+func hashDigits(h io.Writer, s string) {
+	digits := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] >= '0' && s[i] <= '9' {
+			digits = append(digits, s[i])
+		}
+	}
+	h.Write(digits)
+}
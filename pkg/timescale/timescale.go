@@ -0,0 +1,279 @@
+package timescale
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scale is a time scale a clock can be set to.
+type Scale int
+
+const (
+	// UTC is Coordinated Universal Time, TAI minus the leap seconds.
+	UTC Scale = iota
+	// TAI is International Atomic Time.
+	TAI
+	// GPS is GPS time, TAI minus 19 seconds.
+	GPS
+	// BDS is BeiDou time, TAI minus 33 seconds.
+	BDS
+)
+
+const (
+	gpsTAIOffset = -19 * time.Second
+	bdsTAIOffset = -33 * time.Second
+)
+
+func (s Scale) String() string {
+	switch s {
+	case UTC:
+		return "UTC"
+	case TAI:
+		return "TAI"
+	case GPS:
+		return "GPS"
+	case BDS:
+		return "BDS"
+	}
+	return fmt.Sprintf("Scale(%d)", int(s))
+}
+
+// Parse returns the scale named s, case insensitive.
+func Parse(s string) (Scale, error) {
+	switch strings.ToUpper(s) {
+	case "UTC":
+		return UTC, nil
+	case "TAI":
+		return TAI, nil
+	case "GPS", "GPST":
+		return GPS, nil
+	case "BDS", "BDT":
+		return BDS, nil
+	}
+	return UTC, fmt.Errorf("unknown time scale [%s]", s)
+}
+
+// Leap is an entry of the leap second table: from Time on, given in UTC,
+// TAI is ahead of UTC by TAIOffset.
+type Leap struct {
+	Time      time.Time
+	TAIOffset time.Duration
+}
+
+// Table is a leap second table.
+type Table struct {
+	leaps   []Leap
+	expires time.Time
+}
+
+// NewTable returns a table of leaps, which must be in increasing time
+// order, valid until expires.
+func NewTable(leaps []Leap, expires time.Time) (*Table, error) {
+	if len(leaps) == 0 {
+		return nil, fmt.Errorf("empty leap second table")
+	}
+	if !sort.SliceIsSorted(leaps, func(i, j int) bool {
+		return leaps[i].Time.Before(leaps[j].Time)
+	}) {
+		return nil, fmt.Errorf("leap second table not sorted")
+	}
+	ls := make([]Leap, len(leaps))
+	copy(ls, leaps)
+	return &Table{leaps: ls, expires: expires}, nil
+}
+
+// Leaps returns a copy of the table entries.
+func (t *Table) Leaps() []Leap {
+	ls := make([]Leap, len(t.leaps))
+	copy(ls, t.leaps)
+	return ls
+}
+
+// Expires returns the time after which the table may miss leap seconds.
+func (t *Table) Expires() time.Time {
+	return t.expires
+}
+
+// Expired reports whether the table may miss leap seconds at time now.
+func (t *Table) Expired(now time.Time) bool {
+	return !t.expires.IsZero() && now.After(t.expires)
+}
+
+// NextLeap returns the first entry taking effect after the UTC time utc.
+func (t *Table) NextLeap(utc time.Time) (Leap, bool) {
+	for _, l := range t.leaps {
+		if l.Time.After(utc) {
+			return l, true
+		}
+	}
+	return Leap{}, false
+}
+
+// Pending returns the leap second at the end of the UTC day of utc: 1 for
+// an inserted second, -1 for a deleted one and 0 if there is none.
+func (t *Table) Pending(utc time.Time) int {
+	utc = utc.UTC()
+	midnight := time.Date(utc.Year(), utc.Month(), utc.Day()+1,
+		0, 0, 0, 0, time.UTC)
+	next, ok := t.NextLeap(utc)
+	if !ok || !next.Time.Equal(midnight) {
+		return 0
+	}
+	if next.TAIOffset > t.TAIOffset(utc) {
+		return 1
+	}
+	return -1
+}
+
+// TAIOffset returns TAI minus UTC at the UTC time utc. Before the first
+// entry the first offset is returned.
+func (t *Table) TAIOffset(utc time.Time) time.Duration {
+	for i := len(t.leaps) - 1; i >= 0; i-- {
+		if !utc.Before(t.leaps[i].Time) {
+			return t.leaps[i].TAIOffset
+		}
+	}
+	return t.leaps[0].TAIOffset
+}
+
+// taiToUTCOffset returns TAI minus UTC at the TAI time tai.
+func (t *Table) taiToUTCOffset(tai time.Time) time.Duration {
+	for i := len(t.leaps) - 1; i >= 0; i-- {
+		if !tai.Before(t.leaps[i].Time.Add(t.leaps[i].TAIOffset)) {
+			return t.leaps[i].TAIOffset
+		}
+	}
+	return t.leaps[0].TAIOffset
+}
+
+// Offset returns the scale s minus UTC at the UTC time utc.
+func (t *Table) Offset(s Scale, utc time.Time) time.Duration {
+	switch s {
+	case TAI:
+		return t.TAIOffset(utc)
+	case GPS:
+		return t.TAIOffset(utc) + gpsTAIOffset
+	case BDS:
+		return t.TAIOffset(utc) + bdsTAIOffset
+	}
+	return 0
+}
+
+// Convert converts ts, a clock reading in scale from, to scale to.
+func (t *Table) Convert(ts time.Time, from, to Scale) time.Time {
+	if from == to {
+		return ts
+	}
+	var tai time.Time
+	switch from {
+	case UTC:
+		tai = ts.Add(t.TAIOffset(ts))
+	case GPS:
+		tai = ts.Add(-gpsTAIOffset)
+	case BDS:
+		tai = ts.Add(-bdsTAIOffset)
+	default:
+		tai = ts
+	}
+	switch to {
+	case UTC:
+		return tai.Add(-t.taiToUTCOffset(tai))
+	case GPS:
+		return tai.Add(gpsTAIOffset)
+	case BDS:
+		return tai.Add(bdsTAIOffset)
+	}
+	return tai
+}
+
+// Between returns the difference of clock readings in scale to and scale
+// from at the same instant, near the clock reading ts in scale from. Add
+// it to a reading in scale from to obtain the reading in scale to.
+func (t *Table) Between(ts time.Time, from, to Scale) time.Duration {
+	return t.Convert(ts, from, to).Sub(ts)
+}
+
+func utcDate(year int, month time.Month) time.Time {
+	return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// builtin is the leap second table of the IERS leap-seconds.list updated
+// through Bulletin C 70 on 7 July 2025 (#$ 3960835200), expiring on 28 June
+// 2026 (#@ 3991593600), whose hash line is
+//
+//	#h	49db2447 571e5e1b 2f002a53 9c8da8e4 39b8e49e
+//
+// Past its expiry, load the current file with --leap-file.
+var builtin = &Table{
+	leaps: []Leap{
+		{utcDate(1972, time.January), 10 * time.Second},
+		{utcDate(1972, time.July), 11 * time.Second},
+		{utcDate(1973, time.January), 12 * time.Second},
+		{utcDate(1974, time.January), 13 * time.Second},
+		{utcDate(1975, time.January), 14 * time.Second},
+		{utcDate(1976, time.January), 15 * time.Second},
+		{utcDate(1977, time.January), 16 * time.Second},
+		{utcDate(1978, time.January), 17 * time.Second},
+		{utcDate(1979, time.January), 18 * time.Second},
+		{utcDate(1980, time.January), 19 * time.Second},
+		{utcDate(1981, time.July), 20 * time.Second},
+		{utcDate(1982, time.July), 21 * time.Second},
+		{utcDate(1983, time.July), 22 * time.Second},
+		{utcDate(1985, time.July), 23 * time.Second},
+		{utcDate(1988, time.January), 24 * time.Second},
+		{utcDate(1990, time.January), 25 * time.Second},
+		{utcDate(1991, time.January), 26 * time.Second},
+		{utcDate(1992, time.July), 27 * time.Second},
+		{utcDate(1993, time.July), 28 * time.Second},
+		{utcDate(1994, time.July), 29 * time.Second},
+		{utcDate(1996, time.January), 30 * time.Second},
+		{utcDate(1997, time.July), 31 * time.Second},
+		{utcDate(1999, time.January), 32 * time.Second},
+		{utcDate(2006, time.January), 33 * time.Second},
+		{utcDate(2009, time.January), 34 * time.Second},
+		{utcDate(2012, time.July), 35 * time.Second},
+		{utcDate(2015, time.July), 36 * time.Second},
+		{utcDate(2017, time.January), 37 * time.Second},
+	},
+	expires: time.Date(2026, time.June, 28, 0, 0, 0, 0, time.UTC),
+}
+
+var (
+	defaultMu    sync.RWMutex
+	defaultTable = builtin
+)
+
+// Default returns the table used by the package level functions. It is
+// the built-in table unless replaced by SetDefault.
+func Default() *Table {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultTable
+}
+
+// SetDefault replaces the table used by the package level functions, for
+// example with a fresher one loaded from a leap-seconds.list file.
+func SetDefault(t *Table) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultTable = t
+}
+
+// Offset returns the scale s minus UTC at the UTC time utc.
+func Offset(s Scale, utc time.Time) time.Duration {
+	return Default().Offset(s, utc)
+}
+
+// Convert converts ts, a clock reading in scale from, to scale to.
+func Convert(ts time.Time, from, to Scale) time.Time {
+	return Default().Convert(ts, from, to)
+}
+
+// Between returns the reading in scale to minus the reading in scale from
+// at the same instant, near the clock reading ts in scale from.
+func Between(ts time.Time, from, to Scale) time.Duration {
+	return Default().Between(ts, from, to)
+}
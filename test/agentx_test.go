@@ -0,0 +1,250 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/internal/server"
+	"ntsc.ac.cn/ta/time-validater/pkg/agentx"
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+	"ntsc.ac.cn/ta/time-validater/pkg/snmp"
+)
+
+var machineTableOID = snmp.MustParseOID(".1.3.6.1.4.1.326.3.1.2")
+
+// machineColumn returns the instance of column c of tvMachineTable for the
+// machine id.
+func machineColumn(c uint32, id string) snmp.OID {
+	oid := machineTableOID.Append(1, c, uint32(len(id)))
+	for _, b := range []byte(id) {
+		oid = append(oid, uint32(b))
+	}
+	return oid
+}
+
+// startMaster starts a master agent on a unix socket, returning it and its
+// address.
+func startMaster(t *testing.T) (*agentx.Master, string) {
+	addr := "unix:" + filepath.Join(t.TempDir(), "master")
+	master, err := agentx.NewMaster(&agentx.MasterConfig{
+		Address: addr,
+		Timeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = master.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	master.Start()
+	t.Cleanup(func() {
+		master.Close()
+	})
+	return master, addr
+}
+
+func TestAgentX(t *testing.T) {
+	master, addr := startMaster(t)
+	table := machineTableOID
+	column := machineColumn
+	// in no particular order, as the handler may return them
+	rows := []snmp.Varbind{
+		{OID: column(2, "b"), Value: -1500},
+		{OID: column(2, "a"), Value: 250},
+		{OID: column(3, "a"), Value: snmp.Gauge32(800)},
+		{OID: column(5, "a"), Value: []byte("2026")},
+		{OID: column(3, "b"), Value: snmp.Gauge32(1200)},
+	}
+	agent, err := agentx.NewSubAgent(&agentx.Config{
+		Address:       addr,
+		Subtree:       table,
+		Description:   "test",
+		Timeout:       time.Second,
+		RetryInterval: 50 * time.Millisecond,
+		Handler: func() []snmp.Varbind {
+			return append([]snmp.Varbind(nil), rows...)
+		},
+		Objects: []snmp.OID{table.Append(1, 2), table.Append(1, 3),
+			table.Append(1, 4), table.Append(1, 5)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errChan := agent.Start()
+	select {
+	case <-master.Registered():
+	case <-time.After(5 * time.Second):
+		t.Fatal("sub-agent not registered")
+	}
+	if subtrees := master.Subtrees(); len(subtrees) != 1 ||
+		!subtrees[0].Equal(table) {
+		t.Fatalf("registered %v, want [%s]", subtrees, table)
+	}
+
+	ctx := context.Background()
+	t.Run("get", func(t *testing.T) {
+		vbs, err := master.Get(ctx, column(3, "b"), column(4, "a"),
+			column(6, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vbs) != 3 || vbs[0].Value != snmp.Gauge32(1200) ||
+			vbs[1].Value != snmp.NoSuchInstance ||
+			vbs[2].Value != snmp.NoSuchObject {
+			t.Fatalf("got %v", vbs)
+		}
+	})
+	t.Run("walk", func(t *testing.T) {
+		vbs, err := master.Walk(ctx, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []snmp.OID{column(2, "a"), column(2, "b"), column(3, "a"),
+			column(3, "b"), column(5, "a")}
+		if len(vbs) != len(want) {
+			t.Fatalf("walked %v", vbs)
+		}
+		for i := range want {
+			if !vbs[i].OID.Equal(want[i]) {
+				t.Fatalf("walked [%s] at %d, want [%s]", vbs[i].OID, i, want[i])
+			}
+		}
+		if vbs[1].Value != -1500 {
+			t.Fatalf("offset of b %v, want -1500", vbs[1].Value)
+		}
+	})
+	t.Run("bulk", func(t *testing.T) {
+		vbs, err := master.GetBulk(ctx, 1, 3, table, column(3, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the first instance, then those after rtt of a until the end
+		want := []interface{}{250, snmp.Gauge32(1200), []byte("2026"),
+			snmp.EndOfMibView}
+		if len(vbs) != len(want) {
+			t.Fatalf("got %v", vbs)
+		}
+		for i, v := range want {
+			if b, ok := v.([]byte); ok {
+				if got, _ := vbs[i].Value.([]byte); string(got) != string(b) {
+					t.Fatalf("value %v at %d, want %v", vbs[i].Value, i, v)
+				}
+				continue
+			}
+			if vbs[i].Value != v {
+				t.Fatalf("value %v at %d, want %v", vbs[i].Value, i, v)
+			}
+		}
+	})
+	t.Run("set", func(t *testing.T) {
+		if err := master.Set(ctx, snmp.Varbind{
+			OID:   column(2, "a"),
+			Value: 0,
+		}); err == nil {
+			t.Fatal("set accepted by a read-only sub-agent")
+		}
+	})
+
+	agent.Close()
+	select {
+	case err = <-errChan:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sub-agent not stopped")
+	}
+}
+
+func TestAgentXMachineTable(t *testing.T) {
+	master, addr := startMaster(t)
+	fake := clock.NewFake(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := newValidateServer(t, &server.Config{
+		Clock:    fake,
+		Schedule: &server.Schedule{Default: 100 * time.Millisecond},
+		AgentX: &server.AgentXConfig{
+			Address:        addr,
+			AlarmThreshold: time.Millisecond,
+		},
+	})
+	s.Start()
+	select {
+	case <-master.Registered():
+	case <-time.After(5 * time.Second):
+		t.Fatal("machine table not registered")
+	}
+
+	// row returns the offset, rtt, state, last seen and severity of id
+	ctx := context.Background()
+	row := func(id string) []interface{} {
+		var oids []snmp.OID
+		for c := uint32(2); c <= 6; c++ {
+			oids = append(oids, machineColumn(c, id))
+		}
+		vbs, err := master.Get(ctx, oids...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make([]interface{}, len(vbs))
+		for i, vb := range vbs {
+			values[i] = vb.Value
+		}
+		return values
+	}
+	expect := func(id string, want ...interface{}) {
+		t.Helper()
+		if got := row(id); fmt.Sprintf("%v", got) != fmt.Sprintf("%v", want) {
+			t.Fatalf("row %v, want %v", got, want)
+		}
+	}
+	lastSeen := func(t time.Time) []byte {
+		return []byte{byte(t.Year() >> 8), byte(t.Year()), byte(t.Month()),
+			byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()),
+			byte(t.Nanosecond() / int(100*time.Millisecond)), '+', 0, 0}
+	}
+
+	silent := newMachineStream(true)
+	done := validate(s, silent)
+	info := waitSessions(t, s, 1)[0]
+	id := info.MachineID
+	// connecting: not measured, last seen when connected
+	expect(id, snmp.NoSuchInstance, snmp.NoSuchInstance, 1,
+		lastSeen(info.ConnectedAt), 2)
+	fake.Advance(301 * time.Millisecond)
+	expect(id, snmp.NoSuchInstance, snmp.NoSuchInstance, 3,
+		lastSeen(info.ConnectedAt), 3)
+	silent.cancel()
+	<-done
+	expect(id, snmp.NoSuchInstance, snmp.NoSuchInstance, 4,
+		lastSeen(info.ConnectedAt), 2)
+
+	for _, tc := range []struct {
+		offset   time.Duration
+		severity int
+	}{
+		{-500 * time.Microsecond, 1},
+		{2 * time.Millisecond, 4},
+	} {
+		ms := newMachineStream(false)
+		ms.clock = fake
+		ms.offset = tc.offset
+		done = validate(s, ms)
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if info, _ = s.Session(id); info.State == server.SessionActive {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("session %s", info.State)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		expect(id, int(tc.offset/time.Microsecond), snmp.Gauge32(0), 2,
+			lastSeen(info.LastMeasurement.Time), tc.severity)
+		ms.cancel()
+		<-done
+	}
+}
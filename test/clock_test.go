@@ -0,0 +1,122 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+var fakeEpoch = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+func TestFakeClock(t *testing.T) {
+	f := clock.NewFake(fakeEpoch)
+	f.SetDrift(100)
+	f.Advance(10 * time.Second)
+	if want := fakeEpoch.Add(10*time.Second + time.Millisecond); !f.Now().Equal(want) {
+		t.Fatalf("drifted clock reads %s, expect %s", f.Now(), want)
+	}
+	before := f.Now()
+	f.Step(-time.Second)
+	if d := f.Since(before); d != -time.Second {
+		t.Fatalf("since a backward step [%s], expect -1s", d)
+	}
+
+	// timers fire in order, on true time, and ignore steps
+	slow, fast := f.NewTimer(2*time.Second), f.NewTimer(time.Second)
+	stopped := f.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Fatal("stop of a pending timer returned false")
+	}
+	f.Step(time.Hour)
+	f.Advance(1500 * time.Millisecond)
+	select {
+	case <-fast.C():
+	default:
+		t.Fatal("timer not fired")
+	}
+	select {
+	case <-slow.C():
+		t.Fatal("timer fired early")
+	case <-stopped.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f.Sleep(time.Minute)
+		close(done)
+	}()
+	f.BlockUntil(2)
+	f.Advance(time.Minute)
+	<-done
+	<-slow.C()
+}
+
+func TestNTPFakeClock(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		server, local := clock.NewFake(fakeEpoch.Add(2*time.Second)),
+			clock.NewFake(fakeEpoch)
+		server.SetDrift(50)
+		server.Advance(1000 * time.Second)
+		local.Advance(1000 * time.Second)
+		want := 2*time.Second + 50*time.Millisecond
+
+		s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+			Address: "127.0.0.1:0",
+			Network: network,
+			Stratum: 1,
+			Clock:   server,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Listen(); err != nil {
+			t.Fatal(err)
+		}
+		s.Start()
+		defer s.Close()
+
+		nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+			Address:       s.Addr().String(),
+			Network:       network,
+			BurstInterval: time.Hour,
+			Clock:         local,
+		})
+		defer nc.Close()
+		resp, err := nc.Query()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Neither clock moves during the exchange: the measure is exact.
+		if d := resp.ClockOffset - want; d < -10 || d > 10 || resp.RTT != 0 {
+			t.Fatalf("%s: offset [%s] rtt [%s], expect [%s] and 0",
+				network, resp.ClockOffset, resp.RTT, want)
+		}
+
+		// the burst waits on the client clock between queries, while the
+		// server gains 180ms an hour
+		errc := make(chan error, 1)
+		var fr *tcpntp.FilterResult
+		go func() {
+			var err error
+			fr, err = nc.QueryBurst(context.Background(), 3)
+			errc <- err
+		}()
+		for i := 0; i < 2; i++ {
+			local.BlockUntil(1)
+			local.Advance(time.Hour)
+			server.Advance(time.Hour)
+		}
+		if err = <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if fr.Samples != 3 || fr.Delay != 0 || fr.Offset < want-10 ||
+			fr.Offset > want+360*time.Millisecond+10 {
+			t.Fatalf("%s: unexpected burst %+v", network, fr)
+		}
+	}
+}
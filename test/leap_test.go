@@ -0,0 +1,109 @@
+package test
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
+)
+
+const ntpEpochOffset = 2208988800
+
+// leapSecondsList builds a leap-seconds.list file with a valid hash.
+func leapSecondsList(expires time.Time, leaps ...timescale.Leap) string {
+	var b strings.Builder
+	digits := fmt.Sprintf("%d%d", 3913056000, expires.Unix()+ntpEpochOffset)
+	b.WriteString("# test leap seconds\n#\n#$\t 3913056000\n")
+	fmt.Fprintf(&b, "#@\t%d\n#\n", expires.Unix()+ntpEpochOffset)
+	for _, l := range leaps {
+		sec := l.Time.Unix() + ntpEpochOffset
+		off := int(l.TAIOffset / time.Second)
+		fmt.Fprintf(&b, "%d\t%d\t# %s\n", sec, off, l.Time.Format("2 Jan 2006"))
+		digits += fmt.Sprintf("%d%d", sec, off)
+	}
+	sum := sha1.Sum([]byte(digits))
+	b.WriteString("#h\t")
+	for i := 0; i < len(sum); i += 4 {
+		fmt.Fprintf(&b, " %x", sum[i:i+4])
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+func TestLeapSecondsList(t *testing.T) {
+	expires := time.Date(2030, time.June, 28, 0, 0, 0, 0, time.UTC)
+	file := leapSecondsList(expires,
+		timescale.Leap{Time: time.Date(1972, time.January, 1, 0, 0, 0, 0, time.UTC),
+			TAIOffset: 10 * time.Second},
+		timescale.Leap{Time: time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC),
+			TAIOffset: 37 * time.Second},
+		timescale.Leap{Time: time.Date(2029, time.July, 1, 0, 0, 0, 0, time.UTC),
+			TAIOffset: 38 * time.Second})
+	table, err := timescale.ParseLeapSecondsList(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !table.Expires().Equal(expires) || len(table.Leaps()) != 3 {
+		t.Fatalf("unexpected table expiry [%s] leaps [%d]",
+			table.Expires(), len(table.Leaps()))
+	}
+	if table.Expired(expires.Add(-time.Hour)) || !table.Expired(expires.Add(time.Hour)) {
+		t.Fatal("unexpected expiry check")
+	}
+	lastDay := time.Date(2029, time.June, 30, 12, 0, 0, 0, time.UTC)
+	if table.Pending(lastDay) != 1 || table.Pending(lastDay.Add(-24*time.Hour)) != 0 {
+		t.Fatal("unexpected pending leap")
+	}
+
+	tampered := strings.Replace(file, "\t38\t", "\t39\t", 1)
+	if _, err = timescale.ParseLeapSecondsList(strings.NewReader(tampered)); err == nil {
+		t.Fatal("expect hash mismatch error")
+	}
+}
+
+func TestNTPLeapIndicator(t *testing.T) {
+	now := time.Now().UTC()
+	midnight := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+	table, err := timescale.NewTable([]timescale.Leap{
+		{Time: time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC),
+			TAIOffset: 37 * time.Second},
+		{Time: midnight, TAIOffset: 38 * time.Second},
+	}, midnight.Add(180*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+		Address: "127.0.0.1:0",
+		Stratum: 1,
+		Leaps:   table,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Close()
+
+	mc, err := tcpntp.NewMultiClient(&tcpntp.MultiConfig{
+		Sources:      []*tcpntp.Config{{Address: s.Addr().String()}},
+		MinSurvivors: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	result, err := mc.Query(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Leap != tcpntp.LeapAddSecond {
+		t.Fatalf("unexpected leap indicator [%d]", result.Leap)
+	}
+}
@@ -0,0 +1,185 @@
+package test
+
+import (
+	"crypto/md5"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+const testNTPKeys = `# id type secret
+1 MD5 secret-md5
+2 SHA1 HEX:0102030405060708090a0b0c0d0e0f1011121314
+3 AES128CMAC 2b7e151628aed2a6abf7158809cf4f3c
+`
+
+func TestNTPKeysFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ntp.keys")
+	if err := os.WriteFile(path, []byte(testNTPKeys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ks, err := tcpntp.LoadKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, typ := range map[uint32]tcpntp.KeyType{
+		1: tcpntp.KeyMD5, 2: tcpntp.KeySHA1, 3: tcpntp.KeyAES128CMAC,
+	} {
+		if k := ks.Get(id); k == nil || k.Type != typ {
+			t.Fatalf("unexpected key [%d]: %v", id, k)
+		}
+	}
+	if _, err = tcpntp.ParseKeys(strings.NewReader(
+		"4 AES128CMAC short\n")); err == nil {
+		t.Fatal("expect invalid AES key length error")
+	}
+}
+
+func TestNTPAuth(t *testing.T) {
+	serverKeys, _ := tcpntp.ParseKeys(strings.NewReader(testNTPKeys))
+	wrongKeys, _ := tcpntp.ParseKeys(strings.NewReader(
+		"3 AES128CMAC 000102030405060708090a0b0c0d0e0f\n9 MD5 unknown\n"))
+	if _, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+		Address: "127.0.0.1:0",
+		Stratum: 1,
+		Keys:    serverKeys,
+	}); err == nil {
+		t.Fatal("tcp server with optional authentication accepted")
+	}
+	for _, tc := range []struct {
+		network     string
+		requireAuth bool
+	}{
+		{"tcp", true},
+		{"udp", true},
+		{"udp", false},
+	} {
+		network := tc.network
+		s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+			Address:     "127.0.0.1:0",
+			Network:     network,
+			Stratum:     1,
+			Keys:        serverKeys,
+			RequireAuth: tc.requireAuth,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Listen(); err != nil {
+			t.Fatal(err)
+		}
+		s.Start()
+		defer s.Close()
+
+		for id := uint32(1); id <= 3; id++ {
+			nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+				Address: s.Addr().String(),
+				Network: network,
+				KeyID:   id,
+				Keys:    serverKeys,
+			})
+			if _, err = nc.Query(); err != nil {
+				t.Fatalf("%s key [%d]: %v", network, id, err)
+			}
+			nc.Close()
+		}
+		for _, id := range []uint32{3, 9} {
+			nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+				Address: s.Addr().String(),
+				Network: network,
+				KeyID:   id,
+				Keys:    wrongKeys,
+				Timeout: time.Second,
+			})
+			if _, err = nc.Query(); !errors.Is(err, tcpntp.ErrCryptoNAK) {
+				t.Fatalf("%s key [%d]: expect crypto-NAK, got: %v",
+					network, id, err)
+			}
+			nc.Close()
+		}
+
+		// unauthenticated queries are answered only if authentication is
+		// optional, refused with CRYP on udp and never framed on tcp
+		nc, err := tcpntp.NewNTPClient(&tcpntp.Config{
+			Address: s.Addr().String(),
+			Network: network,
+			Timeout: 200 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = nc.Query()
+		var ke *tcpntp.KissError
+		var te *tcpntp.TimeoutError
+		switch {
+		case !tc.requireAuth && err != nil:
+			t.Fatalf("%s unauthenticated: %v", network, err)
+		case tc.requireAuth && network == "udp" &&
+			(!errors.As(err, &ke) || ke.Code != "CRYP"):
+			t.Fatalf("%s unauthenticated: expect CRYP kiss, got: %v",
+				network, err)
+		case tc.requireAuth && network == "tcp" && !errors.As(err, &te):
+			t.Fatalf("%s unauthenticated: expect timeout, got: %v",
+				network, err)
+		}
+		nc.Close()
+	}
+}
+
+// TestNTPAuthSlowMAC sends the MAC of a tcp query in a later segment, as a
+// congested link may deliver it.
+func TestNTPAuthSlowMAC(t *testing.T) {
+	keys, _ := tcpntp.ParseKeys(strings.NewReader(testNTPKeys))
+	s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+		Address:     "127.0.0.1:0",
+		Stratum:     1,
+		Keys:        keys,
+		RequireAuth: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	query := &tcpntp.Packet{TransmitTime: 1}
+	query.SetVersion(4)
+	query.SetMode(tcpntp.ModeClient)
+	hdr, _ := query.Marshal()
+	if _, err = conn.Write(hdr); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	digest := md5.Sum(append([]byte("secret-md5"), hdr...))
+	if _, err = conn.Write(append([]byte{0, 0, 0, 1}, digest[:]...)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, len(hdr)+4+md5.Size)
+	if _, err = io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	var resp tcpntp.Packet
+	if err = resp.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Mode() != tcpntp.ModeServer || resp.Stratum != 1 ||
+		resp.OriginTime != 1 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
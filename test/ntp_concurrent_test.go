@@ -0,0 +1,97 @@
+package test
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+// queryConcurrently runs queries on nc from several goroutines and fails on
+// the first error, such as a response matched to the wrong query.
+func queryConcurrently(t *testing.T, nc *tcpntp.NTPClient) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := nc.Query(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestNTPClientConcurrent(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+			Address: "127.0.0.1:0",
+			Network: network,
+			Stratum: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Listen(); err != nil {
+			t.Fatal(err)
+		}
+		s.Start()
+		defer s.Close()
+
+		nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+			Address:  s.Addr().String(),
+			Network:  network,
+			PoolSize: 4,
+		})
+		queryConcurrently(t, nc)
+		if nc.State() != tcpntp.StateConnected {
+			t.Fatalf("%s: unexpected state [%s]", network, nc.State())
+		}
+		nc.Close()
+	}
+}
+
+func TestNTSConcurrent(t *testing.T) {
+	key, err := tcpntp.GenerateNTSCookieKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+		Address: "127.0.0.1:0",
+		Stratum: 1,
+		NTSKey:  key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Close()
+	_, port, _ := net.SplitHostPort(s.Addr().String())
+	p, _ := strconv.Atoi(port)
+	keAddr, pool := startNTSKEServer(t, key, uint16(p))
+
+	nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+		Address: keAddr,
+		NTS: &tcpntp.NTSConfig{
+			KEAddress: keAddr,
+			TLSConfig: &tls.Config{RootCAs: pool, ServerName: "ntsc.ac.cn"},
+		},
+	})
+	defer nc.Close()
+	queryConcurrently(t, nc)
+}
@@ -0,0 +1,165 @@
+package test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+const controlSystemVars = `version="ntpd 4.2.8p15", leap=00, stratum=2, ` +
+	`precision=-24, rootdelay=1.532, rootdisp=8.271, refid=10.0.0.1,` + "\r\n" +
+	`reftime=0xe5f0a1b2.80000000, peer=4242, offset=-0.123456, ` +
+	`sys_jitter=0.048012, system="Linux/5.15, x86_64", flags`
+
+// controlResponses answers a mode 6 request with its response fragments,
+// the READVAR data split in three and sent out of order.
+func controlResponses(req []byte) [][]byte {
+	op := req[1] & 0x1f
+	frag := func(flags uint8, status, assoc, offset uint16, data []byte) []byte {
+		pkt := make([]byte, 12, 12+len(data)+3)
+		pkt[0] = 4<<3 | 6
+		pkt[1] = 0x80 | flags | op
+		copy(pkt[2:4], req[2:4])
+		binary.BigEndian.PutUint16(pkt[4:], status)
+		binary.BigEndian.PutUint16(pkt[6:], assoc)
+		binary.BigEndian.PutUint16(pkt[8:], offset)
+		binary.BigEndian.PutUint16(pkt[10:], uint16(len(data)))
+		pkt = append(pkt, data...)
+		return append(pkt, make([]byte, (4-len(pkt)%4)%4)...)
+	}
+	assoc := binary.BigEndian.Uint16(req[6:])
+	switch {
+	case op == 1:
+		data := []byte{0x10, 0x92, 0x96, 0x14, 0x10, 0x93, 0x93, 0x14}
+		return [][]byte{frag(0, 0x0618, 0, 0, data)}
+	case op == 2 && assoc == 0:
+		d := []byte(controlSystemVars)
+		a, b := 60, 120
+		return [][]byte{
+			frag(0x20, 0x0618, 0, uint16(a), d[a:b]),
+			frag(0, 0x0618, 0, uint16(b), d[b:]),
+			frag(0x20, 0x0618, 0, 0, d[:a]),
+		}
+	}
+	return [][]byte{frag(0x40, 4<<8, assoc, 0, nil)}
+}
+
+func startControlServer(t *testing.T, network string) string {
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				n, raddr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				// A stray late fragment of an earlier request goes first.
+				stale := append([]byte(nil), buf[:n]...)
+				binary.BigEndian.PutUint16(stale[2:], 0xffff)
+				conn.WriteTo(controlResponses(stale)[0], raddr)
+				for _, pkt := range controlResponses(buf[:n]) {
+					conn.WriteTo(pkt, raddr)
+				}
+			}
+		}()
+		return conn.LocalAddr().String()
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					hdr := make([]byte, 12)
+					if _, err := io.ReadFull(conn, hdr); err != nil {
+						return
+					}
+					count := int(binary.BigEndian.Uint16(hdr[10:]))
+					body := make([]byte, (count+3)&^3)
+					if _, err := io.ReadFull(conn, body); err != nil {
+						return
+					}
+					for _, pkt := range controlResponses(append(hdr, body...)) {
+						conn.Write(pkt)
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestNTPControl(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		cc, err := tcpntp.NewControlClient(&tcpntp.ControlConfig{
+			Address: startControlServer(t, network),
+			Network: network,
+			Timeout: time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+		ctx := context.Background()
+
+		sys, peers, err := cc.ReadStatus(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sys.Synchronized() || sys.Source != 6 || len(peers) != 2 {
+			t.Fatalf("%s: unexpected status %+v peers %+v", network, sys, peers)
+		}
+		if peers[0].AssocID != 0x1092 || peers[0].Selection != tcpntp.PeerSystem ||
+			!peers[0].Reachable || peers[1].Selection != tcpntp.PeerOutlier {
+			t.Fatalf("%s: unexpected peers %+v", network, peers)
+		}
+
+		vars, err := cc.ReadVars(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := vars["system"].String(); v != "Linux/5.15, x86_64" {
+			t.Fatalf("%s: unexpected system [%s]", network, v)
+		}
+		if n, err := vars["stratum"].Int(); err != nil || n != 2 {
+			t.Fatalf("%s: unexpected stratum [%d]: %v", network, n, err)
+		}
+		if d, err := vars["offset"].Millis(); err != nil || d != -123456*time.Nanosecond {
+			t.Fatalf("%s: unexpected offset [%s]: %v", network, d, err)
+		}
+		ref, err := vars["reftime"].Time(time.Now())
+		if err != nil || ref.Year() < 2022 || ref.Nanosecond() != 500000000 {
+			t.Fatalf("%s: unexpected reftime [%s]: %v", network, ref, err)
+		}
+		if _, ok := vars["flags"]; !ok || len(vars) != 13 {
+			t.Fatalf("%s: unexpected variables %s", network,
+				strings.Join(vars.Names(), ","))
+		}
+
+		_, err = cc.ReadVars(ctx, 0x1092, "offset")
+		var ce *tcpntp.ControlError
+		if !errors.As(err, &ce) || ce.Code != 4 {
+			t.Fatalf("%s: expect unknown association error, got: %v", network, err)
+		}
+	}
+}
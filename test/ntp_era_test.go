@@ -0,0 +1,103 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+func TestNTPEraRoundTrip(t *testing.T) {
+	era1 := time.Date(2036, time.February, 7, 6, 28, 16, 0, time.UTC)
+	if tcpntp.NTPEra(era1.Add(-time.Nanosecond)) != 0 || tcpntp.NTPEra(era1) != 1 {
+		t.Fatal("unexpected era around the 2036 rollover")
+	}
+	if tcpntp.NTPEra(time.Date(1899, time.December, 31, 0, 0, 0, 0, time.UTC)) != -1 {
+		t.Fatal("unexpected era before the ntp epoch")
+	}
+	if ts := tcpntp.ToNTPTime(era1); ts != 0 {
+		t.Fatalf("unexpected timestamp [%x] at the rollover", ts)
+	}
+	for _, pivot := range []time.Time{
+		era1.AddDate(-20, 0, 0),
+		era1,
+		era1.AddDate(20, 0, 0),
+	} {
+		for d := -3 * time.Second; d <= 3*time.Second; d += 750 * time.Millisecond {
+			want := era1.Add(d + 123456789)
+			got := tcpntp.FromNTPTime(tcpntp.ToNTPTime(want), pivot)
+			if diff := got.Sub(want); diff < -time.Nanosecond || diff > time.Nanosecond {
+				t.Fatalf("pivot [%s]: [%s] round trips to [%s]", pivot, want, got)
+			}
+		}
+	}
+	// The same timestamp read near 2150 falls in era 1.
+	t2020 := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	got := tcpntp.FromNTPTime(tcpntp.ToNTPTime(t2020),
+		time.Date(2150, time.January, 1, 0, 0, 0, 0, time.UTC))
+	if want := t2020.Add((1 << 32) * time.Second); !got.Equal(want) {
+		t.Fatalf("unexpected time [%s], want [%s]", got, want)
+	}
+}
+
+func TestNTPEraClientClock(t *testing.T) {
+	now := time.Date(2100, time.March, 1, 12, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(now)
+	s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+		Address: "127.0.0.1:0",
+		Stratum: 2,
+		Clock:   fake,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Close()
+
+	// The timestamps of era 1 are read near the client clock, not the
+	// system clock.
+	nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{Address: s.Addr().String(), Clock: fake})
+	defer nc.Close()
+	resp, err := nc.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Time.Equal(now) || resp.ClockOffset != 0 {
+		t.Fatalf("unexpected time [%s] offset [%s]", resp.Time, resp.ClockOffset)
+	}
+}
+
+func TestNTPTimeShortSaturation(t *testing.T) {
+	s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+		Address:        "127.0.0.1:0",
+		Stratum:        2,
+		RootDelay:      70000 * time.Second,
+		RootDispersion: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Close()
+
+	nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{Address: s.Addr().String()})
+	defer nc.Close()
+	resp, err := nc.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.RootDelay < 65535*time.Second || resp.RootDelay > 65536*time.Second {
+		t.Fatalf("unexpected saturated root delay [%s]", resp.RootDelay)
+	}
+	if d := resp.RootDispersion - 100*time.Millisecond; d < -time.Millisecond ||
+		d > time.Millisecond {
+		t.Fatalf("unexpected root dispersion [%s]", resp.RootDispersion)
+	}
+}
@@ -0,0 +1,51 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+func TestNTPQueryBurst(t *testing.T) {
+	s := startNTPServer(t)
+	nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+		Address:       s.Addr().String(),
+		BurstInterval: time.Millisecond,
+	})
+	defer nc.Close()
+
+	if _, err := nc.QueryBurst(context.Background(), 0); err == nil {
+		t.Fatal("expect invalid burst size error")
+	}
+	result, err := nc.QueryBurst(context.Background(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Samples != 4 {
+		t.Fatalf("unexpected samples [%d]", result.Samples)
+	}
+	if result.Response == nil || result.Delay != result.Response.RTT {
+		t.Fatal("selected sample does not match its response")
+	}
+	fmt.Println("offset:", result.Offset, "delay:", result.Delay,
+		"dispersion:", result.Dispersion, "jitter:", result.Jitter)
+
+	// the register holds at most 8 samples
+	if result, err = nc.QueryBurst(context.Background(), 6); err != nil {
+		t.Fatal(err)
+	}
+	if result.Samples != 8 {
+		t.Fatalf("unexpected samples [%d]", result.Samples)
+	}
+	nc.ResetFilter()
+	if result, err = nc.QueryBurst(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if result.Samples != 1 || result.Jitter != 0 {
+		t.Fatalf("unexpected samples [%d] jitter [%s]",
+			result.Samples, result.Jitter)
+	}
+}
@@ -0,0 +1,119 @@
+package test
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+// startKissNTPServer answers udp queries with the kiss code, or with a
+// normal response when code is empty, advertising the poll exponent. It
+// returns the address and the number of queries received.
+func startKissNTPServer(t *testing.T, code string, poll int8) (string, *int32) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	var queries int32
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, raddr, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n < 48 {
+				continue
+			}
+			atomic.AddInt32(&queries, 1)
+			resp := make([]byte, 48)
+			resp[0] = 0x24 // version 4, server mode
+			resp[1] = 2
+			resp[2] = byte(poll)
+			if code != "" {
+				resp[0] |= 0xc0 // not synchronized
+				resp[1] = 0
+				copy(resp[12:16], code)
+			}
+			copy(resp[24:32], buf[40:48])
+			copy(resp[32:40], buf[40:48])
+			copy(resp[40:48], buf[40:48])
+			pc.WriteToUDP(resp, raddr)
+		}
+	}()
+	return pc.LocalAddr().String(), &queries
+}
+
+func TestNTPKissRate(t *testing.T) {
+	addr, queries := startKissNTPServer(t, "RATE", 0)
+	nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{Address: addr, Network: "udp"})
+	defer nc.Close()
+
+	_, err := nc.Query()
+	var ke *tcpntp.KissError
+	if !errors.As(err, &ke) || ke.Code != "RATE" || ke.Fatal() {
+		t.Fatalf("expect RATE kiss error, got: %v", err)
+	}
+	if _, err = nc.Query(); err == nil || errors.As(err, &ke) {
+		t.Fatalf("expect rate limit error, got: %v", err)
+	}
+	if n := atomic.LoadInt32(queries); n != 1 {
+		t.Fatalf("unexpected queries [%d] while rate limited", n)
+	}
+}
+
+func TestNTPKissDeny(t *testing.T) {
+	addr, queries := startKissNTPServer(t, "DENY", 0)
+	nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{Address: addr, Network: "udp"})
+	defer nc.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := nc.Query()
+		var ke *tcpntp.KissError
+		if !errors.As(err, &ke) || !ke.Fatal() {
+			t.Fatalf("expect fatal kiss error, got: %v", err)
+		}
+	}
+	if nc.State() != tcpntp.StateDenied {
+		t.Fatalf("unexpected state [%s]", nc.State())
+	}
+	if n := atomic.LoadInt32(queries); n != 1 {
+		t.Fatalf("unexpected queries [%d] after DENY", n)
+	}
+}
+
+func TestNTPKissOther(t *testing.T) {
+	addr, queries := startKissNTPServer(t, "INIT", 0)
+	nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{Address: addr, Network: "udp"})
+	defer nc.Close()
+
+	for i := 0; i < 2; i++ {
+		var ke *tcpntp.KissError
+		if _, err := nc.Query(); !errors.As(err, &ke) || ke.Code != "INIT" {
+			t.Fatalf("expect INIT kiss error, got: %v", err)
+		}
+		if nc.State() != tcpntp.StateBroken {
+			t.Fatalf("unexpected state [%s]", nc.State())
+		}
+	}
+	if n := atomic.LoadInt32(queries); n != 2 {
+		t.Fatalf("unexpected queries [%d] after redial", n)
+	}
+}
+
+func TestNTPServerPoll(t *testing.T) {
+	addr, _ := startKissNTPServer(t, "", 6)
+	nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{Address: addr, Network: "udp"})
+	defer nc.Close()
+
+	if _, err := nc.Query(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nc.Query(); err == nil {
+		t.Fatal("expect rate limit error within the server poll interval")
+	}
+}
@@ -0,0 +1,109 @@
+package test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+// startSkewedNTPServer answers tcp ntp queries with a clock skewed by
+// offset.
+func startSkewedNTPServer(t *testing.T, offset time.Duration) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ntpEpoch := time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+	stamp := func() uint64 {
+		d := time.Now().Add(offset).Sub(ntpEpoch)
+		sec := uint64(d / time.Second)
+		frac := uint64(d%time.Second) << 32 / uint64(time.Second)
+		return sec<<32 | frac
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req := make([]byte, 48)
+				for {
+					if _, err := io.ReadFull(conn, req); err != nil {
+						return
+					}
+					resp := make([]byte, 48)
+					resp[0] = 0x24
+					resp[1] = 1
+					resp[3] = 0xec // precision 2^-20 s
+					copy(resp[24:32], req[40:48])
+					binary.BigEndian.PutUint64(resp[32:40], stamp())
+					binary.BigEndian.PutUint64(resp[40:48], stamp())
+					conn.Write(resp)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestNTPMultiClient(t *testing.T) {
+	good1 := startSkewedNTPServer(t, 0)
+	good2 := startSkewedNTPServer(t, time.Millisecond)
+	bad := startSkewedNTPServer(t, 2*time.Second)
+	mc, err := tcpntp.NewMultiClient(&tcpntp.MultiConfig{
+		Sources: []*tcpntp.Config{
+			{Address: good1, BurstInterval: 10 * time.Millisecond},
+			{Address: bad, BurstInterval: 10 * time.Millisecond},
+			{Address: good2, BurstInterval: 10 * time.Millisecond},
+			{Address: "127.0.0.1:1", BurstInterval: 10 * time.Millisecond},
+		},
+		// empty filter stages count as 16 s of dispersion, four samples
+		// narrow the intervals below a second
+		Burst: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+	result, err := mc.Query(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ft := result.Falsetickers(); len(ft) != 1 || ft[0] != bad {
+		t.Fatalf("unexpected falsetickers: %v", ft)
+	}
+	if tc := result.Truechimers(); len(tc) != 2 {
+		t.Fatalf("unexpected truechimers: %v", tc)
+	}
+	if result.Sources[3].Err == nil {
+		t.Fatal("expect unreachable source failed")
+	}
+	if result.Offset < -50*time.Millisecond ||
+		result.Offset > 50*time.Millisecond {
+		t.Fatalf("unexpected combined offset [%s]", result.Offset)
+	}
+}
+
+func TestNTPMultiClientNoMajority(t *testing.T) {
+	a := startSkewedNTPServer(t, 0)
+	b := startSkewedNTPServer(t, 3*time.Second)
+	mc, _ := tcpntp.NewMultiClient(&tcpntp.MultiConfig{
+		Sources: []*tcpntp.Config{
+			{Address: a, BurstInterval: 10 * time.Millisecond},
+			{Address: b, BurstInterval: 10 * time.Millisecond},
+		},
+		Burst: 4,
+	})
+	defer mc.Close()
+	if _, err := mc.Query(context.Background()); err == nil {
+		t.Fatal("expect no majority error")
+	}
+}
@@ -0,0 +1,151 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+func selfSignedTLS(t *testing.T) (*tls.Config, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ntsc.ac.cn"},
+		DNSNames:     []string{"ntsc.ac.cn"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}, pool
+}
+
+func startNTSKEServer(t *testing.T, key *tcpntp.NTSCookieKey,
+	ntpPort uint16) (string, *x509.CertPool) {
+	tlsConf, pool := selfSignedTLS(t)
+	ks, err := tcpntp.NewNTSKEServer(&tcpntp.NTSKEServerConfig{
+		Address:   "127.0.0.1:0",
+		TLSConfig: tlsConf,
+		CookieKey: key,
+		NTPPort:   ntpPort,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ks.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	ks.Start()
+	t.Cleanup(func() { ks.Close() })
+	return ks.Addr().String(), pool
+}
+
+func TestNTS(t *testing.T) {
+	key, err := tcpntp.GenerateNTSCookieKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, network := range []string{"tcp", "udp"} {
+		s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+			Address: "127.0.0.1:0",
+			Network: network,
+			Stratum: 1,
+			NTSKey:  key,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Listen(); err != nil {
+			t.Fatal(err)
+		}
+		s.Start()
+		defer s.Close()
+		_, port, _ := net.SplitHostPort(s.Addr().String())
+		p, _ := strconv.Atoi(port)
+		keAddr, pool := startNTSKEServer(t, key, uint16(p))
+
+		// the ntp port is negotiated by nts-ke
+		nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+			Address: "127.0.0.1:1",
+			Network: network,
+			NTS: &tcpntp.NTSConfig{
+				KEAddress: keAddr,
+				TLSConfig: &tls.Config{RootCAs: pool, ServerName: "ntsc.ac.cn"},
+			},
+		})
+		// more queries than cookies handed out by nts-ke
+		for i := 0; i < 20; i++ {
+			if _, err = nc.Query(); err != nil {
+				t.Fatalf("%s query %d: %v", network, i, err)
+			}
+		}
+		nc.Close()
+	}
+}
+
+func TestNTSNAK(t *testing.T) {
+	keKey, _ := tcpntp.GenerateNTSCookieKey()
+	ntpKey, _ := tcpntp.GenerateNTSCookieKey()
+	s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+		Address: "127.0.0.1:0",
+		Stratum: 1,
+		NTSKey:  ntpKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Close()
+	keAddr, pool := startNTSKEServer(t, keKey, 0)
+	nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+		Address: s.Addr().String(),
+		NTS: &tcpntp.NTSConfig{
+			KEAddress: keAddr,
+			TLSConfig: &tls.Config{RootCAs: pool, ServerName: "ntsc.ac.cn"},
+		},
+	})
+	defer nc.Close()
+	if _, err = nc.Query(); !errors.Is(err, tcpntp.ErrNTSNAK) {
+		t.Fatalf("expect nts nak, got: %v", err)
+	}
+
+	// an untrusted nts-ke certificate fails the key exchange
+	nc2, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+		Address: s.Addr().String(),
+		NTS:     &tcpntp.NTSConfig{KEAddress: keAddr},
+	})
+	defer nc2.Close()
+	if _, err = nc2.Query(); err == nil {
+		t.Fatal("expect tls verification failure")
+	}
+}
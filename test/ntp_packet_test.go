@@ -0,0 +1,129 @@
+package test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+func TestNTPPacketRoundTrip(t *testing.T) {
+	p := &tcpntp.Packet{
+		Stratum:      2,
+		Poll:         6,
+		Precision:    -20,
+		RootDelay:    tcpntp.ToNTPTimeShort(1500 * time.Microsecond),
+		ReferenceID:  0x4c4f434c,
+		TransmitTime: tcpntp.ToNTPTime(time.Now()),
+		Extensions: []tcpntp.ExtensionField{
+			{Type: tcpntp.ExtUniqueIdentifier, Body: bytes.Repeat([]byte{1}, 32)},
+			{Type: 0x2005, Body: make([]byte, 12)},
+		},
+		MAC: append([]byte{0, 0, 0, 7}, bytes.Repeat([]byte{0xaa}, 20)...),
+	}
+	p.SetLeap(tcpntp.LeapAddSecond)
+	p.SetVersion(4)
+	p.SetMode(tcpntp.ModeServer)
+	b, err := p.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 48+36+16+24 {
+		t.Fatalf("unexpected packet length [%d]", len(b))
+	}
+
+	var q tcpntp.Packet
+	if err = q.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if q.Leap() != tcpntp.LeapAddSecond || q.Version() != 4 ||
+		q.Mode() != tcpntp.ModeServer {
+		t.Fatalf("unexpected leap [%d] version [%d] mode [%d]",
+			q.Leap(), q.Version(), q.Mode())
+	}
+	if len(q.Extensions) != 2 || q.Extensions[1].Type != 0x2005 ||
+		!bytes.Equal(q.MAC, p.MAC) {
+		t.Fatalf("unexpected extensions [%d] or mac [%x]", len(q.Extensions), q.MAC)
+	}
+	if c, _ := q.Marshal(); !bytes.Equal(b, c) {
+		t.Fatal("packet does not round trip")
+	}
+	if d := tcpntp.FromNTPTimeShort(q.RootDelay); d < 1400*time.Microsecond ||
+		d > 1600*time.Microsecond {
+		t.Fatalf("unexpected root delay [%s]", d)
+	}
+}
+
+func TestNTPPacketExchange(t *testing.T) {
+	s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+		Address: "127.0.0.1:0",
+		Network: "udp",
+		Stratum: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Close()
+
+	conn, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	req := &tcpntp.Packet{TransmitTime: tcpntp.ToNTPTime(time.Now())}
+	req.SetVersion(4)
+	req.SetMode(tcpntp.ModeClient)
+	b, _ := req.Marshal()
+	if _, err = conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp tcpntp.Packet
+	if err = resp.Unmarshal(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Mode() != tcpntp.ModeServer || resp.Stratum != 3 ||
+		resp.OriginTime != req.TransmitTime {
+		t.Fatalf("unexpected response mode [%d] stratum [%d]",
+			resp.Mode(), resp.Stratum)
+	}
+	if d := time.Since(tcpntp.FromNTPTime(resp.TransmitTime, time.Now())); d < -time.Second ||
+		d > time.Second {
+		t.Fatalf("unexpected transmit time, %s off", d)
+	}
+}
+
+func FuzzNTPPacketUnmarshal(f *testing.F) {
+	p := &tcpntp.Packet{
+		Extensions: []tcpntp.ExtensionField{{Type: 0x0104, Body: make([]byte, 16)}},
+		MAC:        make([]byte, 20),
+	}
+	seed, _ := p.Marshal()
+	f.Add(seed)
+	f.Add(make([]byte, 48))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var p tcpntp.Packet
+		if p.Unmarshal(b) != nil {
+			return
+		}
+		out, err := p.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var q tcpntp.Packet
+		if err = q.Unmarshal(out); err != nil {
+			t.Fatalf("re-encoded packet does not decode: %v", err)
+		}
+	})
+}
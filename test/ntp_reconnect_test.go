@@ -0,0 +1,67 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+func TestNTPClientReconnect(t *testing.T) {
+	s := startNTPServer(t)
+	addr := s.Addr().String()
+	nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+		Address:    addr,
+		MinBackoff: 50 * time.Millisecond,
+	})
+	defer nc.Close()
+	if nc.State() != tcpntp.StateIdle {
+		t.Fatalf("unexpected state [%s]", nc.State())
+	}
+	if _, err := nc.Query(); err != nil {
+		t.Fatal(err)
+	}
+	if nc.State() != tcpntp.StateConnected {
+		t.Fatalf("unexpected state [%s]", nc.State())
+	}
+
+	s.Close()
+	if _, err := nc.Query(); err == nil {
+		t.Fatal("expect query failed after server closed")
+	}
+	if nc.State() != tcpntp.StateBroken || nc.LastError() == nil {
+		t.Fatalf("unexpected state [%s]", nc.State())
+	}
+	// the broken stream waits for the backoff, then the redial fails and
+	// doubles it
+	if _, err := nc.Query(); err != tcpntp.ErrConnBroken {
+		t.Fatalf("expect broken connection, got: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := nc.Query(); err == nil || err == tcpntp.ErrConnBroken {
+		t.Fatalf("expect redial failed, got: %v", err)
+	}
+	if _, err := nc.Query(); err != tcpntp.ErrConnBroken {
+		t.Fatalf("expect query failed in backoff, got: %v", err)
+	}
+
+	s2, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+		Address: addr,
+		Stratum: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s2.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	s2.Start()
+	defer s2.Close()
+	time.Sleep(110 * time.Millisecond)
+	if _, err := nc.Query(); err != nil {
+		t.Fatal(err)
+	}
+	if nc.State() != tcpntp.StateConnected || nc.LastError() != nil {
+		t.Fatalf("unexpected state [%s]", nc.State())
+	}
+}
@@ -0,0 +1,55 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+func startNTPServer(t *testing.T) *tcpntp.NTPServer {
+	s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+		Address:     "127.0.0.1:0",
+		Stratum:     1,
+		Precision:   -20,
+		ReferenceID: 0x4c4f434c,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestNTPServer(t *testing.T) {
+	s := startNTPServer(t)
+	nc, err := tcpntp.NewNTPClient(&tcpntp.Config{
+		Address: s.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nc.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, err := nc.Query()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Stratum != 1 || resp.KissCode != "" {
+			t.Fatalf("unexpected stratum [%d] kiss code [%s]",
+				resp.Stratum, resp.KissCode)
+		}
+		if resp.ReferenceID != 0x4c4f434c {
+			t.Fatalf("unexpected reference id [%x]", resp.ReferenceID)
+		}
+		fmt.Println("offset:", resp.ClockOffset, "rtt:", resp.RTT)
+	}
+}
@@ -0,0 +1,59 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+func TestNTPClientTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+		Address: l.Addr().String(),
+		Timeout: 100 * time.Millisecond,
+	})
+	if err = nc.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	start := time.Now()
+	_, err = nc.Query()
+	var te *tcpntp.TimeoutError
+	if !errors.As(err, &te) {
+		t.Fatalf("expect timeout error, got: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("query took %s", time.Since(start))
+	}
+	if _, err = nc.Query(); err != tcpntp.ErrConnBroken {
+		t.Fatalf("expect broken connection, got: %v", err)
+	}
+
+	if err = nc.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err = nc.QueryContext(ctx); err != context.Canceled {
+		t.Fatalf("expect context canceled, got: %v", err)
+	}
+}
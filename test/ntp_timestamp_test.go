@@ -0,0 +1,63 @@
+package test
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+func TestNTPKernelTimestamps(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+			Address: "127.0.0.1:0",
+			Network: network,
+			Stratum: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Listen(); err != nil {
+			t.Fatal(err)
+		}
+		s.Start()
+		defer s.Close()
+
+		nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+			Address:          s.Addr().String(),
+			Network:          network,
+			KernelTimestamps: true,
+		})
+		defer nc.Close()
+		want := tcpntp.TimestampKernel
+		if runtime.GOOS != "linux" {
+			want = tcpntp.TimestampUser
+		}
+		// The kernel turns receive timestamping on asynchronously, so the
+		// first responses may arrive without a timestamp.
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+			resp, err := nc.Query()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Timestamping == want {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for i := 0; i < 3; i++ {
+			resp, err := nc.Query()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Timestamping != want {
+				t.Fatalf("%s: unexpected timestamping [%s]", network, resp.Timestamping)
+			}
+			if resp.ClockOffset < -5*time.Millisecond ||
+				resp.ClockOffset > 5*time.Millisecond {
+				t.Fatalf("%s: unexpected offset [%s]", network, resp.ClockOffset)
+			}
+		}
+	}
+}
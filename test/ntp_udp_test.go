@@ -0,0 +1,93 @@
+package test
+
+import (
+	"net"
+	"testing"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+func TestNTPClientUDP(t *testing.T) {
+	s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+		Address: "127.0.0.1:0",
+		Network: "udp",
+		Stratum: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	defer s.Close()
+
+	nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+		Address: s.Addr().String(),
+		Network: "udp",
+	})
+	if err = nc.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	resp, err := nc.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Stratum != 2 {
+		t.Fatalf("unexpected stratum [%d]", resp.Stratum)
+	}
+}
+
+// TestNTPClientUDPStray answers every query with a short packet, a packet
+// for another origin and then the real response twice.
+func TestNTPClientUDPStray(t *testing.T) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, raddr, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n < 48 {
+				continue
+			}
+			resp := make([]byte, 48)
+			resp[0] = 0x24 // version 4, server mode
+			resp[1] = 3
+			copy(resp[24:32], buf[40:48])
+			copy(resp[32:40], buf[40:48])
+			copy(resp[40:48], buf[40:48])
+			stray := make([]byte, 48)
+			copy(stray, resp)
+			stray[31] ^= 0xff
+			pc.WriteToUDP(resp[:20], raddr)
+			pc.WriteToUDP(stray, raddr)
+			pc.WriteToUDP(resp, raddr)
+			pc.WriteToUDP(resp, raddr)
+		}
+	}()
+
+	nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+		Address: pc.LocalAddr().String(),
+		Network: "udp",
+	})
+	if err = nc.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	for i := 0; i < 3; i++ {
+		resp, err := nc.Query()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Stratum != 3 {
+			t.Fatalf("unexpected stratum [%d]", resp.Stratum)
+		}
+	}
+}
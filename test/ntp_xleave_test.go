@@ -0,0 +1,54 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/tcpntp"
+)
+
+func TestNTPInterleaved(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		for _, serverXleave := range []bool{true, false} {
+			s, err := tcpntp.NewNTPServer(&tcpntp.ServerConfig{
+				Address:     "127.0.0.1:0",
+				Network:     network,
+				Stratum:     1,
+				Interleaved: serverXleave,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Listen(); err != nil {
+				t.Fatal(err)
+			}
+			s.Start()
+			defer s.Close()
+
+			nc, _ := tcpntp.NewNTPClient(&tcpntp.Config{
+				Address:     s.Addr().String(),
+				Network:     network,
+				Interleaved: true,
+			})
+			defer nc.Close()
+			for i := 0; i < 4; i++ {
+				resp, err := nc.Query()
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The first query has no previous exchange to ask about,
+				// and a server without support falls back to basic mode.
+				if want := serverXleave && i > 0; resp.Interleaved != want {
+					t.Fatalf("%s query %d: interleaved [%t], expect [%t]",
+						network, i, resp.Interleaved, want)
+				}
+				if resp.ClockOffset < -5*time.Millisecond ||
+					resp.ClockOffset > 5*time.Millisecond ||
+					resp.RTT < 0 || resp.RTT > 50*time.Millisecond {
+					t.Fatalf("%s query %d: unexpected offset [%s] rtt [%s]",
+						network, i, resp.ClockOffset, resp.RTT)
+				}
+			}
+		}
+	}
+}
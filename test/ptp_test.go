@@ -0,0 +1,111 @@
+package test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/ptp"
+)
+
+// startPTP starts a master sending to a client bound on ephemeral ports.
+func startPTP(t *testing.T, mconf *ptp.MasterConfig) *ptp.Client {
+	conf := &ptp.Config{
+		Address:          "127.0.0.1",
+		LocalEventAddr:   "127.0.0.1:0",
+		LocalGeneralAddr: "127.0.0.1:0",
+		Timeout:          2 * time.Second,
+		LogSyncInterval:  -4,
+	}
+	c, err := ptp.NewClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	event, general := c.LocalAddr()
+	mconf.EventAddr, mconf.GeneralAddr = "127.0.0.1:0", "127.0.0.1:0"
+	mconf.PeerEventPort = event.(*net.UDPAddr).Port
+	mconf.PeerGeneralPort = general.(*net.UDPAddr).Port
+	m, err := ptp.NewMaster(mconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	t.Cleanup(func() { m.Close() })
+	event, general = m.Addr()
+	conf.EventPort = event.(*net.UDPAddr).Port
+	conf.GeneralPort = general.(*net.UDPAddr).Port
+	return c
+}
+
+func TestPTP(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		twoStep bool
+		offset  time.Duration
+	}{
+		{"one-step", false, 0},
+		{"two-step", true, 0},
+		{"skewed", true, 3 * time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := startPTP(t, &ptp.MasterConfig{
+				TwoStep: tc.twoStep,
+				Offset:  tc.offset,
+			})
+			for i := 0; i < 3; i++ {
+				resp, err := c.Query(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if d := resp.ClockOffset - tc.offset; d < -10*time.Millisecond ||
+					d > 10*time.Millisecond {
+					t.Fatalf("unexpected offset [%s]", resp.ClockOffset)
+				}
+				if resp.MeanPathDelay < 0 || resp.MeanPathDelay > 10*time.Millisecond ||
+					resp.RTT != 2*resp.MeanPathDelay {
+					t.Fatalf("unexpected delay [%s] rtt [%s]", resp.MeanPathDelay,
+						resp.RTT)
+				}
+			}
+		})
+	}
+}
+
+func TestPTPTimeout(t *testing.T) {
+	// a master that never answers
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	c, err := ptp.NewClient(&ptp.Config{
+		Address:          "127.0.0.1",
+		EventPort:        port,
+		GeneralPort:      port,
+		LocalEventAddr:   "127.0.0.1:0",
+		LocalGeneralAddr: "127.0.0.1:0",
+		Timeout:          2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = c.Query(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error [%v]", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("query returned after %s", d)
+	}
+}
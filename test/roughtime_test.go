@@ -0,0 +1,128 @@
+package test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/roughtime"
+)
+
+func startRoughtimeServer(t *testing.T, offset time.Duration,
+	window time.Duration) *roughtime.Config {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := roughtime.NewServer(&roughtime.ServerConfig{
+		Address:     "127.0.0.1:0",
+		RootKey:     priv,
+		Offset:      offset,
+		BatchWindow: window,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	t.Cleanup(func() { s.Close() })
+	return &roughtime.Config{
+		Address:   s.Addr().String(),
+		PublicKey: pub,
+		Timeout:   time.Second,
+	}
+}
+
+func TestRoughtime(t *testing.T) {
+	conf := startRoughtimeServer(t, 0, 0)
+	c, err := roughtime.NewClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	resp, err := c.Query(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(resp.Midpoint); d < -time.Second || d > time.Second ||
+		resp.Radius != time.Second {
+		t.Fatalf("unexpected midpoint [%s] radius [%s]", resp.Midpoint, resp.Radius)
+	}
+
+	// replies signed by another root key are not accepted
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	bad, _ := roughtime.NewClient(&roughtime.Config{
+		Address:   conf.Address,
+		PublicKey: other,
+		Timeout:   100 * time.Millisecond,
+	})
+	defer bad.Close()
+	if _, err = bad.Query(context.Background()); err == nil {
+		t.Fatal("expect reply with unknown key rejected")
+	}
+}
+
+func TestRoughtimeBatch(t *testing.T) {
+	conf := startRoughtimeServer(t, 0, 50*time.Millisecond)
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, _ := roughtime.NewClient(conf)
+			defer c.Close()
+			if _, err := c.Query(context.Background()); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestRoughtimeChain(t *testing.T) {
+	var clients []*roughtime.Client
+	for _, offset := range []time.Duration{0, time.Hour, 0} {
+		c, _ := roughtime.NewClient(startRoughtimeServer(t, offset, 0))
+		defer c.Close()
+		clients = append(clients, c)
+	}
+	ch, err := roughtime.QueryChain(context.Background(), clients)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server an hour ahead answered before the last one
+	var ce *roughtime.ConsistencyError
+	if err = ch.Verify(); !errors.As(err, &ce) {
+		t.Fatalf("expect consistency error, got: %v", err)
+	}
+	resps := ch.Responses()
+	if errs := ch.Inconsistencies(); len(errs) != 1 ||
+		errs[0].Earlier != resps[1] || errs[0].Later != resps[2] {
+		t.Fatalf("unexpected inconsistencies: %v", errs)
+	}
+
+	ch, err = roughtime.QueryChain(context.Background(),
+		[]*roughtime.Client{clients[0], clients[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ch.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// a reordered chain no longer proves the order of the replies
+	ch.Links[0], ch.Links[1] = ch.Links[1], ch.Links[0]
+	if err = ch.Verify(); err == nil || errors.As(err, &ce) {
+		t.Fatalf("expect broken chain, got: %v", err)
+	}
+}
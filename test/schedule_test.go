@@ -0,0 +1,94 @@
+package test
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/internal/server"
+)
+
+func TestProbeSchedule(t *testing.T) {
+	sc, err := server.ParseSchedule(strings.NewReader(`
+# probe schedule
+default 1m
+group critical 500ms a b
+group critical 500ms c   # continued
+group lab 10s d
+machine b 2s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[string]time.Duration{
+		"a": 500 * time.Millisecond,
+		"b": 2 * time.Second,
+		"c": 500 * time.Millisecond,
+		"d": 10 * time.Second,
+		"e": time.Minute,
+	} {
+		if d := sc.Interval(id); d != want {
+			t.Fatalf("machine [%s] probed every %s, expect %s", id, d, want)
+		}
+	}
+	var none *server.Schedule
+	if d := none.Interval("a"); d != 3*time.Second {
+		t.Fatalf("nil schedule probes every %s", d)
+	}
+
+	for _, bad := range []string{
+		"default",
+		"default 10ms",
+		"group g 1s a\ngroup g 2s b",
+		"group g 1s a\ngroup h 1s a",
+		"machine a",
+		"machine a 1x",
+		"every a 1s",
+	} {
+		if _, err = server.ParseSchedule(strings.NewReader(bad)); err == nil {
+			t.Fatalf("schedule %q accepted", bad)
+		}
+	}
+}
+
+func TestScheduleLive(t *testing.T) {
+	s := newValidateServer(t, &server.Config{
+		Schedule: &server.Schedule{Default: time.Hour},
+	})
+	s.Start()
+	// the machine answers in 250ms, slower than the probes
+	ms := newMachineStream(false)
+	ms.offset = 40 * time.Millisecond
+	ms.delay = 250 * time.Millisecond
+	done := validate(s, ms)
+	defer func() {
+		ms.cancel()
+		<-done
+	}()
+	id := waitSessions(t, s, 1)[0].MachineID
+
+	if err := s.SetSchedule(&server.Schedule{
+		Machines: map[string]time.Duration{id: 100 * time.Millisecond},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := s.Session(id)
+	if info.Interval != 100*time.Millisecond {
+		t.Fatalf("session probed every %s after reschedule", info.Interval)
+	}
+	time.Sleep(time.Second)
+	info, _ = s.Session(id)
+	if info.State != server.SessionActive || info.LastMeasurement == nil {
+		t.Fatalf("rescheduled session %+v", info)
+	}
+	// a probe at most per response, each paired with its own t1
+	if n := atomic.LoadInt32(&ms.probes); n < 2 || n > 4 {
+		t.Fatalf("%d probes sent in 1s", n)
+	}
+	if d := info.LastMeasurement.Offset - ms.offset; d > 10*time.Millisecond ||
+		d < -10*time.Millisecond {
+		t.Fatalf("offset %s measured, expect %s", info.LastMeasurement.Offset,
+			ms.offset)
+	}
+}
@@ -0,0 +1,217 @@
+package test
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"ntsc.ac.cn/ta/time-validater/internal/server"
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+	"ntsc.ac.cn/tas/tas-commons/pkg/pb"
+)
+
+// machineStream is the server side of a validation stream, answered after
+// delay by a machine whose clock is offset ahead of the server clock. A
+// silent machine never answers.
+type machineStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	cancel   context.CancelFunc
+	clock    clock.Clock
+	offset   time.Duration
+	delay    time.Duration
+	silent   bool
+	probes   int32
+	requests chan *pb.Request
+}
+
+func newMachineStream(silent bool) *machineStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &machineStream{
+		ctx: peer.NewContext(ctx, &peer.Peer{
+			Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000},
+		}),
+		cancel:   cancel,
+		clock:    clock.Or(nil),
+		silent:   silent,
+		requests: make(chan *pb.Request, 16),
+	}
+}
+
+func (ms *machineStream) Context() context.Context {
+	return ms.ctx
+}
+
+func (ms *machineStream) Send(req *pb.Request) error {
+	atomic.AddInt32(&ms.probes, 1)
+	select {
+	case ms.requests <- req:
+	default:
+	}
+	return nil
+}
+
+func (ms *machineStream) Recv() (*pb.Response, error) {
+	for {
+		select {
+		case <-ms.requests:
+			if ms.silent {
+				continue
+			}
+			t2 := ms.clock.Now().Add(ms.offset)
+			ms.clock.Sleep(ms.delay)
+			return &pb.Response{
+				T2: timestamppb.New(t2),
+				T3: timestamppb.New(ms.clock.Now().Add(ms.offset)),
+			}, nil
+		case <-ms.ctx.Done():
+			return nil, io.EOF
+		}
+	}
+}
+
+// validate runs the session of ms on s until ms is cancelled.
+func validate(s *server.ValidateServer, ms *machineStream) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Validate(ms)
+	}()
+	return done
+}
+
+// newValidateServer returns a validation server on conf, without sinks by
+// default, closed at the end of the test. The sessions are probed once the
+// server is started.
+func newValidateServer(t *testing.T, conf *server.Config) *server.ValidateServer {
+	conf.Listener = "127.0.0.1:0"
+	if conf.Sinks == nil {
+		conf.Sinks = []server.MeasurementSink{}
+	}
+	s, err := server.NewValidateServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return s
+}
+
+// waitSessions waits until s lists n sessions, and returns them.
+func waitSessions(t *testing.T, s *server.ValidateServer, n int) []server.SessionInfo {
+	deadline := time.Now().Add(time.Second)
+	for {
+		infos := s.Sessions()
+		if len(infos) == n {
+			return infos
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions listed, expect %d", len(infos), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSessionStates(t *testing.T) {
+	fake := clock.NewFake(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := newValidateServer(t, &server.Config{Clock: fake})
+
+	ms := newMachineStream(true)
+	done := validate(s, ms)
+	info := waitSessions(t, s, 1)[0]
+	if info.State != server.SessionConnecting || info.Interval != 3*time.Second ||
+		info.Peer != "127.0.0.1:4000" {
+		t.Fatalf("unexpected new session %+v", info)
+	}
+	// a machine that never answers goes stale 3 intervals after connecting
+	fake.Advance(9 * time.Second)
+	if info, _ = s.Session(info.MachineID); info.State != server.SessionConnecting {
+		t.Fatalf("session %s after 3 intervals", info.State)
+	}
+	fake.Advance(time.Millisecond)
+	if info, _ = s.Session(info.MachineID); info.State != server.SessionStale {
+		t.Fatalf("silent session %s", info.State)
+	}
+
+	ms.cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if info, _ = s.Session(info.MachineID); info.State != server.SessionClosed {
+		t.Fatalf("ended session %s", info.State)
+	}
+	// the machine may connect again while its closed session is listed
+	again := newMachineStream(true)
+	done = validate(s, again)
+	for {
+		if info, _ = s.Session(info.MachineID); info.State == server.SessionConnecting {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	again.cancel()
+	<-done
+
+	// closed sessions are dropped after 3 intervals
+	fake.Advance(9 * time.Second)
+	waitSessions(t, s, 1)
+	fake.Advance(time.Millisecond)
+	waitSessions(t, s, 0)
+	if _, ok := s.Session(info.MachineID); ok {
+		t.Fatal("expired session found")
+	}
+}
+
+func TestSessionRegistryRace(t *testing.T) {
+	s := newValidateServer(t, &server.Config{})
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, info := range s.Sessions() {
+					s.Session(info.MachineID)
+				}
+				if err := s.SetSchedule(nil); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	var machines sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		machines.Add(1)
+		go func() {
+			defer machines.Done()
+			for j := 0; j < 20; j++ {
+				ms := newMachineStream(true)
+				done := validate(s, ms)
+				time.Sleep(time.Millisecond)
+				ms.cancel()
+				<-done
+			}
+		}()
+	}
+	machines.Wait()
+	close(stop)
+	readers.Wait()
+	for _, info := range s.Sessions() {
+		if info.State != server.SessionClosed {
+			t.Fatalf("session %+v left open", info)
+		}
+	}
+}
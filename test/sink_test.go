@@ -0,0 +1,204 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/internal/server"
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+)
+
+func TestHTTPSink(t *testing.T) {
+	var calls int32
+	var got struct {
+		ID   string `json:"id"`
+		Data []struct {
+			OID   string `json:"oid"`
+			State int    `json:"state"`
+			Type  string `json:"type"`
+		} `json:"data"`
+	}
+	bridge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		// the bridge fails once, then accepts on its root only
+		if atomic.AddInt32(&calls, 1) == 1 || r.URL.Path != "/" {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte(`{"result":"ok"}`))
+	}))
+	defer bridge.Close()
+
+	sink, err := server.NewHTTPSink(&server.HTTPSinkConfig{
+		URL:        bridge.URL + "/",
+		RetryDelay: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Send(context.Background(), "m1", server.Measurement{
+		Offset: 1500 * time.Microsecond,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || got.ID != "m1" || len(got.Data) != 1 ||
+		got.Data[0].State != 1500000 || got.Data[0].Type != "Counter64" {
+		t.Fatalf("unexpected trap after %d calls: %+v", calls, got)
+	}
+
+	noRetry, _ := server.NewHTTPSink(&server.HTTPSinkConfig{
+		URL:     bridge.URL + "/missing",
+		Retries: -1,
+	})
+	atomic.StoreInt32(&calls, 1)
+	if err = noRetry.Send(context.Background(), "m1",
+		server.Measurement{}); err == nil || calls != 2 {
+		t.Fatalf("unexpected error [%v] after %d calls", err, calls)
+	}
+
+	// the retries wait on the sink clock, and stop with the context
+	fake := clock.NewFake(time.Now())
+	slow, _ := server.NewHTTPSink(&server.HTTPSinkConfig{
+		URL:        bridge.URL + "/",
+		RetryDelay: time.Hour,
+		Clock:      fake,
+	})
+	atomic.StoreInt32(&calls, 0)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- slow.Send(context.Background(), "m1", server.Measurement{})
+	}()
+	fake.BlockUntil(1)
+	fake.Advance(time.Hour)
+	if err = <-sent; err != nil || calls != 2 {
+		t.Fatalf("unexpected error [%v] after %d calls", err, calls)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	atomic.StoreInt32(&calls, 0)
+	go func() {
+		sent <- slow.Send(ctx, "m1", server.Measurement{})
+	}()
+	fake.BlockUntil(1)
+	cancel()
+	if err = <-sent; err != context.Canceled {
+		t.Fatalf("cancelled send returned [%v]", err)
+	}
+
+	for spec, ok := range map[string]bool{
+		"log":              true,
+		"https://bridge/x": true,
+		"ftp://bridge/x":   false,
+		"":                 false,
+	} {
+		if _, err := server.ParseSink(spec); (err == nil) != ok {
+			t.Fatalf("sink [%s]: unexpected error [%v]", spec, err)
+		}
+	}
+}
+
+// recordSink records the measurements it is sent. It fails them with err,
+// or holds them until the context is done if hold is set.
+type recordSink struct {
+	err  error
+	hold bool
+
+	mu        sync.Mutex
+	sent      []server.Measurement
+	cancelled bool
+}
+
+func (rs *recordSink) Send(ctx context.Context, machineID string,
+	m server.Measurement) error {
+	rs.mu.Lock()
+	rs.sent = append(rs.sent, m)
+	rs.mu.Unlock()
+	if rs.hold {
+		<-ctx.Done()
+		rs.mu.Lock()
+		rs.cancelled = true
+		rs.mu.Unlock()
+		return ctx.Err()
+	}
+	return rs.err
+}
+
+func (rs *recordSink) String() string {
+	return "record"
+}
+
+func (rs *recordSink) count() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.sent)
+}
+
+func TestSinkPublish(t *testing.T) {
+	fake := clock.NewFake(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	good := &recordSink{}
+	bad := &recordSink{err: errors.New("refused")}
+	held := &recordSink{hold: true}
+	s := newValidateServer(t, &server.Config{
+		Clock:    fake,
+		Schedule: &server.Schedule{Default: 100 * time.Millisecond},
+		Sinks:    []server.MeasurementSink{good, bad, held},
+	})
+	s.Start()
+	ms := newMachineStream(false)
+	ms.clock = fake
+	ms.offset = 2 * time.Millisecond
+	done := validate(s, ms)
+
+	// a failing or stuck sink delays none of the others
+	deadline := time.Now().Add(2 * time.Second)
+	for good.count() < 3 || bad.count() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d and %d measurements sent", good.count(), bad.count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ms.cancel()
+	<-done
+	if held.count() != 1 {
+		t.Fatalf("held sink sent %d measurements", held.count())
+	}
+	good.mu.Lock()
+	if m := good.sent[0]; m.Offset != ms.offset || m.Delay != 0 {
+		t.Fatalf("unexpected measurement %+v", m)
+	}
+	good.mu.Unlock()
+
+	// Close drains the sinks, and gives up on the held one after 5s
+	closed := make(chan error, 1)
+	go func() {
+		closed <- s.Close()
+	}()
+	for {
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Fatal(err)
+			}
+			held.mu.Lock()
+			defer held.mu.Unlock()
+			if !held.cancelled {
+				t.Fatal("held measurement not cancelled")
+			}
+			if n := bad.count(); n != good.count() {
+				t.Fatalf("%d measurements failed, %d sent", n, good.count())
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+			fake.Advance(time.Second)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/internal/server"
+	"ntsc.ac.cn/ta/time-validater/pkg/clock"
+	"ntsc.ac.cn/ta/time-validater/pkg/snmp"
+)
+
+var testTrapOID = snmp.MustParseOID(".1.3.6.1.4.1.326.3.1.0.1")
+
+// startReceiver starts a receiver on an ephemeral port, returning it and
+// the notifications it receives.
+func startReceiver(t *testing.T, users ...*snmp.User) (*snmp.Receiver,
+	chan *snmp.Notification) {
+	notes := make(chan *snmp.Notification, 16)
+	r, err := snmp.NewReceiver(&snmp.ReceiverConfig{
+		Addr:      "127.0.0.1:0",
+		Community: "validater",
+		Users:     users,
+		EngineID:  []byte("\x80\x00\x01\x46\x04receiver"),
+		Handler:   func(n *snmp.Notification) { notes <- n },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Start()
+	t.Cleanup(func() { r.Close() })
+	return r, notes
+}
+
+// lossyProxy relays datagrams to and from addr, dropping the first drop
+// requests.
+func lossyProxy(t *testing.T, addr net.Addr, drop int32) net.Addr {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close(); upstream.Close() })
+	var client atomic.Value
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, raddr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			client.Store(raddr)
+			if atomic.AddInt32(&drop, -1) >= 0 {
+				continue
+			}
+			upstream.Write(buf[:n])
+		}
+	}()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], client.Load().(net.Addr))
+		}
+	}()
+	return conn.LocalAddr()
+}
+
+func TestSNMP(t *testing.T) {
+	user := &snmp.User{
+		Name:         "validater",
+		Auth:         snmp.SHA,
+		AuthPassword: "auth-secret",
+		Priv:         snmp.AES,
+		PrivPassword: "priv-secret",
+	}
+	desUser := &snmp.User{
+		Name:         "legacy",
+		Auth:         snmp.MD5,
+		AuthPassword: "auth-secret",
+		Priv:         snmp.DES,
+		PrivPassword: "priv-secret",
+	}
+	r, notes := startReceiver(t, user, desUser)
+	for _, tc := range []struct {
+		name string
+		conf snmp.Config
+		drop int32
+	}{
+		{"v2c-trap", snmp.Config{Community: "validater"}, 0},
+		{"v2c-inform", snmp.Config{Community: "validater", Inform: true}, 1},
+		{"v3-trap", snmp.Config{Version: snmp.V3, User: user,
+			EngineBootsFile: filepath.Join(t.TempDir(), "boots")}, 0},
+		{"v3-trap-des", snmp.Config{Version: snmp.V3, User: desUser,
+			EngineBoots: 7}, 0},
+		{"v3-inform", snmp.Config{Version: snmp.V3, User: user,
+			Inform: true}, 0},
+		{"v3-inform-lossy", snmp.Config{Version: snmp.V3, User: user,
+			Inform: true}, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := tc.conf
+			conf.Address = lossyProxy(t, r.Addr(), tc.drop).String()
+			conf.Timeout = 200 * time.Millisecond
+			s, err := snmp.NewSender(&conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if err = s.Notify(context.Background(), testTrapOID,
+				snmp.Varbind{OID: testTrapOID.Append(1), Value: "machine-1"},
+				snmp.Varbind{OID: testTrapOID.Append(2),
+					Value: snmp.Counter64(1500000)},
+			); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case n := <-notes:
+				if !n.TrapOID.Equal(testTrapOID) || n.Inform != conf.Inform ||
+					len(n.Varbinds) != 2 ||
+					string(n.Varbinds[0].Value.([]byte)) != "machine-1" ||
+					n.Varbinds[1].Value != snmp.Counter64(1500000) {
+					t.Fatalf("unexpected notification %+v", n)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("notification not received")
+			}
+		})
+	}
+
+	// a trap under the wrong password is dropped, an inform unacknowledged
+	wrong := *user
+	wrong.PrivPassword = "not-the-secret"
+	s, err := snmp.NewSender(&snmp.Config{
+		Address: r.Addr().String(),
+		Version: snmp.V3,
+		User:    &wrong,
+		Inform:  true,
+		Timeout: 100 * time.Millisecond,
+		Retries: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = s.Notify(context.Background(), testTrapOID); err == nil {
+		t.Fatal("inform acknowledged under a wrong password")
+	}
+	select {
+	case n := <-notes:
+		t.Fatalf("unexpected notification %+v", n)
+	default:
+	}
+}
+
+func TestSNMPClock(t *testing.T) {
+	r, notes := startReceiver(t)
+	fake := clock.NewFake(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	s, err := snmp.NewSender(&snmp.Config{
+		Address:   r.Addr().String(),
+		Community: "validater",
+		Clock:     fake,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// sysUpTime follows the sender clock, not the system clock
+	fake.Advance(90 * time.Second)
+	if err = s.Notify(context.Background(), testTrapOID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-notes:
+		if n.Uptime != 9000 {
+			t.Fatalf("unexpected uptime %d", n.Uptime)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("trap not received")
+	}
+}
+
+// secretFile returns the path of a file holding secret.
+func secretFile(t *testing.T, secret string) string {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(secret), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSNMPEngineBoots(t *testing.T) {
+	user := &snmp.User{
+		Name:         "validater",
+		Auth:         snmp.SHA,
+		AuthPassword: "auth-secret",
+	}
+	path := filepath.Join(t.TempDir(), "boots")
+	// each sender started on the file counts a boot
+	for want := int32(1); want <= 3; want++ {
+		s, err := snmp.NewSender(&snmp.Config{
+			Address:         "127.0.0.1",
+			Version:         snmp.V3,
+			User:            user,
+			EngineBootsFile: path,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if boots := s.EngineBoots(); boots != want {
+			t.Fatalf("engine boots %d, expect %d", boots, want)
+		}
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "3\n" {
+		t.Fatalf("unexpected engine boots file %q: %v", b, err)
+	}
+	if err := os.WriteFile(path, []byte("-1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snmp.NewSender(&snmp.Config{Address: "127.0.0.1",
+		Version: snmp.V3, User: user, EngineBootsFile: path}); err == nil {
+		t.Fatal("invalid engine boots file accepted")
+	}
+
+	// authenticated traps need the boots, informs use those of the manager
+	if _, err := snmp.NewSender(&snmp.Config{Address: "127.0.0.1",
+		Version: snmp.V3, User: user}); err == nil {
+		t.Fatal("authenticated traps accepted without engine boots")
+	}
+	if _, err := snmp.NewSender(&snmp.Config{Address: "127.0.0.1",
+		Version: snmp.V3, User: user, Inform: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snmp.NewSender(&snmp.Config{Address: "127.0.0.1",
+		Version: snmp.V3, User: &snmp.User{Name: "public"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.ParseSink("snmpv3://validater@127.0.0.1" +
+		"?auth-pass-file=" + secretFile(t, "auth-secret") + "&engine-boots-file=" +
+		filepath.Join(t.TempDir(), "boots")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSNMPSink(t *testing.T) {
+	r, notes := startReceiver(t, &snmp.User{
+		Name:         "validater",
+		Auth:         snmp.SHA256,
+		AuthPassword: "auth-secret",
+		Priv:         snmp.AES,
+		PrivPassword: "priv-secret",
+	})
+	sink, err := server.ParseSink("snmpv3://validater@" + r.Addr().String() +
+		"?auth=sha256&auth-pass-file=" + secretFile(t, "auth-secret\n") +
+		"&priv-pass-file=" + secretFile(t, "priv-secret") +
+		"&inform=true&alarm=1ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.Send(context.Background(), "machine-1", server.Measurement{
+		Offset: -1500 * time.Microsecond,
+		Delay:  300 * time.Microsecond,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	n := <-notes
+	want := []interface{}{snmp.Counter64(0xffffffffffe91ca0), []byte("machine-1"),
+		snmp.Gauge32(300), 2}
+	if len(n.Varbinds) != len(want) {
+		t.Fatalf("unexpected varbinds %+v", n.Varbinds)
+	}
+	for i, vb := range n.Varbinds {
+		if fmt.Sprint(vb.Value) != fmt.Sprint(want[i]) {
+			t.Fatalf("varbind %s = %v, want %v", vb.OID, vb.Value, want[i])
+		}
+	}
+
+	for _, spec := range []string{
+		"snmp://public@127.0.0.1?bogus=1",
+		"snmpv3://validater@127.0.0.1?priv-pass-file=" + secretFile(t, "priv-secret"),
+		"snmpv3://validater@127.0.0.1?auth-pass-file=" + secretFile(t, "short"),
+		"snmpv3://validater@127.0.0.1?auth-pass-file=" +
+			filepath.Join(t.TempDir(), "missing"),
+		"snmpv3://validater@127.0.0.1?auth-pass=auth-secret&engine-boots=1",
+	} {
+		if _, err := server.ParseSink(spec); err == nil {
+			t.Fatalf("sink [%s] accepted", spec)
+		}
+	}
+}
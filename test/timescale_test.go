@@ -0,0 +1,70 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"ntsc.ac.cn/ta/time-validater/pkg/timescale"
+)
+
+func TestTimescaleConvert(t *testing.T) {
+	utc := time.Date(2020, time.May, 1, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		scale timescale.Scale
+		diff  time.Duration
+	}{
+		{timescale.UTC, 0},
+		{timescale.TAI, 37 * time.Second},
+		{timescale.GPS, 18 * time.Second},
+		{timescale.BDS, 4 * time.Second},
+	} {
+		ts := timescale.Convert(utc, timescale.UTC, c.scale)
+		if d := ts.Sub(utc); d != c.diff {
+			t.Fatalf("%s: unexpected difference [%s]", c.scale, d)
+		}
+		if back := timescale.Convert(ts, c.scale, timescale.UTC); !back.Equal(utc) {
+			t.Fatalf("%s: round trip gives [%s]", c.scale, back)
+		}
+	}
+	if d := timescale.Between(utc, timescale.TAI, timescale.GPS); d != -19*time.Second {
+		t.Fatalf("unexpected tai to gps difference [%s]", d)
+	}
+}
+
+func TestTimescaleLeap(t *testing.T) {
+	leap := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if d := timescale.Offset(timescale.TAI, leap.Add(-time.Second)); d != 36*time.Second {
+		t.Fatalf("unexpected offset before leap [%s]", d)
+	}
+	if d := timescale.Offset(timescale.TAI, leap); d != 37*time.Second {
+		t.Fatalf("unexpected offset after leap [%s]", d)
+	}
+	// TAI 2017-01-01 00:00:36 is UTC 2016-12-31 23:59:60, which time.Time
+	// cannot represent; the second after it is UTC midnight.
+	tai := leap.Add(37 * time.Second)
+	if utc := timescale.Convert(tai, timescale.TAI, timescale.UTC); !utc.Equal(leap) {
+		t.Fatalf("unexpected utc [%s]", utc)
+	}
+}
+
+func TestTimescaleBuiltin(t *testing.T) {
+	tbl := timescale.Default()
+	expires := time.Date(2026, time.June, 28, 0, 0, 0, 0, time.UTC)
+	if !tbl.Expires().Equal(expires) || tbl.Expired(expires.Add(-time.Hour)) ||
+		!tbl.Expired(expires.Add(time.Hour)) {
+		t.Fatalf("built-in leap second table expires on %s, expect %s",
+			tbl.Expires(), expires)
+	}
+	if d := tbl.Offset(timescale.TAI, expires); d != 37*time.Second {
+		t.Fatalf("TAI - UTC %s at the expiry of the built-in table", d)
+	}
+}
+
+func TestTimescaleParse(t *testing.T) {
+	if s, err := timescale.Parse("tai"); err != nil || s != timescale.TAI {
+		t.Fatalf("unexpected scale [%s]: %v", s, err)
+	}
+	if _, err := timescale.Parse("tt"); err == nil {
+		t.Fatal("expect unknown time scale error")
+	}
+}